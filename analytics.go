@@ -30,6 +30,11 @@ type AnalyticsRecord struct {
 	OauthID       string
 	RequestTime   int64
 	Tags          []string
+	Retries       int
+	BytesIn       int64
+	BytesOut      int64
+	RoutingRule   string
+	CacheTier     string
 	ExpireAt      time.Time `bson:"expireAt" json:"expireAt"`
 }
 
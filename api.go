@@ -141,6 +141,9 @@ func handleAddOrUpdate(keyName string, r *http.Request) ([]byte, int) {
 		code = 400
 		success = false
 		responseMessage = createError("Request malformed")
+	} else if !GetAdminTokenFromRequest(r).CanAccessSession(newSession) {
+		log.Warning("Admin token is not permitted to manage this session")
+		return createError("Forbidden"), 403
 	} else {
 		// DO ADD OR UPDATE
 		// Update our session object (create it)
@@ -419,18 +422,21 @@ func signalGroupReload() ([]byte, int) {
 	return responseMessage, code
 }
 
-func HandleGetAPIList() ([]byte, int) {
+// HandleGetAPIList returns all loaded API definitions, if orgID is set only the APIs owned by that org are listed
+func HandleGetAPIList(orgID string) ([]byte, int) {
 	var responseMessage []byte
 	var err error
 
 	var thisAPIIDList []tykcommon.APIDefinition
-	thisAPIIDList = make([]tykcommon.APIDefinition, len(ApiSpecRegister))
+	thisAPIIDList = make([]tykcommon.APIDefinition, 0, len(ApiSpecRegister))
 
-	c := 0
 	for _, apiSpec := range ApiSpecRegister {
-		thisAPIIDList[c] = apiSpec.APIDefinition
-		thisAPIIDList[c].RawData = nil
-		c++
+		if orgID != "" && apiSpec.OrgID != orgID {
+			continue
+		}
+		thisDef := apiSpec.APIDefinition
+		thisDef.RawData = nil
+		thisAPIIDList = append(thisAPIIDList, thisDef)
 	}
 
 	responseMessage, err = json.Marshal(&thisAPIIDList)
@@ -491,6 +497,25 @@ func HandleAddOrUpdateApi(APIID string, r *http.Request) ([]byte, int) {
 		}
 	}
 
+	thisToken := GetAdminTokenFromRequest(r)
+	if !thisToken.CanAccessOrg(newDef.OrgID) {
+		log.Warning("Admin token is not permitted to manage APIs for this organisation")
+		return createError("Forbidden"), 403
+	}
+
+	if GetSpecForApi(newDef.APIID) != nil && !thisToken.CanAccessAPI(newDef.APIID) {
+		log.Warning("Admin token is not permitted to modify this API")
+		return createError("Forbidden"), 403
+	}
+
+	var beforeDef *tykcommon.APIDefinition
+	if AuditLog != nil {
+		beforeDef = getAPIAuditState(newDef.APIID)
+	}
+
+	// Keep the existing file in the history before it is replaced
+	ensureBaseAPIRevision(newDef.APIID)
+
 	// Create a filename
 	defFilename := newDef.APIID + ".json"
 	defFilePath := path.Join(config.AppPath, defFilename)
@@ -523,6 +548,9 @@ func HandleAddOrUpdateApi(APIID string, r *http.Request) ([]byte, int) {
 	}
 
 	if success {
+		RecordAuditEvent(r, action, AuditObjectAPI, newDef.APIID, newDef.OrgID, beforeDef, newDef)
+		RecordAPIRevision(r, action, newDef.APIID, &newDef)
+
 		response := APIModifyKeySuccess{
 			newDef.APIID,
 			"ok",
@@ -540,7 +568,7 @@ func HandleAddOrUpdateApi(APIID string, r *http.Request) ([]byte, int) {
 	return responseMessage, code
 }
 
-func HandleDeleteAPI(APIID string) ([]byte, int) {
+func HandleDeleteAPI(APIID string, r *http.Request) ([]byte, int) {
 	success := true
 	var responseMessage []byte
 	code := 200
@@ -555,9 +583,12 @@ func HandleDeleteAPI(APIID string) ([]byte, int) {
 		return createError("Delete failed"), 500
 	}
 
+	ensureBaseAPIRevision(APIID)
 	os.Remove(defFilePath)
 
 	if success {
+		RecordAPIRevision(r, "deleted", APIID, nil)
+
 		response := APIModifyKeySuccess{
 			APIID,
 			"ok",
@@ -581,6 +612,17 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 	var responseMessage []byte
 	var code int
 
+	if strings.Contains(APIID, "/") {
+		apiHistoryHandler(w, r, APIID)
+		return
+	}
+
+	thisToken := GetAdminTokenFromRequest(r)
+	if APIID != "" && r.Method != "POST" && r.Method != "PUT" && !thisToken.CanAccessAPI(APIID) {
+		DoJSONWrite(w, 403, createError("Forbidden"))
+		return
+	}
+
 	log.Debug(r.Method)
 	if r.Method == "GET" {
 		if APIID != "" {
@@ -588,7 +630,7 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 			responseMessage, code = HandleGetAPI(APIID)
 		} else {
 			log.Debug("Requesting API list")
-			responseMessage, code = HandleGetAPIList()
+			responseMessage, code = HandleGetAPIList(thisToken.OrgID)
 		}
 
 	} else if r.Method == "POST" {
@@ -601,7 +643,11 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 		log.Debug("Deleting existing API: ", APIID)
 		if APIID != "" {
 			log.Debug("Deleting API definition for: ", APIID)
-			responseMessage, code = HandleDeleteAPI(APIID)
+			beforeDef := getAPIAuditState(APIID)
+			responseMessage, code = HandleDeleteAPI(APIID, r)
+			if code == 200 && beforeDef != nil {
+				RecordAuditEvent(r, "deleted", AuditObjectAPI, APIID, beforeDef.OrgID, beforeDef, nil)
+			}
 		} else {
 			code = 400
 			responseMessage = createError("Must specify an APIID to delete")
@@ -622,6 +668,17 @@ func keyHandler(w http.ResponseWriter, r *http.Request) {
 	var responseMessage []byte
 	var code int
 
+	thisToken := GetAdminTokenFromRequest(r)
+	if (APIID != "" && !thisToken.CanAccessAPI(APIID)) || (keyName != "" && !thisToken.CanAccessKey(keyName, APIID)) {
+		DoJSONWrite(w, 403, createError("Forbidden"))
+		return
+	}
+
+	var beforeState *SessionState
+	if AuditLog != nil && r.Method != "GET" {
+		beforeState = getKeyAuditState(keyName, APIID)
+	}
+
 	if r.Method == "POST" || r.Method == "PUT" {
 		responseMessage, code = handleAddOrUpdate(keyName, r)
 
@@ -645,6 +702,11 @@ func keyHandler(w http.ResponseWriter, r *http.Request) {
 		if hashed == "" {
 			responseMessage, code = handleDeleteKey(keyName, APIID)
 		} else {
+			beforeState = getHashedKeyAuditState(keyName, APIID)
+			if beforeState != nil && !thisToken.CanAccessOrg(beforeState.OrgID) {
+				DoJSONWrite(w, 403, createError("Forbidden"))
+				return
+			}
 			responseMessage, code = handleDeleteHashedKey(keyName, APIID)
 		}
 
@@ -654,6 +716,25 @@ func keyHandler(w http.ResponseWriter, r *http.Request) {
 		responseMessage = createError("Method not supported")
 	}
 
+	if AuditLog != nil && code == 200 && r.Method != "GET" {
+		auditKey := getAuditedObjectID(responseMessage, keyName)
+		var afterState *SessionState
+		if r.Method != "DELETE" {
+			afterState = getKeyAuditState(auditKey, APIID)
+		}
+
+		orgID := getSessionOrgID(afterState)
+		if orgID == "" {
+			orgID = getSessionOrgID(beforeState)
+		}
+
+		// Hashed key deletes already reference the key by its hash
+		if r.FormValue("hashed") == "" {
+			auditKey = publicHash(auditKey)
+		}
+		RecordAuditEvent(r, getAuditAction(r.Method), AuditObjectKey, auditKey, orgID, beforeState, afterState)
+	}
+
 	DoJSONWrite(w, code, responseMessage)
 }
 
@@ -668,6 +749,14 @@ func policyUpdateHandler(w http.ResponseWriter, r *http.Request) {
 	var responseMessage []byte
 	var code int
 
+	// The key is already hashed, so its session is read without the hash function of the store
+	thisToken := GetAdminTokenFromRequest(r)
+	beforeState := getHashedKeyAuditState(keyName, APIID)
+	if !thisToken.CanAccessAPI(APIID) || !thisToken.CanAccessOrg(getSessionOrgID(beforeState)) {
+		DoJSONWrite(w, 403, createError("Forbidden"))
+		return
+	}
+
 	if r.Method == "POST" {
 		decoder := json.NewDecoder(r.Body)
 		var policRecord PolicyUpdateObj
@@ -681,6 +770,10 @@ func policyUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		responseMessage, code = handleUpdateHashedKey(keyName, APIID, policRecord.Policy)
+		if AuditLog != nil && code == 200 {
+			afterState := getHashedKeyAuditState(keyName, APIID)
+			RecordAuditEvent(r, "modified", AuditObjectPolicy, keyName, getSessionOrgID(afterState), beforeState, afterState)
+		}
 
 	} else {
 		// Return Not supported message (and code)
@@ -762,6 +855,18 @@ func orgHandler(w http.ResponseWriter, r *http.Request) {
 	var responseMessage []byte
 	var code int
 
+	// Org-restricted tokens may only see their own org record, and never the full list
+	thisToken := GetAdminTokenFromRequest(r)
+	if thisToken.OrgID != "" && keyName != thisToken.OrgID {
+		DoJSONWrite(w, 403, createError("Forbidden"))
+		return
+	}
+
+	var beforeState *SessionState
+	if AuditLog != nil && r.Method != "GET" {
+		beforeState = getOrgAuditState(keyName)
+	}
+
 	if r.Method == "POST" || r.Method == "PUT" {
 		responseMessage, code = handleOrgAddOrUpdate(keyName, r)
 
@@ -785,6 +890,14 @@ func orgHandler(w http.ResponseWriter, r *http.Request) {
 		responseMessage = createError("Method not supported")
 	}
 
+	if AuditLog != nil && code == 200 && r.Method != "GET" {
+		var afterState *SessionState
+		if r.Method != "DELETE" {
+			afterState = getOrgAuditState(keyName)
+		}
+		RecordAuditEvent(r, getAuditAction(r.Method), AuditObjectOrg, keyName, keyName, beforeState, afterState)
+	}
+
 	DoJSONWrite(w, code, responseMessage)
 }
 
@@ -1023,6 +1136,55 @@ func extractKey(orgID, key string) string {
 	return replaced
 }
 
+// applyNewKeySession stores a newly generated key against every API in its access rights, keys without
+// access rights are master keys and are added to all APIs if the configuration allows it
+func applyNewKeySession(newKey string, newSession SessionState) error {
+	if len(newSession.AccessRights) > 0 {
+		for apiId, _ := range newSession.AccessRights {
+			thisAPISpec := GetSpecForApi(apiId)
+			if thisAPISpec != nil {
+				// If we have enabled HMAC checking for keys, we need to generate a secret for the client to use
+				if !thisAPISpec.DontSetQuotasOnCreate {
+					// Reset quota by default
+					thisAPISpec.SessionManager.ResetQuota(newKey, newSession)
+					newSession.QuotaRenews = time.Now().Unix() + newSession.QuotaRenewalRate
+				}
+				err := thisAPISpec.SessionManager.UpdateSession(newKey, newSession, thisAPISpec.SessionLifetime)
+				if err != nil {
+					return errors.New("Failed to create key - " + err.Error())
+				}
+			} else {
+				log.WithFields(logrus.Fields{
+					"apiID": apiId,
+				}).Error("Could not create key for this API ID, API doesn't exist.")
+				return errors.New("Could not create key for this API ID, API doesn't exist.")
+			}
+		}
+	} else {
+		if config.AllowMasterKeys {
+			// nothing defined, add key to ALL
+			log.Warning("No API Access Rights set, adding key to ALL.")
+			for _, spec := range ApiSpecRegister {
+				if !spec.DontSetQuotasOnCreate {
+					// Reset quote by default
+					spec.SessionManager.ResetQuota(newKey, newSession)
+					newSession.QuotaRenews = time.Now().Unix() + newSession.QuotaRenewalRate
+				}
+				err := spec.SessionManager.UpdateSession(newKey, newSession, spec.SessionLifetime)
+				if err != nil {
+					return errors.New("Failed to create key - " + err.Error())
+				}
+			}
+		} else {
+			log.Error("Master keys disallowed in configuration, key not added.")
+			return errors.New("Failed to create key, keys must have at least one Access Rights record set.")
+		}
+
+	}
+
+	return nil
+}
+
 func createKeyHandler(w http.ResponseWriter, r *http.Request) {
 	var responseMessage []byte
 	code := 200
@@ -1038,6 +1200,11 @@ func createKeyHandler(w http.ResponseWriter, r *http.Request) {
 			code = 500
 			log.Error("Couldn't decode body: ", err)
 
+		} else if !GetAdminTokenFromRequest(r).CanAccessSession(newSession) {
+			responseMessage = createError("Forbidden")
+			code = 403
+			log.Warning("Admin token is not permitted to create keys for this session")
+
 		} else {
 
 			newKey := keyGen.GenerateAuthKey(newSession.OrgID)
@@ -1045,58 +1212,13 @@ func createKeyHandler(w http.ResponseWriter, r *http.Request) {
 				newSession.HmacSecret = keyGen.GenerateHMACSecret()
 			}
 
-			if len(newSession.AccessRights) > 0 {
-				for apiId, _ := range newSession.AccessRights {
-					thisAPISpec := GetSpecForApi(apiId)
-					if thisAPISpec != nil {
-						// If we have enabled HMAC checking for keys, we need to generate a secret for the client to use
-						if !thisAPISpec.DontSetQuotasOnCreate {
-							// Reset quota by default
-							thisAPISpec.SessionManager.ResetQuota(newKey, newSession)
-							newSession.QuotaRenews = time.Now().Unix() + newSession.QuotaRenewalRate
-						}
-						err := thisAPISpec.SessionManager.UpdateSession(newKey, newSession, thisAPISpec.SessionLifetime)
-						if err != nil {
-							responseMessage = createError("Failed to create key - " + err.Error())
-							DoJSONWrite(w, 403, responseMessage)
-							return
-						}
-					} else {
-						log.WithFields(logrus.Fields{
-							"apiID": apiId,
-						}).Error("Could not create key for this API ID, API doesn't exist.")
-						responseMessage = createError("Could not create key for this API ID, API doesn't exist.")
-						DoJSONWrite(w, 403, responseMessage)
-						return
-					}
-				}
-			} else {
-				if config.AllowMasterKeys {
-					// nothing defined, add key to ALL
-					log.Warning("No API Access Rights set, adding key to ALL.")
-					for _, spec := range ApiSpecRegister {
-						if !spec.DontSetQuotasOnCreate {
-							// Reset quote by default
-							spec.SessionManager.ResetQuota(newKey, newSession)
-							newSession.QuotaRenews = time.Now().Unix() + newSession.QuotaRenewalRate
-						}
-						err := spec.SessionManager.UpdateSession(newKey, newSession, spec.SessionLifetime)
-						if err != nil {
-							responseMessage = createError("Failed to create key - " + err.Error())
-							DoJSONWrite(w, 403, responseMessage)
-							return
-						}
-					}
-				} else {
-					log.Error("Master keys disallowed in configuration, key not added.")
-					responseMessage = createError("Failed to create key, keys must have at least one Access Rights record set.")
-					code = 403
-					DoJSONWrite(w, code, responseMessage)
-					return
-				}
-
+			if err := applyNewKeySession(newKey, newSession); err != nil {
+				DoJSONWrite(w, 403, createError(err.Error()))
+				return
 			}
 
+			RecordAuditEvent(r, "added", AuditObjectKey, publicHash(newKey), newSession.OrgID, nil, newSession)
+
 			responseObj.Action = "create"
 			responseObj.Key = newKey
 			responseObj.Status = "ok"
@@ -1161,6 +1283,11 @@ func createOauthClient(w http.ResponseWriter, r *http.Request) {
 			Secret:      secret,
 		}
 
+		if !GetAdminTokenFromRequest(r).CanAccessAPI(newOauthClient.APIID) {
+			DoJSONWrite(w, 403, createError("Forbidden"))
+			return
+		}
+
 		storageID := createOauthClientStorageID(newOauthClient.APIID, newClient.GetId())
 		log.Debug("Storage ID: ", storageID)
 
@@ -1184,6 +1311,10 @@ func createOauthClient(w http.ResponseWriter, r *http.Request) {
 			ClientRedirectURI: newClient.GetRedirectUri(),
 		}
 
+		if storeErr == nil {
+			RecordAuditEvent(r, "added", AuditObjectOAuthClient, newClient.GetId(), thisAPISpec.OrgID, nil, reportableClientData)
+		}
+
 		responseMessage, err = json.Marshal(&reportableClientData)
 
 		if err != nil {
@@ -1226,6 +1357,11 @@ func oAuthClientHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !GetAdminTokenFromRequest(r).CanAccessAPI(apiID) {
+		DoJSONWrite(w, 403, createError("Forbidden"))
+		return
+	}
+
 	if r.Method == "GET" {
 		if keyName != "" {
 			// Return single client detail
@@ -1238,6 +1374,9 @@ func oAuthClientHandler(w http.ResponseWriter, r *http.Request) {
 	} else if r.Method == "DELETE" {
 		// Remove a key
 		responseMessage, code = handleDeleteOAuthClient(keyName, apiID)
+		if code == 200 {
+			RecordAuditEvent(r, "deleted", AuditObjectOAuthClient, keyName, getAPIOrgID(apiID), nil, nil)
+		}
 
 	} else {
 		// Return Not supported message (and code)
@@ -1411,6 +1550,9 @@ func healthCheckhandler(w http.ResponseWriter, r *http.Request) {
 			if APIID == "" {
 				code = 405
 				responseMessage = createError("missing api_id parameter")
+			} else if !GetAdminTokenFromRequest(r).CanAccessAPI(APIID) {
+				code = 403
+				responseMessage = createError("Forbidden")
 			} else {
 				thisAPISpec := GetSpecForApi(APIID)
 				if thisAPISpec != nil {
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"github.com/gorilla/context"
 	"github.com/lonelycode/tykcommon"
-	"github.com/rubyist/circuitbreaker"
 	"io/ioutil"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
@@ -98,7 +97,7 @@ type TransformSpec struct {
 
 type ExtendedCircuitBreakerMeta struct {
 	tykcommon.CircuitBreakerMeta
-	CB *circuit.Breaker
+	CB *PathCircuitBreaker
 }
 
 // APISpec represents a path specification for an API, to avoid enumerating multiple nested lists, a single
@@ -116,13 +115,17 @@ type APISpec struct {
 	Health            HealthChecker
 	JSVM              *JSVM
 	ResponseChain     *[]TykResponseHandler
-	RoundRobin        *RoundRobin
+	LoadBalancer      LoadBalancer
+	UpstreamHealth    *UpstreamHealthChecker
 }
 
 // APIDefinitionLoader will load an Api definition from a storage system. It has two methods LoadDefinitionsFromMongo()
 // and LoadDefinitions(), each will pull api specifications from different locations.
 type APIDefinitionLoader struct {
 	dbSession *mgo.Session
+	// Validation collects errors and warnings while compiling a spec, it is only set for dry runs
+	Validation     *APIValidationResult
+	validationPath string
 }
 
 // Connect connects to the storage engine - can be null
@@ -188,6 +191,7 @@ func (a *APIDefinitionLoader) MakeSpec(thisAppConfig tykcommon.APIDefinition) AP
 
 			if getHandlerErr != nil {
 				log.Error("Failed to init event handler: ", getHandlerErr)
+				a.addValidationError("event_handlers.events."+string(eventName), "Failed to init event handler: "+getHandlerErr.Error())
 			} else {
 				log.Debug("Init Event Handler: ", eventName)
 				newAppSpec.EventPaths[eventName] = append(newAppSpec.EventPaths[eventName], thisEventHandlerInstance)
@@ -198,16 +202,19 @@ func (a *APIDefinitionLoader) MakeSpec(thisAppConfig tykcommon.APIDefinition) AP
 
 	newAppSpec.RxPaths = make(map[string][]URLSpec)
 	newAppSpec.WhiteListEnabled = make(map[string]bool)
-	for _, v := range thisAppConfig.VersionData.Versions {
+	for versionKey, v := range thisAppConfig.VersionData.Versions {
 		var pathSpecs []URLSpec
 		var whiteListSpecs bool
 
 		// If we have transitioned to extended path specifications, we should use these now
 		if v.UseExtendedPaths {
+			a.validationPath = "version_data.versions." + versionKey + ".extended_paths"
 			pathSpecs, whiteListSpecs = a.getExtendedPathSpecs(v, &newAppSpec)
 
 		} else {
 			log.Warning("Path-based version path list settings are being deprecated, please upgrade your defintitions to the new standard as soon as spossible")
+			a.validationPath = "version_data.versions." + versionKey + ".paths"
+			a.addValidationWarning(a.validationPath, "Path-based version path list settings are deprecated, use extended_paths instead")
 			pathSpecs, whiteListSpecs = a.getPathSpecs(v)
 		}
 		newAppSpec.RxPaths[v.Name] = pathSpecs
@@ -344,8 +351,14 @@ func (a *APIDefinitionLoader) LoadDefinitions(dir string) []APISpec {
 }
 
 func (a *APIDefinitionLoader) getPathSpecs(apiVersionDef tykcommon.VersionInfo) ([]URLSpec, bool) {
+	basePath := a.validationPath
+	defer func() { a.validationPath = basePath }()
+
+	a.validationPath = basePath + ".ignored"
 	ignoredPaths := a.compilePathSpec(apiVersionDef.Paths.Ignored, Ignored)
+	a.validationPath = basePath + ".black_list"
 	blackListPaths := a.compilePathSpec(apiVersionDef.Paths.BlackList, BlackList)
+	a.validationPath = basePath + ".white_list"
 	whiteListPaths := a.compilePathSpec(apiVersionDef.Paths.WhiteList, WhiteList)
 
 	combinedPath := []URLSpec{}
@@ -360,13 +373,14 @@ func (a *APIDefinitionLoader) getPathSpecs(apiVersionDef tykcommon.VersionInfo)
 	return combinedPath, false
 }
 
-func (a *APIDefinitionLoader) generateRegex(stringSpec string, newSpec *URLSpec, specType URLStatus) {
+func (a *APIDefinitionLoader) generateRegex(stringSpec string, newSpec *URLSpec, specType URLStatus) error {
 	apiLangIDsRegex, _ := regexp.Compile("{(.*?)}")
 	asRegexStr := apiLangIDsRegex.ReplaceAllString(stringSpec, "(.*?)")
-	asRegex, _ := regexp.Compile(asRegexStr)
+	asRegex, rxErr := regexp.Compile(asRegexStr)
 	newSpec.Status = specType
 	newSpec.Spec = asRegex
 
+	return rxErr
 }
 
 func (a *APIDefinitionLoader) compilePathSpec(paths []string, specType URLStatus) []URLSpec {
@@ -375,9 +389,9 @@ func (a *APIDefinitionLoader) compilePathSpec(paths []string, specType URLStatus
 	// This way we can iterate the whole array once, on match we break with status
 	thisURLSpec := []URLSpec{}
 
-	for _, stringSpec := range paths {
+	for i, stringSpec := range paths {
 		newSpec := URLSpec{}
-		a.generateRegex(stringSpec, &newSpec, specType)
+		a.reportPathError(i, "", a.generateRegex(stringSpec, &newSpec, specType))
 		thisURLSpec = append(thisURLSpec, newSpec)
 	}
 
@@ -390,9 +404,9 @@ func (a *APIDefinitionLoader) compileExtendedPathSpec(paths []tykcommon.EndPoint
 	// This way we can iterate the whole array once, on match we break with status
 	thisURLSpec := []URLSpec{}
 
-	for _, stringSpec := range paths {
+	for i, stringSpec := range paths {
 		newSpec := URLSpec{}
-		a.generateRegex(stringSpec.Path, &newSpec, specType)
+		a.reportPathError(i, "path", a.generateRegex(stringSpec.Path, &newSpec, specType))
 
 		// Extend with method actions
 		newSpec.MethodActions = stringSpec.MethodActions
@@ -408,9 +422,9 @@ func (a *APIDefinitionLoader) compileCachedPathSpec(paths []string) []URLSpec {
 	// This way we can iterate the whole array once, on match we break with status
 	thisURLSpec := []URLSpec{}
 
-	for _, stringSpec := range paths {
+	for i, stringSpec := range paths {
 		newSpec := URLSpec{}
-		a.generateRegex(stringSpec, &newSpec, Cached)
+		a.reportPathError(i, "", a.generateRegex(stringSpec, &newSpec, Cached))
 		// Extend with method actions
 		thisURLSpec = append(thisURLSpec, newSpec)
 	}
@@ -444,10 +458,10 @@ func (a *APIDefinitionLoader) compileTransformPathSpec(paths []tykcommon.Templat
 	thisURLSpec := []URLSpec{}
 
 	log.Debug("Checking for transform paths...")
-	for _, stringSpec := range paths {
+	for i, stringSpec := range paths {
 		log.Debug("-- Generating path")
 		newSpec := URLSpec{}
-		a.generateRegex(stringSpec.Path, &newSpec, stat)
+		a.reportPathError(i, "path", a.generateRegex(stringSpec.Path, &newSpec, stat))
 		// Extend with template actions
 
 		newTransformSpec := TransformSpec{TemplateMeta: stringSpec}
@@ -478,6 +492,7 @@ func (a *APIDefinitionLoader) compileTransformPathSpec(paths []tykcommon.Templat
 			log.Debug("-- Loaded")
 		} else {
 			log.Error("Template load failure! Skipping transformation: ", templErr)
+			a.reportPathError(i, "template_data", templErr)
 		}
 
 	}
@@ -491,9 +506,9 @@ func (a *APIDefinitionLoader) compileInjectedHeaderSpec(paths []tykcommon.Header
 	// This way we can iterate the whole array once, on match we break with status
 	thisURLSpec := []URLSpec{}
 
-	for _, stringSpec := range paths {
+	for i, stringSpec := range paths {
 		newSpec := URLSpec{}
-		a.generateRegex(stringSpec.Path, &newSpec, stat)
+		a.reportPathError(i, "path", a.generateRegex(stringSpec.Path, &newSpec, stat))
 		// Extend with method actions
 		if stat == HeaderInjected {
 			newSpec.InjectHeaders = stringSpec
@@ -513,9 +528,9 @@ func (a *APIDefinitionLoader) compileTimeoutPathSpec(paths []tykcommon.HardTimeo
 	// This way we can iterate the whole array once, on match we break with status
 	thisURLSpec := []URLSpec{}
 
-	for _, stringSpec := range paths {
+	for i, stringSpec := range paths {
 		newSpec := URLSpec{}
-		a.generateRegex(stringSpec.Path, &newSpec, stat)
+		a.reportPathError(i, "path", a.generateRegex(stringSpec.Path, &newSpec, stat))
 		// Extend with method actions
 		newSpec.HardTimeout = stringSpec
 
@@ -525,71 +540,26 @@ func (a *APIDefinitionLoader) compileTimeoutPathSpec(paths []tykcommon.HardTimeo
 	return thisURLSpec
 }
 
-func (a *APIDefinitionLoader) compileCircuitBreakerPathSpec(paths []tykcommon.CircuitBreakerMeta, stat URLStatus, apiSpec *APISpec) []URLSpec {
+func (a *APIDefinitionLoader) compileCircuitBreakerPathSpec(paths []tykcommon.CircuitBreakerMeta, stat URLStatus, apiSpec *APISpec, versionName string) []URLSpec {
 
 	// transform an extended configuration URL into an array of URLSpecs
 	// This way we can iterate the whole array once, on match we break with status
 	thisURLSpec := []URLSpec{}
 
-	for _, stringSpec := range paths {
+	for i, stringSpec := range paths {
 		newSpec := URLSpec{}
-		a.generateRegex(stringSpec.Path, &newSpec, stat)
+		a.reportPathError(i, "path", a.generateRegex(stringSpec.Path, &newSpec, stat))
 		// Extend with method actions
 		newSpec.CircuitBreaker = ExtendedCircuitBreakerMeta{CircuitBreakerMeta: stringSpec}
 		log.Debug("Initialising circuit breaker for: ", stringSpec.Path)
-		newSpec.CircuitBreaker.CB = circuit.NewRateBreaker(stringSpec.ThresholdPercent, stringSpec.Samples)
-		events := newSpec.CircuitBreaker.CB.Subscribe()
-		go func() {
-			path := stringSpec.Path
-			spec := apiSpec
-			breakerPtr := newSpec.CircuitBreaker.CB
-			timerActive := false
-			for {
-				e := <-events
-				switch e {
-				case circuit.BreakerTripped:
-					log.Warning("[PROXY] [CIRCUIT BREKER] Breaker tripped for path: ", path)
-					log.Debug("Breaker tripped: ", e)
-					// Start a timer function
-
-					if !timerActive {
-						go func(timeout int, breaker *circuit.Breaker) {
-							log.Debug("-- Sleeping for (s): ", timeout)
-							time.Sleep(time.Duration(timeout) * time.Second)
-							log.Debug("-- Resetting breaker")
-							breaker.Reset()
-							timerActive = false
-						}(newSpec.CircuitBreaker.ReturnToServiceAfter, breakerPtr)
-						timerActive = true
-					}
-
-					if spec.Proxy.ServiceDiscovery.UseDiscoveryService {
-						if ServiceCache != nil {
-							log.Warning("[PROXY] [CIRCUIT BREKER] Refreshing host list")
-							ServiceCache.Delete(spec.APIID)
-						}
-					}
-
-					spec.FireEvent(EVENT_BreakerTriggered,
-						EVENT_CurcuitBreakerMeta{
-							EventMetaDefault: EventMetaDefault{Message: "Breaker Tripped"},
-							CircuitEvent:     e,
-							Path:             path,
-							APIID:            spec.APIID,
-						})
-
-				case circuit.BreakerReset:
-					spec.FireEvent(EVENT_BreakerTriggered,
-						EVENT_CurcuitBreakerMeta{
-							EventMetaDefault: EventMetaDefault{Message: "Breaker Reset"},
-							CircuitEvent:     e,
-							Path:             path,
-							APIID:            spec.APIID,
-						})
-
-				}
-			}
-		}()
+		thisOptions := getCircuitBreakerOptions(apiSpec, versionName, i)
+		newSpec.CircuitBreaker.CB = NewPathCircuitBreaker(apiSpec, versionName, stringSpec, thisOptions)
+		if a.Validation != nil {
+			a.checkCircuitBreakerMeta(i, stringSpec, thisOptions)
+			thisURLSpec = append(thisURLSpec, newSpec)
+			continue
+		}
+		newSpec.CircuitBreaker.CB.loadSharedState()
 
 		thisURLSpec = append(thisURLSpec, newSpec)
 	}
@@ -603,9 +573,10 @@ func (a *APIDefinitionLoader) compileURLRewritesPathSpec(paths []tykcommon.URLRe
 	// This way we can iterate the whole array once, on match we break with status
 	thisURLSpec := []URLSpec{}
 
-	for _, stringSpec := range paths {
+	for i, stringSpec := range paths {
 		newSpec := URLSpec{}
-		a.generateRegex(stringSpec.Path, &newSpec, stat)
+		a.reportPathError(i, "path", a.generateRegex(stringSpec.Path, &newSpec, stat))
+		a.reportPathError(i, "match_pattern", a.checkURLRewriteMeta(stringSpec))
 		// Extend with method actions
 		newSpec.URLRewrite = stringSpec
 
@@ -621,11 +592,12 @@ func (a *APIDefinitionLoader) compileVirtualPathspathSpec(paths []tykcommon.Virt
 	// This way we can iterate the whole array once, on match we break with status
 	thisURLSpec := []URLSpec{}
 
-	for _, stringSpec := range paths {
+	for i, stringSpec := range paths {
 		newSpec := URLSpec{}
-		a.generateRegex(stringSpec.Path, &newSpec, stat)
+		a.reportPathError(i, "path", a.generateRegex(stringSpec.Path, &newSpec, stat))
 		// Extend with method actions
 		newSpec.VirtualPathSpec = stringSpec
+		a.reportPathError(i, "function_source_uri", a.checkVirtualMetaSource(stringSpec))
 		PreLoadVirtualMetaCode(&newSpec.VirtualPathSpec, apiSpec.JSVM)
 
 		thisURLSpec = append(thisURLSpec, newSpec)
@@ -637,17 +609,32 @@ func (a *APIDefinitionLoader) compileVirtualPathspathSpec(paths []tykcommon.Virt
 func (a *APIDefinitionLoader) getExtendedPathSpecs(apiVersionDef tykcommon.VersionInfo, apiSpec *APISpec) ([]URLSpec, bool) {
 	// TODO: New compiler here, needs to put data into a different structure
 
+	basePath := a.validationPath
+	defer func() { a.validationPath = basePath }()
+
+	a.validationPath = basePath + ".ignored"
 	ignoredPaths := a.compileExtendedPathSpec(apiVersionDef.ExtendedPaths.Ignored, Ignored)
+	a.validationPath = basePath + ".black_list"
 	blackListPaths := a.compileExtendedPathSpec(apiVersionDef.ExtendedPaths.BlackList, BlackList)
+	a.validationPath = basePath + ".white_list"
 	whiteListPaths := a.compileExtendedPathSpec(apiVersionDef.ExtendedPaths.WhiteList, WhiteList)
+	a.validationPath = basePath + ".cache"
 	cachedPaths := a.compileCachedPathSpec(apiVersionDef.ExtendedPaths.Cached)
+	a.validationPath = basePath + ".transform"
 	transformPaths := a.compileTransformPathSpec(apiVersionDef.ExtendedPaths.Transform, Transformed)
+	a.validationPath = basePath + ".transform_response"
 	transformResponsePaths := a.compileTransformPathSpec(apiVersionDef.ExtendedPaths.TransformResponse, TransformedResponse)
+	a.validationPath = basePath + ".transform_headers"
 	headerTransformPaths := a.compileInjectedHeaderSpec(apiVersionDef.ExtendedPaths.TransformHeader, HeaderInjected)
+	a.validationPath = basePath + ".transform_response_headers"
 	headerTransformPathsOnResponse := a.compileInjectedHeaderSpec(apiVersionDef.ExtendedPaths.TransformResponseHeader, HeaderInjectedResponse)
+	a.validationPath = basePath + ".hard_timeouts"
 	hardTimeouts := a.compileTimeoutPathSpec(apiVersionDef.ExtendedPaths.HardTimeouts, HardTimeout)
-	circuitBreakers := a.compileCircuitBreakerPathSpec(apiVersionDef.ExtendedPaths.CircuitBreaker, CircuitBreaker, apiSpec)
+	a.validationPath = basePath + ".circuit_breakers"
+	circuitBreakers := a.compileCircuitBreakerPathSpec(apiVersionDef.ExtendedPaths.CircuitBreaker, CircuitBreaker, apiSpec, apiVersionDef.Name)
+	a.validationPath = basePath + ".url_rewrites"
 	urlRewrites := a.compileURLRewritesPathSpec(apiVersionDef.ExtendedPaths.URLRewrite, URLRewrite)
+	a.validationPath = basePath + ".virtual"
 	virtualPaths := a.compileVirtualPathspathSpec(apiVersionDef.ExtendedPaths.Virtual, VirtualPath, apiSpec)
 
 	combinedPath := []URLSpec{}
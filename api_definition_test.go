@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -137,6 +138,32 @@ func createDefinitionFromString(defStr string) APISpec {
 	return thisSpec
 }
 
+// createTestProxyWithDefinition loads an API from a definition and returns the proxy that sends its requests to
+// the upstream
+func createTestProxyWithDefinition(def string, upstreamURL string) (*ReverseProxy, *APISpec) {
+	spec := createDefinitionFromString(def)
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	spec.Init(&RedisStorageManager{}, &RedisStorageManager{}, healthStore, &RedisStorageManager{})
+
+	remote, _ := url.Parse(upstreamURL)
+	proxy := TykNewSingleHostReverseProxy(remote, &spec)
+	proxy.New(nil, &spec)
+
+	return proxy, &spec
+}
+
+// createTestDefinition returns apiTestDef with the ID APIID, fields are added to the root of the definition and
+// versionFields to its Default version. Both are JSON fields that end in a comma, or empty.
+func createTestDefinition(APIID string, fields string, versionFields string) string {
+	def := strings.Replace(apiTestDef, `"api_id": "1",`, `"api_id": "`+APIID+`", `+fields, 1)
+	return strings.Replace(def, `"name": "Default",`, `"name": "Default", `+versionFields, 1)
+}
+
+// createTestProxyWithFields creates the proxy of apiTestDef with extra fields, see createTestDefinition
+func createTestProxyWithFields(fields string, versionFields string, upstreamURL string) (*ReverseProxy, *APISpec) {
+	return createTestProxyWithDefinition(createTestDefinition("1", fields, versionFields), upstreamURL)
+}
+
 func writeDefToFile(configStruct tykcommon.APIDefinition) {
 	newConfig, err := json.Marshal(configStruct)
 	if err != nil {
@@ -0,0 +1,437 @@
+package main
+
+import (
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lonelycode/tykcommon"
+	"github.com/mitchellh/mapstructure"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const VERSION_EXPIRY_FORMAT string = "2006-01-02 15:04"
+
+// APIValidationIssue describes a single problem with an API Definition, Path is the JSON path of the
+// offending field, e.g. "version_data.versions.Default.extended_paths.transform[0].path"
+type APIValidationIssue struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// APIValidationResult is returned by the validation endpoint and the --validate-api command, a definition
+// is only valid if there are no errors, warnings do not stop a definition from loading
+type APIValidationResult struct {
+	Valid    bool                 `json:"valid"`
+	Errors   []APIValidationIssue `json:"errors"`
+	Warnings []APIValidationIssue `json:"warnings"`
+}
+
+func newAPIValidationResult() *APIValidationResult {
+	return &APIValidationResult{
+		Errors:   []APIValidationIssue{},
+		Warnings: []APIValidationIssue{},
+	}
+}
+
+func (v *APIValidationResult) addError(path, message string) {
+	v.Errors = append(v.Errors, APIValidationIssue{Path: path, Message: message})
+}
+
+func (v *APIValidationResult) addWarning(path, message string) {
+	v.Warnings = append(v.Warnings, APIValidationIssue{Path: path, Message: message})
+}
+
+func (a *APIDefinitionLoader) addValidationError(path, message string) {
+	if a.Validation == nil {
+		return
+	}
+
+	a.Validation.addError(path, message)
+}
+
+func (a *APIDefinitionLoader) addValidationWarning(path, message string) {
+	if a.Validation == nil {
+		return
+	}
+
+	a.Validation.addWarning(path, message)
+}
+
+// reportPathError records an error for the i'th entry of the path list currently being compiled
+func (a *APIDefinitionLoader) reportPathError(i int, field string, err error) {
+	if a.Validation == nil || err == nil {
+		return
+	}
+
+	path := fmt.Sprintf("%s[%d]", a.validationPath, i)
+	if field != "" {
+		path = path + "." + field
+	}
+
+	a.Validation.addError(path, err.Error())
+}
+
+func (a *APIDefinitionLoader) checkVirtualMetaSource(meta tykcommon.VirtualMeta) error {
+	if a.Validation == nil {
+		return nil
+	}
+
+	switch meta.FunctionSourceType {
+	case "file":
+		if _, err := os.Stat(meta.FunctionSourceURI); err != nil {
+			return err
+		}
+	case "blob":
+		if config.DisableVirtualPathBlobs {
+			return errors.New("Blobs are not allowed on this node")
+		}
+		if _, err := b64.StdEncoding.DecodeString(meta.FunctionSourceURI); err != nil {
+			return err
+		}
+	default:
+		return errors.New("Type must be either file or blob (b64)")
+	}
+
+	return nil
+}
+
+func (a *APIDefinitionLoader) checkURLRewriteMeta(meta tykcommon.URLRewriteMeta) error {
+	if a.Validation == nil {
+		return nil
+	}
+
+	_, err := regexp.Compile(meta.MatchPattern)
+	return err
+}
+
+func (a *APIDefinitionLoader) checkCircuitBreakerMeta(i int, meta tykcommon.CircuitBreakerMeta, options CircuitBreakerOptions) {
+	if meta.ThresholdPercent <= 0 || meta.ThresholdPercent > 1 {
+		a.reportPathError(i, "threshold_percent", errors.New("Threshold must be a fraction between 0 and 1"))
+	}
+
+	if meta.Samples <= 0 {
+		a.reportPathError(i, "samples", errors.New("Sample size must be greater than 0"))
+	}
+
+	if meta.ReturnToServiceAfter <= 0 {
+		path := fmt.Sprintf("%s[%d].return_to_service_after", a.validationPath, i)
+		a.addValidationWarning(path, "Breaker will never return to service automatically")
+	}
+
+	for _, code := range options.FailureStatusCodes {
+		if code < 100 || code > 599 {
+			a.reportPathError(i, "failure_status_codes", errors.New("Status codes must be between 100 and 599"))
+			break
+		}
+	}
+
+	if options.MinRequests > 0 && meta.Samples > 0 && options.MinRequests > meta.Samples {
+		a.reportPathError(i, "min_requests", errors.New("Minimum request volume can't be larger than the sample size"))
+	}
+
+	if options.HalfOpenProbes < 0 {
+		a.reportPathError(i, "half_open_probes", errors.New("Number of probes can't be negative"))
+	}
+}
+
+// getJSONErrorIssue converts a decoding error into a validation issue, type errors carry the name of the
+// offending field, syntax errors only know the byte offset so we report the line and column instead
+func getJSONErrorIssue(defData []byte, err error) APIValidationIssue {
+	switch jsonErr := err.(type) {
+	case *json.UnmarshalTypeError:
+		return APIValidationIssue{
+			Path:    jsonErr.Field,
+			Message: fmt.Sprintf("Expected %v but got %v", jsonErr.Type, jsonErr.Value),
+		}
+	case *json.SyntaxError:
+		line, col := 1, 1
+		for i := 0; i < int(jsonErr.Offset) && i < len(defData); i++ {
+			col++
+			if defData[i] == '\n' {
+				line++
+				col = 1
+			}
+		}
+		return APIValidationIssue{
+			Message: fmt.Sprintf("%v (line %d, column %d)", jsonErr, line, col),
+		}
+	}
+
+	return APIValidationIssue{Message: err.Error()}
+}
+
+func checkAPIDefinitionStructure(thisAppConfig tykcommon.APIDefinition, result *APIValidationResult) {
+	if thisAppConfig.APIID == "" {
+		result.addError("api_id", "API ID must be set")
+	}
+
+	if thisAppConfig.Name == "" {
+		result.addError("name", "Name must be set")
+	}
+
+	if thisAppConfig.OrgID == "" {
+		result.addWarning("org_id", "No organisation set, quotas and analytics will not be attributed")
+	}
+
+	if thisAppConfig.Proxy.ListenPath == "" {
+		result.addError("proxy.listen_path", "Listen path must be set")
+	}
+
+	usesDiscovery := thisAppConfig.Proxy.ServiceDiscovery.UseDiscoveryService
+	if usesDiscovery {
+		discoveryConfig := GetDiscoveryConfig(&APISpec{APIDefinition: thisAppConfig})
+		switch discoveryConfig.Provider {
+		case DISCOVERY_HTTP:
+			if _, err := url.ParseRequestURI(thisAppConfig.Proxy.ServiceDiscovery.QueryEndpoint); err != nil {
+				result.addError("proxy.service_discovery.query_endpoint", "Invalid query endpoint: "+err.Error())
+			}
+		case DISCOVERY_DNS:
+			if discoveryConfig.DNS.Record == "" {
+				result.addError("discovery.dns.record", "SRV record name must be set")
+			}
+			if discoveryConfig.DNS.Resolver != "" {
+				if _, err := net.ResolveUDPAddr("udp", discoveryConfig.DNS.Resolver); err != nil {
+					result.addError("discovery.dns.resolver", "Invalid resolver address: "+err.Error())
+				}
+			}
+		case DISCOVERY_REGISTRY:
+			switch discoveryConfig.Registry.Source {
+			case REGISTRY_SOURCE_FILE:
+				if _, err := readRegistryFile(discoveryConfig.Registry.Path); err != nil {
+					result.addError("discovery.registry.path", "Can't read target registry: "+err.Error())
+				}
+			case REGISTRY_SOURCE_REDIS:
+			default:
+				result.addError("discovery.registry.source", "Source must be either file or redis")
+			}
+		case DISCOVERY_CONSUL:
+			if discoveryConfig.Consul.Service == "" {
+				result.addError("discovery.consul.service", "Service name must be set")
+			}
+			if _, err := url.ParseRequestURI(discoveryConfig.Consul.Address); err != nil {
+				result.addError("discovery.consul.address", "Invalid Consul address: "+err.Error())
+			}
+		default:
+			result.addError("discovery.provider", "Unknown discovery provider: "+discoveryConfig.Provider)
+		}
+		if discoveryConfig.Provider == DISCOVERY_HTTP && discoveryConfig.MaxStale < discoveryConfig.RefreshInterval {
+			result.addWarning("discovery.max_stale", "Targets will expire before they are refreshed")
+		}
+	}
+
+	if thisAppConfig.Proxy.EnableLoadBalancing && !usesDiscovery {
+		if len(thisAppConfig.Proxy.TargetList) == 0 {
+			result.addError("proxy.target_list", "Load balancing is enabled but no targets are defined")
+		}
+		for i, target := range thisAppConfig.Proxy.TargetList {
+			// Targets may carry a load balancing weight, e.g. "http://10.0.0.1:8080|3"
+			if weightPos := strings.LastIndex(target, "|"); weightPos != -1 {
+				if weight, err := strconv.Atoi(target[weightPos+1:]); err != nil || weight < 1 {
+					result.addError(fmt.Sprintf("proxy.target_list[%d]", i), "Target weight must be a positive number")
+				}
+				target = target[:weightPos]
+			}
+			if err := checkTargetURL(target); err != nil {
+				result.addError(fmt.Sprintf("proxy.target_list[%d]", i), err.Error())
+			}
+		}
+
+		lbSection := loadBalancerSection{}
+		mapstructure.Decode(thisAppConfig.RawData, &lbSection)
+		switch lbSection.LoadBalancing.Strategy {
+		case "", LB_ROUND_ROBIN, LB_WEIGHTED_ROUND_ROBIN, LB_LEAST_CONNECTIONS:
+		case LB_CONSISTENT_HASH:
+			switch lbSection.LoadBalancing.HashOn {
+			case LB_HASH_ON_HEADER, LB_HASH_ON_COOKIE:
+				if lbSection.LoadBalancing.HashName == "" {
+					result.addError("load_balancing.hash_name", "A header or cookie name is required")
+				}
+			case LB_HASH_ON_KEY, LB_HASH_ON_IP:
+			default:
+				result.addError("load_balancing.hash_on", "Must be one of header, cookie, key or ip")
+			}
+		default:
+			result.addError("load_balancing.strategy", "Unknown load balancing strategy: "+lbSection.LoadBalancing.Strategy)
+		}
+	} else if !usesDiscovery {
+		if err := checkTargetURL(thisAppConfig.Proxy.TargetURL); err != nil {
+			result.addError("proxy.target_url", err.Error())
+		}
+	}
+
+	routingSection := routingRulesSection{}
+	mapstructure.Decode(thisAppConfig.RawData, &routingSection)
+	for i, _ := range routingSection.RoutingRules {
+		if err := routingSection.RoutingRules[i].compile(); err != nil {
+			result.addError(fmt.Sprintf("routing_rules[%d]", i), err.Error())
+		}
+	}
+
+	tlsSection := upstreamTLSSection{}
+	mapstructure.Decode(thisAppConfig.RawData, &tlsSection)
+	if _, err := CreateUpstreamTLSConfig(tlsSection.UpstreamTLS); err != nil {
+		result.addError("upstream_tls", err.Error())
+	}
+	if tlsSection.UpstreamTLS.InsecureSkipVerify {
+		result.addWarning("upstream_tls.insecure_skip_verify", "Upstream certificates will not be verified")
+	}
+
+	sizeSection := bodySizeLimitsSection{}
+	mapstructure.Decode(thisAppConfig.RawData, &sizeSection)
+	if sizeSection.SizeLimits.MaxRequestSize < 0 || sizeSection.SizeLimits.MaxResponseSize < 0 {
+		result.addError("size_limits", "Size limits can't be negative")
+	}
+	for i, thisPath := range sizeSection.SizeLimits.Paths {
+		if _, err := regexp.Compile(thisPath.Path); err != nil {
+			result.addError(fmt.Sprintf("size_limits.paths[%d].path", i), err.Error())
+		}
+		if thisPath.MaxRequestSize < 0 || thisPath.MaxResponseSize < 0 {
+			result.addError(fmt.Sprintf("size_limits.paths[%d]", i), "Size limits can't be negative")
+		}
+	}
+
+	keySection := cacheKeySection{}
+	mapstructure.Decode(thisAppConfig.RawData, &keySection)
+	checkCacheKeyIdentity := func(field string, identity string) {
+		switch identity {
+		case "", CACHE_KEY_IDENTITY_KEY, CACHE_KEY_IDENTITY_IP, CACHE_KEY_IDENTITY_NONE:
+		default:
+			result.addError(field, "Identity must be one of key, ip or none")
+		}
+	}
+	checkCacheKeyIdentity("cache_key.identity", keySection.CacheKey.Identity)
+	for i, thisPath := range keySection.CacheKey.Paths {
+		if _, err := regexp.Compile(thisPath.Path); err != nil {
+			result.addError(fmt.Sprintf("cache_key.paths[%d].path", i), err.Error())
+		}
+		checkCacheKeyIdentity(fmt.Sprintf("cache_key.paths[%d].identity", i), thisPath.Identity)
+	}
+	if keySection.CacheKey.Identity == CACHE_KEY_IDENTITY_NONE && thisAppConfig.CacheOptions.EnableCache && !thisAppConfig.UseKeylessAccess {
+		result.addWarning("cache_key.identity", "Cached responses are shared by all keys of this API")
+	}
+
+	httpCacheSection := httpCacheSection{}
+	mapstructure.Decode(thisAppConfig.RawData, &httpCacheSection)
+	if httpCacheSection.HTTPCache.Enabled && !thisAppConfig.CacheOptions.EnableCache {
+		result.addWarning("http_cache.enabled", "HTTP caching has no effect while cache_options.enable_cache is off")
+	}
+
+	refreshSection := cacheRefreshSection{}
+	mapstructure.Decode(thisAppConfig.RawData, &refreshSection)
+	if refreshSection.CacheRefresh.LockTimeout < 0 {
+		result.addError("cache_refresh.lock_timeout", "Lock timeout can't be negative")
+	}
+	if refreshSection.CacheRefresh.StaleWhileRevalidate < 0 {
+		result.addError("cache_refresh.stale_while_revalidate", "Stale window can't be negative")
+	}
+	if refreshSection.CacheRefresh.StaleIfError < 0 {
+		result.addError("cache_refresh.stale_if_error", "Stale window can't be negative")
+	}
+	if refreshSection.CacheRefresh.RedisLock && !refreshSection.CacheRefresh.Coalesce && refreshSection.CacheRefresh.StaleWhileRevalidate == 0 {
+		result.addWarning("cache_refresh.redis_lock", "The Redis lock is only used with coalesce or stale_while_revalidate")
+	}
+
+	chainSection := cacheResponseChainSection{}
+	mapstructure.Decode(thisAppConfig.RawData, &chainSection)
+	switch chainSection.CacheResponseChain {
+	case "", CACHE_RESPONSE_CHAIN_STORE, CACHE_RESPONSE_CHAIN_REPLAY:
+	default:
+		result.addError("cache_response_chain", "Mode must be either 'store' or 'replay'")
+	}
+
+	if len(thisAppConfig.VersionData.Versions) == 0 {
+		result.addError("version_data.versions", "At least one version must be defined")
+	}
+
+	for versionKey, v := range thisAppConfig.VersionData.Versions {
+		if v.Expires == "" {
+			continue
+		}
+		if _, err := time.Parse(VERSION_EXPIRY_FORMAT, v.Expires); err != nil {
+			result.addWarning("version_data.versions."+versionKey+".expires", "Expiry date must use the format "+VERSION_EXPIRY_FORMAT+", version will not expire")
+		}
+	}
+
+	for _, spec := range ApiSpecRegister {
+		if spec.APIID != thisAppConfig.APIID && spec.Proxy.ListenPath == thisAppConfig.Proxy.ListenPath {
+			result.addError("proxy.listen_path", "Listen path is already in use by API "+spec.APIID)
+		}
+	}
+}
+
+func checkTargetURL(target string) error {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+
+	if targetURL.Scheme == "" || targetURL.Host == "" {
+		return errors.New("Target must be an absolute URL with a scheme and host")
+	}
+
+	return nil
+}
+
+// ValidateAPIDefinition runs a definition through the same pipeline that is used when loading APIs, but
+// does not register it, any problems encountered along the way are collected in the result
+func ValidateAPIDefinition(defData []byte) APIValidationResult {
+	result := newAPIValidationResult()
+
+	thisAppConfig := tykcommon.APIDefinition{}
+	if err := json.Unmarshal(defData, &thisAppConfig); err != nil {
+		issue := getJSONErrorIssue(defData, err)
+		result.Errors = append(result.Errors, issue)
+		return *result
+	}
+
+	thisRawConfig := make(map[string]interface{})
+	json.Unmarshal(defData, &thisRawConfig)
+	thisAppConfig.RawData = thisRawConfig
+
+	checkAPIDefinitionStructure(thisAppConfig, result)
+
+	thisLoader := APIDefinitionLoader{Validation: result}
+	thisLoader.MakeSpec(thisAppConfig)
+
+	result.Valid = len(result.Errors) == 0
+	return *result
+}
+
+// validateAPIHandler will run a posted API Definition through the loader without registering it
+func validateAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	defData, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error("Couldn't read API Definition: ", err)
+		DoJSONWrite(w, 400, createError("Request malformed"))
+		return
+	}
+
+	result := ValidateAPIDefinition(defData)
+	responseMessage, err := json.Marshal(&result)
+	if err != nil {
+		log.Error("Marshalling failed: ", err)
+		DoJSONWrite(w, 500, createError("Unmarshalling failed"))
+		return
+	}
+
+	code := 200
+	if !result.Valid {
+		code = 422
+	}
+
+	DoJSONWrite(w, code, responseMessage)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var invalidAPITestDef string = `
+
+	{
+		"name": "Tyk Test API BROKEN",
+		"api_id": "broken",
+		"org_id": "default",
+		"auth": {
+			"auth_header_name": "authorization"
+		},
+		"version_data": {
+			"not_versioned": true,
+			"versions": {
+				"Default": {
+					"name": "Default",
+					"use_extended_paths": true,
+					"extended_paths": {
+						"ignored": [
+							{
+								"path": "/broken/(",
+								"method_actions": {}
+							}
+						],
+						"transform": [
+							{
+								"path": "/transform",
+								"method": "POST",
+								"template_data": {
+									"template_mode": "file",
+									"template_source": "./no-such-template.tmpl"
+								}
+							}
+						]
+					}
+				}
+			}
+		},
+		"proxy": {
+			"listen_path": "/v1",
+			"target_url": "lonelycode.com",
+			"strip_listen_path": false
+		}
+	}
+
+`
+
+func hasValidationIssue(issues []APIValidationIssue, path string) bool {
+	for _, issue := range issues {
+		if issue.Path == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestValidateAPIDefinition(t *testing.T) {
+	MakeSampleAPI()
+
+	result := ValidateAPIDefinition([]byte(invalidAPITestDef))
+	if result.Valid {
+		t.Fatal("Broken definition should not be valid")
+	}
+
+	expectedPaths := []string{
+		"version_data.versions.Default.extended_paths.ignored[0].path",
+		"version_data.versions.Default.extended_paths.transform[0].template_data",
+		"proxy.target_url",
+		"proxy.listen_path",
+	}
+
+	for _, path := range expectedPaths {
+		if !hasValidationIssue(result.Errors, path) {
+			t.Error("Expected an error for ", path, " got: ", result.Errors)
+		}
+	}
+
+	if len(ApiSpecRegister) != 1 || GetSpecForApi("broken") != nil {
+		t.Error("Validation should not register the API")
+	}
+}
+
+func TestValidateAPIDefinitionSyntax(t *testing.T) {
+	result := ValidateAPIDefinition([]byte(`{"name": "test", "api_id": 5}`))
+	if result.Valid || len(result.Errors) != 1 {
+		t.Fatal("Expected a single decoding error, got: ", result.Errors)
+	}
+
+	if result.Errors[0].Path != "api_id" {
+		t.Error("Decoding error should point at api_id, got: ", result.Errors[0].Path)
+	}
+}
+
+func TestValidateAPIHandler(t *testing.T) {
+	MakeSampleAPI()
+
+	req, _ := http.NewRequest("POST", "/tyk/apis/validate", bytes.NewBufferString(apiTestDef))
+	recorder := httptest.NewRecorder()
+	callAsAdmin(validateAPIHandler, recorder, req)
+
+	if recorder.Code != 200 {
+		t.Fatal("Sample definition should be valid, got: ", recorder.Code, recorder.Body.String())
+	}
+
+	var result APIValidationResult
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatal("Could not unmarshal validation result: ", err)
+	}
+
+	if !result.Valid || len(result.Errors) != 0 {
+		t.Error("Sample definition should not have errors: ", result.Errors)
+	}
+
+	// Path-based lists are deprecated
+	if !hasValidationIssue(result.Warnings, "version_data.versions.Default.paths") {
+		t.Error("Expected deprecation warning, got: ", result.Warnings)
+	}
+
+	req, _ = http.NewRequest("POST", "/tyk/apis/validate", bytes.NewBufferString(invalidAPITestDef))
+	recorder = httptest.NewRecorder()
+	callAsAdmin(validateAPIHandler, recorder, req)
+
+	if recorder.Code != 422 {
+		t.Error("Invalid definition should return 422, got: ", recorder.Code)
+	}
+}
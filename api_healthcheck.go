@@ -14,6 +14,10 @@ const (
 	KeyFailure        HealthPrefix = "KeyFailure"
 	RequestLog        HealthPrefix = "Request"
 	BlockedRequestLog HealthPrefix = "BlockedRequest"
+	CacheMemoryHit    HealthPrefix = "CacheMemoryHit"
+	CacheMemoryMiss   HealthPrefix = "CacheMemoryMiss"
+	CacheRedisHit     HealthPrefix = "CacheRedisHit"
+	CacheRedisMiss    HealthPrefix = "CacheRedisMiss"
 
 	HealthCheckRedisPrefix string = "apihealth"
 )
@@ -25,11 +29,13 @@ type HealthChecker interface {
 }
 
 type HealthCheckValues struct {
-	ThrottledRequestsPS float64 `bson:"throttle_reqests_per_second,omitempty" json:"throttle_reqests_per_second"`
-	QuotaViolationsPS   float64 `bson:"quota_violations_per_second,omitempty" json:"quota_violations_per_second"`
-	KeyFailuresPS       float64 `bson:"key_failures_per_second,omitempty" json:"key_failures_per_second"`
-	AvgUpstreamLatency  float64 `bson:"average_upstream_latency,omitempty" json:"average_upstream_latency"`
-	AvgRequestsPS       float64 `bson:"average_requests_per_second,omitempty" json:"average_requests_per_second"`
+	ThrottledRequestsPS float64             `bson:"throttle_reqests_per_second,omitempty" json:"throttle_reqests_per_second"`
+	QuotaViolationsPS   float64             `bson:"quota_violations_per_second,omitempty" json:"quota_violations_per_second"`
+	KeyFailuresPS       float64             `bson:"key_failures_per_second,omitempty" json:"key_failures_per_second"`
+	AvgUpstreamLatency  float64             `bson:"average_upstream_latency,omitempty" json:"average_upstream_latency"`
+	AvgRequestsPS       float64             `bson:"average_requests_per_second,omitempty" json:"average_requests_per_second"`
+	UpstreamPools       []UpstreamPoolStats `bson:"upstream_pools,omitempty" json:"upstream_pools,omitempty"`
+	CacheTiers          []CacheTierStats    `bson:"cache_tiers,omitempty" json:"cache_tiers,omitempty"`
 }
 
 type DefaultHealthChecker struct {
@@ -122,5 +128,29 @@ func (h *DefaultHealthChecker) GetApiHealthValues() (HealthCheckValues, error) {
 		values.AvgUpstreamLatency = roundValue(float64(runningTotal / len(kv)))
 	}
 
+	values.UpstreamPools = UpstreamTransports.Stats(h.APIID)
+	values.CacheTiers = h.getCacheTierStats()
+
 	return values, nil
 }
+
+// getCacheTierStats returns the hit rates of the memory tier, when it is enabled, and of Redis. APIs that don't
+// use the cache have no stats.
+func (h *DefaultHealthChecker) getCacheTierStats() []CacheTierStats {
+	redisStats := newCacheTierStats(CACHE_TIER_REDIS, h.getAvgCount(CacheRedisHit), h.getAvgCount(CacheRedisMiss))
+	memoryTier := getCacheMemoryTier()
+	if memoryTier == nil {
+		if redisStats.HitsPS+redisStats.MissesPS == 0 {
+			return nil
+		}
+		return []CacheTierStats{redisStats}
+	}
+
+	memoryStats := newCacheTierStats(CACHE_TIER_MEMORY, h.getAvgCount(CacheMemoryHit), h.getAvgCount(CacheMemoryMiss))
+	if memoryStats.HitsPS+memoryStats.MissesPS == 0 {
+		return nil
+	}
+	memoryStats.Entries, memoryStats.Bytes = memoryTier.Stats()
+
+	return []CacheTierStats{memoryStats, redisStats}
+}
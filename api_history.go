@@ -0,0 +1,497 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/lonelycode/tykcommon"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	API_HISTORY_KEYPREFIX string = "tyk-api-history-"
+
+	APIRevisionImported   string = "imported"
+	APIRevisionRolledBack string = "rolled back"
+)
+
+var ErrAPIRevisionNotFound = errors.New("Revision not found")
+
+// APIRevision is a numbered snapshot of an API Definition, Definition is nil for revisions that record
+// the deletion of an API
+type APIRevision struct {
+	APIID      string                   `json:"api_id"`
+	Revision   int                      `json:"revision"`
+	Author     string                   `json:"author"`
+	TimeStamp  time.Time                `json:"timestamp"`
+	Action     string                   `json:"action"`
+	Definition *tykcommon.APIDefinition `json:"definition,omitempty"`
+}
+
+// APIHistoryStore keeps the revisions of every API Definition that is written through the control API,
+// AddRevision assigns the next revision number for the API and returns the stored revision
+type APIHistoryStore interface {
+	Init() error
+	AddRevision(APIRevision) (APIRevision, error)
+	GetRevisions(APIID string) ([]APIRevision, error)
+	GetRevision(APIID string, revision int) (*APIRevision, error)
+}
+
+// APIHistory is the global revision store, nil if API history is disabled
+var APIHistory APIHistoryStore
+
+// setupAPIHistory creates the revision store that has been configured in tyk.conf
+func setupAPIHistory() {
+	if !config.APIHistory.Enable {
+		APIHistory = nil
+		return
+	}
+
+	switch config.APIHistory.Type {
+	case "redis":
+		log.Debug("Using Redis API history")
+		APIHistory = &RedisAPIHistoryStore{}
+	default:
+		log.Debug("Using file API history")
+		APIHistory = &FileAPIHistoryStore{Path: config.APIHistory.Path}
+	}
+
+	if err := APIHistory.Init(); err != nil {
+		log.Error("Failed to initialise API history: ", err)
+	}
+}
+
+// FileAPIHistoryStore writes each revision to <path>/<api_id>/<revision>.json
+type FileAPIHistoryStore struct {
+	Path string
+	lock sync.Mutex
+}
+
+func (f *FileAPIHistoryStore) Init() error {
+	if f.Path == "" {
+		f.Path = path.Join(config.AppPath, "history")
+	}
+
+	return os.MkdirAll(f.Path, 0755)
+}
+
+func (f *FileAPIHistoryStore) revisionNumbers(APIID string) []int {
+	files, _ := ioutil.ReadDir(path.Join(f.Path, APIID))
+
+	numbers := []int{}
+	for _, file := range files {
+		number, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		numbers = append(numbers, number)
+	}
+
+	sort.Ints(numbers)
+	return numbers
+}
+
+func (f *FileAPIHistoryStore) readRevision(APIID string, revision int) (*APIRevision, error) {
+	revData, err := ioutil.ReadFile(path.Join(f.Path, APIID, strconv.Itoa(revision)+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrAPIRevisionNotFound
+		}
+		return nil, err
+	}
+
+	thisRevision := APIRevision{}
+	if err := json.Unmarshal(revData, &thisRevision); err != nil {
+		return nil, err
+	}
+
+	return &thisRevision, nil
+}
+
+func (f *FileAPIHistoryStore) AddRevision(thisRevision APIRevision) (APIRevision, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	apiDir := path.Join(f.Path, thisRevision.APIID)
+	if err := os.MkdirAll(apiDir, 0755); err != nil {
+		return thisRevision, err
+	}
+
+	thisRevision.Revision = 1
+	if numbers := f.revisionNumbers(thisRevision.APIID); len(numbers) > 0 {
+		thisRevision.Revision = numbers[len(numbers)-1] + 1
+	}
+
+	asJSON, err := json.MarshalIndent(thisRevision, "", "  ")
+	if err != nil {
+		return thisRevision, err
+	}
+
+	revFilePath := path.Join(apiDir, strconv.Itoa(thisRevision.Revision)+".json")
+	return thisRevision, ioutil.WriteFile(revFilePath, asJSON, 0644)
+}
+
+func (f *FileAPIHistoryStore) GetRevisions(APIID string) ([]APIRevision, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	revisions := []APIRevision{}
+	for _, number := range f.revisionNumbers(APIID) {
+		thisRevision, err := f.readRevision(APIID, number)
+		if err != nil {
+			return revisions, err
+		}
+		revisions = append(revisions, *thisRevision)
+	}
+
+	return revisions, nil
+}
+
+func (f *FileAPIHistoryStore) GetRevision(APIID string, revision int) (*APIRevision, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.readRevision(APIID, revision)
+}
+
+// RedisAPIHistoryStore keeps a list of revisions per API, the revision number is the position in the list. It is
+// taken from the length of the list that RPUSH returns, so writes from different nodes get distinct numbers.
+type RedisAPIHistoryStore struct {
+	Store *RedisClusterStorageManager
+}
+
+func (r *RedisAPIHistoryStore) Init() error {
+	r.Store = &RedisClusterStorageManager{KeyPrefix: ""}
+	if !r.Store.Connect() {
+		return errors.New("Redis connection failed")
+	}
+
+	return nil
+}
+
+// AddRevision stores revisions without their number, it is set from the position in the list when they are read
+func (r *RedisAPIHistoryStore) AddRevision(thisRevision APIRevision) (APIRevision, error) {
+	thisRevision.Revision = 0
+	asJSON, err := json.Marshal(thisRevision)
+	if err != nil {
+		return thisRevision, err
+	}
+
+	length, err := r.Store.AppendToList(API_HISTORY_KEYPREFIX+thisRevision.APIID, string(asJSON))
+	if err != nil {
+		return thisRevision, err
+	}
+
+	thisRevision.Revision = int(length)
+	return thisRevision, nil
+}
+
+func (r *RedisAPIHistoryStore) GetRevisions(APIID string) ([]APIRevision, error) {
+	revisions := []APIRevision{}
+	for i, v := range r.Store.GetListRange(API_HISTORY_KEYPREFIX+APIID, 0, -1) {
+		var thisRevision APIRevision
+		if err := json.Unmarshal([]byte(v), &thisRevision); err != nil {
+			return revisions, err
+		}
+		thisRevision.Revision = i + 1
+		revisions = append(revisions, thisRevision)
+	}
+
+	return revisions, nil
+}
+
+func (r *RedisAPIHistoryStore) GetRevision(APIID string, revision int) (*APIRevision, error) {
+	if revision < 1 {
+		return nil, ErrAPIRevisionNotFound
+	}
+
+	index := int64(revision - 1)
+	values := r.Store.GetListRange(API_HISTORY_KEYPREFIX+APIID, index, index)
+	if len(values) == 0 {
+		return nil, ErrAPIRevisionNotFound
+	}
+
+	thisRevision := APIRevision{}
+	if err := json.Unmarshal([]byte(values[0]), &thisRevision); err != nil {
+		return nil, err
+	}
+	thisRevision.Revision = revision
+
+	return &thisRevision, nil
+}
+
+// readAPIDefinitionFile loads the definition that is currently stored in the app path
+func readAPIDefinitionFile(APIID string) *tykcommon.APIDefinition {
+	defData, err := ioutil.ReadFile(path.Join(config.AppPath, APIID+".json"))
+	if err != nil {
+		return nil
+	}
+
+	thisDef := tykcommon.APIDefinition{}
+	if err := json.Unmarshal(defData, &thisDef); err != nil {
+		return nil
+	}
+
+	return &thisDef
+}
+
+// ensureBaseAPIRevision stores the definition file as it was before history was enabled, so that the
+// first change made through the control API can still be rolled back
+func ensureBaseAPIRevision(APIID string) {
+	if APIHistory == nil {
+		return
+	}
+
+	revisions, err := APIHistory.GetRevisions(APIID)
+	if err != nil || len(revisions) > 0 {
+		return
+	}
+
+	currentDef := readAPIDefinitionFile(APIID)
+	if currentDef == nil {
+		return
+	}
+
+	APIHistory.AddRevision(APIRevision{
+		APIID:      APIID,
+		TimeStamp:  time.Now(),
+		Action:     APIRevisionImported,
+		Definition: currentDef,
+	})
+}
+
+// RecordAPIRevision adds a revision for a change made through the control API, it is a no-op if API
+// history is disabled
+func RecordAPIRevision(r *http.Request, action string, APIID string, thisDef *tykcommon.APIDefinition) {
+	if APIHistory == nil {
+		return
+	}
+
+	thisRevision := APIRevision{
+		APIID:      APIID,
+		Author:     GetAdminTokenFromRequest(r).Name,
+		TimeStamp:  time.Now(),
+		Action:     action,
+		Definition: thisDef,
+	}
+
+	thisRevision, err := APIHistory.AddRevision(thisRevision)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"api_id": APIID,
+			"action": action,
+		}).Error("Failed to store API revision: ", err)
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"api_id":   APIID,
+		"revision": thisRevision.Revision,
+	}).Debug("Stored API revision")
+}
+
+// getRevisionsOrgID finds the organisation of an API from its most recent revision that holds a definition,
+// this lets org scoped tokens inspect the history of deleted APIs
+func getRevisionsOrgID(revisions []APIRevision) string {
+	for i := len(revisions) - 1; i >= 0; i-- {
+		if revisions[i].Definition != nil {
+			return revisions[i].Definition.OrgID
+		}
+	}
+
+	return ""
+}
+
+func handleGetAPIRevisions(revisions []APIRevision) ([]byte, int) {
+	summaries := make([]APIRevision, len(revisions))
+	for i, thisRevision := range revisions {
+		thisRevision.Definition = nil
+		summaries[i] = thisRevision
+	}
+
+	responseMessage, err := json.Marshal(&summaries)
+	if err != nil {
+		log.Error("Marshalling failed: ", err)
+		return []byte(E_SYSTEM_ERROR), 500
+	}
+
+	return responseMessage, 200
+}
+
+func handleGetAPIRevision(APIID string, revision int) ([]byte, int) {
+	thisRevision, err := APIHistory.GetRevision(APIID, revision)
+	if err != nil {
+		return createError(err.Error()), 404
+	}
+
+	responseMessage, err := json.Marshal(thisRevision)
+	if err != nil {
+		log.Error("Marshalling failed: ", err)
+		return []byte(E_SYSTEM_ERROR), 500
+	}
+
+	return responseMessage, 200
+}
+
+// handleDiffAPIRevisions compares two revisions, "to" defaults to the latest revision
+func handleDiffAPIRevisions(APIID string, revisions []APIRevision, r *http.Request) ([]byte, int) {
+	from, fromErr := strconv.Atoi(r.FormValue("from"))
+	if fromErr != nil {
+		return createError("Parameter 'from' must be a revision number"), 400
+	}
+
+	to := len(revisions)
+	if r.FormValue("to") != "" {
+		var toErr error
+		to, toErr = strconv.Atoi(r.FormValue("to"))
+		if toErr != nil {
+			return createError("Parameter 'to' must be a revision number"), 400
+		}
+	}
+
+	fromRevision, err := APIHistory.GetRevision(APIID, from)
+	if err != nil {
+		return createError(err.Error()), 404
+	}
+
+	toRevision, err := APIHistory.GetRevision(APIID, to)
+	if err != nil {
+		return createError(err.Error()), 404
+	}
+
+	responseMessage, err := json.Marshal(CreateAuditDiff(fromRevision.Definition, toRevision.Definition))
+	if err != nil {
+		log.Error("Marshalling failed: ", err)
+		return []byte(E_SYSTEM_ERROR), 500
+	}
+
+	return responseMessage, 200
+}
+
+// writeAPIDefinitionFile replaces the definition file for an API in the app path
+func writeAPIDefinitionFile(thisDef *tykcommon.APIDefinition) error {
+	asByte, err := json.MarshalIndent(thisDef, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(config.AppPath, thisDef.APIID+".json"), asByte, 0644)
+}
+
+// handleRollbackAPI restores the definition held in a revision and tells the group to reload
+func handleRollbackAPI(APIID string, revision int, r *http.Request) ([]byte, int) {
+	thisRevision, err := APIHistory.GetRevision(APIID, revision)
+	if err != nil {
+		return createError(err.Error()), 404
+	}
+
+	if thisRevision.Definition == nil {
+		return createError("Revision records a deletion and cannot be restored"), 400
+	}
+
+	// The revision may have belonged to another org than the current definition
+	if !GetAdminTokenFromRequest(r).CanAccessOrg(thisRevision.Definition.OrgID) {
+		return createError("Forbidden"), 403
+	}
+
+	beforeDef := getAPIAuditState(APIID)
+	if err := writeAPIDefinitionFile(thisRevision.Definition); err != nil {
+		log.Error("Failed to restore API Definition: ", err)
+		return createError("File object creation failed, write error"), 500
+	}
+
+	RecordAPIRevision(r, APIRevisionRolledBack, APIID, thisRevision.Definition)
+	RecordAuditEvent(r, APIRevisionRolledBack, AuditObjectAPI, APIID, thisRevision.Definition.OrgID, beforeDef, thisRevision.Definition)
+
+	log.WithFields(logrus.Fields{
+		"api_id":   APIID,
+		"revision": revision,
+	}).Info("API Definition rolled back, signalling reload")
+	MainNotifier.Notify(Notification{Command: NoticeGroupReload})
+
+	response := APIModifyKeySuccess{
+		APIID,
+		"ok",
+		APIRevisionRolledBack}
+
+	responseMessage, err := json.Marshal(&response)
+	if err != nil {
+		log.Error("Could not create response message: ", err)
+		return []byte(E_SYSTEM_ERROR), 500
+	}
+
+	return responseMessage, 200
+}
+
+// apiHistoryHandler serves the revision endpoints below /tyk/apis/{api_id}/revisions:
+//
+//	GET  /tyk/apis/{api_id}/revisions                     - list revisions, without definitions
+//	GET  /tyk/apis/{api_id}/revisions/{revision}          - a single revision
+//	GET  /tyk/apis/{api_id}/revisions/diff?from=1&to=2    - JSON diff between two revisions
+//	POST /tyk/apis/{api_id}/revisions/{revision}/rollback - restore a revision
+func apiHistoryHandler(w http.ResponseWriter, r *http.Request, resource string) {
+	if APIHistory == nil {
+		DoJSONWrite(w, 404, createError("API history is not enabled"))
+		return
+	}
+
+	segments := strings.Split(strings.Trim(resource, "/"), "/")
+	if len(segments) < 2 || segments[1] != "revisions" {
+		DoJSONWrite(w, 404, createError("Not found"))
+		return
+	}
+
+	APIID := segments[0]
+	revisions, err := APIHistory.GetRevisions(APIID)
+	if err != nil {
+		log.Error("Failed to read API history: ", err)
+		DoJSONWrite(w, 500, []byte(E_SYSTEM_ERROR))
+		return
+	}
+
+	thisToken := GetAdminTokenFromRequest(r)
+	if !thisToken.CanAccessOrg(getRevisionsOrgID(revisions)) {
+		DoJSONWrite(w, 403, createError("Forbidden"))
+		return
+	}
+
+	var responseMessage []byte
+	var code int
+
+	switch {
+	case len(segments) == 2 && r.Method == "GET":
+		responseMessage, code = handleGetAPIRevisions(revisions)
+
+	case len(segments) == 3 && segments[2] == "diff" && r.Method == "GET":
+		responseMessage, code = handleDiffAPIRevisions(APIID, revisions, r)
+
+	case len(segments) == 3 && r.Method == "GET":
+		revision, convErr := strconv.Atoi(segments[2])
+		if convErr != nil {
+			responseMessage, code = createError("Revision must be a number"), 400
+			break
+		}
+		responseMessage, code = handleGetAPIRevision(APIID, revision)
+
+	case len(segments) == 4 && segments[3] == "rollback" && r.Method == "POST":
+		revision, convErr := strconv.Atoi(segments[2])
+		if convErr != nil {
+			responseMessage, code = createError("Revision must be a number"), 400
+			break
+		}
+		responseMessage, code = handleRollbackAPI(APIID, revision, r)
+
+	default:
+		responseMessage, code = createError("Method not supported"), 405
+	}
+
+	DoJSONWrite(w, code, responseMessage)
+}
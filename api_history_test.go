@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lonelycode/tykcommon"
+)
+
+func callAPIEndpoint(t *testing.T, method, uri string, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, uri, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("x-tyk-authorization", "deploy-token")
+
+	recorder := httptest.NewRecorder()
+	CheckAdminScope(AdminScopeAPIs, apiHandler)(recorder, req)
+	return recorder
+}
+
+func TestAPIHistoryRollback(t *testing.T) {
+	appDir, _ := ioutil.TempDir("", "tyk-apps")
+	defer os.RemoveAll(appDir)
+
+	oldAppPath := config.AppPath
+	config.AppPath = appDir
+	defer func() { config.AppPath = oldAppPath }()
+
+	APIHistory = &FileAPIHistoryStore{Path: path.Join(appDir, "history")}
+	APIHistory.Init()
+	defer func() { APIHistory = nil }()
+
+	notifierStore := RedisClusterStorageManager{}
+	notifierStore.Connect()
+	MainNotifier = RedisNotifier{&notifierStore, RedisPubSubChannel}
+
+	config.AdminTokens = []AdminToken{{Name: "deployer", Token: "deploy-token", Scopes: []string{"apis"}}}
+	defer func() { config.AdminTokens = nil }()
+
+	recorder := callAPIEndpoint(t, "POST", "/tyk/apis/", apiTestDef)
+	if recorder.Code != 200 {
+		t.Fatal("API creation failed: ", recorder.Body.String())
+	}
+
+	modifiedDef := strings.Replace(apiTestDef, `"listen_path": "/v1"`, `"listen_path": "/v2"`, 1)
+	recorder = callAPIEndpoint(t, "PUT", "/tyk/apis/1", modifiedDef)
+	if recorder.Code != 200 {
+		t.Fatal("API update failed: ", recorder.Body.String())
+	}
+
+	recorder = callAPIEndpoint(t, "GET", "/tyk/apis/1/revisions", "")
+	var revisions []APIRevision
+	json.Unmarshal(recorder.Body.Bytes(), &revisions)
+	if len(revisions) != 2 {
+		t.Fatal("Expected two revisions, got: ", recorder.Body.String())
+	}
+
+	if revisions[0].Author != "deployer" || revisions[0].Action != "added" || revisions[1].Action != "modified" {
+		t.Error("Revisions recorded incorrectly: ", revisions)
+	}
+
+	if revisions[0].Definition != nil {
+		t.Error("Revision list should not include definitions")
+	}
+
+	recorder = callAPIEndpoint(t, "GET", "/tyk/apis/1/revisions/diff?from=1&to=2", "")
+	var diff []AuditDiff
+	json.Unmarshal(recorder.Body.Bytes(), &diff)
+	if len(diff) != 1 || diff[0].Path != "proxy.listen_path" || diff[0].Before != "/v1" || diff[0].After != "/v2" {
+		t.Error("Diff between revisions is incorrect: ", recorder.Body.String())
+	}
+
+	recorder = callAPIEndpoint(t, "POST", "/tyk/apis/1/revisions/1/rollback", "")
+	if recorder.Code != 200 {
+		t.Fatal("Rollback failed: ", recorder.Body.String())
+	}
+
+	restoredDef := readAPIDefinitionFile("1")
+	if restoredDef == nil || restoredDef.Proxy.ListenPath != "/v1" {
+		t.Error("Definition file was not restored: ", restoredDef)
+	}
+
+	latest, err := APIHistory.GetRevision("1", 3)
+	if err != nil || latest.Action != APIRevisionRolledBack || latest.Definition.Proxy.ListenPath != "/v1" {
+		t.Error("Rollback should be recorded as a new revision: ", latest, err)
+	}
+
+	recorder = callAPIEndpoint(t, "DELETE", "/tyk/apis/1", "")
+	if recorder.Code != 200 {
+		t.Fatal("API delete failed: ", recorder.Body.String())
+	}
+
+	recorder = callAPIEndpoint(t, "POST", "/tyk/apis/1/revisions/4/rollback", "")
+	if recorder.Code != 400 {
+		t.Error("Rolling back to a deletion should fail, got: ", recorder.Code)
+	}
+}
+
+func TestRedisAPIHistoryRevisions(t *testing.T) {
+	store := &RedisAPIHistoryStore{}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	APIHistory = store
+	defer func() { APIHistory = nil }()
+	defer store.Store.DeleteKey(API_HISTORY_KEYPREFIX + "history-org-test")
+
+	// Concurrent writers get distinct revision numbers
+	numbers := make(chan int, 10)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			thisRevision, _ := store.AddRevision(APIRevision{APIID: "history-org-test", Action: "modified", Definition: &tykcommon.APIDefinition{OrgID: "other-org"}})
+			numbers <- thisRevision.Revision
+		}()
+	}
+	wg.Wait()
+	close(numbers)
+	seen := map[int]bool{}
+	for number := range numbers {
+		seen[number] = true
+	}
+	if len(seen) != 10 || !seen[1] || !seen[10] {
+		t.Error("Expected revisions 1 to 10, got: ", seen)
+	}
+	if thisRevision, err := store.GetRevision("history-org-test", 4); err != nil || thisRevision.Revision != 4 {
+		t.Error("Revision should be numbered by its position: ", thisRevision, err)
+	}
+
+	// Revisions of another org can't be restored, even once the API belongs to the token's org
+	store.AddRevision(APIRevision{APIID: "history-org-test", Action: "modified", Definition: &tykcommon.APIDefinition{APIID: "history-org-test", OrgID: "my-org"}})
+	config.AdminTokens = []AdminToken{{Name: "org-deployer", Token: "deploy-token", Scopes: []string{"apis"}, OrgID: "my-org"}}
+	defer func() { config.AdminTokens = nil }()
+
+	recorder := callAPIEndpoint(t, "POST", "/tyk/apis/history-org-test/revisions/1/rollback", "")
+	if recorder.Code != 403 {
+		t.Error("Rolling back to another org's revision should be forbidden, got: ", recorder.Code, recorder.Body.String())
+	}
+}
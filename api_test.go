@@ -48,6 +48,12 @@ var apiTestDef string = `
 
 `
 
+// callAsAdmin runs a control API handler behind the admin check, authorised with the gateway secret
+func callAsAdmin(handler func(http.ResponseWriter, *http.Request), w http.ResponseWriter, r *http.Request) {
+	r.Header.Set("x-tyk-authorization", config.Secret)
+	CheckIsAPIOwner(handler)(w, r)
+}
+
 func MakeSampleAPI() *APISpec {
 	log.Warning("CREATING TEMPORARY API")
 	thisSpec := createDefinitionFromString(apiTestDef)
@@ -100,7 +106,7 @@ func TestHealthCheckEndpoint(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	healthCheckhandler(recorder, req)
+	callAsAdmin(healthCheckhandler, recorder, req)
 
 	var ApiHealthValues HealthCheckValues
 	err = json.Unmarshal([]byte(recorder.Body.String()), &ApiHealthValues)
@@ -131,7 +137,7 @@ func TestApiHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	apiHandler(recorder, req)
+	callAsAdmin(apiHandler, recorder, req)
 
 	// We can't deserialize BSON ObjectID's if they are not in th test base!
 	var ApiList []testAPIDefinition
@@ -168,7 +174,7 @@ func TestApiHandlerGetSingle(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	apiHandler(recorder, req)
+	callAsAdmin(apiHandler, recorder, req)
 
 	// We can't deserialize BSON ObjectID's if they are not in th test base!
 	var ApiDefinition testAPIDefinition
@@ -200,7 +206,7 @@ func TestKeyHandlerNewKey(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	keyHandler(recorder, req)
+	callAsAdmin(keyHandler, recorder, req)
 
 	newSuccess := Success{}
 	err = json.Unmarshal([]byte(recorder.Body.String()), &newSuccess)
@@ -233,7 +239,7 @@ func TestKeyHandlerUpdateKey(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	keyHandler(recorder, req)
+	callAsAdmin(keyHandler, recorder, req)
 
 	newSuccess := Success{}
 	err = json.Unmarshal([]byte(recorder.Body.String()), &newSuccess)
@@ -260,7 +266,7 @@ func createKey() {
 	param := make(url.Values)
 	req, _ := http.NewRequest(method, uri+param.Encode(), strings.NewReader(string(body)))
 
-	keyHandler(recorder, req)
+	callAsAdmin(keyHandler, recorder, req)
 }
 
 func TestKeyHandlerDeleteKey(t *testing.T) {
@@ -279,7 +285,7 @@ func TestKeyHandlerDeleteKey(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	keyHandler(recorder, req)
+	callAsAdmin(keyHandler, recorder, req)
 
 	newSuccess := Success{}
 	err = json.Unmarshal([]byte(recorder.Body.String()), &newSuccess)
@@ -315,7 +321,7 @@ func TestCreateKeyHandlerCreateNewKey(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	createKeyHandler(recorder, req)
+	callAsAdmin(createKeyHandler, recorder, req)
 
 	newSuccess := Success{}
 	err = json.Unmarshal([]byte(recorder.Body.String()), &newSuccess)
@@ -375,3 +381,122 @@ func TestAPIAuthOk(t *testing.T) {
 		t.Error("Access to API should have been blocked, but response code was: ", recorder.Code)
 	}
 }
+
+func TestAdminTokenOrgChecks(t *testing.T) {
+	// Handlers that are reached without the admin check get no rights
+	req, _ := http.NewRequest("GET", "/tyk/keys/", nil)
+	if thisToken := GetAdminTokenFromRequest(req); thisToken.CanAccessOrg("default") || thisToken.CanAccessKey("any", "") || thisToken.CanAccessSession(SessionState{}) {
+		t.Error("Requests without an admin token should not be granted access")
+	}
+
+	spec := createDefinitionFromString(createTestDefinition("admin-org-test", "", ""))
+	keyStore := &RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	spec.Init(keyStore, keyStore, &RedisClusterStorageManager{KeyPrefix: "apihealth."}, &RedisClusterStorageManager{KeyPrefix: "orgKey."})
+	ApiSpecRegister = map[string]*APISpec{spec.APIID: &spec}
+	defer func() { ApiSpecRegister = make(map[string]*APISpec) }()
+
+	spec.SessionManager.UpdateSession("org-a-custom-key", SessionState{OrgID: "org-ab"}, 60)
+	defer spec.SessionManager.RemoveSession("org-a-custom-key")
+
+	// Keys are matched by the org of their session, not by their name
+	prefixToken := AdminToken{Name: "prefix", Scopes: []string{AdminScopeKeys}, OrgID: "org-a"}
+	if prefixToken.CanAccessKey("org-a-custom-key", spec.APIID) || prefixToken.CanAccessKey("org-a-custom-key", "") {
+		t.Error("Token should not access the key of another org")
+	}
+	ownerToken := AdminToken{Name: "owner", Scopes: []string{AdminScopeKeys}, OrgID: "org-ab"}
+	if !ownerToken.CanAccessKey("org-a-custom-key", spec.APIID) || !ownerToken.CanAccessKey("org-a-custom-key", "") {
+		t.Error("Token should access the keys of its org")
+	}
+}
+
+func TestAdminTokenKeyOwnership(t *testing.T) {
+	spec := createDefinitionFromString(strings.Replace(apiTestDef, `"org_id": "default",`, `"org_id": "org-b",`, 1))
+	keyStore := &RedisClusterStorageManager{KeyPrefix: "apikey-", HashKeys: true}
+	spec.Init(keyStore, keyStore, &RedisClusterStorageManager{KeyPrefix: "apihealth."}, &RedisClusterStorageManager{KeyPrefix: "orgKey."})
+	ApiSpecRegister = map[string]*APISpec{spec.APIID: &spec}
+	defer func() { ApiSpecRegister = make(map[string]*APISpec) }()
+
+	config.AdminTokens = []AdminToken{{Name: "org-b", Token: "org-b-token", Scopes: []string{AdminScopeKeys}, OrgID: "org-b"}}
+	defer func() { config.AdminTokens = nil }()
+
+	spec.SessionManager.UpdateSession("org-a-key", SessionState{OrgID: "org-a", ApplyPolicyID: "org-a-policy"}, 60)
+	defer spec.SessionManager.RemoveSession("org-a-key")
+
+	callAsOrgB := func(handler func(http.ResponseWriter, *http.Request), uri string, body string) int {
+		req, _ := http.NewRequest("POST", uri, strings.NewReader(body))
+		req.Header.Set("x-tyk-authorization", "org-b-token")
+		recorder := httptest.NewRecorder()
+		CheckAdminScope(AdminScopeKeys, handler)(recorder, req)
+		return recorder.Code
+	}
+
+	// Existing keys of another org can't be overwritten with a session of the token's org
+	ownSession := `{"org_id": "org-b", "access_rights": {"1": {"api_id": "1", "api_name": "Tyk Test API ONE", "versions": ["Default"]}}}`
+	if code := callAsOrgB(keyHandler, "/tyk/keys/org-a-key", ownSession); code != 403 {
+		t.Error("Key of another org should not be overwritten, got: ", code)
+	}
+
+	// Nor can their policy be changed through the hashed key
+	if code := callAsOrgB(policyUpdateHandler, "/tyk/keys/policy/"+doHash("org-a-key")+"?api_id=1", `{"policy": "org-b-policy"}`); code != 403 {
+		t.Error("Policy of another org's key should not be changed, got: ", code)
+	}
+
+	thisSession, _ := spec.SessionManager.GetSessionDetail("org-a-key")
+	if thisSession.OrgID != "org-a" || thisSession.ApplyPolicyID != "org-a-policy" {
+		t.Error("Key of another org was changed: ", thisSession)
+	}
+}
+
+func TestAPIAuthScopedTokens(t *testing.T) {
+	config.AdminTokens = []AdminToken{
+		{Name: "reader", Token: "reader-token", Scopes: []string{"keys:read"}},
+		{Name: "reloader", Token: "reload-token", Scopes: []string{"reload"}},
+		{Name: "other-org", Token: "org-token", Scopes: []string{"apis"}, OrgID: "some-other-org"},
+	}
+	defer func() { config.AdminTokens = nil }()
+
+	MakeSampleAPI()
+
+	tests := []struct {
+		token  string
+		method string
+		uri    string
+		scope  string
+		code   int
+	}{
+		{"reader-token", "GET", "/tyk/keys/?api_id=1", "keys", 200},
+		{"reader-token", "DELETE", "/tyk/keys/1234?api_id=1", "keys", 403},
+		{"reload-token", "GET", "/tyk/apis/", "apis", 403},
+		{"org-token", "GET", "/tyk/apis/1", "apis", 403},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest(test.method, test.uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("x-tyk-authorization", test.token)
+
+		handler := keyHandler
+		if test.scope == "apis" {
+			handler = apiHandler
+		}
+		CheckAdminScope(test.scope, handler)(recorder, req)
+
+		if recorder.Code != test.code {
+			t.Error(test.token, test.method, test.uri, "should return", test.code, "but returned: ", recorder.Code)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/tyk/apis/", nil)
+	req.Header.Add("x-tyk-authorization", "org-token")
+	CheckAdminScope(AdminScopeAPIs, apiHandler)(recorder, req)
+
+	var ApiList []testAPIDefinition
+	json.Unmarshal(recorder.Body.Bytes(), &ApiList)
+	if len(ApiList) != 0 {
+		t.Error("Org restricted token should not list APIs of other orgs: ", recorder.Body.String())
+	}
+}
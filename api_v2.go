@@ -0,0 +1,759 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/lonelycode/tykcommon"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const V2_API_PREFIX string = "/tyk/v2"
+
+// Error codes used in v2 error bodies, clients should switch on these rather than on the message
+const (
+	V2ErrorMalformedRequest   string = "malformed_request"
+	V2ErrorValidationFailed   string = "validation_failed"
+	V2ErrorUnauthorized       string = "unauthorized"
+	V2ErrorForbidden          string = "forbidden"
+	V2ErrorNotFound           string = "not_found"
+	V2ErrorMethodNotAllowed   string = "method_not_allowed"
+	V2ErrorConflict           string = "conflict"
+	V2ErrorPreconditionFailed string = "precondition_failed"
+	V2ErrorNotEnabled         string = "not_enabled"
+	V2ErrorInternal           string = "internal_error"
+)
+
+// V2Error is the error object returned by every v2 endpoint, Details holds field level problems when a
+// submitted object fails validation
+type V2Error struct {
+	Code    string               `json:"code"`
+	Message string               `json:"message"`
+	Details []APIValidationIssue `json:"details,omitempty"`
+}
+
+// V2ErrorResponse wraps V2Error so that error bodies can always be told apart from resources
+type V2ErrorResponse struct {
+	Error V2Error `json:"error"`
+}
+
+// V2KeyResponse is returned when a key is generated
+type V2KeyResponse struct {
+	Key     string       `json:"key"`
+	Session SessionState `json:"session"`
+}
+
+// V2Route describes a single v2 endpoint, the same table is used for routing and to generate the OpenAPI
+// document. Patterns use {name} for path parameters, Request and Response are zero values of the body types.
+type V2Route struct {
+	Method      string
+	Pattern     string
+	Scope       string
+	Summary     string
+	Query       []string
+	Request     interface{}
+	Response    interface{}
+	SuccessCode int
+	Handler     func(http.ResponseWriter, *http.Request, map[string]string)
+}
+
+// V2Routes is populated in init, the OpenAPI handler reads it so it can't be set in the declaration
+var V2Routes []V2Route
+
+func init() {
+	V2Routes = []V2Route{
+		{"GET", "/apis", AdminScopeAPIs, "List API Definitions", nil, nil, []tykcommon.APIDefinition{}, 200, v2ListAPIs},
+		{"POST", "/apis", AdminScopeAPIs, "Create an API Definition", nil, tykcommon.APIDefinition{}, tykcommon.APIDefinition{}, 201, v2CreateAPI},
+		{"GET", "/apis/{api_id}", AdminScopeAPIs, "Get an API Definition", nil, nil, tykcommon.APIDefinition{}, 200, v2GetAPI},
+		{"PUT", "/apis/{api_id}", AdminScopeAPIs, "Replace an API Definition", nil, tykcommon.APIDefinition{}, tykcommon.APIDefinition{}, 200, v2UpdateAPI},
+		{"DELETE", "/apis/{api_id}", AdminScopeAPIs, "Delete an API Definition", nil, nil, nil, 204, v2DeleteAPI},
+		{"GET", "/apis/{api_id}/health", AdminScopeHealth, "Get health check values for an API", nil, nil, HealthCheckValues{}, 200, v2GetAPIHealth},
+		{"GET", "/apis/{api_id}/keys", AdminScopeKeys, "List the keys of an API", []string{"filter"}, nil, APIAllKeys{}, 200, v2ListKeys},
+		{"GET", "/apis/{api_id}/keys/{key_id}", AdminScopeKeys, "Get a key session", nil, nil, SessionState{}, 200, v2GetKey},
+		{"PUT", "/apis/{api_id}/keys/{key_id}", AdminScopeKeys, "Create or replace a key session", []string{"suppress_reset"}, SessionState{}, SessionState{}, 200, v2PutKey},
+		{"DELETE", "/apis/{api_id}/keys/{key_id}", AdminScopeKeys, "Delete a key", nil, nil, nil, 204, v2DeleteKey},
+		{"DELETE", "/apis/{api_id}/hashed-keys/{key_hash}", AdminScopeKeys, "Delete a key by its hash", nil, nil, nil, 204, v2DeleteHashedKey},
+		{"POST", "/keys", AdminScopeKeys, "Generate a key", nil, SessionState{}, V2KeyResponse{}, 201, v2CreateKey},
+		{"GET", "/orgs/{org_id}", AdminScopeOrgs, "Get an organisation session", nil, nil, SessionState{}, 200, v2GetOrg},
+		{"PUT", "/orgs/{org_id}", AdminScopeOrgs, "Create or replace an organisation session", []string{"reset_quota"}, SessionState{}, SessionState{}, 200, v2PutOrg},
+		{"DELETE", "/orgs/{org_id}", AdminScopeOrgs, "Delete an organisation session", nil, nil, nil, 204, v2DeleteOrg},
+		{"POST", "/reload", AdminScopeReload, "Reload the APIs on this node", nil, nil, nil, 204, v2Reload},
+		{"POST", "/reload/group", AdminScopeReload, "Reload the APIs on all nodes", nil, nil, nil, 202, v2GroupReload},
+		{"GET", "/openapi.json", AdminScopeAPIs, "This document", nil, nil, nil, 200, v2OpenAPIHandler},
+	}
+}
+
+func writeV2JSON(w http.ResponseWriter, code int, obj interface{}) {
+	responseMessage, err := json.Marshal(obj)
+	if err != nil {
+		log.Error("Marshalling failed: ", err)
+		writeV2Error(w, 500, V2ErrorInternal, "Marshalling failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(responseMessage)
+}
+
+func writeV2Error(w http.ResponseWriter, code int, errorCode string, message string) {
+	writeV2JSON(w, code, V2ErrorResponse{V2Error{Code: errorCode, Message: message}})
+}
+
+func writeV2ValidationError(w http.ResponseWriter, result APIValidationResult) {
+	thisError := V2Error{
+		Code:    V2ErrorValidationFailed,
+		Message: "Definition failed validation",
+		Details: result.Errors,
+	}
+	writeV2JSON(w, 422, V2ErrorResponse{thisError})
+}
+
+// createV2ETag hashes the JSON encoding of a resource
+func createV2ETag(obj interface{}) string {
+	asJSON, _ := json.Marshal(obj)
+	return fmt.Sprintf(`"%x"`, md5.Sum(asJSON))
+}
+
+// getSessionETag ignores the fields that change with traffic, so that a key can be updated while it is in use
+func getSessionETag(thisSession SessionState) string {
+	thisSession.LastCheck = 0
+	thisSession.Allowance = 0
+	thisSession.QuotaRemaining = 0
+	thisSession.QuotaRenews = 0
+	return createV2ETag(thisSession)
+}
+
+// v2ObjectLock is held while an object is read, checked against If-Match and written
+type v2ObjectLock struct {
+	sync.Mutex
+	users int
+}
+
+var (
+	v2ObjectLocksMu sync.Mutex
+	v2ObjectLocks   = make(map[string]*v2ObjectLock)
+)
+
+// lockV2Object serialises the requests that change an object on this node, so that two requests carrying the
+// same ETag can't both pass the If-Match check. It returns the function that releases the lock.
+func lockV2Object(objectType string, objectID string) func() {
+	lockID := objectType + ":" + objectID
+
+	v2ObjectLocksMu.Lock()
+	thisLock, found := v2ObjectLocks[lockID]
+	if !found {
+		thisLock = &v2ObjectLock{}
+		v2ObjectLocks[lockID] = thisLock
+	}
+	thisLock.users++
+	v2ObjectLocksMu.Unlock()
+
+	thisLock.Lock()
+	return func() {
+		thisLock.Unlock()
+
+		v2ObjectLocksMu.Lock()
+		thisLock.users--
+		if thisLock.users == 0 {
+			delete(v2ObjectLocks, lockID)
+		}
+		v2ObjectLocksMu.Unlock()
+	}
+}
+
+// checkV2IfMatch implements If-Match, requests without the header are always allowed. The object must be locked
+// with lockV2Object from before its current ETag is read until it has been written.
+func checkV2IfMatch(r *http.Request, currentETag string, exists bool) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return true
+	}
+
+	if !exists {
+		return false
+	}
+
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == currentETag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchV2Route(pattern string, segments []string) (map[string]string, bool) {
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	if len(patternSegments) != len(segments) {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for i, p := range patternSegments {
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[p[1:len(p)-1]] = segments[i]
+		} else if p != segments[i] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+// v2Handler routes every request below /tyk/v2/ using V2Routes
+func v2Handler(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, V2_API_PREFIX), "/"), "/")
+
+	allowed := []string{}
+	for _, route := range V2Routes {
+		params, ok := matchV2Route(route.Pattern, segments)
+		if !ok {
+			continue
+		}
+
+		if route.Method != r.Method {
+			allowed = append(allowed, route.Method)
+			continue
+		}
+
+		thisToken, found, inScope := getAdminTokenForScope(r, route.Scope)
+		if !found {
+			writeV2Error(w, 401, V2ErrorUnauthorized, "Missing or invalid admin token")
+			return
+		}
+
+		if !inScope {
+			writeV2Error(w, 403, V2ErrorForbidden, "Admin token does not have the "+route.Scope+" scope")
+			return
+		}
+
+		context.Set(r, AdminTokenData, thisToken)
+		route.Handler(w, r, params)
+		context.Clear(r)
+		return
+	}
+
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeV2Error(w, 405, V2ErrorMethodNotAllowed, "Method not supported")
+		return
+	}
+
+	writeV2Error(w, 404, V2ErrorNotFound, "No such resource")
+}
+
+func v2ListAPIs(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	thisToken := GetAdminTokenFromRequest(r)
+
+	apiList := []tykcommon.APIDefinition{}
+	for _, apiSpec := range ApiSpecRegister {
+		if !thisToken.CanAccessOrg(apiSpec.OrgID) {
+			continue
+		}
+		thisDef := apiSpec.APIDefinition
+		thisDef.RawData = nil
+		apiList = append(apiList, thisDef)
+	}
+
+	writeV2JSON(w, 200, apiList)
+}
+
+// decodeV2APIDefinition validates a submitted definition before decoding it, invalid definitions are
+// rejected with the validation details
+func decodeV2APIDefinition(w http.ResponseWriter, r *http.Request) (*tykcommon.APIDefinition, bool) {
+	defData, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeV2Error(w, 400, V2ErrorMalformedRequest, "Could not read request body")
+		return nil, false
+	}
+
+	result := ValidateAPIDefinition(defData)
+	if !result.Valid {
+		writeV2ValidationError(w, result)
+		return nil, false
+	}
+
+	newDef := tykcommon.APIDefinition{}
+	if err := json.Unmarshal(defData, &newDef); err != nil {
+		writeV2Error(w, 400, V2ErrorMalformedRequest, err.Error())
+		return nil, false
+	}
+
+	return &newDef, true
+}
+
+func v2CreateAPI(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	newDef, ok := decodeV2APIDefinition(w, r)
+	if !ok {
+		return
+	}
+
+	if !GetAdminTokenFromRequest(r).CanAccessOrg(newDef.OrgID) {
+		writeV2Error(w, 403, V2ErrorForbidden, "Admin token may not manage APIs for this organisation")
+		return
+	}
+
+	defer lockV2Object(AuditObjectAPI, newDef.APIID)()
+	if getAPIAuditState(newDef.APIID) != nil {
+		writeV2Error(w, 409, V2ErrorConflict, "An API with this ID already exists")
+		return
+	}
+
+	if err := writeAPIDefinitionFile(newDef); err != nil {
+		log.Error("Failed to create file! - ", err)
+		writeV2Error(w, 500, V2ErrorInternal, "Could not write API Definition")
+		return
+	}
+
+	RecordAuditEvent(r, "added", AuditObjectAPI, newDef.APIID, newDef.OrgID, nil, newDef)
+	RecordAPIRevision(r, "added", newDef.APIID, newDef)
+
+	w.Header().Set("Location", V2_API_PREFIX+"/apis/"+newDef.APIID)
+	w.Header().Set("ETag", createV2ETag(newDef))
+	writeV2JSON(w, 201, newDef)
+}
+
+// getV2API finds the current definition of an API and checks the token may access it, it writes the
+// error response itself and returns nil if the request can't continue
+func getV2API(w http.ResponseWriter, r *http.Request, APIID string) *tykcommon.APIDefinition {
+	currentDef := getAPIAuditState(APIID)
+	if currentDef == nil {
+		writeV2Error(w, 404, V2ErrorNotFound, "API not found")
+		return nil
+	}
+
+	if !GetAdminTokenFromRequest(r).CanAccessOrg(currentDef.OrgID) {
+		writeV2Error(w, 403, V2ErrorForbidden, "Admin token may not access this API")
+		return nil
+	}
+
+	return currentDef
+}
+
+func v2GetAPI(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	currentDef := getV2API(w, r, params["api_id"])
+	if currentDef == nil {
+		return
+	}
+
+	w.Header().Set("ETag", createV2ETag(currentDef))
+	writeV2JSON(w, 200, currentDef)
+}
+
+func v2UpdateAPI(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	APIID := params["api_id"]
+	defer lockV2Object(AuditObjectAPI, APIID)()
+	currentDef := getV2API(w, r, APIID)
+	if currentDef == nil {
+		return
+	}
+
+	if !checkV2IfMatch(r, createV2ETag(currentDef), true) {
+		writeV2Error(w, 412, V2ErrorPreconditionFailed, "API Definition has been modified")
+		return
+	}
+
+	newDef, ok := decodeV2APIDefinition(w, r)
+	if !ok {
+		return
+	}
+
+	if newDef.APIID != APIID {
+		writeV2Error(w, 400, V2ErrorMalformedRequest, "api_id in the definition does not match the URL")
+		return
+	}
+
+	if !GetAdminTokenFromRequest(r).CanAccessOrg(newDef.OrgID) {
+		writeV2Error(w, 403, V2ErrorForbidden, "Admin token may not manage APIs for this organisation")
+		return
+	}
+
+	ensureBaseAPIRevision(APIID)
+	if err := writeAPIDefinitionFile(newDef); err != nil {
+		log.Error("Failed to write file! - ", err)
+		writeV2Error(w, 500, V2ErrorInternal, "Could not write API Definition")
+		return
+	}
+
+	RecordAuditEvent(r, "modified", AuditObjectAPI, APIID, newDef.OrgID, currentDef, newDef)
+	RecordAPIRevision(r, "modified", APIID, newDef)
+
+	w.Header().Set("ETag", createV2ETag(newDef))
+	writeV2JSON(w, 200, newDef)
+}
+
+func v2DeleteAPI(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	APIID := params["api_id"]
+	defer lockV2Object(AuditObjectAPI, APIID)()
+	currentDef := getV2API(w, r, APIID)
+	if currentDef == nil {
+		return
+	}
+
+	if !checkV2IfMatch(r, createV2ETag(currentDef), true) {
+		writeV2Error(w, 412, V2ErrorPreconditionFailed, "API Definition has been modified")
+		return
+	}
+
+	ensureBaseAPIRevision(APIID)
+	if err := os.Remove(path.Join(config.AppPath, APIID+".json")); err != nil {
+		if os.IsNotExist(err) {
+			writeV2Error(w, 404, V2ErrorNotFound, "API is not loaded from a definition file")
+			return
+		}
+		log.Error("Failed to delete file! - ", err)
+		writeV2Error(w, 500, V2ErrorInternal, "Could not delete API Definition")
+		return
+	}
+
+	RecordAuditEvent(r, "deleted", AuditObjectAPI, APIID, currentDef.OrgID, currentDef, nil)
+	RecordAPIRevision(r, "deleted", APIID, nil)
+
+	w.WriteHeader(204)
+}
+
+// getV2APISpec finds a loaded API and checks the token may access it
+func getV2APISpec(w http.ResponseWriter, r *http.Request, APIID string) *APISpec {
+	thisSpec := GetSpecForApi(APIID)
+	if thisSpec == nil {
+		writeV2Error(w, 404, V2ErrorNotFound, "API not found")
+		return nil
+	}
+
+	if !GetAdminTokenFromRequest(r).CanAccessAPI(APIID) {
+		writeV2Error(w, 403, V2ErrorForbidden, "Admin token may not access this API")
+		return nil
+	}
+
+	return thisSpec
+}
+
+func v2GetAPIHealth(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !config.HealthCheck.EnableHealthChecks {
+		writeV2Error(w, 404, V2ErrorNotEnabled, "Health checks are not enabled for this node")
+		return
+	}
+
+	thisSpec := getV2APISpec(w, r, params["api_id"])
+	if thisSpec == nil {
+		return
+	}
+
+	health, _ := thisSpec.Health.GetApiHealthValues()
+	writeV2JSON(w, 200, health)
+}
+
+func v2ListKeys(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	thisSpec := getV2APISpec(w, r, params["api_id"])
+	if thisSpec == nil {
+		return
+	}
+
+	keys := []string{}
+	for _, s := range thisSpec.SessionManager.GetSessions(r.FormValue("filter")) {
+		if !strings.Contains(s, QuotaKeyPrefix) && !strings.Contains(s, RateLimitKeyPrefix) {
+			keys = append(keys, s)
+		}
+	}
+
+	writeV2JSON(w, 200, APIAllKeys{keys})
+}
+
+// getV2Key finds a key session for an API, found is false if the key does not exist
+func getV2Key(w http.ResponseWriter, r *http.Request, params map[string]string) (*APISpec, SessionState, bool, bool) {
+	thisSpec := getV2APISpec(w, r, params["api_id"])
+	if thisSpec == nil {
+		return nil, SessionState{}, false, false
+	}
+
+	if !GetAdminTokenFromRequest(r).CanAccessKey(params["key_id"], params["api_id"]) {
+		writeV2Error(w, 403, V2ErrorForbidden, "Admin token may not access this key")
+		return nil, SessionState{}, false, false
+	}
+
+	thisSession, found := thisSpec.SessionManager.GetSessionDetail(params["key_id"])
+	return thisSpec, thisSession, found, true
+}
+
+func v2GetKey(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	_, thisSession, found, ok := getV2Key(w, r, params)
+	if !ok {
+		return
+	}
+
+	if !found {
+		writeV2Error(w, 404, V2ErrorNotFound, "Key not found")
+		return
+	}
+
+	w.Header().Set("ETag", getSessionETag(thisSession))
+	writeV2JSON(w, 200, thisSession)
+}
+
+func v2PutKey(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	defer lockV2Object(AuditObjectKey, params["key_id"])()
+	thisSpec, currentSession, found, ok := getV2Key(w, r, params)
+	if !ok {
+		return
+	}
+
+	if !checkV2IfMatch(r, getSessionETag(currentSession), found) {
+		writeV2Error(w, 412, V2ErrorPreconditionFailed, "Key has been modified")
+		return
+	}
+
+	var newSession SessionState
+	if err := json.NewDecoder(r.Body).Decode(&newSession); err != nil {
+		writeV2Error(w, 400, V2ErrorMalformedRequest, "Could not decode session: "+err.Error())
+		return
+	}
+
+	if !GetAdminTokenFromRequest(r).CanAccessSession(newSession) {
+		writeV2Error(w, 403, V2ErrorForbidden, "Admin token may not manage this session")
+		return
+	}
+
+	if _, hasAccess := newSession.AccessRights[thisSpec.APIID]; len(newSession.AccessRights) > 0 && !hasAccess {
+		writeV2Error(w, 422, V2ErrorValidationFailed, "Session does not grant access to this API")
+		return
+	}
+
+	keyName := params["key_id"]
+	if err := doAddOrUpdate(keyName, newSession, r.FormValue("suppress_reset") == "1"); err != nil {
+		writeV2Error(w, 422, V2ErrorValidationFailed, err.Error())
+		return
+	}
+
+	var beforeState *SessionState
+	code := 201
+	action := "added"
+	if found {
+		beforeState = &currentSession
+		code = 200
+		action = "modified"
+	}
+
+	storedSession, _ := thisSpec.SessionManager.GetSessionDetail(keyName)
+	RecordAuditEvent(r, action, AuditObjectKey, publicHash(keyName), newSession.OrgID, beforeState, storedSession)
+
+	w.Header().Set("ETag", getSessionETag(storedSession))
+	writeV2JSON(w, code, storedSession)
+}
+
+func v2DeleteKey(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	defer lockV2Object(AuditObjectKey, params["key_id"])()
+	thisSpec, currentSession, found, ok := getV2Key(w, r, params)
+	if !ok {
+		return
+	}
+
+	if !found {
+		writeV2Error(w, 404, V2ErrorNotFound, "Key not found")
+		return
+	}
+
+	if !checkV2IfMatch(r, getSessionETag(currentSession), true) {
+		writeV2Error(w, 412, V2ErrorPreconditionFailed, "Key has been modified")
+		return
+	}
+
+	thisSpec.SessionManager.RemoveSession(params["key_id"])
+	RecordAuditEvent(r, "deleted", AuditObjectKey, publicHash(params["key_id"]), currentSession.OrgID, currentSession, nil)
+
+	w.WriteHeader(204)
+}
+
+func v2DeleteHashedKey(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	thisSpec := getV2APISpec(w, r, params["api_id"])
+	if thisSpec == nil {
+		return
+	}
+
+	currentSession := getHashedKeyAuditState(params["key_hash"], thisSpec.APIID)
+	if currentSession == nil {
+		writeV2Error(w, 404, V2ErrorNotFound, "Key not found")
+		return
+	}
+
+	if !GetAdminTokenFromRequest(r).CanAccessSession(*currentSession) {
+		writeV2Error(w, 403, V2ErrorForbidden, "Admin token may not manage this session")
+		return
+	}
+
+	// This is so we bypass the hash function
+	thisSpec.SessionManager.GetStore().DeleteRawKey("apikey-" + params["key_hash"])
+	RecordAuditEvent(r, "deleted", AuditObjectKey, params["key_hash"], currentSession.OrgID, currentSession, nil)
+
+	w.WriteHeader(204)
+}
+
+func v2CreateKey(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var newSession SessionState
+	if err := json.NewDecoder(r.Body).Decode(&newSession); err != nil {
+		writeV2Error(w, 400, V2ErrorMalformedRequest, "Could not decode session: "+err.Error())
+		return
+	}
+
+	if !GetAdminTokenFromRequest(r).CanAccessSession(newSession) {
+		writeV2Error(w, 403, V2ErrorForbidden, "Admin token may not create keys for this session")
+		return
+	}
+
+	newKey := keyGen.GenerateAuthKey(newSession.OrgID)
+	if newSession.HMACEnabled {
+		newSession.HmacSecret = keyGen.GenerateHMACSecret()
+	}
+
+	if err := applyNewKeySession(newKey, newSession); err != nil {
+		writeV2Error(w, 422, V2ErrorValidationFailed, err.Error())
+		return
+	}
+
+	RecordAuditEvent(r, "added", AuditObjectKey, publicHash(newKey), newSession.OrgID, nil, newSession)
+	log.WithFields(logrus.Fields{
+		"key": newKey,
+	}).Debug("Generated new key - success.")
+
+	writeV2JSON(w, 201, V2KeyResponse{newKey, newSession})
+}
+
+// getV2OrgSessionManager returns the store that holds an organisation session, or nil if the org is unknown
+func getV2OrgSessionManager(orgID string) SessionHandler {
+	if spec := GetSpecForOrg(orgID); spec != nil {
+		return spec.OrgSessionManager
+	}
+
+	if config.SupressDefaultOrgStore {
+		return nil
+	}
+
+	return &DefaultOrgStore
+}
+
+func checkV2OrgAccess(w http.ResponseWriter, r *http.Request, orgID string) bool {
+	if !GetAdminTokenFromRequest(r).CanAccessOrg(orgID) {
+		writeV2Error(w, 403, V2ErrorForbidden, "Admin token may not access this organisation")
+		return false
+	}
+
+	return true
+}
+
+func v2GetOrg(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !checkV2OrgAccess(w, r, params["org_id"]) {
+		return
+	}
+
+	thisSession := getOrgAuditState(params["org_id"])
+	if thisSession == nil {
+		writeV2Error(w, 404, V2ErrorNotFound, "Organisation not found")
+		return
+	}
+
+	w.Header().Set("ETag", getSessionETag(*thisSession))
+	writeV2JSON(w, 200, thisSession)
+}
+
+func v2PutOrg(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	orgID := params["org_id"]
+	if !checkV2OrgAccess(w, r, orgID) {
+		return
+	}
+
+	thisSessionManager := getV2OrgSessionManager(orgID)
+	if thisSessionManager == nil {
+		writeV2Error(w, 404, V2ErrorNotFound, "No such organisation found in Active API list")
+		return
+	}
+
+	defer lockV2Object(AuditObjectOrg, orgID)()
+	currentSession := getOrgAuditState(orgID)
+	currentETag := ""
+	if currentSession != nil {
+		currentETag = getSessionETag(*currentSession)
+	}
+
+	if !checkV2IfMatch(r, currentETag, currentSession != nil) {
+		writeV2Error(w, 412, V2ErrorPreconditionFailed, "Organisation has been modified")
+		return
+	}
+
+	var newSession SessionState
+	if err := json.NewDecoder(r.Body).Decode(&newSession); err != nil {
+		writeV2Error(w, 400, V2ErrorMalformedRequest, "Could not decode session: "+err.Error())
+		return
+	}
+
+	if r.FormValue("reset_quota") == "1" {
+		thisSessionManager.ResetQuota(orgID, newSession)
+		newSession.QuotaRenews = time.Now().Unix() + newSession.QuotaRenewalRate
+		// manage quotas seperately
+		DefaultQuotaStore.RemoveSession(QuotaKeyPrefix + publicHash(orgID))
+	}
+
+	if err := thisSessionManager.UpdateSession(orgID, newSession, 0); err != nil {
+		writeV2Error(w, 500, V2ErrorInternal, "Error writing to key store "+err.Error())
+		return
+	}
+
+	code := 201
+	action := "added"
+	if currentSession != nil {
+		code = 200
+		action = "modified"
+	}
+	RecordAuditEvent(r, action, AuditObjectOrg, orgID, orgID, currentSession, newSession)
+
+	w.Header().Set("ETag", getSessionETag(newSession))
+	writeV2JSON(w, code, newSession)
+}
+
+func v2DeleteOrg(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	orgID := params["org_id"]
+	if !checkV2OrgAccess(w, r, orgID) {
+		return
+	}
+
+	defer lockV2Object(AuditObjectOrg, orgID)()
+	currentSession := getOrgAuditState(orgID)
+	thisSessionManager := getV2OrgSessionManager(orgID)
+	if currentSession == nil || thisSessionManager == nil {
+		writeV2Error(w, 404, V2ErrorNotFound, "Organisation not found")
+		return
+	}
+
+	if !checkV2IfMatch(r, getSessionETag(*currentSession), true) {
+		writeV2Error(w, 412, V2ErrorPreconditionFailed, "Organisation has been modified")
+		return
+	}
+
+	thisSessionManager.RemoveSession(orgID)
+	RecordAuditEvent(r, "deleted", AuditObjectOrg, orgID, orgID, currentSession, nil)
+
+	w.WriteHeader(204)
+}
+
+func v2Reload(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	ReloadURLStructure()
+	log.Info("Reloaded URL Structure - Success")
+	w.WriteHeader(204)
+}
+
+func v2GroupReload(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	log.Info("Group reload: sending to channel")
+	MainNotifier.Notify(Notification{Command: NoticeGroupReload})
+	w.WriteHeader(202)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The OpenAPI document is generated from V2Routes, body schemas are derived from the Go types of the
+// route's Request and Response values using their JSON tags
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// v2SchemaForType builds a JSON schema for a type, named structs are added to schemas and referenced
+func v2SchemaForType(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return v2SchemaForType(t.Elem(), schemas)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": v2SchemaForType(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": v2SchemaForType(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t == timeType {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" {
+			return v2StructSchema(t, schemas)
+		}
+		if _, exists := schemas[t.Name()]; !exists {
+			// Reserve the name first so that recursive types terminate
+			schemas[t.Name()] = nil
+			schemas[t.Name()] = v2StructSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+
+	return map[string]interface{}{}
+}
+
+func v2StructSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	v2AddStructProperties(t, properties, schemas)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func v2AddStructProperties(t reflect.Type, properties map[string]interface{}, schemas map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+
+		// Embedded structs without a name are flattened, like encoding/json does
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			v2AddStructProperties(field.Type, properties, schemas)
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = v2SchemaForType(field.Type, schemas)
+	}
+}
+
+func v2JSONContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+// CreateV2OpenAPIDocument describes every route in V2Routes as an OpenAPI 3 document
+func CreateV2OpenAPIDocument() map[string]interface{} {
+	schemas := make(map[string]interface{})
+	errorSchema := v2SchemaForType(reflect.TypeOf(V2ErrorResponse{}), schemas)
+
+	paths := make(map[string]interface{})
+	for _, route := range V2Routes {
+		operation := map[string]interface{}{
+			"summary":     route.Summary,
+			"operationId": strings.ToLower(route.Method) + strings.NewReplacer("/", "_", "-", "_", ".", "_", "{", "", "}", "").Replace(route.Pattern),
+		}
+
+		parameters := []interface{}{}
+		for _, segment := range strings.Split(route.Pattern, "/") {
+			if strings.HasPrefix(segment, "{") {
+				parameters = append(parameters, map[string]interface{}{
+					"name":     strings.Trim(segment, "{}"),
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]interface{}{"type": "string"},
+				})
+			}
+		}
+		for _, query := range route.Query {
+			parameters = append(parameters, map[string]interface{}{
+				"name":   query,
+				"in":     "query",
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		if route.Method == "PUT" || route.Method == "DELETE" {
+			parameters = append(parameters, map[string]interface{}{
+				"name":        "If-Match",
+				"in":          "header",
+				"description": "ETag of the resource, the request fails with 412 if it has been modified",
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+
+		if route.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  v2JSONContent(v2SchemaForType(reflect.TypeOf(route.Request), schemas)),
+			}
+		}
+
+		success := map[string]interface{}{"description": http.StatusText(route.SuccessCode)}
+		if route.Response != nil {
+			success["content"] = v2JSONContent(v2SchemaForType(reflect.TypeOf(route.Response), schemas))
+		}
+		operation["responses"] = map[string]interface{}{
+			strconv.Itoa(route.SuccessCode): success,
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content":     v2JSONContent(errorSchema),
+			},
+		}
+
+		if route.Scope != "" {
+			operation["security"] = []interface{}{map[string]interface{}{"admin_token": []string{route.Scope}}}
+			operation["description"] = "Requires an admin token with the `" + route.Scope + "` scope."
+		}
+
+		thisPath := V2_API_PREFIX + route.Pattern
+		if _, exists := paths[thisPath]; !exists {
+			paths[thisPath] = make(map[string]interface{})
+		}
+		paths[thisPath].(map[string]interface{})[strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "Tyk Gateway Control API",
+			"version": "2",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"admin_token": map[string]interface{}{
+					"type": "apiKey",
+					"in":   "header",
+					"name": "X-Tyk-Authorization",
+				},
+			},
+		},
+	}
+}
+
+func v2OpenAPIHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	writeV2JSON(w, 200, CreateV2OpenAPIDocument())
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func callV2Endpoint(method, uri, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, uri, bytes.NewBufferString(body))
+	req.Header.Add("x-tyk-authorization", "v2-token")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	recorder := httptest.NewRecorder()
+	v2Handler(recorder, req)
+	return recorder
+}
+
+func setV2TestToken() func() {
+	config.AdminTokens = []AdminToken{{Name: "v2-test", Token: "v2-token", Scopes: []string{AdminScopeAll}}}
+	return func() { config.AdminTokens = nil }
+}
+
+func getV2ErrorCode(t *testing.T, recorder *httptest.ResponseRecorder) string {
+	var errorResponse V2ErrorResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &errorResponse); err != nil {
+		t.Fatal("Error body is not a v2 error: ", recorder.Body.String())
+	}
+
+	return errorResponse.Error.Code
+}
+
+func TestV2APILifecycle(t *testing.T) {
+	defer setV2TestToken()()
+
+	appDir, _ := ioutil.TempDir("", "tyk-apps")
+	defer os.RemoveAll(appDir)
+
+	oldAppPath := config.AppPath
+	config.AppPath = appDir
+	defer func() { config.AppPath = oldAppPath }()
+
+	ApiSpecRegister = make(map[string]*APISpec)
+	newDef := createTestDefinition("v2-test", "", "")
+
+	recorder := callV2Endpoint("POST", "/tyk/v2/apis", newDef, nil)
+	if recorder.Code != 201 {
+		t.Fatal("API creation failed: ", recorder.Code, recorder.Body.String())
+	}
+
+	originalETag := recorder.Header().Get("ETag")
+	if originalETag == "" || recorder.Header().Get("Location") != "/tyk/v2/apis/v2-test" {
+		t.Error("Creation should set the ETag and Location headers: ", recorder.Header())
+	}
+
+	recorder = callV2Endpoint("POST", "/tyk/v2/apis", newDef, nil)
+	if recorder.Code != 409 || getV2ErrorCode(t, recorder) != V2ErrorConflict {
+		t.Error("Creating a duplicate API should conflict, got: ", recorder.Code)
+	}
+
+	modifiedDef := strings.Replace(newDef, `"listen_path": "/v1"`, `"listen_path": "/v2"`, 1)
+	recorder = callV2Endpoint("PUT", "/tyk/v2/apis/v2-test", modifiedDef, map[string]string{"If-Match": originalETag})
+	if recorder.Code != 200 {
+		t.Fatal("API update failed: ", recorder.Code, recorder.Body.String())
+	}
+
+	// The definition has changed, so the old ETag is stale
+	recorder = callV2Endpoint("PUT", "/tyk/v2/apis/v2-test", newDef, map[string]string{"If-Match": originalETag})
+	if recorder.Code != 412 || getV2ErrorCode(t, recorder) != V2ErrorPreconditionFailed {
+		t.Error("Update with a stale ETag should fail, got: ", recorder.Code)
+	}
+
+	recorder = callV2Endpoint("GET", "/tyk/v2/apis/v2-test", "", nil)
+	if recorder.Code != 200 || !strings.Contains(recorder.Body.String(), `"listen_path":"/v2"`) {
+		t.Error("Could not read updated definition: ", recorder.Body.String())
+	}
+
+	invalidDef := strings.Replace(modifiedDef, `"target_url": "http://lonelycode.com"`, `"target_url": "lonelycode.com"`, 1)
+	recorder = callV2Endpoint("PUT", "/tyk/v2/apis/v2-test", invalidDef, nil)
+	if recorder.Code != 422 || getV2ErrorCode(t, recorder) != V2ErrorValidationFailed {
+		t.Error("Invalid definition should be rejected, got: ", recorder.Code)
+	}
+
+	recorder = callV2Endpoint("DELETE", "/tyk/v2/apis/v2-test", "", nil)
+	if recorder.Code != 204 {
+		t.Error("API delete failed: ", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = callV2Endpoint("GET", "/tyk/v2/apis/v2-test", "", nil)
+	if recorder.Code != 404 || getV2ErrorCode(t, recorder) != V2ErrorNotFound {
+		t.Error("Deleted API should not be found, got: ", recorder.Code)
+	}
+}
+
+func TestV2ConcurrentUpdates(t *testing.T) {
+	defer setV2TestToken()()
+
+	appDir, _ := ioutil.TempDir("", "tyk-apps")
+	defer os.RemoveAll(appDir)
+
+	oldAppPath := config.AppPath
+	config.AppPath = appDir
+	defer func() { config.AppPath = oldAppPath }()
+
+	ApiSpecRegister = make(map[string]*APISpec)
+	newDef := createTestDefinition("v2-concurrent", "", "")
+	etag := callV2Endpoint("POST", "/tyk/v2/apis", newDef, nil).Header().Get("ETag")
+
+	// Only one of the updates that were based on the same ETag may win
+	codes := make(chan int, 10)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			modifiedDef := strings.Replace(newDef, `"listen_path": "/v1"`, `"listen_path": "/v1-`+strconv.Itoa(i)+`"`, 1)
+			codes <- callV2Endpoint("PUT", "/tyk/v2/apis/v2-concurrent", modifiedDef, map[string]string{"If-Match": etag}).Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	results := map[int]int{}
+	for code := range codes {
+		results[code]++
+	}
+	if results[200] != 1 || results[412] != 9 {
+		t.Error("Expected one update and nine conflicts, got: ", results)
+	}
+}
+
+func TestV2Keys(t *testing.T) {
+	defer setV2TestToken()()
+
+	MakeSampleAPI()
+
+	sessionJSON, _ := json.Marshal(createSampleSession())
+	recorder := callV2Endpoint("PUT", "/tyk/v2/apis/1/keys/v2-key", string(sessionJSON), nil)
+	if recorder.Code != 201 {
+		t.Fatal("Key creation failed: ", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = callV2Endpoint("GET", "/tyk/v2/apis/1/keys/v2-key", "", nil)
+	etag := recorder.Header().Get("ETag")
+	if recorder.Code != 200 || etag == "" {
+		t.Fatal("Key retrieval failed: ", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = callV2Endpoint("DELETE", "/tyk/v2/apis/1/keys/v2-key", "", map[string]string{"If-Match": `"stale"`})
+	if recorder.Code != 412 {
+		t.Error("Delete with a stale ETag should fail, got: ", recorder.Code)
+	}
+
+	recorder = callV2Endpoint("DELETE", "/tyk/v2/apis/1/keys/v2-key", "", map[string]string{"If-Match": etag})
+	if recorder.Code != 204 {
+		t.Error("Key delete failed: ", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = callV2Endpoint("GET", "/tyk/v2/apis/1/keys/v2-key", "", nil)
+	if recorder.Code != 404 {
+		t.Error("Deleted key should not be found, got: ", recorder.Code)
+	}
+}
+
+func TestV2Errors(t *testing.T) {
+	defer setV2TestToken()()
+
+	recorder := callV2Endpoint("GET", "/tyk/v2/nothing-here", "", nil)
+	if recorder.Code != 404 || getV2ErrorCode(t, recorder) != V2ErrorNotFound {
+		t.Error("Unknown route should return not_found, got: ", recorder.Code)
+	}
+
+	recorder = callV2Endpoint("PATCH", "/tyk/v2/apis", "", nil)
+	if recorder.Code != 405 || recorder.Header().Get("Allow") != "GET, POST" {
+		t.Error("Unsupported method should return 405 with Allow header, got: ", recorder.Code, recorder.Header())
+	}
+
+	recorder = callV2Endpoint("GET", "/tyk/v2/apis", "", map[string]string{"x-tyk-authorization": "wrong"})
+	if recorder.Code != 401 || getV2ErrorCode(t, recorder) != V2ErrorUnauthorized {
+		t.Error("Invalid token should return 401, got: ", recorder.Code)
+	}
+}
+
+func TestV2OpenAPIDocument(t *testing.T) {
+	defer setV2TestToken()()
+
+	recorder := callV2Endpoint("GET", "/tyk/v2/openapi.json", "", map[string]string{"x-tyk-authorization": ""})
+	if recorder.Code != 401 {
+		t.Error("OpenAPI document should require an admin token, got: ", recorder.Code)
+	}
+
+	recorder = callV2Endpoint("GET", "/tyk/v2/openapi.json", "", nil)
+	if recorder.Code != 200 {
+		t.Fatal("OpenAPI document not served: ", recorder.Code)
+	}
+
+	var doc struct {
+		Paths      map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &doc)
+
+	for _, route := range V2Routes {
+		if _, ok := doc.Paths[V2_API_PREFIX+route.Pattern][strings.ToLower(route.Method)]; !ok {
+			t.Error("Route missing from OpenAPI document: ", route.Method, route.Pattern)
+		}
+	}
+
+	for _, schema := range []string{"APIDefinition", "SessionState", "V2ErrorResponse"} {
+		if doc.Components.Schemas[schema] == nil {
+			t.Error("Schema missing from OpenAPI document: ", schema)
+		}
+	}
+}
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/lonelycode/tykcommon"
+	"io/ioutil"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AUDIT_KEYNAME       string = "tyk-audit-log"
+	AUDIT_REDACTED      string = "<redacted>"
+	AUDIT_DEFAULT_LIMIT int    = 100
+	// The Redis audit log is read in pages of this many records, newest first
+	AUDIT_QUERY_PAGE_SIZE int64 = 1000
+
+	AuditObjectKey         string = "key"
+	AuditObjectAPI         string = "api"
+	AuditObjectOrg         string = "org"
+	AuditObjectOAuthClient string = "oauth_client"
+	AuditObjectPolicy      string = "key_policy"
+	AuditObjectBreaker     string = "circuit_breaker"
+	AuditObjectTargets     string = "targets"
+	AuditObjectCache       string = "cache"
+)
+
+// auditRedactedFields are never written to the audit trail, only the fact that they changed is recorded
+var auditRedactedFields = map[string]bool{
+	"password":      true,
+	"hmac_string":   true,
+	"secret":        true,
+	"client_secret": true,
+	"shared_secret": true,
+}
+
+// AuditDiff is a single changed field in an audited object, Path is the dotted JSON path of the field
+type AuditDiff struct {
+	Path   string      `json:"path" bson:"path"`
+	Before interface{} `json:"before" bson:"before"`
+	After  interface{} `json:"after" bson:"after"`
+}
+
+// AuditRecord describes a single change made through the control API
+type AuditRecord struct {
+	TimeStamp  time.Time   `json:"timestamp" bson:"timestamp"`
+	TokenName  string      `json:"token_name" bson:"token_name"`
+	SourceIP   string      `json:"source_ip" bson:"source_ip"`
+	Action     string      `json:"action" bson:"action"`
+	ObjectType string      `json:"object_type" bson:"object_type"`
+	ObjectID   string      `json:"object_id" bson:"object_id"`
+	OrgID      string      `json:"org_id" bson:"org_id"`
+	Diff       []AuditDiff `json:"diff" bson:"diff"`
+}
+
+// AuditQuery filters the records returned by an AuditSink, empty fields are ignored
+type AuditQuery struct {
+	TokenName  string
+	Action     string
+	ObjectType string
+	ObjectID   string
+	OrgID      string
+	From       time.Time
+	To         time.Time
+	Limit      int
+}
+
+// Matches checks a record against the query filters
+func (q AuditQuery) Matches(thisRecord AuditRecord) bool {
+	if q.TokenName != "" && thisRecord.TokenName != q.TokenName {
+		return false
+	}
+	if q.Action != "" && thisRecord.Action != q.Action {
+		return false
+	}
+	if q.ObjectType != "" && thisRecord.ObjectType != q.ObjectType {
+		return false
+	}
+	if q.ObjectID != "" && thisRecord.ObjectID != q.ObjectID {
+		return false
+	}
+	if q.OrgID != "" && thisRecord.OrgID != q.OrgID {
+		return false
+	}
+	if !q.From.IsZero() && thisRecord.TimeStamp.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && thisRecord.TimeStamp.After(q.To) {
+		return false
+	}
+
+	return true
+}
+
+// AuditSink is an append-only store for audit records
+type AuditSink interface {
+	Init() error
+	Write(AuditRecord) error
+	Query(AuditQuery) ([]AuditRecord, error)
+}
+
+// AuditLog is the global audit sink, nil if auditing is disabled
+var AuditLog AuditSink
+
+// setupAuditLog creates the sink that has been configured in tyk.conf
+func setupAuditLog() {
+	if !config.AuditLog.Enable {
+		AuditLog = nil
+		return
+	}
+
+	switch config.AuditLog.Type {
+	case "redis":
+		log.Debug("Using Redis audit log")
+		AuditLog = &RedisAuditSink{}
+	case "mongo":
+		log.Debug("Using MongoDB audit log")
+		AuditLog = &MongoAuditSink{}
+	default:
+		log.Debug("Using file audit log")
+		AuditLog = &FileAuditSink{Path: config.AuditLog.FilePath}
+	}
+
+	if err := AuditLog.Init(); err != nil {
+		log.Error("Failed to initialise audit log: ", err)
+	}
+}
+
+// FileAuditSink appends audit records to a JSON-lines file
+type FileAuditSink struct {
+	Path string
+	lock sync.Mutex
+}
+
+func (f *FileAuditSink) Init() error {
+	if f.Path == "" {
+		f.Path = "tyk-audit.log"
+	}
+
+	outfile, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	return outfile.Close()
+}
+
+func (f *FileAuditSink) Write(thisRecord AuditRecord) error {
+	asJSON, err := json.Marshal(thisRecord)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	outfile, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer outfile.Close()
+
+	_, err = outfile.Write(append(asJSON, '\n'))
+	return err
+}
+
+func (f *FileAuditSink) Query(q AuditQuery) ([]AuditRecord, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	infile, err := os.Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer infile.Close()
+
+	records := []AuditRecord{}
+	scanner := bufio.NewScanner(infile)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		var thisRecord AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &thisRecord); err != nil {
+			log.Warning("Skipping malformed audit record: ", err)
+			continue
+		}
+		if q.Matches(thisRecord) {
+			records = append(records, thisRecord)
+		}
+	}
+
+	return newestAuditRecords(records, q.Limit), scanner.Err()
+}
+
+// RedisAuditSink pushes audit records onto a Redis list
+type RedisAuditSink struct {
+	Store *RedisClusterStorageManager
+}
+
+func (r *RedisAuditSink) Init() error {
+	r.Store = &RedisClusterStorageManager{KeyPrefix: ""}
+	if !r.Store.Connect() {
+		return errors.New("Redis connection failed")
+	}
+
+	return nil
+}
+
+func (r *RedisAuditSink) Write(thisRecord AuditRecord) error {
+	asJSON, err := json.Marshal(thisRecord)
+	if err != nil {
+		return err
+	}
+
+	r.Store.AppendToSet(AUDIT_KEYNAME, string(asJSON))
+	return nil
+}
+
+// Query reads the list in pages from the newest record backwards, until the limit is reached or the records are
+// older than the From filter
+func (r *RedisAuditSink) Query(q AuditQuery) ([]AuditRecord, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = AUDIT_DEFAULT_LIMIT
+	}
+
+	records := []AuditRecord{}
+	for end := int64(-1); len(records) < limit; end -= AUDIT_QUERY_PAGE_SIZE {
+		page := r.Store.GetListRange(AUDIT_KEYNAME, end-AUDIT_QUERY_PAGE_SIZE+1, end)
+		for i := len(page) - 1; i >= 0 && len(records) < limit; i-- {
+			var thisRecord AuditRecord
+			if err := json.Unmarshal([]byte(page[i]), &thisRecord); err != nil {
+				log.Warning("Skipping malformed audit record: ", err)
+				continue
+			}
+			if !q.From.IsZero() && thisRecord.TimeStamp.Before(q.From) {
+				return newestAuditRecords(records, limit), nil
+			}
+			if q.Matches(thisRecord) {
+				records = append(records, thisRecord)
+			}
+		}
+
+		if int64(len(page)) < AUDIT_QUERY_PAGE_SIZE {
+			break
+		}
+	}
+
+	return newestAuditRecords(records, limit), nil
+}
+
+// MongoAuditSink inserts audit records into a MongoDB collection
+type MongoAuditSink struct {
+	dbSession *mgo.Session
+}
+
+func (m *MongoAuditSink) Init() error {
+	var err error
+	m.dbSession, err = mgo.Dial(config.AuditLog.MongoURL)
+	return err
+}
+
+func (m *MongoAuditSink) collection() (*mgo.Collection, error) {
+	if m.dbSession == nil {
+		if err := m.Init(); err != nil {
+			return nil, err
+		}
+	}
+
+	return m.dbSession.DB("").C(config.AuditLog.MongoCollection), nil
+}
+
+func (m *MongoAuditSink) Write(thisRecord AuditRecord) error {
+	auditCollection, err := m.collection()
+	if err != nil {
+		return err
+	}
+
+	return auditCollection.Insert(thisRecord)
+}
+
+func (m *MongoAuditSink) Query(q AuditQuery) ([]AuditRecord, error) {
+	auditCollection, err := m.collection()
+	if err != nil {
+		return nil, err
+	}
+
+	search := bson.M{}
+	for field, value := range map[string]string{
+		"token_name":  q.TokenName,
+		"action":      q.Action,
+		"object_type": q.ObjectType,
+		"object_id":   q.ObjectID,
+		"org_id":      q.OrgID,
+	} {
+		if value != "" {
+			search[field] = value
+		}
+	}
+
+	timeRange := bson.M{}
+	if !q.From.IsZero() {
+		timeRange["$gte"] = q.From
+	}
+	if !q.To.IsZero() {
+		timeRange["$lte"] = q.To
+	}
+	if len(timeRange) > 0 {
+		search["timestamp"] = timeRange
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = AUDIT_DEFAULT_LIMIT
+	}
+
+	records := []AuditRecord{}
+	err = auditCollection.Find(search).Sort("-timestamp").Limit(limit).All(&records)
+	return records, err
+}
+
+// newestAuditRecords sorts records newest first and applies the limit
+func newestAuditRecords(records []AuditRecord, limit int) []AuditRecord {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].TimeStamp.After(records[j].TimeStamp)
+	})
+
+	if limit <= 0 {
+		limit = AUDIT_DEFAULT_LIMIT
+	}
+
+	if len(records) > limit {
+		return records[:limit]
+	}
+
+	return records
+}
+
+// flattenAuditObject turns an object into a map of dotted JSON paths to leaf values
+func flattenAuditObject(obj interface{}) map[string]interface{} {
+	flat := make(map[string]interface{})
+	if obj == nil || (reflect.ValueOf(obj).Kind() == reflect.Ptr && reflect.ValueOf(obj).IsNil()) {
+		return flat
+	}
+
+	asJSON, err := json.Marshal(obj)
+	if err != nil {
+		log.Error("Couldn't encode object for audit: ", err)
+		return flat
+	}
+
+	var generic interface{}
+	if err := json.Unmarshal(asJSON, &generic); err != nil {
+		log.Error("Couldn't decode object for audit: ", err)
+		return flat
+	}
+
+	flattenAuditValue("", generic, flat)
+	return flat
+}
+
+func flattenAuditValue(prefix string, value interface{}, flat map[string]interface{}) {
+	switch thisValue := value.(type) {
+	case map[string]interface{}:
+		for k, v := range thisValue {
+			path := k
+			if prefix != "" {
+				path = prefix + "." + k
+			}
+			flattenAuditValue(path, v, flat)
+		}
+	case []interface{}:
+		for i, v := range thisValue {
+			flattenAuditValue(prefix+"."+strconv.Itoa(i), v, flat)
+		}
+	default:
+		flat[prefix] = thisValue
+	}
+}
+
+func isRedactedAuditPath(path string) bool {
+	segments := strings.Split(path, ".")
+	return auditRedactedFields[segments[len(segments)-1]]
+}
+
+// CreateAuditDiff compares the before and after state of an object, fields that hold secrets are redacted
+func CreateAuditDiff(before interface{}, after interface{}) []AuditDiff {
+	beforeFlat := flattenAuditObject(before)
+	afterFlat := flattenAuditObject(after)
+
+	paths := make(map[string]bool)
+	for k, _ := range beforeFlat {
+		paths[k] = true
+	}
+	for k, _ := range afterFlat {
+		paths[k] = true
+	}
+
+	diff := []AuditDiff{}
+	for path, _ := range paths {
+		beforeVal, inBefore := beforeFlat[path]
+		afterVal, inAfter := afterFlat[path]
+		if inBefore && inAfter && reflect.DeepEqual(beforeVal, afterVal) {
+			continue
+		}
+
+		if isRedactedAuditPath(path) {
+			if inBefore {
+				beforeVal = AUDIT_REDACTED
+			}
+			if inAfter {
+				afterVal = AUDIT_REDACTED
+			}
+		}
+
+		diff = append(diff, AuditDiff{Path: path, Before: beforeVal, After: afterVal})
+	}
+
+	sort.Slice(diff, func(i, j int) bool {
+		return diff[i].Path < diff[j].Path
+	})
+
+	return diff
+}
+
+// getAuditSourceIP returns the address of the client that made a control API request. X-Forwarded-For is only
+// read when the request came from a trusted proxy, from the right, and the first address that isn't a trusted
+// proxy is the client.
+func getAuditSourceIP(r *http.Request) string {
+	ip, err := GetIP(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if !isTrustedAuditProxy(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+
+		ip = hop
+		if !isTrustedAuditProxy(hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// isTrustedAuditProxy checks an address against the trusted proxies of the audit log, which are addresses or CIDR ranges
+func isTrustedAuditProxy(ip string) bool {
+	thisIP := net.ParseIP(ip)
+	if thisIP == nil {
+		return false
+	}
+
+	for _, trusted := range config.AuditLog.TrustedProxies {
+		if _, network, err := net.ParseCIDR(trusted); err == nil {
+			if network.Contains(thisIP) {
+				return true
+			}
+			continue
+		}
+
+		if thisIP.Equal(net.ParseIP(trusted)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RecordAuditEvent writes a control API change to the audit log, it is a no-op if auditing is disabled
+func RecordAuditEvent(r *http.Request, action, objectType, objectID, orgID string, before, after interface{}) {
+	if AuditLog == nil {
+		return
+	}
+
+	thisRecord := AuditRecord{
+		TimeStamp:  time.Now(),
+		TokenName:  GetAdminTokenFromRequest(r).Name,
+		SourceIP:   getAuditSourceIP(r),
+		Action:     action,
+		ObjectType: objectType,
+		ObjectID:   objectID,
+		OrgID:      orgID,
+		Diff:       CreateAuditDiff(before, after),
+	}
+
+	if err := AuditLog.Write(thisRecord); err != nil {
+		log.WithFields(logrus.Fields{
+			"action": action,
+			"object": objectType,
+		}).Error("Failed to write audit record: ", err)
+	}
+}
+
+// getKeyAuditState finds the current session for a key, it is used to capture the state before
+// and after a change, returns nil if the key does not exist
+func getKeyAuditState(keyName string, APIID string) *SessionState {
+	if keyName == "" {
+		return nil
+	}
+
+	if thisSession, found := getKeySession(keyName, APIID); found {
+		return &thisSession
+	}
+
+	return nil
+}
+
+// getHashedKeyAuditState reads a session by its hashed key name, bypassing the hash function of the store
+func getHashedKeyAuditState(keyName string, APIID string) *SessionState {
+	thisSpec := GetSpecForApi(APIID)
+	if thisSpec == nil {
+		return nil
+	}
+
+	rawSessionData, err := thisSpec.SessionManager.GetStore().GetRawKey("apikey-" + keyName)
+	if err != nil {
+		return nil
+	}
+
+	thisSession := SessionState{}
+	if err := json.Unmarshal([]byte(rawSessionData), &thisSession); err != nil {
+		return nil
+	}
+
+	return &thisSession
+}
+
+// getOrgAuditState finds the current org session, returns nil if it does not exist
+func getOrgAuditState(orgID string) *SessionState {
+	var thisSession SessionState
+	var found bool
+
+	if thisSpec := GetSpecForOrg(orgID); thisSpec != nil {
+		thisSession, found = thisSpec.OrgSessionManager.GetSessionDetail(orgID)
+	} else if !config.SupressDefaultOrgStore {
+		thisSession, found = DefaultOrgStore.GetSessionDetail(orgID)
+	}
+
+	if !found {
+		return nil
+	}
+
+	return &thisSession
+}
+
+// getAPIAuditState reads the stored definition of an API, falling back to the loaded spec, returns nil
+// if the API does not exist
+func getAPIAuditState(APIID string) *tykcommon.APIDefinition {
+	if APIID == "" {
+		return nil
+	}
+
+	defFilePath := path.Join(config.AppPath, APIID+".json")
+	if defData, err := ioutil.ReadFile(defFilePath); err == nil {
+		thisDef := tykcommon.APIDefinition{}
+		if err := json.Unmarshal(defData, &thisDef); err == nil {
+			return &thisDef
+		}
+	}
+
+	if thisSpec := GetSpecForApi(APIID); thisSpec != nil {
+		thisDef := thisSpec.APIDefinition
+		thisDef.RawData = nil
+		return &thisDef
+	}
+
+	return nil
+}
+
+func getAPIOrgID(APIID string) string {
+	if thisSpec := GetSpecForApi(APIID); thisSpec != nil {
+		return thisSpec.OrgID
+	}
+
+	return ""
+}
+
+// getAuditAction maps a control API method onto the action names used in API responses
+func getAuditAction(method string) string {
+	switch method {
+	case "POST":
+		return "added"
+	case "DELETE":
+		return "deleted"
+	}
+
+	return "modified"
+}
+
+// getAuditedObjectID reads the object ID from a successful control API response, this is needed
+// where the ID is generated or modified by the handler
+func getAuditedObjectID(responseMessage []byte, fallback string) string {
+	var thisResponse APIModifyKeySuccess
+	if err := json.Unmarshal(responseMessage, &thisResponse); err != nil || thisResponse.Key == "" {
+		return fallback
+	}
+
+	return thisResponse.Key
+}
+
+func getSessionOrgID(thisSession *SessionState) string {
+	if thisSession == nil {
+		return ""
+	}
+
+	return thisSession.OrgID
+}
+
+// auditHandler exposes the audit trail, org-restricted admin tokens only see records for their own org
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	if AuditLog == nil {
+		DoJSONWrite(w, 400, createError("Audit log is not enabled for this node"))
+		return
+	}
+
+	q := AuditQuery{
+		TokenName:  r.FormValue("token_name"),
+		Action:     r.FormValue("action"),
+		ObjectType: r.FormValue("object_type"),
+		ObjectID:   r.FormValue("object_id"),
+		OrgID:      r.FormValue("org_id"),
+	}
+
+	if thisToken := GetAdminTokenFromRequest(r); thisToken.OrgID != "" {
+		q.OrgID = thisToken.OrgID
+	}
+
+	if from := r.FormValue("from"); from != "" {
+		fromTS, err := strconv.ParseInt(from, 10, 64)
+		if err != nil {
+			DoJSONWrite(w, 400, createError("from must be a unix timestamp"))
+			return
+		}
+		q.From = time.Unix(fromTS, 0)
+	}
+
+	if to := r.FormValue("to"); to != "" {
+		toTS, err := strconv.ParseInt(to, 10, 64)
+		if err != nil {
+			DoJSONWrite(w, 400, createError("to must be a unix timestamp"))
+			return
+		}
+		q.To = time.Unix(toTS, 0)
+	}
+
+	if limit := r.FormValue("limit"); limit != "" {
+		var err error
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			DoJSONWrite(w, 400, createError("limit must be a number"))
+			return
+		}
+	}
+
+	records, err := AuditLog.Query(q)
+	if err != nil {
+		log.Error("Audit log query failed: ", err)
+		DoJSONWrite(w, 500, createError("Audit log query failed"))
+		return
+	}
+
+	responseMessage, err := json.Marshal(&records)
+	if err != nil {
+		log.Error("Marshalling failed: ", err)
+		DoJSONWrite(w, 500, []byte(E_SYSTEM_ERROR))
+		return
+	}
+
+	DoJSONWrite(w, 200, responseMessage)
+}
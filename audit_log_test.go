@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditDiffRedactsSecrets(t *testing.T) {
+	before := createSampleSession()
+	before.HmacSecret = "old-secret"
+	after := before
+	after.HmacSecret = "new-secret"
+	after.Rate = 10
+
+	diff := CreateAuditDiff(before, after)
+	if len(diff) != 2 {
+		t.Fatal("Expected two changed fields, got: ", diff)
+	}
+
+	for _, d := range diff {
+		switch d.Path {
+		case "hmac_string":
+			if d.Before != AUDIT_REDACTED || d.After != AUDIT_REDACTED {
+				t.Error("Secret was not redacted: ", d)
+			}
+		case "rate":
+			if d.Before != 5.0 || d.After != 10.0 {
+				t.Error("Rate change recorded incorrectly: ", d)
+			}
+		default:
+			t.Error("Unexpected path in diff: ", d.Path)
+		}
+	}
+}
+
+func TestAuditKeyChanges(t *testing.T) {
+	auditDir, _ := ioutil.TempDir("", "tyk-audit")
+	defer os.RemoveAll(auditDir)
+
+	AuditLog = &FileAuditSink{Path: path.Join(auditDir, "audit.log")}
+	defer func() { AuditLog = nil }()
+
+	config.AdminTokens = []AdminToken{{Name: "auditor", Token: "audit-token", Scopes: []string{"all"}}}
+	defer func() { config.AdminTokens = nil }()
+
+	MakeSampleAPI()
+
+	body, _ := json.Marshal(createSampleSession())
+	req, _ := http.NewRequest("POST", "/tyk/keys/audited-key?api_id=1", strings.NewReader(string(body)))
+	req.Header.Add("x-tyk-authorization", "audit-token")
+	recorder := httptest.NewRecorder()
+	CheckAdminScope(AdminScopeKeys, keyHandler)(recorder, req)
+
+	if recorder.Code != 200 {
+		t.Fatal("Key creation failed: ", recorder.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/tyk/audit?object_type=key", nil)
+	req.Header.Add("x-tyk-authorization", "audit-token")
+	recorder = httptest.NewRecorder()
+	CheckAdminScope(AdminScopeAudit, auditHandler)(recorder, req)
+
+	var records []AuditRecord
+	if err := json.Unmarshal(recorder.Body.Bytes(), &records); err != nil {
+		t.Fatal("Could not unmarshal audit records: ", err, recorder.Body.String())
+	}
+
+	if len(records) != 1 {
+		t.Fatal("Expected one audit record, got: ", len(records))
+	}
+
+	if records[0].TokenName != "auditor" || records[0].Action != "added" || records[0].ObjectID != publicHash("audited-key") {
+		t.Error("Audit record is incorrect: ", records[0])
+	}
+
+	if len(records[0].Diff) == 0 {
+		t.Error("Audit record should contain the new session state")
+	}
+}
+
+func TestAuditSourceIP(t *testing.T) {
+	config.AuditLog.TrustedProxies = []string{"10.0.0.0/8", "192.168.1.1"}
+	defer func() { config.AuditLog.TrustedProxies = nil }()
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"203.0.113.5:1234", "", "203.0.113.5"},
+		// Clients can't pick their own address
+		{"203.0.113.5:1234", "198.51.100.1", "203.0.113.5"},
+		{"10.1.2.3:1234", "198.51.100.1", "198.51.100.1"},
+		// Forged hops in front of the trusted proxies are skipped
+		{"192.168.1.1:1234", "1.2.3.4, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"10.1.2.3:1234", "", "10.1.2.3"},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/tyk/keys/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+
+		if ip := getAuditSourceIP(req); ip != test.expected {
+			t.Error(test.remoteAddr, test.forwarded, "should be recorded as", test.expected, "but was: ", ip)
+		}
+	}
+}
+
+func TestRedisAuditSinkPages(t *testing.T) {
+	sink := &RedisAuditSink{}
+	if err := sink.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Store.DeleteKey(AUDIT_KEYNAME)
+
+	start := time.Now().Add(-time.Hour)
+	records := int(AUDIT_QUERY_PAGE_SIZE) + 10
+	for i := 0; i < records; i++ {
+		thisRecord := AuditRecord{TimeStamp: start.Add(time.Duration(i) * time.Second), Action: "modified", ObjectID: strconv.Itoa(i)}
+		if i == 0 {
+			thisRecord.Action = "added"
+		}
+		sink.Write(thisRecord)
+	}
+
+	newest, _ := sink.Query(AuditQuery{Limit: 5})
+	if len(newest) != 5 || newest[0].ObjectID != strconv.Itoa(records-1) {
+		t.Error("Expected the newest records: ", newest)
+	}
+
+	// Filters reach records on older pages
+	added, _ := sink.Query(AuditQuery{Action: "added"})
+	if len(added) != 1 || added[0].ObjectID != "0" {
+		t.Error("Expected the oldest record: ", added)
+	}
+
+	// Reading stops at the From filter
+	recent, _ := sink.Query(AuditQuery{From: start.Add(time.Duration(records-3) * time.Second)})
+	if len(recent) != 3 {
+		t.Error("Expected three records after From, got: ", len(recent))
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/mitchellh/mapstructure"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Cached responses carry when they were stored and until when they are fresh, the headers are removed
+	// before a cached response is served
+	CACHE_STORED_AT_HEADER   = "X-Tyk-Cache-Stored-At"
+	CACHE_FRESH_UNTIL_HEADER = "X-Tyk-Cache-Fresh-Until"
+	// Responses with a Vary header are stored under their own key, the cache key of the request holds the
+	// names of the headers the response varies by
+	CACHE_VARY_PREFIX = "vary:"
+)
+
+// HTTPCacheConfig is set per API in the definition under "http_cache". When it is enabled the cache follows
+// the Cache-Control, Expires and Vary headers of the upstream, answers conditional requests from the cache and
+// revalidates stale responses that have an ETag or Last-Modified header with a conditional request. Such
+// responses are kept for KeepStale seconds after they became stale.
+type HTTPCacheConfig struct {
+	Enabled   bool  `mapstructure:"enabled" bson:"enabled" json:"enabled"`
+	KeepStale int64 `mapstructure:"keep_stale" bson:"keep_stale" json:"keep_stale"`
+}
+
+type httpCacheSection struct {
+	HTTPCache HTTPCacheConfig `mapstructure:"http_cache" bson:"http_cache" json:"http_cache"`
+}
+
+// GetHTTPCacheConfig reads the HTTP cache options of an API
+func GetHTTPCacheConfig(spec *APISpec) HTTPCacheConfig {
+	thisSection := httpCacheSection{}
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisSection); err != nil {
+		log.Error("Failed to decode HTTP cache configuration: ", err)
+	}
+
+	thisConfig := thisSection.HTTPCache
+	if thisConfig.KeepStale <= 0 {
+		thisConfig.KeepStale = 300
+	}
+
+	return thisConfig
+}
+
+// CacheControl holds the directives of a Cache-Control header, the numeric directives are -1 if they are not set
+type CacheControl struct {
+	NoStore              bool
+	NoCache              bool
+	Private              bool
+	MaxAge               int64
+	SMaxAge              int64
+	StaleWhileRevalidate int64
+	StaleIfError         int64
+}
+
+func parseCacheControl(header http.Header) CacheControl {
+	thisControl := CacheControl{MaxAge: -1, SMaxAge: -1, StaleWhileRevalidate: -1, StaleIfError: -1}
+	for _, thisValue := range header["Cache-Control"] {
+		for _, directive := range strings.Split(thisValue, ",") {
+			name, value := strings.TrimSpace(directive), ""
+			if i := strings.Index(name, "="); i != -1 {
+				name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+			}
+
+			switch strings.ToLower(name) {
+			case "no-store":
+				thisControl.NoStore = true
+			case "no-cache":
+				thisControl.NoCache = true
+			case "private":
+				thisControl.Private = true
+			case "max-age":
+				if asInt, err := strconv.ParseInt(value, 10, 64); err == nil {
+					thisControl.MaxAge = asInt
+				}
+			case "s-maxage":
+				if asInt, err := strconv.ParseInt(value, 10, 64); err == nil {
+					thisControl.SMaxAge = asInt
+				}
+			case "stale-while-revalidate":
+				if asInt, err := strconv.ParseInt(value, 10, 64); err == nil {
+					thisControl.StaleWhileRevalidate = asInt
+				}
+			case "stale-if-error":
+				if asInt, err := strconv.ParseInt(value, 10, 64); err == nil {
+					thisControl.StaleIfError = asInt
+				}
+			}
+		}
+	}
+
+	return thisControl
+}
+
+// responseVary returns the header names of the Vary header of a response
+func responseVary(header http.Header) []string {
+	names := []string{}
+	for _, thisValue := range header["Vary"] {
+		for _, name := range strings.Split(thisValue, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	return names
+}
+
+func hasValidators(header http.Header) bool {
+	return header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+}
+
+// Responses with these status codes can be cached unless the upstream says otherwise
+var httpCacheableStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// httpCacheLifetime returns how many seconds a response is fresh for, defaultTTL is used if the upstream sets
+// no lifetime. Responses marked private are only stored if the cache entry belongs to a single client.
+func httpCacheLifetime(res *http.Response, defaultTTL int64, perClient bool) (int64, bool) {
+	thisControl := parseCacheControl(res.Header)
+	if thisControl.NoStore || (thisControl.Private && !perClient) || !httpCacheableStatus[res.StatusCode] {
+		return 0, false
+	}
+	for _, name := range responseVary(res.Header) {
+		if name == "*" {
+			return 0, false
+		}
+	}
+
+	lifetime := defaultTTL
+	switch {
+	case thisControl.NoCache:
+		lifetime = 0
+	case thisControl.SMaxAge >= 0:
+		lifetime = thisControl.SMaxAge
+	case thisControl.MaxAge >= 0:
+		lifetime = thisControl.MaxAge
+	case res.Header.Get("Expires") != "":
+		// An invalid date means the response has already expired
+		expires, err := http.ParseTime(res.Header.Get("Expires"))
+		date, dateErr := http.ParseTime(res.Header.Get("Date"))
+		if dateErr != nil {
+			date = time.Now()
+		}
+		lifetime = 0
+		if err == nil && expires.After(date) {
+			lifetime = int64(expires.Sub(date) / time.Second)
+		}
+	}
+
+	// Time the response already spent in other caches
+	if age, err := strconv.ParseInt(res.Header.Get("Age"), 10, 64); err == nil {
+		lifetime -= age
+	}
+	if lifetime < 0 {
+		lifetime = 0
+	}
+
+	// Without validators a response that is already stale is of no use
+	if lifetime == 0 && !hasValidators(res.Header) {
+		return 0, false
+	}
+
+	return lifetime, true
+}
+
+// etagMatches compares entity tags the weak way, as If-None-Match does
+func etagMatches(list string, etag string) bool {
+	if etag == "" {
+		return false
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isNotModified checks the conditional headers of a request against a cached response, If-Modified-Since is
+// only used when the request has no If-None-Match header
+func isNotModified(r *http.Request, header http.Header) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, header.Get("ETag"))
+	}
+
+	ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+
+	return !lastModified.After(ifModifiedSince)
+}
+
+// Headers that are sent with a 304, and that are updated when a cached response is revalidated. The names are
+// in canonical form as they are used as map keys.
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "Etag", "Expires", "Last-Modified", "Vary"}
+
+// varyChecksum hashes the request headers a response varies by
+func varyChecksum(header http.Header, names []string) string {
+	h := md5.New()
+	io.WriteString(h, cacheKeyHeaders(header, names))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cachedResponse is a response that was read from the cache
+type cachedResponse struct {
+	Key      string
+	Response *http.Response
+	Body     []byte
+	StoredAt time.Time
+	// Zero for responses that were stored without HTTP semantics, they are fresh until they expire
+	FreshUntil time.Time
+}
+
+func parseCacheTimestamp(value string) time.Time {
+	asInt, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(asInt, 0)
+}
+
+// decodeCachedResponse reads a response in wire format, as it is stored in the cache
+func decodeCachedResponse(key string, blob string, r *http.Request) (*cachedResponse, error) {
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(blob)), r)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	thisResponse := &cachedResponse{
+		Key:        key,
+		Response:   res,
+		Body:       body,
+		StoredAt:   parseCacheTimestamp(res.Header.Get(CACHE_STORED_AT_HEADER)),
+		FreshUntil: parseCacheTimestamp(res.Header.Get(CACHE_FRESH_UNTIL_HEADER)),
+	}
+	res.Header.Del(CACHE_STORED_AT_HEADER)
+	res.Header.Del(CACHE_FRESH_UNTIL_HEADER)
+	for _, h := range hopHeaders {
+		res.Header.Del(h)
+	}
+
+	return thisResponse, nil
+}
+
+// encodeCachedResponse writes a response in wire format, freshUntil is left out when it is zero
+func encodeCachedResponse(res *http.Response, body []byte, storedAt time.Time, freshUntil time.Time) string {
+	toStore := new(http.Response)
+	*toStore = *res
+	toStore.Header = make(http.Header)
+	copyHeader(toStore.Header, res.Header)
+	toStore.Body = ioutil.NopCloser(bytes.NewReader(body))
+	toStore.ContentLength = int64(len(body))
+	toStore.TransferEncoding = nil
+
+	toStore.Header.Set(CACHE_STORED_AT_HEADER, strconv.FormatInt(storedAt.Unix(), 10))
+	if !freshUntil.IsZero() {
+		toStore.Header.Set(CACHE_FRESH_UNTIL_HEADER, strconv.FormatInt(freshUntil.Unix(), 10))
+	}
+
+	var wireFormat bytes.Buffer
+	toStore.Write(&wireFormat)
+	return wireFormat.String()
+}
+
+func (c *cachedResponse) IsFresh(now time.Time) bool {
+	return c.FreshUntil.IsZero() || now.Before(c.FreshUntil)
+}
+
+// IsStaleWithin checks if a stale response became stale less than window seconds ago
+func (c *cachedResponse) IsStaleWithin(now time.Time, window int64) bool {
+	if c.FreshUntil.IsZero() || window <= 0 {
+		return false
+	}
+
+	return now.Before(c.FreshUntil.Add(time.Duration(window) * time.Second))
+}
+
+// Age returns the Age header of the response, including the time it spent in other caches
+func (c *cachedResponse) Age(now time.Time) int64 {
+	age, _ := strconv.ParseInt(c.Response.Header.Get("Age"), 10, 64)
+	if !c.StoredAt.IsZero() && now.After(c.StoredAt) {
+		age += int64(now.Sub(c.StoredAt) / time.Second)
+	}
+
+	return age
+}
+
+// refresh updates a cached response with the headers of a 304 from the upstream
+func (c *cachedResponse) refresh(notModified *http.Response, now time.Time) {
+	for _, name := range notModifiedHeaders {
+		if values, found := notModified.Header[name]; found {
+			c.Response.Header[name] = values
+		}
+	}
+	c.Response.Header.Del("Age")
+	if age := notModified.Header.Get("Age"); age != "" {
+		c.Response.Header.Set("Age", age)
+	}
+	c.StoredAt = now
+}
+
+// cacheResponseBuffer holds a response that the upstream sent while a cached response was revalidated,
+// it is only sent to the client if the cached response can't be used
+type cacheResponseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newCacheResponseBuffer() *cacheResponseBuffer {
+	return &cacheResponseBuffer{header: make(http.Header)}
+}
+
+func (b *cacheResponseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *cacheResponseBuffer) Write(data []byte) (int, error) {
+	if b.status == 0 {
+		b.status = 200
+	}
+	return b.body.Write(data)
+}
+
+func (b *cacheResponseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *cacheResponseBuffer) replay(w http.ResponseWriter) {
+	copyHeader(w.Header(), b.header)
+	if b.status == 0 {
+		b.status = 200
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
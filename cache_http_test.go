@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPCacheLifetime(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name      string
+		status    int
+		headers   map[string]string
+		perClient bool
+		lifetime  int64
+		cacheable bool
+	}{
+		{"Default TTL", 200, nil, false, 60, true},
+		{"max-age", 200, map[string]string{"Cache-Control": "public, max-age=30"}, false, 30, true},
+		{"s-maxage wins", 200, map[string]string{"Cache-Control": "max-age=30, s-maxage=10"}, false, 10, true},
+		{"Age is subtracted", 200, map[string]string{"Cache-Control": "max-age=30", "Age": "20"}, false, 10, true},
+		{"Expires", 200, map[string]string{"Expires": now.Add(45 * time.Second).Format(http.TimeFormat), "Date": now.Format(http.TimeFormat)}, false, 45, true},
+		{"Invalid Expires", 200, map[string]string{"Expires": "0"}, false, 0, false},
+		{"no-store", 200, map[string]string{"Cache-Control": "no-store"}, false, 0, false},
+		{"private in a shared cache", 200, map[string]string{"Cache-Control": "private, max-age=30"}, false, 0, false},
+		{"private per client", 200, map[string]string{"Cache-Control": "private, max-age=30"}, true, 30, true},
+		{"no-cache with validator", 200, map[string]string{"Cache-Control": "no-cache", "ETag": `"1"`}, false, 0, true},
+		{"no-cache without validator", 200, map[string]string{"Cache-Control": "no-cache"}, false, 0, false},
+		{"Vary *", 200, map[string]string{"Vary": "*"}, false, 0, false},
+		{"Error", 500, map[string]string{"Cache-Control": "max-age=30"}, false, 0, false},
+		{"Not found", 404, nil, false, 60, true},
+	}
+
+	for _, test := range tests {
+		res := &http.Response{StatusCode: test.status, Header: make(http.Header)}
+		for name, value := range test.headers {
+			res.Header.Set(name, value)
+		}
+
+		lifetime, cacheable := httpCacheLifetime(res, 60, test.perClient)
+		if lifetime != test.lifetime || cacheable != test.cacheable {
+			t.Error(test.name, ": expected ", test.lifetime, test.cacheable, " got ", lifetime, cacheable)
+		}
+	}
+}
+
+func TestHTTPCacheConditionals(t *testing.T) {
+	cached := http.Header{}
+	cached.Set("ETag", `W/"v1"`)
+	cached.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+
+	tests := []struct {
+		name        string
+		headers     map[string]string
+		notModified bool
+	}{
+		{"Matching ETag", map[string]string{"If-None-Match": `"v0", "v1"`}, true},
+		{"Other ETag", map[string]string{"If-None-Match": `"v2"`}, false},
+		{"Any ETag", map[string]string{"If-None-Match": "*"}, true},
+		{"ETag wins over date", map[string]string{"If-None-Match": `"v2"`, "If-Modified-Since": "Tue, 03 Jan 2006 15:04:05 GMT"}, false},
+		{"Not modified since", map[string]string{"If-Modified-Since": "Tue, 03 Jan 2006 15:04:05 GMT"}, true},
+		{"Modified since", map[string]string{"If-Modified-Since": "Sun, 01 Jan 2006 15:04:05 GMT"}, false},
+		{"Unconditional", nil, false},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+		if isNotModified(req, cached) != test.notModified {
+			t.Error(test.name, ": expected not modified to be ", test.notModified)
+		}
+	}
+}
+
+// httpCacheTestUpstream serves a versioned resource with an ETag and counts full and conditional requests
+type httpCacheTestUpstream struct {
+	lock        sync.Mutex
+	version     string
+	full        int
+	conditional int
+}
+
+func (u *httpCacheTestUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	etag := `"` + u.version + `"`
+	w.Header().Set("Cache-Control", "max-age=1")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Accept-Language")
+	if r.Header.Get("If-None-Match") == etag {
+		u.conditional++
+		w.WriteHeader(304)
+		return
+	}
+
+	u.full++
+	w.Write([]byte(u.version + " " + r.Header.Get("Accept-Language")))
+}
+
+func (u *httpCacheTestUpstream) counts() (int, int) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.full, u.conditional
+}
+
+func TestHTTPCacheRevalidation(t *testing.T) {
+	upstream := &httpCacheTestUpstream{version: "v1"}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	proxy, spec := createTestProxyWithDefinition(createTestDefinition("http-cache-test", cacheTestOptions+`"http_cache": {"enabled": true, "keep_stale": 60},`, `"use_extended_paths": true, "extended_paths": {"cache": ["/resource"]},`), server.URL)
+	m := &RedisCacheMiddleware{TykMiddleware: &TykMiddleware{Spec: spec, Proxy: proxy}, CacheStore: getCacheStore(spec.APIID)}
+	m.New()
+	defer PurgeAPICache(m.Spec.APIID)
+
+	get := func(headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/resource", nil)
+		req.Header.Set("version", "Default")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		req.RemoteAddr = "10.0.0.1:1234"
+		recorder := httptest.NewRecorder()
+		m.ProcessRequest(recorder, req, nil)
+		return recorder
+	}
+	waitForCached := func(headers map[string]string, expected string) {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if recorder := get(headers); recorder.Header().Get("x-tyk-cached-response") != "" {
+				if recorder.Body.String() != expected {
+					t.Fatal("Expected cached ", expected, " got: ", recorder.Body.String())
+				}
+				return
+			}
+		}
+		t.Fatal("Response was not cached: ", expected)
+	}
+
+	german := map[string]string{"Accept-Language": "de"}
+	english := map[string]string{"Accept-Language": "en"}
+	get(german)
+	waitForCached(german, "v1 de")
+
+	// Variants are cached separately
+	if recorder := get(english); recorder.Header().Get("x-tyk-cached-response") != "" {
+		t.Error("Other language should not be served from the cache")
+	}
+	waitForCached(english, "v1 en")
+
+	full, conditional := upstream.counts()
+
+	// Conditional requests are answered from the cache
+	recorder := get(map[string]string{"Accept-Language": "de", "If-None-Match": `"v1"`})
+	if recorder.Code != 304 || recorder.Body.Len() != 0 || recorder.Header().Get("ETag") != `"v1"` {
+		t.Error("Expected a 304 from the cache, got: ", recorder.Code, recorder.Body.String())
+	}
+	if nowFull, nowConditional := upstream.counts(); nowFull != full || nowConditional != conditional {
+		t.Fatal("Fresh responses should not reach the upstream: ", nowFull, nowConditional)
+	}
+
+	// Stale responses are revalidated instead of fetched again
+	time.Sleep(2100 * time.Millisecond)
+	recorder = get(german)
+	if recorder.Code != 200 || recorder.Body.String() != "v1 de" || recorder.Header().Get("x-tyk-cached-response") == "" {
+		t.Error("Revalidated response should be served from the cache: ", recorder.Code, recorder.Body.String())
+	}
+	if nowFull, nowConditional := upstream.counts(); nowFull != full || nowConditional != conditional+1 {
+		t.Error("Expected a conditional request: ", nowFull, nowConditional)
+	}
+	waitForCached(german, "v1 de")
+
+	// A changed resource replaces the cached one
+	time.Sleep(2100 * time.Millisecond)
+	upstream.lock.Lock()
+	upstream.version = "v2"
+	upstream.lock.Unlock()
+	if recorder := get(german); recorder.Body.String() != "v2 de" || recorder.Header().Get("x-tyk-cached-response") != "" {
+		t.Error("Changed resource should come from the upstream: ", recorder.Body.String())
+	}
+	waitForCached(german, "v2 de")
+}
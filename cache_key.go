@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/mitchellh/mapstructure"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// The session key is part of the cache key, or the client IP if the request has no key
+	CACHE_KEY_IDENTITY_KEY string = "key"
+	// The client IP is part of the cache key
+	CACHE_KEY_IDENTITY_IP string = "ip"
+	// Responses are shared by all clients
+	CACHE_KEY_IDENTITY_NONE string = "none"
+)
+
+// CacheKeyRule changes how the cache key is built for the requests that match Path (a regex) and Method.
+// Headers, Identity and IgnoreQueryParams replace the values that are set for the whole API when they are
+// set, HashBody adds the body to the key and allows POST requests to listed cached paths to be cached.
+type CacheKeyRule struct {
+	Path              string   `mapstructure:"path" bson:"path" json:"path"`
+	Method            string   `mapstructure:"method" bson:"method" json:"method"`
+	Headers           []string `mapstructure:"headers" bson:"headers" json:"headers"`
+	Identity          string   `mapstructure:"identity" bson:"identity" json:"identity"`
+	IgnoreQueryParams []string `mapstructure:"ignore_query_params" bson:"ignore_query_params" json:"ignore_query_params"`
+	HashBody          bool     `mapstructure:"hash_body" bson:"hash_body" json:"hash_body"`
+
+	path *regexp.Regexp
+}
+
+// CacheKeyConfig is set per API in the definition under "cache_key". By default the cache key is made of
+// the method, the URL and the session key (or client IP). The first matching entry in Paths is used.
+type CacheKeyConfig struct {
+	Headers           []string       `mapstructure:"headers" bson:"headers" json:"headers"`
+	Identity          string         `mapstructure:"identity" bson:"identity" json:"identity"`
+	IgnoreQueryParams []string       `mapstructure:"ignore_query_params" bson:"ignore_query_params" json:"ignore_query_params"`
+	HashBody          bool           `mapstructure:"hash_body" bson:"hash_body" json:"hash_body"`
+	Paths             []CacheKeyRule `mapstructure:"paths" bson:"paths" json:"paths"`
+}
+
+type cacheKeySection struct {
+	CacheKey CacheKeyConfig `mapstructure:"cache_key" bson:"cache_key" json:"cache_key"`
+}
+
+// NewCacheKeyConfig compiles the cache key configuration of an API
+func NewCacheKeyConfig(spec *APISpec) *CacheKeyConfig {
+	thisSection := cacheKeySection{}
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisSection); err != nil {
+		log.Error("Failed to decode cache key configuration: ", err)
+	}
+
+	thisConfig := thisSection.CacheKey
+	if thisConfig.Identity == "" {
+		thisConfig.Identity = CACHE_KEY_IDENTITY_KEY
+	}
+
+	compiledPaths := []CacheKeyRule{}
+	for _, thisPath := range thisConfig.Paths {
+		asRegex, err := regexp.Compile(thisPath.Path)
+		if err != nil {
+			log.Error("Skipping cache key rule for path ", thisPath.Path, " of API ", spec.APIID, ": ", err)
+			continue
+		}
+		thisPath.path = asRegex
+		compiledPaths = append(compiledPaths, thisPath)
+	}
+	thisConfig.Paths = compiledPaths
+
+	return &thisConfig
+}
+
+// GetRule returns how the cache key of a request is built
+func (c *CacheKeyConfig) GetRule(r *http.Request) CacheKeyRule {
+	thisRule := CacheKeyRule{
+		Headers:           c.Headers,
+		Identity:          c.Identity,
+		IgnoreQueryParams: c.IgnoreQueryParams,
+		HashBody:          c.HashBody,
+	}
+
+	for _, thisPath := range c.Paths {
+		if thisPath.Method != "" && !strings.EqualFold(thisPath.Method, r.Method) {
+			continue
+		}
+		if !thisPath.path.MatchString(r.URL.Path) {
+			continue
+		}
+
+		if len(thisPath.Headers) > 0 {
+			thisRule.Headers = thisPath.Headers
+		}
+		if thisPath.Identity != "" {
+			thisRule.Identity = thisPath.Identity
+		}
+		if len(thisPath.IgnoreQueryParams) > 0 {
+			thisRule.IgnoreQueryParams = thisPath.IgnoreQueryParams
+		}
+		thisRule.HashBody = thisRule.HashBody || thisPath.HashBody
+		break
+	}
+
+	return thisRule
+}
+
+// cacheKeyQuery returns the query string without the ignored parameters, sorted so that the order of the
+// parameters doesn't matter
+func cacheKeyQuery(r *http.Request, ignored []string) string {
+	query := r.URL.Query()
+	for _, thisParam := range ignored {
+		query.Del(thisParam)
+	}
+
+	return query.Encode()
+}
+
+// cacheKeyHeaders returns the values of the headers that are part of the cache key, in a fixed order
+func cacheKeyHeaders(header http.Header, headers []string) string {
+	names := make([]string, len(headers))
+	for i, thisHeader := range headers {
+		names[i] = http.CanonicalHeaderKey(thisHeader)
+	}
+	sort.Strings(names)
+
+	values := []string{}
+	for _, thisHeader := range names {
+		values = append(values, thisHeader+":"+strings.Join(header[thisHeader], ","))
+	}
+
+	return strings.Join(values, "\n")
+}
+
+// createCacheKeyChecksum hashes the parts of a request that are part of the cache key, body is only used
+// when the rule hashes the body
+func createCacheKeyChecksum(r *http.Request, thisRule CacheKeyRule, body []byte) string {
+	h := md5.New()
+	toEncode := strings.Join([]string{r.Method, r.URL.Path, cacheKeyQuery(r, thisRule.IgnoreQueryParams)}, "-")
+	if len(thisRule.Headers) > 0 {
+		toEncode += "-" + cacheKeyHeaders(r.Header, thisRule.Headers)
+	}
+	log.Debug("Cache encoding: ", toEncode)
+	io.WriteString(h, toEncode)
+
+	if thisRule.HashBody {
+		io.WriteString(h, "-")
+		h.Write(body)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const cacheKeyTestDef = `"cache_key": {
+		"headers": ["Accept"],
+		"ignore_query_params": ["utm_source"],
+		"paths": [
+			{"path": "^/search", "method": "POST", "hash_body": true},
+			{"path": "^/public", "identity": "none", "headers": ["Accept-Language"]}
+		]
+	},`
+
+func TestCacheKeyComposition(t *testing.T) {
+	spec := createDefinitionFromString(createTestDefinition("cache-key-test", cacheKeyTestDef, ""))
+	m := RedisCacheMiddleware{TykMiddleware: &TykMiddleware{Spec: &spec}}
+	m.New()
+
+	cacheKey := func(method, uri string, headers map[string]string, body string) string {
+		req, _ := http.NewRequest(method, uri, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		thisRule := m.KeyConfig.GetRule(req)
+		identity := "key-1"
+		if thisRule.Identity == CACHE_KEY_IDENTITY_NONE {
+			identity = ""
+		}
+		return m.CreateCheckSum(req, identity, thisRule, []byte(body))
+	}
+
+	base := cacheKey("GET", "/items?a=1&b=2", map[string]string{"Accept": "application/json"}, "")
+	tests := []struct {
+		name    string
+		key     string
+		matches string
+		same    bool
+	}{
+		{"Query order is ignored", cacheKey("GET", "/items?b=2&a=1", map[string]string{"Accept": "application/json"}, ""), base, true},
+		{"Ignored params are dropped", cacheKey("GET", "/items?a=1&b=2&utm_source=mail", map[string]string{"Accept": "application/json"}, ""), base, true},
+		{"Other params are kept", cacheKey("GET", "/items?a=1&b=3", map[string]string{"Accept": "application/json"}, ""), base, false},
+		{"Listed headers are part of the key", cacheKey("GET", "/items?a=1&b=2", map[string]string{"Accept": "text/xml"}, ""), base, false},
+		{"Other headers are not", cacheKey("GET", "/items?a=1&b=2", map[string]string{"Accept": "application/json", "X-Other": "1"}, ""), base, true},
+		{"Body is hashed for matching paths",
+			cacheKey("POST", "/search", nil, `{"q": "a"}`), cacheKey("POST", "/search", nil, `{"q": "b"}`), false},
+		{"Same body gives the same key",
+			cacheKey("POST", "/search", nil, `{"q": "a"}`), cacheKey("POST", "/search", nil, `{"q": "a"}`), true},
+		{"Path rules replace the headers",
+			cacheKey("GET", "/public", map[string]string{"Accept-Language": "de"}, ""), cacheKey("GET", "/public", map[string]string{"Accept-Language": "en"}, ""), false},
+	}
+
+	for _, test := range tests {
+		if (test.key == test.matches) != test.same {
+			t.Error(test.name, ": expected same key ", test.same, ", got ", test.key, " and ", test.matches)
+		}
+	}
+
+	// Shared paths leave the client out of the key
+	req, _ := http.NewRequest("GET", "/public", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	if identity, _ := m.cacheIdentity(req, m.KeyConfig.GetRule(req)); identity != "" {
+		t.Error("Shared paths should not include the client, got: ", identity)
+	}
+	req, _ = http.NewRequest("GET", "/items", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	if identity, _ := m.cacheIdentity(req, m.KeyConfig.GetRule(req)); identity != "10.0.0.1" {
+		t.Error("Keyless requests should use the client IP, got: ", identity)
+	}
+}
+
+// cacheTestOptions enables the cache of a test definition
+const cacheTestOptions = `"cache_options": {"enable_cache": true, "cache_timeout": 60},`
+
+func TestCachePostWithBodyHash(t *testing.T) {
+	var upstreamCalls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamCalls, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("results for "), body...))
+	}))
+	defer upstream.Close()
+
+	proxy, spec := createTestProxyWithDefinition(createTestDefinition("cache-post-test", cacheTestOptions+cacheKeyTestDef, `"use_extended_paths": true, "extended_paths": {"cache": ["/search"]},`), upstream.URL)
+	m := &RedisCacheMiddleware{TykMiddleware: &TykMiddleware{Spec: spec, Proxy: proxy}, CacheStore: getCacheStore(spec.APIID)}
+	m.New()
+
+	search := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/search", bytes.NewBufferString(query))
+		req.Header.Set("version", "Default")
+		req.RemoteAddr = "10.0.0.1:1234"
+		recorder := httptest.NewRecorder()
+		if _, code := m.ProcessRequest(recorder, req, nil); code != 666 {
+			t.Fatal("Request should be handled by the cache, got: ", code)
+		}
+		return recorder
+	}
+
+	if recorder := search(`{"q": "a"}`); recorder.Body.String() != `results for {"q": "a"}` {
+		t.Fatal("Body should reach the upstream: ", recorder.Body.String())
+	}
+
+	// Results are written to the cache in the background
+	var cached *httptest.ResponseRecorder
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cached = search(`{"q": "a"}`); cached.Header().Get("x-tyk-cached-response") != "" {
+			break
+		}
+	}
+	if cached.Header().Get("x-tyk-cached-response") == "" || cached.Body.String() != `results for {"q": "a"}` {
+		t.Fatal("Same body should be served from the cache: ", cached.Body.String())
+	}
+
+	calls := atomic.LoadInt32(&upstreamCalls)
+	if recorder := search(`{"q": "b"}`); recorder.Header().Get("x-tyk-cached-response") != "" || recorder.Body.String() != `results for {"q": "b"}` {
+		t.Error("Different bodies should not share a cache entry: ", recorder.Body.String())
+	}
+	if atomic.LoadInt32(&upstreamCalls) != calls+1 {
+		t.Error("Different body should go to the upstream")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	UPSTREAM_CACHE_PURGE_HEADER_NAME = "x-tyk-cache-purge"
+	CACHE_INDEX_KEYPREFIX            = "cache-index."
+	// Cache keys end in the hex MD5 of the request
+	cacheChecksumLength = 32
+)
+
+// getCacheStore returns the store that holds the cached responses of an API, the middleware uses the same prefix
+func getCacheStore(APIID string) *RedisClusterStorageManager {
+	cacheStore := &RedisClusterStorageManager{KeyPrefix: "cache-" + APIID}
+	cacheStore.Connect()
+
+	return cacheStore
+}
+
+// getCacheIndexStore returns the store of the index that maps the cache keys of an API to the upstream path
+// they were stored for, cache keys are hashes so they can't be matched to a path otherwise. The index of an
+// API is a sorted set of cacheIndexEntry members scored by the time their cache entry expires.
+func getCacheIndexStore() *RedisClusterStorageManager {
+	indexStore := &RedisClusterStorageManager{KeyPrefix: CACHE_INDEX_KEYPREFIX}
+	indexStore.Connect()
+
+	return indexStore
+}
+
+// cacheUpstreamPath returns the path of a request as the upstream sees it, purge patterns are matched against it
+func cacheUpstreamPath(spec *APISpec, r *http.Request) string {
+	if spec.Proxy.StripListenPath {
+		return strings.Replace(r.URL.Path, spec.Proxy.ListenPath, "", 1)
+	}
+
+	return r.URL.Path
+}
+
+type cacheIndexEntry struct {
+	Key  string `json:"key"`
+	Path string `json:"path"`
+}
+
+// indexCacheKey records the path of a cache entry and drops the entries that have expired since, the index
+// lives as long as the longest lived entry in it
+func indexCacheKey(APIID string, path string, cacheKey string, ttl int64) {
+	now := time.Now().Unix()
+	expiresAt := math.Inf(1)
+	if ttl > 0 {
+		expiresAt = float64(now + ttl)
+	}
+	member, _ := json.Marshal(cacheIndexEntry{Key: cacheKey, Path: path})
+
+	indexStore := getCacheIndexStore()
+	err := indexStore.AddToSortedSet(APIID, string(member), expiresAt, ttl)
+	if err == nil {
+		err = indexStore.RemoveSortedSetRange(APIID, "-inf", strconv.FormatInt(now, 10))
+	}
+	if err != nil {
+		log.Error("Failed to index cache entry: ", err)
+	}
+}
+
+// readCacheIndex returns the index entries of an API that have not expired, mapped by their member in the index
+func readCacheIndex(indexStore *RedisClusterStorageManager, APIID string) (map[string]cacheIndexEntry, error) {
+	members, err := indexStore.GetSortedSetRange(APIID, strconv.FormatInt(time.Now().Unix(), 10), "+inf")
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]cacheIndexEntry)
+	for _, member := range members {
+		thisEntry := cacheIndexEntry{}
+		if err := json.Unmarshal([]byte(member), &thisEntry); err != nil {
+			continue
+		}
+		index[member] = thisEntry
+	}
+
+	return index, nil
+}
+
+// cachePathPattern compiles a purge pattern, * matches any characters including slashes
+func cachePathPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, errors.New("Path pattern is empty")
+	}
+
+	parts := strings.Split(pattern, "*")
+	for i, _ := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+
+	return regexp.Compile("^" + strings.Join(parts, ".*") + "$")
+}
+
+// PurgeAPICache removes all cached responses of an API and returns how many were removed
+func PurgeAPICache(APIID string) (int, error) {
+	cacheStore := getCacheStore(APIID)
+	cacheKeys := cacheStore.GetKeys(APIID)
+	cacheStore.DeleteKeys(cacheKeys)
+	notifyCachePurge(APIID, nil)
+
+	getCacheIndexStore().DeleteKey(APIID)
+
+	return len(cacheKeys), nil
+}
+
+// PurgeCacheByPath removes the cached responses of an API for the upstream paths that match a pattern
+func PurgeCacheByPath(APIID string, pattern string) (int, error) {
+	asRegex, err := cachePathPattern(pattern)
+	if err != nil {
+		return 0, err
+	}
+
+	indexStore := getCacheIndexStore()
+	index, err := readCacheIndex(indexStore, APIID)
+	if err != nil {
+		return 0, err
+	}
+
+	cacheKeys, members := []string{}, []string{}
+	for member, thisEntry := range index {
+		if asRegex.MatchString(thisEntry.Path) {
+			cacheKeys = append(cacheKeys, thisEntry.Key)
+			members = append(members, member)
+		}
+	}
+	if len(cacheKeys) == 0 {
+		return 0, nil
+	}
+
+	getCacheStore(APIID).DeleteKeys(cacheKeys)
+	notifyCachePurge(APIID, cacheKeys)
+	return len(cacheKeys), indexStore.RemoveSortedSetMembers(APIID, members)
+}
+
+// PurgeCacheByKey removes the cached responses of an API that belong to a session key, or to a client IP for
+// keyless requests
+func PurgeCacheByKey(APIID string, keyName string) (int, error) {
+	if keyName == "" {
+		return 0, errors.New("Key is empty")
+	}
+
+	// Longer keys that start with the same characters have their own entries, the checksum of the request is
+	// followed by a second one for responses that vary by request headers
+	cacheKeys := []string{}
+	for _, cacheKey := range getCacheStore(APIID).GetKeys(APIID + keyName) {
+		checksumLength := len(cacheKey) - len(APIID) - len(keyName)
+		if checksumLength == cacheChecksumLength || checksumLength == 2*cacheChecksumLength {
+			cacheKeys = append(cacheKeys, cacheKey)
+		}
+	}
+	if len(cacheKeys) == 0 {
+		return 0, nil
+	}
+
+	getCacheStore(APIID).DeleteKeys(cacheKeys)
+	notifyCachePurge(APIID, cacheKeys)
+	return len(cacheKeys), unindexCacheKeys(APIID, cacheKeys)
+}
+
+// unindexCacheKeys removes purged cache keys from the index of an API
+func unindexCacheKeys(APIID string, cacheKeys []string) error {
+	indexStore := getCacheIndexStore()
+	index, err := readCacheIndex(indexStore, APIID)
+	if err != nil {
+		return err
+	}
+
+	purged := make(map[string]bool)
+	for _, cacheKey := range cacheKeys {
+		purged[cacheKey] = true
+	}
+	members := []string{}
+	for member, thisEntry := range index {
+		if purged[thisEntry.Key] {
+			members = append(members, member)
+		}
+	}
+
+	return indexStore.RemoveSortedSetMembers(APIID, members)
+}
+
+// handleUpstreamCachePurge purges the cached responses that an upstream lists in the purge header of a
+// successful response to a request that changed data, patterns are separated by commas
+func handleUpstreamCachePurge(spec *APISpec, r *http.Request, res *http.Response) {
+	patterns := res.Header.Get(UPSTREAM_CACHE_PURGE_HEADER_NAME)
+	if patterns == "" {
+		return
+	}
+	res.Header.Del(UPSTREAM_CACHE_PURGE_HEADER_NAME)
+
+	if !spec.CacheOptions.EnableCache || res.StatusCode < 200 || res.StatusCode > 299 {
+		return
+	}
+	if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+		return
+	}
+
+	for _, thisPattern := range strings.Split(patterns, ",") {
+		thisPattern = strings.TrimSpace(thisPattern)
+		purged, err := PurgeCacheByPath(spec.APIID, thisPattern)
+		thisLog := log.WithFields(logrus.Fields{
+			"api_id":  spec.APIID,
+			"pattern": thisPattern,
+		})
+		if err != nil {
+			thisLog.Error("[CACHE] Upstream purge failed: ", err)
+			continue
+		}
+		thisLog.Info("[CACHE] Upstream purged ", purged, " cached responses")
+	}
+}
+
+// CachePurgeResult is returned by the cache endpoint
+type CachePurgeResult struct {
+	APIID  string `json:"api_id"`
+	Status string `json:"status"`
+	Purged int    `json:"purged"`
+}
+
+// cacheHandler purges cached responses with DELETE /tyk/cache/{api_id}. All responses of the API are removed
+// unless the path parameter (a pattern where * matches anything) or the key parameter is set.
+func cacheHandler(w http.ResponseWriter, r *http.Request) {
+	APIID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tyk/cache"), "/")
+	thisSpec := GetSpecForApi(APIID)
+	if APIID == "" || thisSpec == nil || !GetAdminTokenFromRequest(r).CanAccessAPI(APIID) {
+		DoJSONWrite(w, 404, createError("API ID not found"))
+		return
+	}
+
+	if r.Method != "DELETE" {
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	pathPattern, keyName := r.URL.Query().Get("path"), r.URL.Query().Get("key")
+	var purged int
+	var err error
+	switch {
+	case pathPattern != "" && keyName != "":
+		DoJSONWrite(w, 400, createError("Purge either by path or by key"))
+		return
+	case pathPattern != "":
+		if _, err := cachePathPattern(pathPattern); err != nil {
+			DoJSONWrite(w, 400, createError("Invalid path pattern: "+err.Error()))
+			return
+		}
+		purged, err = PurgeCacheByPath(APIID, pathPattern)
+	case keyName != "":
+		purged, err = PurgeCacheByKey(APIID, keyName)
+	default:
+		purged, err = PurgeAPICache(APIID)
+	}
+
+	if err != nil {
+		log.Error("Failed to purge cache: ", err)
+		DoJSONWrite(w, 500, createError("Failed to purge cache"))
+		return
+	}
+
+	// Keys are not written to the audit log
+	purgedObject := map[string]interface{}{"purged": purged}
+	if pathPattern != "" {
+		purgedObject["path"] = pathPattern
+	}
+	RecordAuditEvent(r, "delete", AuditObjectCache, APIID, thisSpec.OrgID, purgedObject, nil)
+
+	responseMessage, _ := json.Marshal(CachePurgeResult{APIID: APIID, Status: "ok", Purged: purged})
+	DoJSONWrite(w, 200, responseMessage)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCachePathPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		matches bool
+	}{
+		{"/products/*", "/products/1", true},
+		{"/products/*", "/products/1/reviews", true},
+		{"/products/*", "/products", false},
+		{"/products", "/products", true},
+		{"/products", "/products/1", false},
+		{"/products.json", "/productsxjson", false},
+		{"*/reviews", "/products/1/reviews", true},
+	}
+
+	for _, test := range tests {
+		asRegex, err := cachePathPattern(test.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if asRegex.MatchString(test.path) != test.matches {
+			t.Error("Pattern ", test.pattern, " matching ", test.path, " should be ", test.matches)
+		}
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	var upstreamCalls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamCalls, 1)
+		if r.Method == "POST" {
+			w.Header().Set(UPSTREAM_CACHE_PURGE_HEADER_NAME, "/products/*, /missing")
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	proxy, spec := createTestProxyWithDefinition(createTestDefinition("cache-purge-test", cacheTestOptions, `"use_extended_paths": true, "extended_paths": {"cache": ["/products", "/orders"]},`), upstream.URL)
+	m := &RedisCacheMiddleware{TykMiddleware: &TykMiddleware{Spec: spec, Proxy: proxy}, CacheStore: getCacheStore(spec.APIID)}
+	m.New()
+	ApiSpecRegister = map[string]*APISpec{m.Spec.APIID: m.Spec}
+	defer func() { ApiSpecRegister = make(map[string]*APISpec) }()
+	defer PurgeAPICache(m.Spec.APIID)
+
+	request := func(method, path, keyName string) *http.Request {
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("version", "Default")
+		req.RemoteAddr = "10.0.0.1:1234"
+		context.Set(req, AuthHeaderValue, keyName)
+		return req
+	}
+	isCached := func(path, keyName string) bool {
+		recorder := httptest.NewRecorder()
+		m.ProcessRequest(recorder, request("GET", path, keyName), nil)
+		return recorder.Header().Get("x-tyk-cached-response") != ""
+	}
+	cache := func(path, keyName string) {
+		for deadline := time.Now().Add(time.Second); !isCached(path, keyName); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("Response was not cached: ", path)
+			}
+		}
+	}
+	purge := func(query string) int {
+		req, _ := http.NewRequest("DELETE", "/tyk/cache/"+m.Spec.APIID+query, nil)
+		req.Header.Set("x-tyk-authorization", config.Secret)
+		recorder := httptest.NewRecorder()
+		CheckAdminScope(AdminScopeCache, cacheHandler)(recorder, req)
+		if recorder.Code != 200 {
+			t.Fatal("Purge failed: ", recorder.Code, recorder.Body.String())
+		}
+		result := CachePurgeResult{}
+		json.Unmarshal(recorder.Body.Bytes(), &result)
+		return result.Purged
+	}
+	cacheAll := func() {
+		cache("/products/1", "key-a")
+		cache("/products/2", "key-a")
+		cache("/orders/1", "key-a")
+		cache("/products/1", "key-b")
+		cache("/products/1", "key-bb")
+	}
+
+	// By path pattern
+	cacheAll()
+	if purged := purge("?path=/products/*"); purged != 4 {
+		t.Error("Expected 4 purged entries, got: ", purged)
+	}
+	if isCached("/products/1", "key-a") || isCached("/products/2", "key-a") || !isCached("/orders/1", "key-a") {
+		t.Error("Only matching paths should be purged")
+	}
+
+	// By key, other keys that start the same way are kept
+	cacheAll()
+	if purged := purge("?key=key-b"); purged != 1 {
+		t.Error("Expected 1 purged entry, got: ", purged)
+	}
+	if isCached("/products/1", "key-b") || !isCached("/products/1", "key-bb") || !isCached("/products/1", "key-a") {
+		t.Error("Only entries of the key should be purged")
+	}
+
+	// Everything
+	cacheAll()
+	if purged := purge(""); purged != 5 {
+		t.Error("Expected 5 purged entries, got: ", purged)
+	}
+	if isCached("/orders/1", "key-a") {
+		t.Error("All entries should be purged")
+	}
+
+	// By the upstream, after a successful change
+	cacheAll()
+	recorder := httptest.NewRecorder()
+	m.Proxy.ServeHTTP(recorder, request("POST", "/products", "key-a"))
+	if recorder.Header().Get(UPSTREAM_CACHE_PURGE_HEADER_NAME) != "" {
+		t.Error("Purge header should not reach the client")
+	}
+	if isCached("/products/1", "key-b") || isCached("/products/2", "key-a") || !isCached("/orders/1", "key-a") {
+		t.Error("Upstream purge should remove matching paths only")
+	}
+
+	req, _ := http.NewRequest("GET", "/tyk/cache/"+m.Spec.APIID, nil)
+	req.Header.Set("x-tyk-authorization", config.Secret)
+	recorder = httptest.NewRecorder()
+	CheckAdminScope(AdminScopeCache, cacheHandler)(recorder, req)
+	if recorder.Code != 405 {
+		t.Error("Only DELETE should be supported, got: ", recorder.Code)
+	}
+}
+
+func TestCacheIndexPrune(t *testing.T) {
+	APIID := "cache-index-prune-test"
+	indexStore := getCacheIndexStore()
+	defer indexStore.DeleteKey(APIID)
+
+	// An entry whose response has expired, the index outlives it while other responses are cached
+	indexStore.AddToSortedSet(APIID, `{"key": "expired", "path": "/old"}`, float64(time.Now().Unix()-10), 60)
+	indexCacheKey(APIID, "/new", "fresh", 60)
+
+	members, err := indexStore.GetSortedSetRange(APIID, "-inf", "+inf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 {
+		t.Fatal("Expired entries should be dropped from the index, got: ", members)
+	}
+
+	index, _ := readCacheIndex(indexStore, APIID)
+	for _, thisEntry := range index {
+		if thisEntry.Key != "fresh" || thisEntry.Path != "/new" {
+			t.Error("Unexpected index entry: ", thisEntry)
+		}
+	}
+}
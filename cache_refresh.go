@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	CACHE_LOCK_KEYPREFIX = "cache-lock."
+	// Warnings that are sent with stale responses
+	CACHE_WARNING_STALE              = `110 - "Response is Stale"`
+	CACHE_WARNING_REVALIDATION_ERROR = `111 - "Revalidation Failed"`
+)
+
+// CacheRefreshConfig is set per API in the definition under "cache_refresh". With Coalesce only one request
+// per cache key goes to the upstream when the cached response is missing or stale, other requests for the key
+// wait for it, up to LockTimeout seconds, and are then served what it stored. RedisLock does the same across
+// gateways. Stale responses are served for StaleWhileRevalidate seconds while a background request refreshes
+// them, and for StaleIfError seconds when the upstream fails or the circuit breaker is open. With the HTTP
+// cache enabled the stale-while-revalidate and stale-if-error directives of the upstream take precedence.
+type CacheRefreshConfig struct {
+	Coalesce             bool  `mapstructure:"coalesce" bson:"coalesce" json:"coalesce"`
+	RedisLock            bool  `mapstructure:"redis_lock" bson:"redis_lock" json:"redis_lock"`
+	LockTimeout          int64 `mapstructure:"lock_timeout" bson:"lock_timeout" json:"lock_timeout"`
+	StaleWhileRevalidate int64 `mapstructure:"stale_while_revalidate" bson:"stale_while_revalidate" json:"stale_while_revalidate"`
+	StaleIfError         int64 `mapstructure:"stale_if_error" bson:"stale_if_error" json:"stale_if_error"`
+}
+
+type cacheRefreshSection struct {
+	CacheRefresh CacheRefreshConfig `mapstructure:"cache_refresh" bson:"cache_refresh" json:"cache_refresh"`
+}
+
+// GetCacheRefreshConfig reads the cache refresh options of an API
+func GetCacheRefreshConfig(spec *APISpec) CacheRefreshConfig {
+	thisSection := cacheRefreshSection{}
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisSection); err != nil {
+		log.Error("Failed to decode cache refresh configuration: ", err)
+	}
+
+	thisConfig := thisSection.CacheRefresh
+	if thisConfig.LockTimeout <= 0 {
+		thisConfig.LockTimeout = 10
+	}
+
+	return thisConfig
+}
+
+// staleWindows returns for how many seconds a response can be served stale while it is revalidated and when
+// the upstream fails
+func (c CacheRefreshConfig) staleWindows(header http.Header, useDirectives bool) (int64, int64) {
+	whileRevalidate, ifError := c.StaleWhileRevalidate, c.StaleIfError
+	if !useDirectives {
+		return whileRevalidate, ifError
+	}
+
+	thisControl := parseCacheControl(header)
+	if thisControl.StaleWhileRevalidate >= 0 {
+		whileRevalidate = thisControl.StaleWhileRevalidate
+	}
+	if thisControl.StaleIfError >= 0 {
+		ifError = thisControl.StaleIfError
+	}
+
+	return whileRevalidate, ifError
+}
+
+// cacheFlights tracks the cache keys that are being refreshed in this process, the channel of a key is closed
+// when its refresh finishes
+type cacheFlights struct {
+	sync.Mutex
+	inFlight map[string]chan struct{}
+}
+
+var cacheRefreshFlights = &cacheFlights{inFlight: make(map[string]chan struct{})}
+
+// start registers the refresh of a key, if the key is already being refreshed false is returned together with
+// the channel of that refresh
+func (f *cacheFlights) start(key string) (chan struct{}, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	if done, found := f.inFlight[key]; found {
+		return done, false
+	}
+	f.inFlight[key] = make(chan struct{})
+
+	return nil, true
+}
+
+func (f *cacheFlights) finish(key string) {
+	f.Lock()
+	defer f.Unlock()
+
+	if done, found := f.inFlight[key]; found {
+		close(done)
+		delete(f.inFlight, key)
+	}
+}
+
+// getCacheLockStore returns the store of the locks that gateways hold while they refresh a cache key
+func getCacheLockStore() *RedisClusterStorageManager {
+	lockStore := &RedisClusterStorageManager{KeyPrefix: CACHE_LOCK_KEYPREFIX}
+	lockStore.Connect()
+
+	return lockStore
+}
+
+// waitForCacheLock waits until another gateway released the lock of a cache key, or until timeout
+func waitForCacheLock(lockStore *RedisClusterStorageManager, key string, timeout time.Duration) {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if _, err := lockStore.GetKey(key); err != nil {
+			return
+		}
+	}
+}
+
+// cloneCacheRequest copies a request for a refresh that runs after the client was served, the context data of
+// the request is copied with it and must be cleared when the refresh is done
+func cloneCacheRequest(r *http.Request, body []byte) *http.Request {
+	clone := new(http.Request)
+	*clone = *r
+	clone.URL = new(url.URL)
+	*clone.URL = *r.URL
+	clone.Header = make(http.Header)
+	copyHeader(clone.Header, r.Header)
+
+	clone.Body = nil
+	if len(body) > 0 {
+		clone.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	for name, value := range context.GetAll(r) {
+		context.Set(clone, name, value)
+	}
+
+	return clone
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cacheRefreshTestUpstream answers with its current body and counts the requests it gets
+type cacheRefreshTestUpstream struct {
+	lock   sync.Mutex
+	body   string
+	status int
+	delay  time.Duration
+	calls  int32
+}
+
+func (u *cacheRefreshTestUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&u.calls, 1)
+	time.Sleep(u.delay)
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.status != 0 {
+		w.WriteHeader(u.status)
+	}
+	w.Write([]byte(u.body))
+}
+
+func (u *cacheRefreshTestUpstream) set(status int, body string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.status, u.body = status, body
+}
+
+func cacheRefreshTestRequest() *http.Request {
+	req, _ := http.NewRequest("GET", "/resource", nil)
+	req.Header.Set("version", "Default")
+	req.RemoteAddr = "10.0.0.1:1234"
+	return req
+}
+
+func getConcurrently(m *RedisCacheMiddleware, count int) []*httptest.ResponseRecorder {
+	recorders := make([]*httptest.ResponseRecorder, count)
+	wg := sync.WaitGroup{}
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(recorder *httptest.ResponseRecorder) {
+			defer wg.Done()
+			m.ProcessRequest(recorder, cacheRefreshTestRequest(), nil)
+		}(recorders[i])
+	}
+	wg.Wait()
+
+	return recorders
+}
+
+func waitForCacheEntry(t *testing.T, m *RedisCacheMiddleware, expected string) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		recorder := httptest.NewRecorder()
+		m.ProcessRequest(recorder, cacheRefreshTestRequest(), nil)
+		if recorder.Header().Get("x-tyk-cached-response") != "" && recorder.Header().Get("Warning") == "" {
+			if recorder.Body.String() != expected {
+				t.Fatal("Expected cached ", expected, " got: ", recorder.Body.String())
+			}
+			return
+		}
+	}
+	t.Fatal("Response was not cached: ", expected)
+}
+
+func TestCacheRefreshCoalescing(t *testing.T) {
+	upstream := &cacheRefreshTestUpstream{body: "v1", delay: 100 * time.Millisecond}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	proxy, spec := createTestProxyWithDefinition(createTestDefinition("cache-coalesce-test", cacheTestOptions+`"cache_refresh": {"coalesce": true},`, `"use_extended_paths": true, "extended_paths": {"cache": ["/resource"]},`), server.URL)
+	m := &RedisCacheMiddleware{TykMiddleware: &TykMiddleware{Spec: spec, Proxy: proxy}, CacheStore: getCacheStore(spec.APIID)}
+	m.New()
+	defer PurgeAPICache(m.Spec.APIID)
+
+	for i, recorder := range getConcurrently(m, 10) {
+		if recorder.Code != 200 || recorder.Body.String() != "v1" {
+			t.Error("Request ", i, " got: ", recorder.Code, recorder.Body.String())
+		}
+	}
+	if calls := atomic.LoadInt32(&upstream.calls); calls != 1 {
+		t.Error("Concurrent misses should reach the upstream once, got: ", calls)
+	}
+}
+
+func TestCacheRefreshRedisLock(t *testing.T) {
+	upstream := &cacheRefreshTestUpstream{body: "v1"}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	proxy, spec := createTestProxyWithDefinition(createTestDefinition("cache-lock-test", cacheTestOptions+`"cache_refresh": {"coalesce": true, "redis_lock": true, "lock_timeout": 5},`, `"use_extended_paths": true, "extended_paths": {"cache": ["/resource"]},`), server.URL)
+	m := &RedisCacheMiddleware{TykMiddleware: &TykMiddleware{Spec: spec, Proxy: proxy}, CacheStore: getCacheStore(spec.APIID)}
+	m.New()
+	defer PurgeAPICache(m.Spec.APIID)
+
+	// Another gateway is refreshing the key
+	req := cacheRefreshTestRequest()
+	thisKey := m.CreateCheckSum(req, "10.0.0.1", m.KeyConfig.GetRule(req), nil)
+	lockStore := getCacheLockStore()
+	if locked, err := lockStore.SetKeyIfNotExists(thisKey, "other", 5); !locked || err != nil {
+		t.Fatal("Failed to lock key: ", err)
+	}
+	if locked, _ := lockStore.SetKeyIfNotExists(thisKey, "other", 5); locked {
+		t.Fatal("Key should only be locked once")
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	start := time.Now()
+	go func() {
+		recorder := httptest.NewRecorder()
+		m.ProcessRequest(recorder, cacheRefreshTestRequest(), nil)
+		done <- recorder
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	if calls := atomic.LoadInt32(&upstream.calls); calls != 0 {
+		t.Fatal("Request should wait for the lock, upstream got: ", calls)
+	}
+	lockStore.DeleteKey(thisKey)
+
+	recorder := <-done
+	if recorder.Body.String() != "v1" || time.Since(start) < 300*time.Millisecond {
+		t.Error("Expected the response after the lock was released, got: ", recorder.Body.String())
+	}
+	if calls := atomic.LoadInt32(&upstream.calls); calls != 1 {
+		t.Error("Expected one upstream request, got: ", calls)
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	upstream := &cacheRefreshTestUpstream{body: "v1"}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	proxy, spec := createTestProxyWithDefinition(createTestDefinition("cache-swr-test", cacheTestOptions+`"cache_refresh": {"stale_while_revalidate": 60},`, `"use_extended_paths": true, "extended_paths": {"cache": ["/resource"]},`), server.URL)
+	m := &RedisCacheMiddleware{TykMiddleware: &TykMiddleware{Spec: spec, Proxy: proxy}, CacheStore: getCacheStore(spec.APIID)}
+	m.New()
+	m.Spec.APIDefinition.CacheOptions.CacheTimeout = 2
+	defer PurgeAPICache(m.Spec.APIID)
+
+	m.ProcessRequest(httptest.NewRecorder(), cacheRefreshTestRequest(), nil)
+	waitForCacheEntry(t, m, "v1")
+
+	time.Sleep(3100 * time.Millisecond)
+	upstream.set(0, "v2")
+	calls := atomic.LoadInt32(&upstream.calls)
+
+	// Stale responses are served right away, one request refreshes them
+	for i, recorder := range getConcurrently(m, 5) {
+		if recorder.Body.String() != "v1" || recorder.Header().Get("Warning") != CACHE_WARNING_STALE {
+			t.Error("Request ", i, " should get the stale response, got: ", recorder.Body.String(), recorder.Header())
+		}
+	}
+	waitForCacheEntry(t, m, "v2")
+	if newCalls := atomic.LoadInt32(&upstream.calls); newCalls != calls+1 {
+		t.Error("Expected a single background refresh, upstream got: ", newCalls-calls)
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	upstream := &cacheRefreshTestUpstream{body: "ok"}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	breaker := `"circuit_breakers": [{"path": "/resource", "method": "GET", "threshold_percent": 0.5, "samples": 2, "return_to_service_after": 60, "failure_status_codes": [500], "min_requests": 2}]`
+	proxy, spec := createTestProxyWithDefinition(createTestDefinition("cache-sie-test", cacheTestOptions+`"cache_refresh": {"stale_if_error": 60},`, `"use_extended_paths": true, "extended_paths": {"cache": ["/resource"], `+breaker+`},`), server.URL)
+	m := &RedisCacheMiddleware{TykMiddleware: &TykMiddleware{Spec: spec, Proxy: proxy}, CacheStore: getCacheStore(spec.APIID)}
+	m.New()
+	m.Spec.APIDefinition.CacheOptions.CacheTimeout = 2
+	defer PurgeAPICache(m.Spec.APIID)
+
+	m.ProcessRequest(httptest.NewRecorder(), cacheRefreshTestRequest(), nil)
+	waitForCacheEntry(t, m, "ok")
+
+	time.Sleep(3100 * time.Millisecond)
+	upstream.set(500, "broken")
+	calls := atomic.LoadInt32(&upstream.calls)
+
+	// Errors from the upstream, and then from the open breaker, are replaced by the stale response
+	for i := 0; i < 6; i++ {
+		recorder := httptest.NewRecorder()
+		m.ProcessRequest(recorder, cacheRefreshTestRequest(), nil)
+		if recorder.Code != 200 || recorder.Body.String() != "ok" || recorder.Header().Get("Warning") != CACHE_WARNING_REVALIDATION_ERROR {
+			t.Error("Request ", i, " should get the stale response, got: ", recorder.Code, recorder.Body.String())
+		}
+	}
+	if failed := atomic.LoadInt32(&upstream.calls) - calls; failed == 0 || failed >= 6 {
+		t.Error("Breaker should open after the first failures, upstream got: ", failed)
+	}
+	for _, thisBreaker := range GetCircuitBreakers(m.Spec) {
+		if thisBreaker.Status().State != BREAKER_OPEN {
+			t.Error("Breaker should be open: ", thisBreaker.Status())
+		}
+		thisBreaker.Reset()
+	}
+}
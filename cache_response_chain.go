@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"github.com/mitchellh/mapstructure"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	// The response chain runs before a response is cached, cache hits are served as they were stored
+	CACHE_RESPONSE_CHAIN_STORE = "store"
+	// The upstream response is cached as it is, the response chain runs again on every cache hit
+	CACHE_RESPONSE_CHAIN_REPLAY = "replay"
+)
+
+type cacheResponseChainSection struct {
+	CacheResponseChain string `mapstructure:"cache_response_chain" bson:"cache_response_chain" json:"cache_response_chain"`
+}
+
+// GetCacheResponseChainMode reads how the response middleware of an API applies to cached responses, they are
+// stored after the response chain ran unless "cache_response_chain" is set to "replay"
+func GetCacheResponseChainMode(spec *APISpec) string {
+	thisSection := cacheResponseChainSection{}
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisSection); err != nil {
+		log.Error("Failed to decode cache response chain mode: ", err)
+	}
+
+	if thisSection.CacheResponseChain == CACHE_RESPONSE_CHAIN_REPLAY {
+		return CACHE_RESPONSE_CHAIN_REPLAY
+	}
+
+	return CACHE_RESPONSE_CHAIN_STORE
+}
+
+// copyResponseForCache buffers the body of a response and returns a copy of the response for the cache. The
+// headers are copied too, so that changes to the response after this point don't end up in the cache.
+func copyResponseForCache(res *http.Response) *http.Response {
+	var bodyBuffer bytes.Buffer
+	io.Copy(&bodyBuffer, res.Body)
+	res.Body.Close()
+	body := bodyBuffer.Bytes()
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	copiedRes := new(http.Response)
+	*copiedRes = *res
+	copiedRes.Header = make(http.Header)
+	copyHeader(copiedRes.Header, res.Header)
+	copiedRes.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return copiedRes
+}
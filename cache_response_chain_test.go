@@ -0,0 +1,68 @@
+package main
+
+import (
+	b64 "encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func createCacheResponseChainTestMiddleware(upstreamURL string, APIID string, mode string) *RedisCacheMiddleware {
+	template := b64.StdEncoding.EncodeToString([]byte(`{"greeting": "hello {{.name}}"}`))
+	responseMiddleware := `"transform_response": [{"path": "/resource", "method": "GET", "template_data": {"input_type": "json", "template_mode": "blob", "template_source": "` + template + `"}}],
+		"transform_response_headers": [{"path": "/resource", "method": "GET", "add_headers": {"X-Injected": "yes"}, "delete_headers": ["X-Upstream"]}]`
+	processors := `"response_processors": [{"name": "response_body_transform"}, {"name": "header_injector"}], "cache_response_chain": "` + mode + `",`
+
+	proxy, spec := createTestProxyWithDefinition(createTestDefinition(APIID, cacheTestOptions+processors, `"use_extended_paths": true, "extended_paths": {"cache": ["/resource"], `+responseMiddleware+`},`), upstreamURL)
+	m := &RedisCacheMiddleware{TykMiddleware: &TykMiddleware{Spec: spec, Proxy: proxy}, CacheStore: getCacheStore(spec.APIID)}
+	m.New()
+	creeateResponseMiddlewareChain(m.Spec)
+
+	return m
+}
+
+func TestCacheResponseChain(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "1")
+		w.Write([]byte(`{"name": "world"}`))
+	}))
+	defer upstream.Close()
+
+	transformed := `{"greeting": "hello world"}`
+	for _, mode := range []string{CACHE_RESPONSE_CHAIN_STORE, CACHE_RESPONSE_CHAIN_REPLAY} {
+		m := createCacheResponseChainTestMiddleware(upstream.URL, "cache-chain-"+mode+"-test", mode)
+		if m.Proxy.CacheResponseChain != mode {
+			t.Fatal("Expected mode ", mode, " got: ", m.Proxy.CacheResponseChain)
+		}
+
+		miss := httptest.NewRecorder()
+		m.ProcessRequest(miss, cacheRefreshTestRequest(), nil)
+		waitForCacheEntry(t, m, transformed)
+		hit := httptest.NewRecorder()
+		m.ProcessRequest(hit, cacheRefreshTestRequest(), nil)
+
+		// Hits look like the response the chain returned on the miss
+		for _, recorder := range []*httptest.ResponseRecorder{miss, hit} {
+			if recorder.Body.String() != transformed || recorder.Header().Get("X-Injected") != "yes" || recorder.Header().Get("X-Upstream") != "" {
+				t.Error("Mode ", mode, " should serve the transformed response, got: ", recorder.Body.String(), recorder.Header())
+			}
+		}
+		if hit.Header().Get("x-tyk-cached-response") == "" || hit.Header().Get("Content-Length") != miss.Header().Get("Content-Length") {
+			t.Error("Mode ", mode, " should serve the same response from the cache, got: ", hit.Header())
+		}
+
+		// Only replayed responses are stored as the upstream sent them
+		req := cacheRefreshTestRequest()
+		thisKey := m.CreateCheckSum(req, "10.0.0.1", m.KeyConfig.GetRule(req), nil)
+		cached, _, found := m.getCachedResponse(thisKey, req)
+		if !found {
+			t.Fatal("Mode ", mode, " should have cached the response")
+		}
+		isRaw := string(cached.Body) == `{"name": "world"}` && cached.Response.Header.Get("X-Upstream") == "1" && cached.Response.Header.Get("X-Injected") == ""
+		if isRaw != (mode == CACHE_RESPONSE_CHAIN_REPLAY) {
+			t.Error("Mode ", mode, " stored an unexpected response: ", string(cached.Body), cached.Response.Header)
+		}
+
+		PurgeAPICache(m.Spec.APIID)
+	}
+}
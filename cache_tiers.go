@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Tiers of the response cache, a request that was looked up in the cache but not found is a miss
+	CACHE_TIER_MEMORY = "memory"
+	CACHE_TIER_REDIS  = "redis"
+	CACHE_TIER_MISS   = "miss"
+	// Cached responses above the compression threshold are stored in Redis gzipped, behind this prefix
+	CACHE_GZIP_PREFIX = "gzip:"
+	// Bookkeeping of a memory tier entry that is counted on top of the response
+	cacheMemoryEntryOverhead = 256
+)
+
+var (
+	cacheTiersLock sync.RWMutex
+	// The in-process tier of the response cache, nil when it is disabled
+	cacheMemory *CacheMemoryTier
+	// Responses larger than this are compressed in Redis, 0 turns compression off
+	cacheCompressThreshold int
+)
+
+// setupCacheTiers creates the memory tier and sets the compression threshold that have been configured in tyk.conf
+func setupCacheTiers() {
+	var memoryTier *CacheMemoryTier
+	if config.ResponseCache.MemoryTierSize > 0 {
+		log.Debug("Using a memory tier of ", config.ResponseCache.MemoryTierSize, " bytes for the response cache")
+		memoryTier = NewCacheMemoryTier(config.ResponseCache.MemoryTierSize)
+	}
+
+	setCacheTiers(memoryTier, config.ResponseCache.CompressThreshold)
+}
+
+func setCacheTiers(memoryTier *CacheMemoryTier, compressThreshold int) {
+	cacheTiersLock.Lock()
+	defer cacheTiersLock.Unlock()
+
+	cacheMemory = memoryTier
+	cacheCompressThreshold = compressThreshold
+}
+
+// getCacheMemoryTier returns the memory tier of the response cache, nil if it is disabled
+func getCacheMemoryTier() *CacheMemoryTier {
+	cacheTiersLock.RLock()
+	defer cacheTiersLock.RUnlock()
+
+	return cacheMemory
+}
+
+func getCacheCompressThreshold() int {
+	cacheTiersLock.RLock()
+	defer cacheTiersLock.RUnlock()
+
+	return cacheCompressThreshold
+}
+
+// cacheMemoryEntry holds either a parsed response or, for responses that vary by request headers, the names of
+// those headers
+type cacheMemoryEntry struct {
+	key         string
+	APIID       string
+	response    *cachedResponse
+	varyHeaders []string
+	expires     time.Time
+	size        int64
+}
+
+// CacheMemoryTier is a LRU of parsed cached responses in front of Redis, bounded by the bytes of the responses
+// it holds. Entries expire together with the Redis key they were stored as or read from.
+type CacheMemoryTier struct {
+	lock     sync.Mutex
+	maxBytes int64
+	bytes    int64
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+func NewCacheMemoryTier(maxBytes int64) *CacheMemoryTier {
+	return &CacheMemoryTier{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *CacheMemoryTier) get(key string, now time.Time) (*cacheMemoryEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+
+	thisEntry := element.Value.(*cacheMemoryEntry)
+	if !thisEntry.expires.IsZero() && !now.Before(thisEntry.expires) {
+		c.remove(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+
+	return thisEntry, true
+}
+
+// set adds an entry that expires after ttl seconds, the least recently used entries are evicted to make room
+// for it. Entries that are larger than the tier are not kept.
+func (c *CacheMemoryTier) set(thisEntry *cacheMemoryEntry, ttl int64) {
+	if ttl > 0 {
+		thisEntry.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, found := c.entries[thisEntry.key]; found {
+		c.remove(element)
+	}
+	if thisEntry.size > c.maxBytes {
+		return
+	}
+
+	c.entries[thisEntry.key] = c.order.PushFront(thisEntry)
+	c.bytes += thisEntry.size
+	for c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops an entry, the lock must be held
+func (c *CacheMemoryTier) remove(element *list.Element) {
+	thisEntry := c.order.Remove(element).(*cacheMemoryEntry)
+	delete(c.entries, thisEntry.key)
+	c.bytes -= thisEntry.size
+}
+
+// Delete removes entries by cache key
+func (c *CacheMemoryTier) Delete(keys []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, key := range keys {
+		if element, found := c.entries[key]; found {
+			c.remove(element)
+		}
+	}
+}
+
+// DeleteAPI removes all entries of an API and returns how many were removed
+func (c *CacheMemoryTier) DeleteAPI(APIID string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	removed := 0
+	for _, element := range c.entries {
+		if element.Value.(*cacheMemoryEntry).APIID == APIID {
+			c.remove(element)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// Stats returns the number of entries and the bytes they take up
+func (c *CacheMemoryTier) Stats() (int, int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.entries), c.bytes
+}
+
+// copy returns a cached response that can be changed without changing c, the body is shared as it is never
+// written to
+func (c *cachedResponse) copy() *cachedResponse {
+	res := new(http.Response)
+	*res = *c.Response
+	res.Header = make(http.Header)
+	copyHeader(res.Header, c.Response.Header)
+	res.Body = ioutil.NopCloser(bytes.NewReader(c.Body))
+	res.Request = nil
+
+	thisCopy := *c
+	thisCopy.Response = res
+	return &thisCopy
+}
+
+func newCacheMemoryResponse(APIID string, cached *cachedResponse) *cacheMemoryEntry {
+	size := int64(len(cached.Key) + len(cached.Body) + cacheMemoryEntryOverhead)
+	for name, values := range cached.Response.Header {
+		size += int64(len(name))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+
+	return &cacheMemoryEntry{key: cached.Key, APIID: APIID, response: cached.copy(), size: size}
+}
+
+func newCacheMemoryVary(APIID string, key string, varyHeaders []string) *cacheMemoryEntry {
+	size := int64(len(key) + cacheMemoryEntryOverhead)
+	for _, name := range varyHeaders {
+		size += int64(len(name))
+	}
+
+	return &cacheMemoryEntry{key: key, APIID: APIID, varyHeaders: varyHeaders, size: size}
+}
+
+// compressCachedResponse gzips a cached response that is larger than the configured threshold, it is left as
+// it is if that doesn't make it smaller
+func compressCachedResponse(blob string) string {
+	threshold := getCacheCompressThreshold()
+	if threshold <= 0 || len(blob) < threshold {
+		return blob
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(blob))
+	if err := gz.Close(); err != nil {
+		log.Error("Failed to compress cached response: ", err)
+		return blob
+	}
+	if len(CACHE_GZIP_PREFIX)+compressed.Len() >= len(blob) {
+		return blob
+	}
+
+	return CACHE_GZIP_PREFIX + compressed.String()
+}
+
+func decompressCachedResponse(blob string) (string, error) {
+	if !strings.HasPrefix(blob, CACHE_GZIP_PREFIX) {
+		return blob, nil
+	}
+
+	gz, err := gzip.NewReader(strings.NewReader(strings.TrimPrefix(blob, CACHE_GZIP_PREFIX)))
+	if err != nil {
+		return "", err
+	}
+	defer gz.Close()
+
+	decompressed, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return "", err
+	}
+
+	return string(decompressed), nil
+}
+
+// cachePurgeNotice tells the gateways which entries of an API to drop from their memory tier, all entries of
+// the API are dropped if no keys are listed
+type cachePurgeNotice struct {
+	APIID string   `json:"api_id"`
+	Keys  []string `json:"keys,omitempty"`
+}
+
+// notifyCachePurge drops purged responses from the memory tier of this gateway and of the others
+func notifyCachePurge(APIID string, keys []string) {
+	thisNotice := cachePurgeNotice{APIID: APIID, Keys: keys}
+	purgeCacheMemory(thisNotice)
+
+	asJSON, err := json.Marshal(thisNotice)
+	if err != nil {
+		log.Error("Failed to encode cache purge notification: ", err)
+		return
+	}
+	MainNotifier.Notify(Notification{Command: NoticeCachePurged, Payload: string(asJSON)})
+}
+
+func handleCachePurgeNotification(payload string) {
+	thisNotice := cachePurgeNotice{}
+	if err := json.Unmarshal([]byte(payload), &thisNotice); err != nil {
+		log.Error("Failed to decode cache purge notification: ", err)
+		return
+	}
+
+	purgeCacheMemory(thisNotice)
+}
+
+func purgeCacheMemory(thisNotice cachePurgeNotice) {
+	memoryTier := getCacheMemoryTier()
+	if memoryTier == nil {
+		return
+	}
+
+	if len(thisNotice.Keys) == 0 {
+		memoryTier.DeleteAPI(thisNotice.APIID)
+		return
+	}
+	memoryTier.Delete(thisNotice.Keys)
+}
+
+// CacheTierStats are the hits and misses per second of a tier of the response cache, the memory tier also
+// reports its size on the gateway that answered
+type CacheTierStats struct {
+	Tier     string  `json:"tier"`
+	HitsPS   float64 `json:"hits_per_second"`
+	MissesPS float64 `json:"misses_per_second"`
+	HitRatio float64 `json:"hit_ratio"`
+	Entries  int     `json:"entries,omitempty"`
+	Bytes    int64   `json:"bytes,omitempty"`
+}
+
+func newCacheTierStats(tier string, hitsPS float64, missesPS float64) CacheTierStats {
+	thisStats := CacheTierStats{Tier: tier, HitsPS: hitsPS, MissesPS: missesPS}
+	if hitsPS+missesPS > 0 {
+		thisStats.HitRatio = roundValue(hitsPS / (hitsPS + missesPS))
+	}
+
+	return thisStats
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMemoryEntry(APIID string, key string, body string) *cacheMemoryEntry {
+	res := &http.Response{StatusCode: 200, Header: make(http.Header)}
+	return newCacheMemoryResponse(APIID, &cachedResponse{Key: key, Response: res, Body: []byte(body)})
+}
+
+func TestCacheMemoryTier(t *testing.T) {
+	body := strings.Repeat("x", 1000)
+	entrySize := newTestMemoryEntry("api", "a", body).size
+	tier := NewCacheMemoryTier(3 * entrySize)
+
+	tier.set(newTestMemoryEntry("api", "a", body), 60)
+	tier.set(newTestMemoryEntry("api", "b", body), 60)
+	tier.set(newTestMemoryEntry("other", "c", body), 60)
+	// a is used, so b is the least recently used entry
+	if _, found := tier.get("a", time.Now()); !found {
+		t.Fatal("Entry should be found")
+	}
+	tier.set(newTestMemoryEntry("api", "d", body), 60)
+	if _, found := tier.get("b", time.Now()); found {
+		t.Error("Least recently used entry should be evicted")
+	}
+	if entries, size := tier.Stats(); entries != 3 || size != 3*entrySize {
+		t.Error("Tier should be full: ", entries, size)
+	}
+
+	// Returned responses can't change the cached one
+	thisEntry, _ := tier.get("a", time.Now())
+	thisEntry.response.copy().Response.Header.Set("X-Changed", "1")
+	if thisEntry.response.Response.Header.Get("X-Changed") != "" {
+		t.Error("Copies should not share headers")
+	}
+
+	// Entries expire with their TTL
+	if _, found := tier.get("d", time.Now().Add(61*time.Second)); found {
+		t.Error("Expired entry should not be found")
+	}
+
+	// Entries larger than the tier are not kept
+	tier.set(newTestMemoryEntry("api", "big", strings.Repeat("x", int(4*entrySize))), 60)
+	if _, found := tier.get("big", time.Now()); found {
+		t.Error("Entry larger than the tier should not be kept")
+	}
+
+	if removed := tier.DeleteAPI("api"); removed != 1 {
+		t.Error("Expected one entry of the API to be removed, got: ", removed)
+	}
+	tier.Delete([]string{"c"})
+	if entries, size := tier.Stats(); entries != 0 || size != 0 {
+		t.Error("Tier should be empty: ", entries, size)
+	}
+}
+
+func TestCacheCompression(t *testing.T) {
+	setCacheTiers(nil, 100)
+	defer setCacheTiers(nil, 0)
+
+	large := "HTTP/1.1 200 OK\r\n\r\n" + strings.Repeat("compressible ", 100)
+	compressed := compressCachedResponse(large)
+	if !strings.HasPrefix(compressed, CACHE_GZIP_PREFIX) || len(compressed) >= len(large) {
+		t.Fatal("Large responses should be compressed")
+	}
+	if decompressed, err := decompressCachedResponse(compressed); err != nil || decompressed != large {
+		t.Error("Decompressed response should match: ", err)
+	}
+
+	small := "HTTP/1.1 200 OK\r\n\r\nsmall"
+	if compressCachedResponse(small) != small {
+		t.Error("Responses below the threshold should be stored as they are")
+	}
+	if decompressed, _ := decompressCachedResponse(small); decompressed != small {
+		t.Error("Uncompressed responses should be read as they are")
+	}
+}
+
+func TestCacheTiers(t *testing.T) {
+	memoryTier := NewCacheMemoryTier(1 << 20)
+	setCacheTiers(memoryTier, 512)
+	defer setCacheTiers(nil, 0)
+	enableHealthChecks := config.HealthCheck.EnableHealthChecks
+	config.HealthCheck.EnableHealthChecks = true
+	defer func() { config.HealthCheck.EnableHealthChecks = enableHealthChecks }()
+
+	body := strings.Repeat("a large response ", 100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+
+	proxy, spec := createTestProxyWithDefinition(createTestDefinition("cache-tiers-test", cacheTestOptions, `"use_extended_paths": true, "extended_paths": {"cache": ["/resource"]},`), upstream.URL)
+	m := &RedisCacheMiddleware{TykMiddleware: &TykMiddleware{Spec: spec, Proxy: proxy}, CacheStore: getCacheStore(spec.APIID)}
+	m.New()
+	defer PurgeAPICache(m.Spec.APIID)
+	healthChecker := &DefaultHealthChecker{APIID: m.Spec.APIID}
+	healthChecker.Init(&RedisClusterStorageManager{KeyPrefix: "apihealth."})
+	m.Spec.Health = healthChecker
+
+	req := cacheRefreshTestRequest()
+	thisKey := m.CreateCheckSum(req, "10.0.0.1", m.KeyConfig.GetRule(req), nil)
+	lookup := func(expectedTier string) {
+		cached, tier, found := m.getCachedResponse(thisKey, cacheRefreshTestRequest())
+		if tier != expectedTier {
+			t.Fatal("Expected tier ", expectedTier, " got: ", tier)
+		}
+		if found && string(cached.Body) != body {
+			t.Fatal("Cached body should match: ", string(cached.Body))
+		}
+	}
+
+	lookup(CACHE_TIER_MISS)
+	m.ProcessRequest(httptest.NewRecorder(), cacheRefreshTestRequest(), nil)
+	waitForCacheEntry(t, m, body)
+	lookup(CACHE_TIER_MEMORY)
+	m.ProcessRequest(httptest.NewRecorder(), cacheRefreshTestRequest(), nil)
+
+	// Redis holds the compressed response, the memory tier is filled from it
+	if blob, _ := m.CacheStore.GetKey(thisKey); !strings.HasPrefix(blob, CACHE_GZIP_PREFIX) {
+		t.Error("Large response should be compressed in Redis")
+	}
+	memoryTier.DeleteAPI(m.Spec.APIID)
+	lookup(CACHE_TIER_REDIS)
+	lookup(CACHE_TIER_MEMORY)
+
+	// Other gateways drop purged responses when they are notified
+	notice, _ := json.Marshal(Notification{Command: NoticeCachePurged, Payload: `{"api_id": "` + m.Spec.APIID + `"}`})
+	HandleRedisReloadMsg(redis.Message{Data: notice})
+	if entries, _ := memoryTier.Stats(); entries != 0 {
+		t.Error("Notification should purge the memory tier, entries left: ", entries)
+	}
+	lookup(CACHE_TIER_REDIS)
+
+	// Purges clear both tiers
+	if purged, _ := PurgeCacheByPath(m.Spec.APIID, "/resource"); purged != 1 {
+		t.Error("Expected one purged response, got: ", purged)
+	}
+	lookup(CACHE_TIER_MISS)
+
+	// Hits and misses are reported per tier
+	var health HealthCheckValues
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if health, _ = m.Spec.Health.GetApiHealthValues(); len(health.CacheTiers) == 2 && health.CacheTiers[0].HitsPS > 0 {
+			break
+		}
+	}
+	if len(health.CacheTiers) != 2 || health.CacheTiers[0].Tier != CACHE_TIER_MEMORY || health.CacheTiers[0].HitsPS == 0 || health.CacheTiers[1].MissesPS == 0 {
+		t.Error("Expected hits and misses per tier, got: ", health.CacheTiers)
+	}
+}
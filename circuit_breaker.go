@@ -0,0 +1,617 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/lonelycode/tykcommon"
+	"github.com/mitchellh/mapstructure"
+	"github.com/rubyist/circuitbreaker"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BREAKER_CLOSED    string = "closed"
+	BREAKER_OPEN      string = "open"
+	BREAKER_HALF_OPEN string = "half-open"
+
+	BREAKER_KEYPREFIX string = "circuit-breaker."
+)
+
+// CircuitBreakerOptions are read from the same circuit_breakers entry of the extended paths as the threshold
+// and sample size. Samples is the number of recent results the failure rate is calculated over, the breaker
+// can't trip before MinRequests of them have been recorded.
+type CircuitBreakerOptions struct {
+	FailureStatusCodes []int `mapstructure:"failure_status_codes" bson:"failure_status_codes" json:"failure_status_codes"`
+	IgnoreTimeouts     bool  `mapstructure:"ignore_timeouts" bson:"ignore_timeouts" json:"ignore_timeouts"`
+	MinRequests        int64 `mapstructure:"min_requests" bson:"min_requests" json:"min_requests"`
+	HalfOpenProbes     int   `mapstructure:"half_open_probes" bson:"half_open_probes" json:"half_open_probes"`
+	ShareState         bool  `mapstructure:"share_state" bson:"share_state" json:"share_state"`
+}
+
+// getCircuitBreakerOptions finds the raw circuit_breakers entry of a version, tykcommon drops the fields
+// it does not know about so they have to be decoded from the raw definition
+func getCircuitBreakerOptions(spec *APISpec, versionName string, i int) CircuitBreakerOptions {
+	thisOptions := CircuitBreakerOptions{}
+
+	versionData, _ := spec.APIDefinition.RawData["version_data"].(map[string]interface{})
+	versions, _ := versionData["versions"].(map[string]interface{})
+	for _, rawVersion := range versions {
+		thisVersion, _ := rawVersion.(map[string]interface{})
+		if thisVersion == nil || thisVersion["name"] != versionName {
+			continue
+		}
+
+		extendedPaths, _ := thisVersion["extended_paths"].(map[string]interface{})
+		breakers, _ := extendedPaths["circuit_breakers"].([]interface{})
+		if i < len(breakers) {
+			if err := mapstructure.Decode(breakers[i], &thisOptions); err != nil {
+				log.Error("Failed to decode circuit breaker options: ", err)
+			}
+		}
+		break
+	}
+
+	return thisOptions
+}
+
+func (o CircuitBreakerOptions) withDefaults(samples int64) CircuitBreakerOptions {
+	if len(o.FailureStatusCodes) == 0 {
+		o.FailureStatusCodes = []int{500}
+	}
+	if o.MinRequests <= 0 {
+		o.MinRequests = samples
+	}
+	if o.HalfOpenProbes <= 0 {
+		o.HalfOpenProbes = 1
+	}
+
+	return o
+}
+
+// CircuitBreakerStatus is returned by the breakers endpoint
+type CircuitBreakerStatus struct {
+	ID         string     `json:"id"`
+	APIID      string     `json:"api_id"`
+	Version    string     `json:"version"`
+	Path       string     `json:"path"`
+	Method     string     `json:"method"`
+	State      string     `json:"state"`
+	Held       bool       `json:"held"`
+	Requests   int64      `json:"requests"`
+	Failures   int64      `json:"failures"`
+	OpenedAt   *time.Time `json:"opened_at,omitempty"`
+	ShareState bool       `json:"share_state"`
+}
+
+type sharedBreakerState struct {
+	APIID     string `json:"api_id"`
+	BreakerID string `json:"breaker_id"`
+	State     string `json:"state"`
+	Held      bool   `json:"held"`
+	OpenedAt  int64  `json:"opened_at"`
+}
+
+// PathCircuitBreaker stops requests to a path once the share of failures in its recent results goes over the
+// threshold. After ReturnToServiceAfter seconds it lets HalfOpenProbes requests through, the breaker closes if
+// all of them succeed and opens again on the first failure. A breaker tripped through the API is held open
+// until it is reset.
+type PathCircuitBreaker struct {
+	ID                   string
+	APIID                string
+	Version              string
+	Path                 string
+	Method               string
+	ThresholdPercent     float64
+	Samples              int64
+	ReturnToServiceAfter int
+	Options              CircuitBreakerOptions
+
+	lock           sync.Mutex
+	state          string
+	held           bool
+	openedAt       time.Time
+	results        []bool
+	next           int
+	failures       int64
+	probes         int
+	probeSuccesses int
+
+	spec  *APISpec
+	store *RedisClusterStorageManager
+}
+
+func getCircuitBreakerID(version string, meta tykcommon.CircuitBreakerMeta) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(version+"."+meta.Method+"."+meta.Path)))
+}
+
+// NewPathCircuitBreaker creates the breaker of a path, breakers that share their state load it from Redis so
+// that a reload does not close a breaker that is open on the rest of the cluster
+func NewPathCircuitBreaker(spec *APISpec, version string, meta tykcommon.CircuitBreakerMeta, options CircuitBreakerOptions) *PathCircuitBreaker {
+	cb := &PathCircuitBreaker{
+		ID:                   getCircuitBreakerID(version, meta),
+		APIID:                spec.APIID,
+		Version:              version,
+		Path:                 meta.Path,
+		Method:               meta.Method,
+		ThresholdPercent:     meta.ThresholdPercent,
+		Samples:              meta.Samples,
+		ReturnToServiceAfter: meta.ReturnToServiceAfter,
+		Options:              options.withDefaults(meta.Samples),
+		state:                BREAKER_CLOSED,
+		spec:                 spec,
+	}
+
+	if cb.Samples > 0 {
+		cb.results = make([]bool, 0, cb.Samples)
+	}
+
+	return cb
+}
+
+// loadSharedState connects to Redis and applies the last state that was published for the breaker
+func (cb *PathCircuitBreaker) loadSharedState() {
+	if !cb.Options.ShareState {
+		return
+	}
+
+	cb.store = &RedisClusterStorageManager{KeyPrefix: BREAKER_KEYPREFIX}
+	cb.store.Connect()
+
+	rawState, err := cb.store.GetKey(cb.sharedStateKey())
+	if err != nil {
+		return
+	}
+
+	thisState := sharedBreakerState{}
+	if err := json.Unmarshal([]byte(rawState), &thisState); err != nil {
+		log.Error("Failed to decode shared circuit breaker state: ", err)
+		return
+	}
+	cb.applySharedState(thisState)
+}
+
+func (cb *PathCircuitBreaker) sharedStateKey() string {
+	return cb.APIID + "." + cb.ID
+}
+
+// Ready checks if a request may be sent upstream, an open breaker switches to half-open once its
+// return to service period is over
+func (cb *PathCircuitBreaker) Ready() bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if cb.state == BREAKER_OPEN && !cb.held && cb.ReturnToServiceAfter > 0 &&
+		time.Since(cb.openedAt) >= time.Duration(cb.ReturnToServiceAfter)*time.Second {
+		log.Debug("[PROXY] [CIRCUIT BREAKER] Breaker half-open for path: ", cb.Path)
+		cb.state = BREAKER_HALF_OPEN
+		cb.probes = 0
+		cb.probeSuccesses = 0
+	}
+
+	switch cb.state {
+	case BREAKER_CLOSED:
+		return true
+	case BREAKER_HALF_OPEN:
+		if cb.probes < cb.Options.HalfOpenProbes {
+			cb.probes++
+			return true
+		}
+	}
+
+	return false
+}
+
+func isTimeoutError(err error) bool {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+
+	return strings.Contains(err.Error(), "timeout awaiting response headers")
+}
+
+// IsFailure classifies the result of an upstream request, counted is false for results the breaker ignores
+func (cb *PathCircuitBreaker) IsFailure(res *http.Response, err error) (failure bool, counted bool) {
+	if err != nil {
+		// The client sent too much, that says nothing about the upstream
+		if isRequestBodyTooLarge(err) {
+			return false, false
+		}
+		if cb.Options.IgnoreTimeouts && isTimeoutError(err) {
+			return false, false
+		}
+		return true, true
+	}
+
+	for _, code := range cb.Options.FailureStatusCodes {
+		if res.StatusCode == code {
+			return true, true
+		}
+	}
+
+	return false, true
+}
+
+// Record adds the result of an upstream request that was let through by Ready
+func (cb *PathCircuitBreaker) Record(res *http.Response, err error) {
+	failure, counted := cb.IsFailure(res, err)
+	if !counted {
+		cb.lock.Lock()
+		if cb.state == BREAKER_HALF_OPEN && cb.probes > 0 {
+			// Give the probe slot back so that another request can decide
+			cb.probes--
+		}
+		cb.lock.Unlock()
+		return
+	}
+
+	if failure {
+		cb.Fail()
+	} else {
+		cb.Success()
+	}
+}
+
+func (cb *PathCircuitBreaker) Fail() {
+	cb.lock.Lock()
+
+	switch cb.state {
+	case BREAKER_HALF_OPEN:
+		cb.lock.Unlock()
+		cb.trip(false, "Probe request failed")
+		return
+	case BREAKER_CLOSED:
+		cb.addResult(true)
+		if cb.shouldTrip() {
+			cb.lock.Unlock()
+			cb.trip(false, "Breaker Tripped")
+			return
+		}
+	}
+
+	cb.lock.Unlock()
+}
+
+func (cb *PathCircuitBreaker) Success() {
+	cb.lock.Lock()
+
+	switch cb.state {
+	case BREAKER_HALF_OPEN:
+		cb.probeSuccesses++
+		if cb.probeSuccesses >= cb.Options.HalfOpenProbes {
+			cb.lock.Unlock()
+			cb.reset(false, "Breaker Reset")
+			return
+		}
+	case BREAKER_CLOSED:
+		// The minimum volume may only be reached now
+		cb.addResult(false)
+		if cb.shouldTrip() {
+			cb.lock.Unlock()
+			cb.trip(false, "Breaker Tripped")
+			return
+		}
+	}
+
+	cb.lock.Unlock()
+}
+
+// addResult keeps the last Samples results, the caller holds the lock
+func (cb *PathCircuitBreaker) addResult(failure bool) {
+	if cb.Samples <= 0 {
+		return
+	}
+
+	if int64(len(cb.results)) < cb.Samples {
+		cb.results = append(cb.results, failure)
+	} else {
+		if cb.results[cb.next] {
+			cb.failures--
+		}
+		cb.results[cb.next] = failure
+		cb.next = (cb.next + 1) % len(cb.results)
+	}
+
+	if failure {
+		cb.failures++
+	}
+}
+
+func (cb *PathCircuitBreaker) shouldTrip() bool {
+	total := int64(len(cb.results))
+	if total == 0 || total < cb.Options.MinRequests {
+		return false
+	}
+
+	return float64(cb.failures)/float64(total) >= cb.ThresholdPercent
+}
+
+func (cb *PathCircuitBreaker) clearResults() {
+	cb.results = cb.results[:0]
+	cb.next = 0
+	cb.failures = 0
+}
+
+// Trip opens the breaker and holds it open until it is reset
+func (cb *PathCircuitBreaker) Trip() {
+	cb.trip(true, "Breaker Tripped manually")
+}
+
+// Reset closes the breaker
+func (cb *PathCircuitBreaker) Reset() {
+	cb.reset(true, "Breaker Reset manually")
+}
+
+func (cb *PathCircuitBreaker) trip(held bool, message string) {
+	cb.lock.Lock()
+	cb.state = BREAKER_OPEN
+	cb.held = held
+	cb.openedAt = time.Now()
+	cb.clearResults()
+	cb.lock.Unlock()
+
+	log.Warning("[PROXY] [CIRCUIT BREAKER] Breaker tripped for path: ", cb.Path)
+	cb.publishState()
+
+	if cb.spec == nil {
+		return
+	}
+
+	if cb.spec.Proxy.ServiceDiscovery.UseDiscoveryService {
+		log.Warning("[PROXY] [CIRCUIT BREAKER] Refreshing host list")
+		refreshDiscoveryTargets(cb.spec.APIID)
+	}
+
+	cb.spec.FireEvent(EVENT_BreakerTriggered,
+		EVENT_CurcuitBreakerMeta{
+			EventMetaDefault: EventMetaDefault{Message: message},
+			CircuitEvent:     circuit.BreakerTripped,
+			Path:             cb.Path,
+			APIID:            cb.APIID,
+		})
+}
+
+func (cb *PathCircuitBreaker) reset(manual bool, message string) {
+	cb.lock.Lock()
+	wasClosed := cb.state == BREAKER_CLOSED
+	cb.state = BREAKER_CLOSED
+	cb.held = false
+	cb.clearResults()
+	cb.lock.Unlock()
+
+	if wasClosed && !manual {
+		return
+	}
+
+	log.Info("[PROXY] [CIRCUIT BREAKER] Breaker reset for path: ", cb.Path)
+	cb.publishState()
+
+	if cb.spec == nil {
+		return
+	}
+
+	cb.spec.FireEvent(EVENT_BreakerReset,
+		EVENT_CurcuitBreakerMeta{
+			EventMetaDefault: EventMetaDefault{Message: message},
+			CircuitEvent:     circuit.BreakerReset,
+			Path:             cb.Path,
+			APIID:            cb.APIID,
+		})
+}
+
+// publishState stores the state of a shared breaker and tells the other nodes about it
+func (cb *PathCircuitBreaker) publishState() {
+	if cb.store == nil {
+		return
+	}
+
+	cb.lock.Lock()
+	thisState := sharedBreakerState{
+		APIID:     cb.APIID,
+		BreakerID: cb.ID,
+		State:     cb.state,
+		Held:      cb.held,
+		OpenedAt:  cb.openedAt.UnixNano(),
+	}
+	cb.lock.Unlock()
+
+	asJSON, _ := json.Marshal(thisState)
+	cb.store.SetKey(cb.sharedStateKey(), string(asJSON), 0)
+	MainNotifier.Notify(Notification{Command: NoticeBreakerChanged, Payload: string(asJSON)})
+}
+
+// applySharedState takes over a state published by another node, events are only fired by the node
+// where the change happened
+func (cb *PathCircuitBreaker) applySharedState(thisState sharedBreakerState) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	switch thisState.State {
+	case BREAKER_OPEN:
+		openedAt := time.Unix(0, thisState.OpenedAt)
+		if cb.state == BREAKER_OPEN && cb.openedAt.Equal(openedAt) {
+			return
+		}
+		cb.state = BREAKER_OPEN
+		cb.held = thisState.Held
+		cb.openedAt = openedAt
+		cb.clearResults()
+	case BREAKER_CLOSED:
+		if cb.state != BREAKER_CLOSED {
+			cb.state = BREAKER_CLOSED
+			cb.held = false
+			cb.clearResults()
+		}
+	}
+}
+
+func (cb *PathCircuitBreaker) Status() CircuitBreakerStatus {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	thisStatus := CircuitBreakerStatus{
+		ID:         cb.ID,
+		APIID:      cb.APIID,
+		Version:    cb.Version,
+		Path:       cb.Path,
+		Method:     cb.Method,
+		State:      cb.state,
+		Held:       cb.held,
+		Requests:   int64(len(cb.results)),
+		Failures:   cb.failures,
+		ShareState: cb.Options.ShareState,
+	}
+
+	if cb.state != BREAKER_CLOSED {
+		openedAt := cb.openedAt
+		thisStatus.OpenedAt = &openedAt
+	}
+
+	return thisStatus
+}
+
+// GetCircuitBreakers returns the breakers of every version of an API
+func GetCircuitBreakers(spec *APISpec) []*PathCircuitBreaker {
+	breakers := []*PathCircuitBreaker{}
+	for _, pathSpecs := range spec.RxPaths {
+		for i, _ := range pathSpecs {
+			if pathSpecs[i].Status == CircuitBreaker && pathSpecs[i].CircuitBreaker.CB != nil {
+				breakers = append(breakers, pathSpecs[i].CircuitBreaker.CB)
+			}
+		}
+	}
+
+	sort.Slice(breakers, func(i, j int) bool { return breakers[i].ID < breakers[j].ID })
+	return breakers
+}
+
+func getCircuitBreaker(APIID string, breakerID string) *PathCircuitBreaker {
+	thisSpec := GetSpecForApi(APIID)
+	if thisSpec == nil {
+		return nil
+	}
+
+	for _, thisBreaker := range GetCircuitBreakers(thisSpec) {
+		if thisBreaker.ID == breakerID {
+			return thisBreaker
+		}
+	}
+
+	return nil
+}
+
+// handleBreakerNotification applies a breaker state change that was published by another node
+func handleBreakerNotification(payload string) {
+	thisState := sharedBreakerState{}
+	if err := json.Unmarshal([]byte(payload), &thisState); err != nil {
+		log.Error("Failed to decode circuit breaker notification: ", err)
+		return
+	}
+
+	if thisBreaker := getCircuitBreaker(thisState.APIID, thisState.BreakerID); thisBreaker != nil {
+		thisBreaker.applySharedState(thisState)
+	}
+}
+
+// breakersHandler lists breakers with GET /tyk/breakers and GET /tyk/breakers/{api_id}, shows one with
+// GET /tyk/breakers/{api_id}/{breaker_id} and changes its state with POST /tyk/breakers/{api_id}/{breaker_id}/reset
+// or /trip
+func breakersHandler(w http.ResponseWriter, r *http.Request) {
+	thisToken := GetAdminTokenFromRequest(r)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/tyk/breakers"), "/"), "/")
+	if parts[0] == "" {
+		parts = []string{}
+	}
+
+	if len(parts) == 0 {
+		if r.Method != "GET" {
+			DoJSONWrite(w, 405, createError("Method not supported"))
+			return
+		}
+
+		statuses := []CircuitBreakerStatus{}
+		for _, thisSpec := range ApiSpecRegister {
+			if !thisToken.CanAccessOrg(thisSpec.OrgID) {
+				continue
+			}
+			for _, thisBreaker := range GetCircuitBreakers(thisSpec) {
+				statuses = append(statuses, thisBreaker.Status())
+			}
+		}
+
+		sort.Slice(statuses, func(i, j int) bool {
+			if statuses[i].APIID != statuses[j].APIID {
+				return statuses[i].APIID < statuses[j].APIID
+			}
+			return statuses[i].ID < statuses[j].ID
+		})
+		responseMessage, _ := json.Marshal(statuses)
+		DoJSONWrite(w, 200, responseMessage)
+		return
+	}
+
+	APIID := parts[0]
+	thisSpec := GetSpecForApi(APIID)
+	if thisSpec == nil || !thisToken.CanAccessAPI(APIID) {
+		DoJSONWrite(w, 404, createError("API ID not found"))
+		return
+	}
+
+	if len(parts) == 1 {
+		if r.Method != "GET" {
+			DoJSONWrite(w, 405, createError("Method not supported"))
+			return
+		}
+
+		statuses := []CircuitBreakerStatus{}
+		for _, thisBreaker := range GetCircuitBreakers(thisSpec) {
+			statuses = append(statuses, thisBreaker.Status())
+		}
+		responseMessage, _ := json.Marshal(statuses)
+		DoJSONWrite(w, 200, responseMessage)
+		return
+	}
+
+	thisBreaker := getCircuitBreaker(APIID, parts[1])
+	if thisBreaker == nil || len(parts) > 3 {
+		DoJSONWrite(w, 404, createError("Circuit breaker not found"))
+		return
+	}
+
+	if len(parts) == 2 {
+		if r.Method != "GET" {
+			DoJSONWrite(w, 405, createError("Method not supported"))
+			return
+		}
+		responseMessage, _ := json.Marshal(thisBreaker.Status())
+		DoJSONWrite(w, 200, responseMessage)
+		return
+	}
+
+	if r.Method != "POST" {
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	before := thisBreaker.Status()
+	switch parts[2] {
+	case "reset":
+		thisBreaker.Reset()
+	case "trip":
+		thisBreaker.Trip()
+	default:
+		DoJSONWrite(w, 404, createError("Unknown action, use reset or trip"))
+		return
+	}
+
+	after := thisBreaker.Status()
+	RecordAuditEvent(r, parts[2], AuditObjectBreaker, APIID+"/"+thisBreaker.ID, thisSpec.OrgID, before, after)
+
+	responseMessage, _ := json.Marshal(after)
+	DoJSONWrite(w, 200, responseMessage)
+}
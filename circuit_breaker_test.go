@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/lonelycode/tykcommon"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const breakerTestPaths = `"use_extended_paths": true,
+					"extended_paths": {
+						"circuit_breakers": [{
+							"path": "/flaky",
+							"method": "GET",
+							"threshold_percent": 0.5,
+							"samples": 4,
+							"return_to_service_after": 60,
+							"failure_status_codes": [502, 503],
+							"min_requests": 2,
+							"half_open_probes": 2
+						}]
+					},`
+
+func newTestBreaker(options CircuitBreakerOptions) *PathCircuitBreaker {
+	meta := tykcommon.CircuitBreakerMeta{Path: "/test", Method: "GET", ThresholdPercent: 0.5, Samples: 4, ReturnToServiceAfter: 1}
+	return NewPathCircuitBreaker(&APISpec{}, "Default", meta, options)
+}
+
+func TestCircuitBreakerClassification(t *testing.T) {
+	cb := newTestBreaker(CircuitBreakerOptions{FailureStatusCodes: []int{503}, IgnoreTimeouts: true})
+
+	for i := 0; i < 4; i++ {
+		cb.Record(&http.Response{StatusCode: 500}, nil)
+	}
+	cb.Record(nil, errors.New("net/http: timeout awaiting response headers"))
+	if !cb.Ready() {
+		t.Fatal("Status codes that are not configured and ignored timeouts should not trip the breaker")
+	}
+
+	if failure, counted := cb.IsFailure(&http.Response{StatusCode: 503}, nil); !failure || !counted {
+		t.Error("Configured status code should be a failure")
+	}
+	if failure, _ := cb.IsFailure(nil, errors.New("connection refused")); !failure {
+		t.Error("Transport errors should always be failures")
+	}
+}
+
+func TestCircuitBreakerMinimumVolume(t *testing.T) {
+	cb := newTestBreaker(CircuitBreakerOptions{MinRequests: 3})
+
+	cb.Fail()
+	cb.Fail()
+	if cb.Status().State != BREAKER_CLOSED {
+		t.Fatal("Breaker tripped before the minimum volume was reached")
+	}
+
+	cb.Success()
+	if cb.Status().State != BREAKER_OPEN {
+		t.Fatal("Breaker should trip once the minimum volume is reached: ", cb.Status())
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	cb := newTestBreaker(CircuitBreakerOptions{HalfOpenProbes: 2})
+	cb.trip(false, "test")
+
+	if cb.Ready() {
+		t.Fatal("Open breaker should not let requests through")
+	}
+
+	cb.openedAt = time.Now().Add(-2 * time.Second)
+	if !cb.Ready() || !cb.Ready() || cb.Ready() {
+		t.Fatal("Half-open breaker should let exactly two probes through")
+	}
+
+	cb.Success()
+	cb.Fail()
+	if cb.Status().State != BREAKER_OPEN {
+		t.Fatal("A failed probe should open the breaker again")
+	}
+
+	cb.openedAt = time.Now().Add(-2 * time.Second)
+	cb.Ready()
+	cb.Ready()
+	cb.Success()
+	if cb.Status().State != BREAKER_HALF_OPEN {
+		t.Fatal("Breaker should wait for every probe")
+	}
+	cb.Success()
+	if cb.Status().State != BREAKER_CLOSED {
+		t.Fatal("Breaker should close when all probes succeed")
+	}
+
+	// A manual trip is not lifted by the return to service period
+	cb.Trip()
+	cb.openedAt = time.Now().Add(-2 * time.Second)
+	if cb.Ready() {
+		t.Error("Manually tripped breaker should stay open")
+	}
+}
+
+func TestCircuitBreakerSharedState(t *testing.T) {
+	options := CircuitBreakerOptions{ShareState: true}
+	first := newTestBreaker(options)
+	first.APIID = "shared-breaker-test"
+	first.loadSharedState()
+	first.Trip()
+	defer first.store.DeleteKey(first.sharedStateKey())
+
+	second := newTestBreaker(options)
+	second.APIID = "shared-breaker-test"
+	second.loadSharedState()
+	if thisStatus := second.Status(); thisStatus.State != BREAKER_OPEN || !thisStatus.Held {
+		t.Fatal("Breaker should load the shared state: ", thisStatus)
+	}
+
+	second.applySharedState(sharedBreakerState{State: BREAKER_CLOSED})
+	if second.Status().State != BREAKER_CLOSED {
+		t.Error("Breaker should close when the shared state is closed")
+	}
+}
+
+func TestCircuitBreakerProxy(t *testing.T) {
+	var status int32 = 503
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer upstream.Close()
+
+	proxy, spec := createTestProxyWithFields("", breakerTestPaths, upstream.URL)
+	ApiSpecRegister = map[string]*APISpec{spec.APIID: spec}
+	defer func() { ApiSpecRegister = make(map[string]*APISpec) }()
+
+	events := make(chan EventMessage, 4)
+	spec.EventPaths[EVENT_BreakerTriggered] = []TykEventHandler{testHostEventHandler{events}}
+	spec.EventPaths[EVENT_BreakerReset] = []TykEventHandler{testHostEventHandler{events}}
+
+	sendRequest := func() int {
+		req, _ := http.NewRequest("GET", "/flaky", nil)
+		req.Header.Set("version", "Default")
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	sendRequest()
+	sendRequest()
+	waitForHostEvent(t, events, EVENT_BreakerTriggered)
+	if code := sendRequest(); code != 503 {
+		t.Fatal("Open breaker should answer with a 503, got: ", code)
+	}
+
+	breakers := GetCircuitBreakers(spec)
+	if len(breakers) != 1 {
+		t.Fatal("Expected one breaker, got: ", len(breakers))
+	}
+
+	callBreakersEndpoint := func(method, uri string) []byte {
+		req, _ := http.NewRequest(method, uri, nil)
+		req.Header.Set("x-tyk-authorization", config.Secret)
+		recorder := httptest.NewRecorder()
+		CheckAdminScope(AdminScopeBreakers, breakersHandler)(recorder, req)
+		if recorder.Code != 200 {
+			t.Fatal("Breakers endpoint failed: ", recorder.Code, recorder.Body.String())
+		}
+		return recorder.Body.Bytes()
+	}
+
+	statuses := []CircuitBreakerStatus{}
+	json.Unmarshal(callBreakersEndpoint("GET", "/tyk/breakers"), &statuses)
+	if len(statuses) != 1 || statuses[0].State != BREAKER_OPEN || statuses[0].Path != "/flaky" {
+		t.Fatal("Breaker not listed: ", statuses)
+	}
+
+	atomic.StoreInt32(&status, 200)
+	thisStatus := CircuitBreakerStatus{}
+	json.Unmarshal(callBreakersEndpoint("POST", "/tyk/breakers/"+spec.APIID+"/"+breakers[0].ID+"/reset"), &thisStatus)
+	if thisStatus.State != BREAKER_CLOSED {
+		t.Fatal("Breaker was not reset: ", thisStatus)
+	}
+	waitForHostEvent(t, events, EVENT_BreakerReset)
+
+	if code := sendRequest(); code != 200 {
+		t.Error("Request should be proxied once the breaker is reset, got: ", code)
+	}
+
+	// State published by another node is applied without a reload
+	openState, _ := json.Marshal(sharedBreakerState{APIID: spec.APIID, BreakerID: breakers[0].ID, State: BREAKER_OPEN, OpenedAt: time.Now().UnixNano()})
+	handleBreakerNotification(string(openState))
+	if code := sendRequest(); code != 503 {
+		t.Error("Breaker should apply the state of other nodes, got: ", code)
+	}
+	breakers[0].applySharedState(sharedBreakerState{State: BREAKER_CLOSED})
+
+	json.Unmarshal(callBreakersEndpoint("POST", "/tyk/breakers/"+spec.APIID+"/"+breakers[0].ID+"/trip"), &thisStatus)
+	if code := sendRequest(); code != 503 || !thisStatus.Held {
+		t.Error("Manually tripped breaker should stop requests, got: ", code, thisStatus)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/lonelycode/go-uuid/uuid"
 	"github.com/lonelycode/tykcommon"
 	"io/ioutil"
+	"os"
 	"strings"
 )
 
@@ -18,6 +19,7 @@ var CommandModeOptions = map[string]bool{
 	"--as-mock":          true,
 	"--for-api":          true,
 	"--as-version":       true,
+	"--validate-api":     true,
 }
 
 // ./tyk --import-blueprint=blueprint.json --create-api --org-id=<id> --upstream-target="http://widgets.com/api/"`
@@ -31,6 +33,10 @@ func HandleCommandModeArgs(arguments map[string]interface{}) {
 		handleSwaggerMode(arguments)
 	}
 
+	if arguments["--validate-api"] != nil {
+		handleValidateAPIMode(arguments)
+	}
+
 }
 
 func handleBluePrintMode(arguments map[string]interface{}) {
@@ -101,6 +107,31 @@ func handleBluePrintMode(arguments map[string]interface{}) {
 	}
 }
 
+// ./tyk --validate-api=my_api.json --conf=tyk.conf
+func handleValidateAPIMode(arguments map[string]interface{}) {
+	// Command mode runs before the configuration is loaded, we need it for template and JS paths
+	if confFile := arguments["--conf"]; confFile != nil {
+		loadConfig(confFile.(string), &config)
+	}
+
+	defData, err := ioutil.ReadFile(arguments["--validate-api"].(string))
+	if err != nil {
+		log.Error("File load error: ", err)
+		os.Exit(1)
+	}
+
+	result := ValidateAPIDefinition(defData)
+	asJson, err := json.MarshalIndent(&result, "", "    ")
+	if err != nil {
+		log.Error("Marshalling failed: ", err)
+	}
+
+	fmt.Println(string(asJson))
+	if !result.Valid {
+		os.Exit(1)
+	}
+}
+
 func printDef(def *tykcommon.APIDefinition) {
 	asJson, err := json.MarshalIndent(def, "", "    ")
 	if err != nil {
@@ -99,6 +99,32 @@ type Config struct {
 		ForceSessionProvider bool                          `json:"force_session_provider"`
 		SessionProvider      tykcommon.SessionProviderMeta `json:"session_provider"`
 	} `json:"auth_override"`
+	AdminTokens []AdminToken `json:"admin_tokens"`
+	ControlAPI  struct {
+		ListenAddress string     `json:"listen_address"`
+		ListenPort    int        `json:"listen_port"`
+		UseSSL        bool       `json:"use_ssl"`
+		Certificates  []CertData `json:"certificates"`
+		ServerName    string     `json:"server_name"`
+		MinVersion    uint16     `json:"min_version"`
+	} `json:"control_api"`
+	AuditLog struct {
+		Enable          bool     `json:"enable"`
+		Type            string   `json:"type"`
+		FilePath        string   `json:"file_path"`
+		MongoURL        string   `json:"mongo_url"`
+		MongoCollection string   `json:"mongo_collection"`
+		TrustedProxies  []string `json:"trusted_proxies"`
+	} `json:"audit_log"`
+	APIHistory struct {
+		Enable bool   `json:"enable"`
+		Type   string `json:"type"`
+		Path   string `json:"path"`
+	} `json:"api_history"`
+	ResponseCache struct {
+		MemoryTierSize    int64 `json:"memory_tier_size"`
+		CompressThreshold int   `json:"compress_threshold"`
+	} `json:"response_cache"`
 }
 
 type CertData struct {
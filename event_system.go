@@ -28,6 +28,12 @@ const (
 	EVENT_OrgQuotaExceeded  tykcommon.TykEvent = "OrgQuotaExceeded"
 	EVENT_TriggerExceeded   tykcommon.TykEvent = "TriggerExceeded"
 	EVENT_BreakerTriggered  tykcommon.TykEvent = "BreakerTriggered"
+	EVENT_BreakerReset      tykcommon.TykEvent = "BreakerReset"
+	EVENT_HostDown          tykcommon.TykEvent = "HostDown"
+	EVENT_HostUp            tykcommon.TykEvent = "HostUp"
+
+	EVENT_DiscoveryTargetsChanged tykcommon.TykEvent = "ServiceDiscoveryTargetsChanged"
+	EVENT_DiscoveryUnreachable    tykcommon.TykEvent = "ServiceDiscoveryUnreachable"
 )
 
 // EventMetaDefault is a standard embedded struct to be used with custom event metadata types, gives an interface for
@@ -61,7 +67,7 @@ type EVENT_AuthFailureMeta struct {
 	Key    string
 }
 
-// EVENT_CurcuitBreakerMeta is the event status for a circuit breaker tripping
+// EVENT_CurcuitBreakerMeta is the event status for a circuit breaker tripping (EVENT_BreakerTriggered) or being reset (EVENT_BreakerReset)
 type EVENT_CurcuitBreakerMeta struct {
 	EventMetaDefault
 	Path         string
@@ -69,6 +75,23 @@ type EVENT_CurcuitBreakerMeta struct {
 	CircuitEvent circuit.BreakerEvent
 }
 
+// EVENT_HostStatusMeta is the metadata structure for an upstream host going down or coming back up (EVENT_HostDown, EVENT_HostUp)
+type EVENT_HostStatusMeta struct {
+	EventMetaDefault
+	HostInfo string
+	APIID    string
+}
+
+// EVENT_ServiceDiscoveryMeta is the metadata structure for the targets of an API changing (EVENT_DiscoveryTargetsChanged)
+// or discovery failing (EVENT_DiscoveryUnreachable), in which case Targets are the last known targets
+type EVENT_ServiceDiscoveryMeta struct {
+	EventMetaDefault
+	APIID           string
+	Provider        string
+	Targets         []string
+	PreviousTargets []string
+}
+
 // EVENT_KeyExpiredMeta is the metadata structure for an auth failure (EVENT_KeyExpired)
 type EVENT_KeyExpiredMeta struct {
 	EventMetaDefault
@@ -214,10 +237,20 @@ func (l LogMessageEventHandler) HandleEvent(em EventMessage) {
 		formattedMsgString = fmt.Sprintf("%s:%s:%s:%s", formattedMsgString, msgConf.Key, msgConf.Origin, msgConf.Path)
 	}
 
-	if em.EventType == EVENT_BreakerTriggered {
+	if em.EventType == EVENT_BreakerTriggered || em.EventType == EVENT_BreakerReset {
 		msgConf := em.EventMetaData.(EVENT_CurcuitBreakerMeta)
 		formattedMsgString = fmt.Sprintf("%s:%s:%s: [STATUS] %v", formattedMsgString, msgConf.APIID, msgConf.Path, msgConf.CircuitEvent)
 	}
 
+	if em.EventType == EVENT_HostDown || em.EventType == EVENT_HostUp {
+		msgConf := em.EventMetaData.(EVENT_HostStatusMeta)
+		formattedMsgString = fmt.Sprintf("%s:%s:%s", formattedMsgString, msgConf.APIID, msgConf.HostInfo)
+	}
+
+	if em.EventType == EVENT_DiscoveryTargetsChanged || em.EventType == EVENT_DiscoveryUnreachable {
+		msgConf := em.EventMetaData.(EVENT_ServiceDiscoveryMeta)
+		formattedMsgString = fmt.Sprintf("%s:%s:%s:%v", formattedMsgString, msgConf.APIID, msgConf.Message, msgConf.Targets)
+	}
+
 	log.Warning(formattedMsgString)
 }
@@ -55,6 +55,13 @@ func (e ErrorHandler) HandleError(w http.ResponseWriter, r *http.Request, err st
 			tags = thisSessionState.(SessionState).Tags
 		}
 
+		retries, _ := context.Get(r, UpstreamRetries).(int)
+		routingRule := ""
+		if thisRule, ok := context.Get(r, RoutingRuleData).(*RoutingRule); ok {
+			routingRule = thisRule.Name
+		}
+		cacheTier, _ := context.Get(r, CacheTierData).(string)
+
 		thisRecord := AnalyticsRecord{
 			r.Method,
 			r.URL.Path,
@@ -74,6 +81,11 @@ func (e ErrorHandler) HandleError(w http.ResponseWriter, r *http.Request, err st
 			OauthClientID,
 			0,
 			tags,
+			retries,
+			0,
+			0,
+			routingRule,
+			cacheTier,
 			time.Now(),
 		}
 
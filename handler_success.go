@@ -19,6 +19,21 @@ const (
 	AuthHeaderValue   = 1
 	VersionData       = 2
 	VersionKeyContext = 3
+	AdminTokenData    = 4
+	// The number of times the upstream request was retried
+	UpstreamRetries = 5
+	// Targets a retry should not be sent to
+	RetryExcludedTargets = 6
+	// Traffic totals of a websocket tunnel
+	WebSocketData = 7
+	// The routing rule that picked the upstream
+	RoutingRuleData = 8
+	// The tier of the response cache that served the request
+	CacheTierData = 9
+	// Set by the director when no upstream target could be picked
+	UpstreamTargetError = 10
+	// The target the load balancer picked, it is released when the upstream is done with the request
+	LoadBalancedTarget = 11
 )
 
 // TykMiddleware wraps up the ApiSpec and Proxy objects to be included in a
@@ -137,6 +152,14 @@ func (s SuccessHandler) RecordHit(w http.ResponseWriter, r *http.Request, timing
 			tags = thisSessionState.(SessionState).Tags
 		}
 
+		retries, _ := context.Get(r, UpstreamRetries).(int)
+		webSocketStats, _ := context.Get(r, WebSocketData).(WebSocketStats)
+		routingRule := ""
+		if thisRule, ok := context.Get(r, RoutingRuleData).(*RoutingRule); ok {
+			routingRule = thisRule.Name
+		}
+		cacheTier, _ := context.Get(r, CacheTierData).(string)
+
 		thisRecord := AnalyticsRecord{
 			r.Method,
 			r.URL.Path,
@@ -156,6 +179,11 @@ func (s SuccessHandler) RecordHit(w http.ResponseWriter, r *http.Request, timing
 			OauthClientID,
 			timing,
 			tags,
+			retries,
+			webSocketStats.BytesIn,
+			webSocketStats.BytesOut,
+			routingRule,
+			cacheTier,
 			time.Now(),
 		}
 
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	LB_ROUND_ROBIN          = "round_robin"
+	LB_WEIGHTED_ROUND_ROBIN = "weighted_round_robin"
+	LB_LEAST_CONNECTIONS    = "least_connections"
+	LB_CONSISTENT_HASH      = "consistent_hash"
+
+	LB_HASH_ON_HEADER = "header"
+	LB_HASH_ON_COOKIE = "cookie"
+	LB_HASH_ON_KEY    = "key"
+	LB_HASH_ON_IP     = "ip"
+
+	// Points each unit of weight gets on the consistent hash ring
+	LB_HASH_REPLICAS = 100
+)
+
+// LoadBalancerConfig is set per API in the definition under "load_balancing"
+type LoadBalancerConfig struct {
+	Strategy string `mapstructure:"strategy" bson:"strategy" json:"strategy"`
+	HashOn   string `mapstructure:"hash_on" bson:"hash_on" json:"hash_on"`
+	HashName string `mapstructure:"hash_name" bson:"hash_name" json:"hash_name"`
+}
+
+type loadBalancerSection struct {
+	LoadBalancing LoadBalancerConfig `mapstructure:"load_balancing" bson:"load_balancing" json:"load_balancing"`
+}
+
+// LoadBalancerTarget is an upstream target and its weight, weights are set in the target list by appending
+// them to the URL, e.g. "http://10.0.0.1:8080|3", targets without a weight have a weight of 1
+type LoadBalancerTarget struct {
+	URL    string
+	Weight int
+}
+
+// LoadBalancer picks the target for a request, implementations must be safe for concurrent use. Release is
+// called with the scheme and host of the target once the upstream request has completed.
+type LoadBalancer interface {
+	Next(targets []LoadBalancerTarget, r *http.Request) LoadBalancerTarget
+	Release(target string)
+}
+
+func GetLoadBalancerConfig(spec *APISpec) LoadBalancerConfig {
+	thisSection := loadBalancerSection{}
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisSection); err != nil {
+		log.Error("Failed to decode load balancing configuration: ", err)
+	}
+
+	return thisSection.LoadBalancing
+}
+
+// NewLoadBalancer creates the load balancer configured for the API, round robin is used by default
+func NewLoadBalancer(spec *APISpec) LoadBalancer {
+	thisConfig := GetLoadBalancerConfig(spec)
+
+	switch thisConfig.Strategy {
+	case "", LB_ROUND_ROBIN:
+		return &RoundRobin{}
+	case LB_WEIGHTED_ROUND_ROBIN:
+		return &WeightedRoundRobin{current: make(map[string]int)}
+	case LB_LEAST_CONNECTIONS:
+		return &LeastConnections{inFlight: make(map[string]int)}
+	case LB_CONSISTENT_HASH:
+		return &ConsistentHash{HashOn: thisConfig.HashOn, HashName: thisConfig.HashName}
+	}
+
+	log.Error("Unknown load balancing strategy '", thisConfig.Strategy, "' for API ", spec.APIID, ", using round robin")
+	return &RoundRobin{}
+}
+
+// GetLoadBalancerTargets parses a target list, stripping and decoding the weights
+func GetLoadBalancerTargets(targetList []string) []LoadBalancerTarget {
+	targets := make([]LoadBalancerTarget, 0, len(targetList))
+	for _, thisTarget := range targetList {
+		weight := 1
+		if i := strings.LastIndex(thisTarget, "|"); i != -1 {
+			if asInt, err := strconv.Atoi(thisTarget[i+1:]); err == nil && asInt > 0 {
+				weight = asInt
+			} else {
+				log.Warning("Invalid weight for load balancer target: ", thisTarget)
+			}
+			thisTarget = thisTarget[:i]
+		}
+
+		targets = append(targets, LoadBalancerTarget{URL: EnsureTransport(thisTarget), Weight: weight})
+	}
+
+	return targets
+}
+
+// lbTargetKey reduces a target to its scheme and host, which is all that is left of it after the director ran
+func lbTargetKey(target string) string {
+	asURL, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+
+	return asURL.Scheme + "://" + asURL.Host
+}
+
+// WeightedRoundRobin spreads requests in proportion to the weights of the targets, using the smooth weighted
+// round robin algorithm so that heavy targets don't receive their share in bursts
+type WeightedRoundRobin struct {
+	current map[string]int
+	sync.Mutex
+}
+
+func (w *WeightedRoundRobin) Next(targets []LoadBalancerTarget, r *http.Request) LoadBalancerTarget {
+	w.Lock()
+	defer w.Unlock()
+
+	// Drop the state of targets that have been removed
+	if len(w.current) > len(targets)*2 {
+		w.current = make(map[string]int)
+	}
+
+	total := 0
+	best := 0
+	for i, thisTarget := range targets {
+		w.current[thisTarget.URL] += thisTarget.Weight
+		total += thisTarget.Weight
+		if w.current[thisTarget.URL] > w.current[targets[best].URL] {
+			best = i
+		}
+	}
+
+	w.current[targets[best].URL] -= total
+	return targets[best]
+}
+
+func (w *WeightedRoundRobin) Release(target string) {}
+
+// LeastConnections sends requests to the target with the fewest requests in flight relative to its weight
+type LeastConnections struct {
+	inFlight map[string]int
+	offset   int
+	sync.Mutex
+}
+
+func (l *LeastConnections) Next(targets []LoadBalancerTarget, r *http.Request) LoadBalancerTarget {
+	l.Lock()
+	defer l.Unlock()
+
+	// Rotate the starting point so that ties don't always go to the first target
+	l.offset = (l.offset + 1) % len(targets)
+
+	best := -1
+	var bestLoad float64
+	for i := 0; i < len(targets); i++ {
+		thisTarget := targets[(l.offset+i)%len(targets)]
+		thisLoad := float64(l.inFlight[lbTargetKey(thisTarget.URL)]) / float64(thisTarget.Weight)
+		if best == -1 || thisLoad < bestLoad {
+			best = (l.offset + i) % len(targets)
+			bestLoad = thisLoad
+		}
+	}
+
+	l.inFlight[lbTargetKey(targets[best].URL)]++
+	return targets[best]
+}
+
+func (l *LeastConnections) Release(target string) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.inFlight[target] <= 1 {
+		delete(l.inFlight, target)
+		return
+	}
+	l.inFlight[target]--
+}
+
+// InFlight returns the number of requests that are being handled by a target
+func (l *LeastConnections) InFlight(target string) int {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.inFlight[lbTargetKey(target)]
+}
+
+// ConsistentHash sends requests with the same header, cookie, key or client IP to the same target, when a
+// target is added or removed only the requests that hashed to it move. Requests without a value to hash on
+// are balanced round robin.
+type ConsistentHash struct {
+	HashOn   string
+	HashName string
+
+	ring      []uint32
+	ringNodes map[uint32]LoadBalancerTarget
+	ringFor   string
+	fallback  RoundRobin
+	sync.Mutex
+}
+
+func (c *ConsistentHash) getHashValue(r *http.Request) string {
+	switch c.HashOn {
+	case LB_HASH_ON_HEADER:
+		return r.Header.Get(c.HashName)
+	case LB_HASH_ON_COOKIE:
+		if cookie, err := r.Cookie(c.HashName); err == nil {
+			return cookie.Value
+		}
+	case LB_HASH_ON_KEY:
+		if authHeaderValue, ok := context.Get(r, AuthHeaderValue).(string); ok {
+			return authHeaderValue
+		}
+	case LB_HASH_ON_IP:
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			return host
+		}
+		return r.RemoteAddr
+	}
+
+	return ""
+}
+
+func getRingSignature(targets []LoadBalancerTarget) string {
+	signature := make([]string, len(targets))
+	for i, thisTarget := range targets {
+		signature[i] = thisTarget.URL + "|" + strconv.Itoa(thisTarget.Weight)
+	}
+
+	return strings.Join(signature, ",")
+}
+
+func (c *ConsistentHash) buildRing(targets []LoadBalancerTarget, signature string) {
+	c.ring = []uint32{}
+	c.ringNodes = make(map[uint32]LoadBalancerTarget)
+	for _, thisTarget := range targets {
+		for i := 0; i < LB_HASH_REPLICAS*thisTarget.Weight; i++ {
+			point := crc32.ChecksumIEEE([]byte(thisTarget.URL + "-" + strconv.Itoa(i)))
+			if _, exists := c.ringNodes[point]; exists {
+				continue
+			}
+			c.ringNodes[point] = thisTarget
+			c.ring = append(c.ring, point)
+		}
+	}
+
+	sort.Sort(uint32Slice(c.ring))
+	c.ringFor = signature
+}
+
+func (c *ConsistentHash) Next(targets []LoadBalancerTarget, r *http.Request) LoadBalancerTarget {
+	hashValue := c.getHashValue(r)
+	if hashValue == "" {
+		return c.fallback.Next(targets, r)
+	}
+
+	signature := getRingSignature(targets)
+
+	c.Lock()
+	defer c.Unlock()
+
+	// The ring is only rebuilt when the targets change, e.g. when a target fails its health checks
+	if c.ringFor != signature {
+		c.buildRing(targets, signature)
+	}
+
+	point := crc32.ChecksumIEEE([]byte(hashValue))
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i] >= point })
+	if i == len(c.ring) {
+		i = 0
+	}
+
+	return c.ringNodes[c.ring[i]]
+}
+
+func (c *ConsistentHash) Release(target string) {}
+
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestGetLoadBalancerTargets(t *testing.T) {
+	targets := GetLoadBalancerTargets([]string{"http://a.com", "b.com:8080|3", "http://c.com|bad"})
+	expected := []LoadBalancerTarget{{"http://a.com", 1}, {"http://b.com:8080", 3}, {"http://c.com", 1}}
+
+	for i, thisTarget := range expected {
+		if targets[i] != thisTarget {
+			t.Error("Expected ", thisTarget, " got ", targets[i])
+		}
+	}
+}
+
+func TestRoundRobinConcurrent(t *testing.T) {
+	lb := &RoundRobin{}
+	targets := GetLoadBalancerTargets([]string{"http://a.com", "http://b.com", "http://c.com"})
+
+	counts := make(map[string]int)
+	var countLock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 300; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			thisTarget := lb.Next(targets, nil)
+			countLock.Lock()
+			counts[thisTarget.URL]++
+			countLock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for _, thisTarget := range targets {
+		if counts[thisTarget.URL] != 100 {
+			t.Error("Targets should be used evenly: ", counts)
+		}
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	lb := &WeightedRoundRobin{current: make(map[string]int)}
+	targets := GetLoadBalancerTargets([]string{"http://a.com|3", "http://b.com|1"})
+
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		counts[lb.Next(targets, nil).URL]++
+	}
+
+	if counts["http://a.com"] != 6 || counts["http://b.com"] != 2 {
+		t.Error("Targets should be used in proportion to their weights: ", counts)
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	lb := &LeastConnections{inFlight: make(map[string]int)}
+	targets := GetLoadBalancerTargets([]string{"http://a.com", "http://b.com"})
+
+	first := lb.Next(targets, nil)
+	second := lb.Next(targets, nil)
+	if first == second {
+		t.Fatal("Second request should go to the idle target")
+	}
+
+	// The first target finishes, so it has the fewest requests in flight
+	lb.Release(lbTargetKey(first.URL))
+	if next := lb.Next(targets, nil); next != first {
+		t.Error("Expected the least loaded target ", first, " got ", next)
+	}
+
+	if lb.InFlight(second.URL) != 1 {
+		t.Error("Second target should have one request in flight")
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	lb := &ConsistentHash{HashOn: LB_HASH_ON_HEADER, HashName: "X-User"}
+	targets := GetLoadBalancerTargets([]string{"http://a.com", "http://b.com", "http://c.com"})
+
+	assigned := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User", "user-"+strconv.Itoa(i))
+
+		thisTarget := lb.Next(targets, req)
+		if again := lb.Next(targets, req); again != thisTarget {
+			t.Fatal("The same user should always go to the same target")
+		}
+		assigned[req.Header.Get("X-User")] = thisTarget.URL
+	}
+
+	// Removing a target should only move the users that were on it
+	for user, url := range assigned {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User", user)
+
+		thisTarget := lb.Next(targets[:2], req)
+		if url != "http://c.com" && thisTarget.URL != url {
+			t.Error("User ", user, " moved from ", url, " to ", thisTarget.URL)
+		}
+	}
+}
+
+func TestEmptyTargetList(t *testing.T) {
+	proxy, spec := createTestProxyWithDefinition(apiTestDef, "http://upstream.test")
+	spec.Proxy.EnableLoadBalancing = true
+	spec.Proxy.TargetList = []string{}
+
+	if _, err := GetNextTarget(&spec.Proxy.TargetList, spec, nil); err != ErrNoUpstreamTargets {
+		t.Error("Expected an error without targets, got: ", err)
+	}
+
+	req, _ := http.NewRequest("GET", "/v1/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	defer context.Clear(req)
+
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, req)
+	if recorder.Code != 503 {
+		t.Error("Requests without a target should be answered with a 503, got: ", recorder.Code)
+	}
+}
@@ -51,6 +51,9 @@ const (
 // Display configuration options
 func displayConfig() {
 	log.Info("--> Listening on port: ", config.ListenPort)
+	for _, token := range config.AdminTokens {
+		log.Info("--> Admin token loaded: ", token.Name, " (", token.scopesAsString(), ")")
+	}
 }
 
 // Create all globals and init connection handlers
@@ -106,6 +109,15 @@ func setupGlobals() {
 	MainNotifierStore.Connect()
 	MainNotifier = RedisNotifier{&MainNotifierStore, RedisPubSubChannel}
 
+	// Set up the control API audit trail
+	setupAuditLog()
+
+	// Set up the API Definition revision store
+	setupAPIHistory()
+
+	// Set up the memory tier and compression of the response cache
+	setupCacheTiers()
+
 	if config.Monitor.EnableTriggerMonitors {
 		var monitorErr error
 		MonitoringHandler, monitorErr = WebHookHandler{}.New(config.Monitor.Config)
@@ -168,22 +180,101 @@ func getPolicies() {
 // Set up default Tyk control API endpoints - these are global, so need to be added first
 func loadAPIEndpoints(Muxer *http.ServeMux) {
 	// set up main API handlers
-	Muxer.HandleFunc("/tyk/reload/group", CheckIsAPIOwner(groupResetHandler))
-	Muxer.HandleFunc("/tyk/reload/", CheckIsAPIOwner(resetHandler))
+	Muxer.HandleFunc("/tyk/reload/group", CheckAdminScope(AdminScopeReload, groupResetHandler))
+	Muxer.HandleFunc("/tyk/reload/", CheckAdminScope(AdminScopeReload, resetHandler))
 
 	if !IsRPCMode() {
-		Muxer.HandleFunc("/tyk/org/keys/", CheckIsAPIOwner(orgHandler))
-		Muxer.HandleFunc("/tyk/keys/policy/", CheckIsAPIOwner(policyUpdateHandler))
-		Muxer.HandleFunc("/tyk/keys/create", CheckIsAPIOwner(createKeyHandler))
-		Muxer.HandleFunc("/tyk/apis/", CheckIsAPIOwner(apiHandler))
-		Muxer.HandleFunc("/tyk/health/", CheckIsAPIOwner(healthCheckhandler))
-		Muxer.HandleFunc("/tyk/oauth/clients/create", CheckIsAPIOwner(createOauthClient))
+		Muxer.HandleFunc("/tyk/org/keys/", CheckAdminScope(AdminScopeOrgs, orgHandler))
+		Muxer.HandleFunc("/tyk/keys/policy/", CheckAdminScope(AdminScopeKeys, policyUpdateHandler))
+		Muxer.HandleFunc("/tyk/keys/create", CheckAdminScope(AdminScopeKeys, createKeyHandler))
+		Muxer.HandleFunc("/tyk/apis/validate", CheckAdminScope(AdminScopeAPIs, validateAPIHandler))
+		Muxer.HandleFunc("/tyk/apis/", CheckAdminScope(AdminScopeAPIs, apiHandler))
+		Muxer.HandleFunc("/tyk/health/", CheckAdminScope(AdminScopeHealth, healthCheckhandler))
+		Muxer.HandleFunc("/tyk/oauth/clients/create", CheckAdminScope(AdminScopeOAuth, createOauthClient))
 	} else {
 		log.Info("Node is slaved, REST API minimised")
 	}
 
-	Muxer.HandleFunc("/tyk/keys/", CheckIsAPIOwner(keyHandler))
-	Muxer.HandleFunc("/tyk/oauth/clients/", CheckIsAPIOwner(oAuthClientHandler))
+	Muxer.HandleFunc("/tyk/keys/", CheckAdminScope(AdminScopeKeys, keyHandler))
+	Muxer.HandleFunc("/tyk/oauth/clients/", CheckAdminScope(AdminScopeOAuth, oAuthClientHandler))
+	Muxer.HandleFunc("/tyk/audit", CheckAdminScope(AdminScopeAudit, auditHandler))
+	Muxer.HandleFunc("/tyk/breakers", CheckAdminScope(AdminScopeBreakers, breakersHandler))
+	Muxer.HandleFunc("/tyk/breakers/", CheckAdminScope(AdminScopeBreakers, breakersHandler))
+	Muxer.HandleFunc("/tyk/targets/", CheckAdminScope(AdminScopeTargets, targetsHandler))
+	Muxer.HandleFunc("/tyk/cache/", CheckAdminScope(AdminScopeCache, cacheHandler))
+
+	// v2 endpoints check their own scopes, they are only available on nodes that manage their own APIs
+	if !IsRPCMode() {
+		Muxer.HandleFunc(V2_API_PREFIX+"/", v2Handler)
+	}
+}
+
+// useSeparateControlAPI is true when the control API has been bound to its own listener, in which case the
+// /tyk/ endpoints are not added to the gateway muxer
+func useSeparateControlAPI() bool {
+	return config.ControlAPI.ListenPort > 0
+}
+
+// getTLSConfig loads the certificates for a listener and creates the matching TLS configuration
+func getTLSConfig(certificates []CertData, serverName string, minVersion uint16) *tls.Config {
+	certs := make([]tls.Certificate, len(certificates))
+	certNameMap := make(map[string]*tls.Certificate)
+	for i, certData := range certificates {
+		cert, err := tls.LoadX509KeyPair(certData.CertFile, certData.KeyFile)
+		if err != nil {
+			log.Fatalf("Server error: loadkeys: %s", err)
+		}
+		certs[i] = cert
+		certNameMap[certData.Name] = &certs[i]
+	}
+
+	return &tls.Config{
+		Certificates:      certs,
+		NameToCertificate: certNameMap,
+		ServerName:        serverName,
+		MinVersion:        minVersion,
+	}
+}
+
+// startControlAPIListener serves the control API on its own address, the endpoints are static so
+// this muxer never needs to be swapped out during a reload
+func startControlAPIListener() {
+	controlMux := http.NewServeMux()
+	loadAPIEndpoints(controlMux)
+
+	address := fmt.Sprintf("%s:%d", config.ControlAPI.ListenAddress, config.ControlAPI.ListenPort)
+
+	var l net.Listener
+	var err error
+
+	// When resuming via goagain the parent process may still hold the port, so retry for a short while
+	for attempt := 0; attempt < 10; attempt++ {
+		if config.ControlAPI.UseSSL {
+			tlsConfig := getTLSConfig(config.ControlAPI.Certificates, config.ControlAPI.ServerName, config.ControlAPI.MinVersion)
+			l, err = tls.Listen("tcp", address, tlsConfig)
+		} else {
+			l, err = net.Listen("tcp", address)
+		}
+
+		if err == nil {
+			break
+		}
+
+		log.Warning("Control API listener could not bind, retrying: ", err)
+		time.Sleep(time.Second)
+	}
+
+	if err != nil {
+		log.Error("Control API listener failed to start: ", err)
+		return
+	}
+
+	if config.ControlAPI.UseSSL {
+		log.Warning("--> Control API using SSL (https)")
+	}
+	log.Info("--> Control API listening on: ", address)
+
+	http.Serve(l, controlMux)
 }
 
 // Create API-specific OAuth handlers and respective auth servers
@@ -220,7 +311,7 @@ func addOAuthHandlers(spec *APISpec, Muxer *http.ServeMux, test bool) *OAuthMana
 	oauthManager := OAuthManager{spec, osinServer}
 	oauthHandlers := OAuthHandlers{oauthManager}
 
-	Muxer.HandleFunc(apiAuthorizePath, CheckIsAPIOwner(oauthHandlers.HandleGenerateAuthCodeData))
+	Muxer.HandleFunc(apiAuthorizePath, CheckAdminScope(AdminScopeOAuth, oauthHandlers.HandleGenerateAuthCodeData))
 	Muxer.HandleFunc(clientAuthPath, oauthHandlers.HandleAuthorizePassthrough)
 	Muxer.HandleFunc(clientAccessPath, oauthHandlers.HandleAccessRequest)
 
@@ -452,6 +543,10 @@ func loadApps(APISpecs []APISpec, Muxer *http.ServeMux) {
 			proxy.New(nil, &referenceSpec)
 			referenceSpec.target = remote
 
+			// Start probing the upstream targets
+			startUpstreamHealthChecker(&referenceSpec)
+			startDiscoveryWatcher(&referenceSpec)
+
 			// Create the response processors
 			creeateResponseMiddlewareChain(&referenceSpec)
 
@@ -468,6 +563,9 @@ func loadApps(APISpecs []APISpec, Muxer *http.ServeMux) {
 				var chainArray = []alice.Constructor{}
 				handleCORS(&chainArray, &referenceSpec)
 
+				// Oversized bodies are rejected before anything reads them
+				chainArray = append(chainArray, CreateMiddleware(&BodySizeLimitMiddleware{tykMiddleware}, tykMiddleware))
+
 				var baseChainArray = []alice.Constructor{
 					CreateMiddleware(&IPWhiteListMiddleware{TykMiddleware: tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&OrganizationMonitor{TykMiddleware: tykMiddleware}, tykMiddleware),
@@ -517,6 +615,7 @@ func loadApps(APISpecs []APISpec, Muxer *http.ServeMux) {
 				var chainArray = []alice.Constructor{}
 
 				handleCORS(&chainArray, &referenceSpec)
+				chainArray = append(chainArray, CreateMiddleware(&BodySizeLimitMiddleware{tykMiddleware}, tykMiddleware))
 				var baseChainArray = []alice.Constructor{
 					CreateMiddleware(&IPWhiteListMiddleware{TykMiddleware: tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&OrganizationMonitor{TykMiddleware: tykMiddleware}, tykMiddleware),
@@ -591,9 +690,14 @@ func ReloadURLStructure() {
 	GlobalEventsJSVM.Init(config.TykJSPath)
 
 	newMuxes := http.NewServeMux()
-	loadAPIEndpoints(newMuxes)
+	if !useSeparateControlAPI() {
+		loadAPIEndpoints(newMuxes)
+	}
 	specs := getAPISpecs()
 	loadApps(specs, newMuxes)
+	pruneUpstreamHealthCheckers(specs)
+	pruneDiscoveryWatchers(specs)
+	UpstreamTransports.Prune(specs)
 
 	// Load the API Policies
 	getPolicies()
@@ -623,6 +727,7 @@ func init() {
 		--as-mock                    Creates the API as a mock based on example fields
 		--for-api=<path>             Adds blueprint to existing API Defintition as version
 		--as-version=<version>       The version number to use when inserting
+		--validate-api=<file>        Validate an API Definition file without loading it
 	`
 
 	arguments, err := docopt.Parse(usage, nil, true, VERSION, false, false)
@@ -750,7 +855,11 @@ func main() {
 		DefaultQuotaStore.Init(GetGlobalStorageHandler("orgkey.", false))
 	}
 
-	loadAPIEndpoints(http.DefaultServeMux)
+	if useSeparateControlAPI() {
+		go startControlAPIListener()
+	} else {
+		loadAPIEndpoints(http.DefaultServeMux)
+	}
 
 	// Start listening for reload messages
 	if !config.SuppressRedisSignalReload {
@@ -778,24 +887,8 @@ func main() {
 		log.Info("Setting up Server")
 		if config.HttpServerOptions.UseSSL {
 			log.Warning("--> Using SSL (https)")
-			certs := make([]tls.Certificate, len(config.HttpServerOptions.Certificates))
-			certNameMap := make(map[string]*tls.Certificate)
-			for i, certData := range config.HttpServerOptions.Certificates {
-				cert, err := tls.LoadX509KeyPair(certData.CertFile, certData.KeyFile)
-				if err != nil {
-					log.Fatalf("Server error: loadkeys: %s", err)
-				}
-				certs[i] = cert
-				certNameMap[certData.Name] = &certs[i]
-			}
-
-			config := tls.Config{
-				Certificates:      certs,
-				NameToCertificate: certNameMap,
-				ServerName:        config.HttpServerOptions.ServerName,
-				MinVersion:        config.HttpServerOptions.MinVersion,
-			}
-			l, err = tls.Listen("tcp", targetPort, &config)
+			tlsConfig := getTLSConfig(config.HttpServerOptions.Certificates, config.HttpServerOptions.ServerName, config.HttpServerOptions.MinVersion)
+			l, err = tls.Listen("tcp", targetPort, tlsConfig)
 		} else {
 			log.Warning("--> Standard listener (http)")
 			l, err = net.Listen("tcp", targetPort)
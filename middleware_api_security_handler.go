@@ -1,27 +1,225 @@
 package main
 
 import (
-	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
 	"net/http"
+	"strings"
 )
 
+// Admin token scopes, a scope without the read suffix grants both read and write access to that
+// resource group, e.g. "keys" allows managing keys, while "keys:read" only allows listing and retrieval
+const (
+	AdminScopeAll        string = "all"
+	AdminScopeKeys       string = "keys"
+	AdminScopeAPIs       string = "apis"
+	AdminScopeOrgs       string = "orgs"
+	AdminScopeOAuth      string = "oauth"
+	AdminScopeHealth     string = "health"
+	AdminScopeReload     string = "reload"
+	AdminScopeAudit      string = "audit"
+	AdminScopeBreakers   string = "breakers"
+	AdminScopeTargets    string = "targets"
+	AdminScopeCache      string = "cache"
+	AdminScopeReadSuffix string = ":read"
+)
+
+// AdminToken is a named credential for the control API, it can be limited to a set of scopes and to
+// a single organisation. The legacy "secret" setting is treated as an unrestricted admin token.
+type AdminToken struct {
+	Name   string   `json:"name"`
+	Token  string   `json:"token"`
+	Scopes []string `json:"scopes"`
+	OrgID  string   `json:"org_id"`
+}
+
+// HasScope checks if the token may perform a request with the given method against a resource group,
+// read-only scopes are only honoured for GET requests
+func (a AdminToken) HasScope(scope string, method string) bool {
+	for _, s := range a.Scopes {
+		if s == AdminScopeAll || s == scope {
+			return true
+		}
+
+		if method == "GET" && s == scope+AdminScopeReadSuffix {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CanAccessOrg checks if the token is allowed to work with objects that belong to orgID
+func (a AdminToken) CanAccessOrg(orgID string) bool {
+	if len(a.Scopes) == 0 {
+		return false
+	}
+
+	if a.OrgID == "" {
+		return true
+	}
+
+	return a.OrgID == orgID
+}
+
+// CanAccessAPI checks if the token is allowed to work with the API identified by APIID
+func (a AdminToken) CanAccessAPI(APIID string) bool {
+	if len(a.Scopes) == 0 {
+		return false
+	}
+
+	if a.OrgID == "" {
+		return true
+	}
+
+	thisSpec := GetSpecForApi(APIID)
+	if thisSpec == nil {
+		return false
+	}
+
+	return thisSpec.OrgID == a.OrgID
+}
+
+// CanAccessKey checks if a key belongs to the token's organisation, the session of the key is read from the API or,
+// if no API is given, from any loaded API. Keys that don't exist yet are allowed, the session they are created with
+// is checked with CanAccessSession.
+func (a AdminToken) CanAccessKey(keyName string, APIID string) bool {
+	if len(a.Scopes) == 0 {
+		return false
+	}
+
+	if a.OrgID == "" {
+		return true
+	}
+
+	thisSession, found := getKeySession(keyName, APIID)
+	if !found {
+		return true
+	}
+
+	return thisSession.OrgID == a.OrgID
+}
+
+// CanAccessSession checks the organisation and the access rights of a session object, sessions without access
+// rights are applied to every API so they can only be managed by unrestricted tokens
+func (a AdminToken) CanAccessSession(thisSession SessionState) bool {
+	if len(a.Scopes) == 0 {
+		return false
+	}
+
+	if a.OrgID == "" {
+		return true
+	}
+
+	if thisSession.OrgID != a.OrgID || len(thisSession.AccessRights) == 0 {
+		return false
+	}
+
+	for apiID, _ := range thisSession.AccessRights {
+		if !a.CanAccessAPI(apiID) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func getAdminToken(key string) (AdminToken, bool) {
+	for _, token := range config.AdminTokens {
+		if token.Token != "" && token.Token == key {
+			return token, true
+		}
+	}
+
+	if key == config.Secret {
+		return AdminToken{Name: "default", Scopes: []string{AdminScopeAll}}, true
+	}
+
+	return AdminToken{}, false
+}
+
+// getKeySession reads the session of a key from an API, or from the first loaded API that knows the key
+func getKeySession(keyName string, APIID string) (SessionState, bool) {
+	if thisSpec := GetSpecForApi(APIID); thisSpec != nil {
+		return thisSpec.SessionManager.GetSessionDetail(keyName)
+	}
+
+	for _, thisSpec := range ApiSpecRegister {
+		if thisSession, found := thisSpec.SessionManager.GetSessionDetail(keyName); found {
+			return thisSession, true
+		}
+	}
+
+	return SessionState{}, false
+}
+
+// GetAdminTokenFromRequest returns the admin token that was used to authorise a control API request. Every control
+// API handler must be wrapped in CheckIsAPIOwner or CheckAdminScope, requests that did not pass through them get an
+// empty token that has no scopes and can't access any object.
+func GetAdminTokenFromRequest(r *http.Request) AdminToken {
+	thisToken := context.Get(r, AdminTokenData)
+	if thisToken == nil {
+		log.Error("Control API request was handled without an admin token, access denied")
+		return AdminToken{}
+	}
+
+	return thisToken.(AdminToken)
+}
+
+func writeAdminForbidden(w http.ResponseWriter) {
+	responseMessage := createError("Forbidden")
+	w.WriteHeader(403)
+	w.Write(responseMessage)
+}
+
 // CheckIsAPIOwner will ensure that the accessor of the tyk API has the correct security credentials - this is a
 // shared secret between the client and the owner and is set in the tyk.conf file. This should never be made public!
 func CheckIsAPIOwner(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		tykAuthKey := r.Header.Get("X-Tyk-Authorization")
-		if tykAuthKey != config.Secret {
-			// Error
-			log.Warning("Attempted administrative access with invalid or missing key!")
-
-			responseMessage := createError("Forbidden")
-			w.WriteHeader(403)
-			fmt.Fprintf(w, string(responseMessage))
+	return CheckAdminScope(AdminScopeAll, handler)
+}
 
+// CheckAdminScope will ensure that the accessor of the tyk API has presented a valid admin token, and that
+// the token has been granted the scope required by the handler
+func CheckAdminScope(scope string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		thisToken, found, inScope := getAdminTokenForScope(r, scope)
+		if !found || !inScope {
+			writeAdminForbidden(w)
 			return
 		}
 
+		context.Set(r, AdminTokenData, thisToken)
 		handler(w, r)
+		context.Clear(r)
 
 	}
 }
+
+// getAdminTokenForScope finds the admin token presented with a request, found is false if the key is missing
+// or unknown and inScope is false if the token has not been granted the scope for the request method
+func getAdminTokenForScope(r *http.Request, scope string) (AdminToken, bool, bool) {
+	tykAuthKey := r.Header.Get("X-Tyk-Authorization")
+	thisToken, found := getAdminToken(tykAuthKey)
+	if !found {
+		// Error
+		log.Warning("Attempted administrative access with invalid or missing key!")
+		return thisToken, false, false
+	}
+
+	if !thisToken.HasScope(scope, r.Method) {
+		log.WithFields(logrus.Fields{
+			"token":  thisToken.Name,
+			"scope":  scope,
+			"method": r.Method,
+			"path":   r.URL.Path,
+		}).Warning("Attempted administrative access outside of token scope!")
+		return thisToken, true, false
+	}
+
+	return thisToken, true, true
+}
+
+// scopesAsString is used for reporting token permissions in the startup output
+func (a AdminToken) scopesAsString() string {
+	return strings.Join(a.Scopes, ", ")
+}
@@ -38,13 +38,19 @@ func CopyRequest(r *http.Request) *http.Request {
 	var bodyBuffer bytes.Buffer
 	bodyBuffer2 := new(bytes.Buffer)
 
-	io.Copy(&bodyBuffer, r.Body)
+	_, err := io.Copy(&bodyBuffer, r.Body)
 	*bodyBuffer2 = bodyBuffer
 
 	// Create new ReadClosers so we can split output
 	r.Body = ioutil.NopCloser(&bodyBuffer)
 	tempRes.Body = ioutil.NopCloser(bodyBuffer2)
 
+	// A body over the size limit keeps failing after the part that was read
+	if isRequestBodyTooLarge(err) {
+		r.Body = ioutil.NopCloser(io.MultiReader(&bodyBuffer, failingReader{err}))
+		tempRes.Body = ioutil.NopCloser(io.MultiReader(bodyBuffer2, failingReader{err}))
+	}
+
 	return tempRes
 }
 
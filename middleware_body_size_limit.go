@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"github.com/mitchellh/mapstructure"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// BodySizeLimit overrides the limits of an API for the requests that match Path (a regex) and Method, a
+// limit of 0 keeps the value that is set for the whole API
+type BodySizeLimit struct {
+	Path            string `mapstructure:"path" bson:"path" json:"path"`
+	Method          string `mapstructure:"method" bson:"method" json:"method"`
+	MaxRequestSize  int64  `mapstructure:"max_request_size" bson:"max_request_size" json:"max_request_size"`
+	MaxResponseSize int64  `mapstructure:"max_response_size" bson:"max_response_size" json:"max_response_size"`
+
+	path *regexp.Regexp
+}
+
+// BodySizeLimits is set per API in the definition under "size_limits", sizes are in bytes. The first
+// matching entry in Paths is used. Larger requests are answered with a 413 and larger upstream responses with
+// a 502. Oversized requests don't count as circuit breaker failures.
+type BodySizeLimits struct {
+	MaxRequestSize  int64           `mapstructure:"max_request_size" bson:"max_request_size" json:"max_request_size"`
+	MaxResponseSize int64           `mapstructure:"max_response_size" bson:"max_response_size" json:"max_response_size"`
+	Paths           []BodySizeLimit `mapstructure:"paths" bson:"paths" json:"paths"`
+}
+
+type bodySizeLimitsSection struct {
+	SizeLimits BodySizeLimits `mapstructure:"size_limits" bson:"size_limits" json:"size_limits"`
+}
+
+// NewBodySizeLimits compiles the size limits of an API, nil is returned if the API has none
+func NewBodySizeLimits(spec *APISpec) *BodySizeLimits {
+	thisSection := bodySizeLimitsSection{}
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisSection); err != nil {
+		log.Error("Failed to decode size limits: ", err)
+		return nil
+	}
+
+	thisLimits := thisSection.SizeLimits
+	compiledPaths := []BodySizeLimit{}
+	for _, thisPath := range thisLimits.Paths {
+		asRegex, err := regexp.Compile(thisPath.Path)
+		if err != nil {
+			log.Error("Skipping size limit for path ", thisPath.Path, " of API ", spec.APIID, ": ", err)
+			continue
+		}
+		thisPath.path = asRegex
+		compiledPaths = append(compiledPaths, thisPath)
+	}
+	thisLimits.Paths = compiledPaths
+
+	if thisLimits.MaxRequestSize <= 0 && thisLimits.MaxResponseSize <= 0 && len(thisLimits.Paths) == 0 {
+		return nil
+	}
+
+	return &thisLimits
+}
+
+// GetLimits returns the maximum request and response sizes for a request, 0 means unlimited
+func (l *BodySizeLimits) GetLimits(r *http.Request) (int64, int64) {
+	maxRequest, maxResponse := l.MaxRequestSize, l.MaxResponseSize
+	for _, thisPath := range l.Paths {
+		if thisPath.Method != "" && !strings.EqualFold(thisPath.Method, r.Method) {
+			continue
+		}
+		if !thisPath.path.MatchString(r.URL.Path) {
+			continue
+		}
+
+		if thisPath.MaxRequestSize > 0 {
+			maxRequest = thisPath.MaxRequestSize
+		}
+		if thisPath.MaxResponseSize > 0 {
+			maxResponse = thisPath.MaxResponseSize
+		}
+		break
+	}
+
+	return maxRequest, maxResponse
+}
+
+// isRequestBodyTooLarge checks if an error was caused by reading past the request size limit
+func isRequestBodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "request body too large")
+}
+
+// failingReader is put behind a buffered copy of a body so that reading the copy fails like the original did
+type failingReader struct {
+	err error
+}
+
+func (f failingReader) Read([]byte) (int, error) {
+	return 0, f.err
+}
+
+// BodySizeLimitMiddleware rejects requests that are larger than the limit, it runs before any middleware
+// that reads the body. Requests that don't declare their length have their body wrapped in a reader that
+// fails once the limit is reached, anything that buffers the body then answers with a 413.
+type BodySizeLimitMiddleware struct {
+	*TykMiddleware
+}
+
+// New lets you do any initialisations for the object can be done here
+func (b *BodySizeLimitMiddleware) New() {}
+
+// GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
+func (b *BodySizeLimitMiddleware) GetConfig() (interface{}, error) {
+	return nil, nil
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (b *BodySizeLimitMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	if b.Proxy == nil || b.Proxy.SizeLimits == nil {
+		return nil, 200
+	}
+
+	maxRequest, _ := b.Proxy.SizeLimits.GetLimits(r)
+	if maxRequest <= 0 {
+		return nil, 200
+	}
+
+	if r.ContentLength > maxRequest {
+		return errors.New("Request body too large"), 413
+	}
+
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequest)
+	}
+
+	return nil, 200
+}
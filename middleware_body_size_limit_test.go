@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const sizeLimitTestDef = `"size_limits": {
+		"max_request_size": 10,
+		"max_response_size": 10,
+		"paths": [{"path": "^/v1/upload", "method": "POST", "max_request_size": 100}]
+	},`
+
+// chunkedBody hides the length of a body from http.NewRequest
+type chunkedBody struct {
+	*strings.Reader
+}
+
+func sendSizeLimitRequest(proxy *ReverseProxy, req *http.Request, withCache bool) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	sizeLimit := &BodySizeLimitMiddleware{&TykMiddleware{proxy.TykAPISpec, proxy}}
+	if err, code := sizeLimit.ProcessRequest(recorder, req, nil); err != nil {
+		recorder.Code = code
+		return recorder
+	}
+
+	if withCache {
+		proxy.ServeHTTPForCache(recorder, req)
+	} else {
+		proxy.ServeHTTP(recorder, req)
+	}
+	return recorder
+}
+
+func TestBodySizeLimitRequest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	proxy, _ := createTestProxyWithFields(sizeLimitTestDef, "", upstream.URL)
+	largeBody := strings.Repeat("a", 50)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		hidden bool
+		code   int
+	}{
+		{"Within limit", "POST", "/v1/", "small", false, 200},
+		{"Content-Length over limit", "POST", "/v1/", largeBody, false, 413},
+		{"Chunked body over limit", "POST", "/v1/", largeBody, true, 413},
+		{"Path override", "POST", "/v1/upload", largeBody, false, 200},
+		{"Path override is per method", "PUT", "/v1/upload", largeBody, false, 413},
+		{"Chunked body over path override", "POST", "/v1/upload", strings.Repeat("a", 150), true, 413},
+	}
+
+	for _, test := range tests {
+		var req *http.Request
+		if test.hidden {
+			req, _ = http.NewRequest(test.method, test.path, chunkedBody{strings.NewReader(test.body)})
+		} else {
+			req, _ = http.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		}
+
+		recorder := sendSizeLimitRequest(proxy, req, false)
+		if recorder.Code != test.code {
+			t.Error(test.name, ": expected ", test.code, ", got: ", recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestBodySizeLimitRetryBuffer(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	proxy, _ := createTestProxyWithFields(sizeLimitTestDef+`"proxy_retries": {"max_retries": 2},`, "", upstream.URL)
+	req, _ := http.NewRequest("POST", "/v1/", chunkedBody{strings.NewReader(strings.Repeat("a", 50))})
+
+	// The body is read into the retry buffer before the request is sent
+	if recorder := sendSizeLimitRequest(proxy, req, false); recorder.Code != 413 {
+		t.Error("Expected 413 from the retry buffer, got: ", recorder.Code)
+	}
+}
+
+func TestBodySizeLimitResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("stream") != "" {
+			// Flushing first keeps the length of the response unknown
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte(strings.Repeat("b", 50)))
+	}))
+	defer upstream.Close()
+
+	proxy, _ := createTestProxyWithFields(sizeLimitTestDef, "", upstream.URL)
+
+	req, _ := http.NewRequest("GET", "/v1/", nil)
+	if recorder := sendSizeLimitRequest(proxy, req, false); recorder.Code != 502 {
+		t.Error("Response with a Content-Length over the limit should fail, got: ", recorder.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/v1/?stream=1", nil)
+	if recorder := sendSizeLimitRequest(proxy, req, true); recorder.Code != 502 {
+		t.Error("Response buffered for the cache should be checked, got: ", recorder.Code)
+	}
+
+	// Nothing buffers the response, it is streamed to the client as is
+	req, _ = http.NewRequest("GET", "/v1/?stream=1", nil)
+	if recorder := sendSizeLimitRequest(proxy, req, false); recorder.Code != 200 || recorder.Body.Len() != 50 {
+		t.Error("Streamed response should not be checked, got: ", recorder.Code, recorder.Body.Len())
+	}
+}
+
+func TestBodySizeLimitTruncatedResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Promises more than it sends, reading the body fails
+		w.Header().Set("Content-Length", "8")
+		w.Write([]byte("abc"))
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer upstream.Close()
+
+	proxy, _ := createTestProxyWithFields(sizeLimitTestDef, "", upstream.URL)
+
+	req, _ := http.NewRequest("GET", "/v1/", nil)
+	if recorder := sendSizeLimitRequest(proxy, req, true); recorder.Code != 502 {
+		t.Error("Truncated response should not be served, got: ", recorder.Code, recorder.Body.String())
+	}
+}
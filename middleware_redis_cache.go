@@ -1,16 +1,15 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"crypto/md5"
-	"encoding/hex"
 	"errors"
 	"github.com/gorilla/context"
-	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -21,8 +20,11 @@ const (
 // RedisCacheMiddleware is a caching middleware that will pull data from Redis instead of the upstream proxy
 type RedisCacheMiddleware struct {
 	*TykMiddleware
-	CacheStore StorageHandler
-	sh         SuccessHandler
+	CacheStore   StorageHandler
+	KeyConfig    *CacheKeyConfig
+	HTTPCache    HTTPCacheConfig
+	CacheRefresh CacheRefreshConfig
+	sh           SuccessHandler
 }
 
 type RedisCacheMiddlewareConfig struct {
@@ -31,6 +33,9 @@ type RedisCacheMiddlewareConfig struct {
 // New lets you do any initialisations for the object can be done here
 func (m *RedisCacheMiddleware) New() {
 	m.sh = SuccessHandler{m.TykMiddleware}
+	m.KeyConfig = NewCacheKeyConfig(m.Spec)
+	m.HTTPCache = GetHTTPCacheConfig(m.Spec)
+	m.CacheRefresh = GetCacheRefreshConfig(m.Spec)
 }
 
 // GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
@@ -39,18 +44,36 @@ func (m *RedisCacheMiddleware) GetConfig() (interface{}, error) {
 	return thisModuleConfig, nil
 }
 
-func (m RedisCacheMiddleware) CreateCheckSum(req *http.Request, keyName string) string {
-	h := md5.New()
-	toEncode := strings.Join([]string{req.Method, req.URL.String()}, "-")
-	log.Debug("Cache encoding: ", toEncode)
-	io.WriteString(h, toEncode)
-	reqChecksum := hex.EncodeToString(h.Sum(nil))
-
+// CreateCheckSum returns the cache key of a request, keyName is the session key or client IP when the
+// rule includes one. Requests that a routing rule sent to another upstream are cached apart.
+func (m RedisCacheMiddleware) CreateCheckSum(req *http.Request, keyName string, thisRule CacheKeyRule, body []byte) string {
+	reqChecksum := createCacheKeyChecksum(req, thisRule, body)
 	cacheKey := m.Spec.APIDefinition.APIID + keyName + reqChecksum
+	if routingRule, ok := context.Get(req, RoutingRuleData).(*RoutingRule); ok {
+		cacheKey += "-" + routingRule.Name
+	}
 
 	return cacheKey
 }
 
+// cacheIdentity returns the part of the cache key that identifies the client
+func (m RedisCacheMiddleware) cacheIdentity(r *http.Request, thisRule CacheKeyRule) (string, error) {
+	switch thisRule.Identity {
+	case CACHE_KEY_IDENTITY_NONE:
+		return "", nil
+	case CACHE_KEY_IDENTITY_IP:
+		return GetIP(r.RemoteAddr)
+	}
+
+	// No authentication data? use the IP.
+	authVal := context.Get(r, AuthHeaderValue)
+	if authVal == nil {
+		return GetIP(r.RemoteAddr)
+	}
+
+	return authVal.(string), nil
+}
+
 func GetIP(ip string) (string, error) {
 	IPWithoutPort := strings.Split(ip, ":")
 
@@ -72,12 +95,20 @@ func (m *RedisCacheMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Req
 		return nil, 200
 	}
 
+	// Tunnels can't be cached
+	if IsWebSocketUpgrade(r) {
+		return nil, 200
+	}
+
 	var stat RequestStatus
 	var isVirtual bool
-	// Only allow idempotent (safe) methods
-	if r.Method == "GET" || r.Method == "OPTIONS" || r.Method == "HEAD" {
+	keyRule := m.KeyConfig.GetRule(r)
+	isSafe := r.Method == "GET" || r.Method == "OPTIONS" || r.Method == "HEAD"
+	// POST requests can only be cached when the body is part of the key and the path is listed as cached
+	isCacheablePost := r.Method == "POST" && keyRule.HashBody
+	if isSafe || isCacheablePost {
 		// Lets see if we can throw a sledgehammer at this
-		if m.Spec.APIDefinition.CacheOptions.CacheAllSafeRequests {
+		if isSafe && m.Spec.APIDefinition.CacheOptions.CacheAllSafeRequests {
 			stat = StatusCached
 		} else {
 			// New request checker, more targetted, less likely to fail
@@ -91,111 +122,553 @@ func (m *RedisCacheMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Req
 
 		// Cached route matched, let go
 		if stat == StatusCached {
-			var authHeaderValue string
-			var ipErr error
-			authVal := context.Get(r, AuthHeaderValue)
-
-			// No authentication data? use the IP.
-			if authVal == nil {
-				authHeaderValue, ipErr = GetIP(r.RemoteAddr)
-				if ipErr != nil {
-					log.Error(ipErr)
-					return nil, 200
+			authHeaderValue, ipErr := m.cacheIdentity(r, keyRule)
+			if ipErr != nil {
+				log.Error(ipErr)
+				return nil, 200
+			}
+
+			var body []byte
+			if keyRule.HashBody && r.Body != nil {
+				var readErr error
+				body, readErr = ioutil.ReadAll(r.Body)
+				r.Body.Close()
+				if isRequestBodyTooLarge(readErr) {
+					return errors.New("Request body too large"), 413
 				}
-			} else {
-				authHeaderValue = authVal.(string)
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
 			}
 
-			thisKey := m.CreateCheckSum(r, authHeaderValue)
-			retBlob, found := m.CacheStore.GetKey(thisKey)
-			if found != nil {
-				log.Debug("Cache enabled, but record not found")
-				// Pass through to proxy AND CACHE RESULT
+			// The routing rule picks the upstream, so it has to be known before the cache is read
+			if m.Proxy != nil {
+				m.Proxy.MatchRoutingRule(w, r)
+			}
+			thisKey := m.CreateCheckSum(r, authHeaderValue, keyRule, body)
+			upstreamPath := cacheUpstreamPath(m.Spec, r)
+			perClient := keyRule.Identity == CACHE_KEY_IDENTITY_KEY && context.Get(r, AuthHeaderValue) != nil
+			// The proxy changes the request headers, Vary is matched against the ones the client sent
+			requestHeaders := make(http.Header)
+			copyHeader(requestHeaders, r.Header)
+
+			cached, tier, found := m.getCachedResponse(thisKey, r)
+			m.recordCacheLookup(r, tier)
+			if found && cached.IsFresh(time.Now()) {
+				m.serveCachedResponse(w, r, cached, true, "")
+				return nil, 666
+			}
 
-				reqVal := new(http.Response)
-
-				if isVirtual {
-					log.Debug("This is a virtual function")
-					thisVP := VirtualEndpoint{TykMiddleware: m.TykMiddleware}
-					thisVP.New()
-					reqVal = thisVP.ServeHTTPForCache(w, r)
-				} else {
-					// This passes through and will write the value to the writer, but spit out a copy for the cache
-					log.Debug("Not virtual, passing")
-					reqVal = m.sh.ServeHTTPWithCache(w, r)
+			// Stale responses are served while one request refreshes them in the background
+			if found && !isVirtual {
+				whileRevalidate, _ := m.CacheRefresh.staleWindows(cached.Response.Header, m.HTTPCache.Enabled)
+				if cached.IsStaleWithin(time.Now(), whileRevalidate) {
+					refreshReq := cloneCacheRequest(r, body)
+					m.serveCachedResponse(w, r, cached, true, CACHE_WARNING_STALE)
+					if m.startRefresh(thisKey, false) {
+						go m.refreshInBackground(refreshReq, requestHeaders, thisKey, upstreamPath, cached, perClient)
+					} else {
+						context.Clear(refreshReq)
+					}
+					return nil, 666
 				}
+			}
 
-				cacheThisRequest := true
-				cacheTTL := m.Spec.APIDefinition.CacheOptions.CacheTimeout
-				// Are we using upstream cache control?
-				if m.Spec.APIDefinition.CacheOptions.EnableUpstreamCacheControl {
-					log.Debug("Upstream control enabled")
-					// Do we cache?
-					if reqVal.Header.Get(UPSTREAM_CACHE_HEADER_NAME) == "" {
-						log.Warning("Upstream cache action not found, not caching")
-						cacheThisRequest = false
-					}
-					// Do we override TTL?
-					ttl := reqVal.Header.Get(UPSTREAM_CACHE_TTL_HEADER_NAME)
-					if ttl != "" {
-						log.Debug("TTL Set upstream")
-						cacheAsInt, valErr := strconv.Atoi(ttl)
-						if valErr != nil {
-							log.Error("Failed to decode TTL cache value: ", valErr)
-							cacheTTL = m.Spec.APIDefinition.CacheOptions.CacheTimeout
-						}
-						cacheTTL = int64(cacheAsInt)
+			// Only one request goes to the upstream, the others are served what it stored
+			leader := false
+			if m.CacheRefresh.Coalesce {
+				if leader = m.startRefresh(thisKey, true); !leader {
+					cached, _, found = m.getCachedResponse(thisKey, r)
+					if found && cached.IsFresh(time.Now()) {
+						m.serveCachedResponse(w, r, cached, true, "")
+						return nil, 666
 					}
 				}
+			}
 
-				if cacheThisRequest {
-					log.Debug("Caching request to redis")
-					var wireFormatReq bytes.Buffer
-					reqVal.Write(&wireFormatReq)
-					log.Debug("Cache TTL is:", cacheTTL)
-					go m.CacheStore.SetKey(thisKey, wireFormatReq.String(), cacheTTL)
-
-				}
+			if !found {
+				log.Debug("Cache enabled, but record not found")
+				// Pass through to proxy AND CACHE RESULT
+				reqVal := m.fetch(w, r, isVirtual)
+				m.storeInBackground(requestHeaders, thisKey, upstreamPath, reqVal, perClient, leader)
 				return nil, 666
+			}
 
+			// Stale responses are checked with the upstream if they have validators or can be served when it
+			// fails, unless they come from a virtual endpoint
+			_, ifError := m.CacheRefresh.staleWindows(cached.Response.Header, m.HTTPCache.Enabled)
+			if isVirtual || (!m.canRevalidate(cached) && !cached.IsStaleWithin(time.Now(), ifError)) {
+				reqVal := m.fetch(w, r, isVirtual)
+				m.storeInBackground(requestHeaders, thisKey, upstreamPath, reqVal, perClient, leader)
+				return nil, 666
 			}
 
-			retObj := bytes.NewReader([]byte(retBlob))
-			log.Debug("Cache got: ", retBlob)
+			m.revalidate(w, r, requestHeaders, thisKey, upstreamPath, cached, perClient, leader)
+			return nil, 666
+		}
+	}
+
+	return nil, 200
+}
+
+// fetch passes a request to the upstream, or the virtual endpoint, and returns a copy of the response for the
+// cache. The response is written to w as well, nil is returned if the request failed.
+func (m *RedisCacheMiddleware) fetch(w http.ResponseWriter, r *http.Request, isVirtual bool) *http.Response {
+	if isVirtual {
+		log.Debug("This is a virtual function")
+		thisVP := VirtualEndpoint{TykMiddleware: m.TykMiddleware}
+		thisVP.New()
+		return thisVP.ServeHTTPForCache(w, r)
+	}
+
+	// This passes through and will write the value to the writer, but spit out a copy for the cache
+	log.Debug("Not virtual, passing")
+	return m.sh.ServeHTTPWithCache(w, r)
+}
+
+// getCachedResponse reads the response for a cache key from the memory tier or from Redis, and returns the tier
+// it was found in. Responses that vary by request headers are read from the key of the variant that matches the
+// request.
+func (m *RedisCacheMiddleware) getCachedResponse(thisKey string, r *http.Request) (*cachedResponse, string, bool) {
+	memoryTier := getCacheMemoryTier()
+	if cached, found := m.getMemoryCachedResponse(memoryTier, thisKey, r); found {
+		return cached, CACHE_TIER_MEMORY, true
+	}
+
+	retBlob, err := m.CacheStore.GetKey(thisKey)
+	if err != nil {
+		return nil, CACHE_TIER_MISS, false
+	}
 
-			asBufioReader := bufio.NewReader(retObj)
-			newRes, resErr := http.ReadResponse(asBufioReader, r)
-			if resErr != nil {
-				log.Error("Could not create response object: ", resErr)
+	if strings.HasPrefix(retBlob, CACHE_VARY_PREFIX) {
+		varyHeaders := strings.Split(strings.TrimPrefix(retBlob, CACHE_VARY_PREFIX), ",")
+		if memoryTier != nil {
+			m.rememberInMemory(memoryTier, newCacheMemoryVary(m.Spec.APIID, thisKey, varyHeaders))
+		}
+		thisKey = thisKey + varyChecksum(r.Header, varyHeaders)
+		if retBlob, err = m.CacheStore.GetKey(thisKey); err != nil {
+			return nil, CACHE_TIER_MISS, false
+		}
+	}
+
+	if retBlob, err = decompressCachedResponse(retBlob); err != nil {
+		log.Error("Could not decompress cached response: ", err)
+		return nil, CACHE_TIER_MISS, false
+	}
+
+	log.Debug("Cache got: ", retBlob)
+	cached, err := decodeCachedResponse(thisKey, retBlob, r)
+	if err != nil {
+		log.Error("Could not create response object: ", err)
+		return nil, CACHE_TIER_MISS, false
+	}
+
+	if memoryTier != nil && cached.IsFresh(time.Now()) {
+		m.rememberInMemory(memoryTier, newCacheMemoryResponse(m.Spec.APIID, cached))
+	}
+
+	return cached, CACHE_TIER_REDIS, true
+}
+
+// getMemoryCachedResponse reads a fresh response from the memory tier. Stale responses are read from Redis, where
+// another gateway may already have refreshed them.
+func (m *RedisCacheMiddleware) getMemoryCachedResponse(memoryTier *CacheMemoryTier, thisKey string, r *http.Request) (*cachedResponse, bool) {
+	if memoryTier == nil {
+		return nil, false
+	}
+
+	now := time.Now()
+	thisEntry, found := memoryTier.get(thisKey, now)
+	if found && thisEntry.varyHeaders != nil {
+		thisEntry, found = memoryTier.get(thisKey+varyChecksum(r.Header, thisEntry.varyHeaders), now)
+	}
+	if !found || thisEntry.response == nil || !thisEntry.response.IsFresh(now) {
+		return nil, false
+	}
+
+	return thisEntry.response.copy(), true
+}
+
+// rememberInMemory adds an entry that was read from Redis to the memory tier, it expires with the Redis key
+func (m *RedisCacheMiddleware) rememberInMemory(memoryTier *CacheMemoryTier, thisEntry *cacheMemoryEntry) {
+	// Keys without an expiry have a TTL of -1, keys that are gone or about to go are left out
+	ttl, err := m.CacheStore.GetExp(thisEntry.key)
+	if err != nil || ttl == 0 || ttl < -1 {
+		return
+	}
+
+	memoryTier.set(thisEntry, ttl)
+}
+
+// recordCacheLookup reports the tier of the cache that a request was found in, or a miss, in the analytics
+// record and in the health check values of the API
+func (m *RedisCacheMiddleware) recordCacheLookup(r *http.Request, tier string) {
+	context.Set(r, CacheTierData, tier)
+	if tier == CACHE_TIER_MEMORY {
+		ReportHealthCheckValue(m.Spec.Health, CacheMemoryHit, "1")
+		return
+	}
+
+	if getCacheMemoryTier() != nil {
+		ReportHealthCheckValue(m.Spec.Health, CacheMemoryMiss, "1")
+	}
+	if tier == CACHE_TIER_REDIS {
+		ReportHealthCheckValue(m.Spec.Health, CacheRedisHit, "1")
+	} else {
+		ReportHealthCheckValue(m.Spec.Health, CacheRedisMiss, "1")
+	}
+}
+
+// cacheLifetime returns how many seconds a response is fresh for and how many seconds it is kept in the cache
+func (m *RedisCacheMiddleware) cacheLifetime(res *http.Response, perClient bool) (int64, int64, bool) {
+	cacheTTL := m.Spec.APIDefinition.CacheOptions.CacheTimeout
+	ttlFromUpstream := false
+	// Are we using upstream cache control?
+	if m.Spec.APIDefinition.CacheOptions.EnableUpstreamCacheControl {
+		log.Debug("Upstream control enabled")
+		// Do we cache?
+		if res.Header.Get(UPSTREAM_CACHE_HEADER_NAME) == "" {
+			log.Warning("Upstream cache action not found, not caching")
+			return 0, 0, false
+		}
+		// Do we override TTL?
+		if ttl := res.Header.Get(UPSTREAM_CACHE_TTL_HEADER_NAME); ttl != "" {
+			log.Debug("TTL Set upstream")
+			cacheAsInt, valErr := strconv.Atoi(ttl)
+			if valErr != nil {
+				log.Error("Failed to decode TTL cache value: ", valErr)
+			} else {
+				cacheTTL = int64(cacheAsInt)
+				ttlFromUpstream = true
 			}
+		}
+	}
+
+	if !m.HTTPCache.Enabled {
+		return cacheTTL, cacheTTL, true
+	}
+
+	lifetime, cacheable := httpCacheLifetime(res, cacheTTL, perClient)
+	if !cacheable {
+		return 0, 0, false
+	}
+	// The Tyk TTL header is more specific than Cache-Control
+	if ttlFromUpstream {
+		lifetime = cacheTTL
+	}
+
+	keepFor := lifetime
+	if hasValidators(res.Header) {
+		keepFor += m.HTTPCache.KeepStale
+	}
+	if keepFor <= 0 {
+		return 0, 0, false
+	}
 
-			defer newRes.Body.Close()
-			for _, h := range hopHeaders {
-				newRes.Header.Del(h)
+	return lifetime, keepFor, true
+}
+
+// storeResponse writes a response to the cache, requestHeaders are the headers the client sent
+func (m *RedisCacheMiddleware) storeResponse(requestHeaders http.Header, thisKey string, upstreamPath string, res *http.Response, perClient bool) {
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		log.Error("Failed to read response for the cache: ", err)
+		return
+	}
+
+	m.storeCachedResponse(requestHeaders, thisKey, upstreamPath, res, body, perClient)
+}
+
+func (m *RedisCacheMiddleware) storeCachedResponse(requestHeaders http.Header, thisKey string, upstreamPath string, res *http.Response, body []byte, perClient bool) {
+	freshFor, keepFor, cacheThisRequest := m.cacheLifetime(res, perClient)
+	if !cacheThisRequest {
+		return
+	}
+
+	// Stale responses are kept for as long as they can be served
+	whileRevalidate, ifError := m.CacheRefresh.staleWindows(res.Header, m.HTTPCache.Enabled)
+	if whileRevalidate < ifError {
+		whileRevalidate = ifError
+	}
+	if freshFor+whileRevalidate > keepFor {
+		keepFor = freshFor + whileRevalidate
+	}
+
+	now := time.Now()
+	freshUntil := time.Time{}
+	varyHeaders := []string{}
+	if m.HTTPCache.Enabled || keepFor > freshFor {
+		freshUntil = now.Add(time.Duration(freshFor) * time.Second)
+	}
+	if m.HTTPCache.Enabled {
+		varyHeaders = responseVary(res.Header)
+	}
+
+	log.Debug("Caching request to redis")
+	log.Debug("Cache TTL is:", keepFor)
+	wireFormatReq := encodeCachedResponse(res, body, now, freshUntil)
+
+	// The key of the request points to the variant of the response
+	memoryTier := getCacheMemoryTier()
+	if len(varyHeaders) > 0 {
+		m.CacheStore.SetKey(thisKey, CACHE_VARY_PREFIX+strings.Join(varyHeaders, ","), keepFor)
+		indexCacheKey(m.Spec.APIID, upstreamPath, thisKey, keepFor)
+		if memoryTier != nil {
+			memoryTier.set(newCacheMemoryVary(m.Spec.APIID, thisKey, varyHeaders), keepFor)
+		}
+		thisKey = thisKey + varyChecksum(requestHeaders, varyHeaders)
+	}
+
+	m.CacheStore.SetKey(thisKey, compressCachedResponse(wireFormatReq), keepFor)
+	indexCacheKey(m.Spec.APIID, upstreamPath, thisKey, keepFor)
+
+	// The memory tier gets the response as it would be read back from Redis
+	if memoryTier != nil {
+		if cached, err := decodeCachedResponse(thisKey, wireFormatReq, nil); err == nil {
+			memoryTier.set(newCacheMemoryResponse(m.Spec.APIID, cached), keepFor)
+		}
+	}
+}
+
+// storeInBackground writes a response to the cache and then releases the cache key if this request refreshed it
+func (m *RedisCacheMiddleware) storeInBackground(requestHeaders http.Header, thisKey string, upstreamPath string, res *http.Response, perClient bool, leader bool) {
+	go func() {
+		if res != nil {
+			m.storeResponse(requestHeaders, thisKey, upstreamPath, res, perClient)
+		}
+		m.finishRefresh(thisKey, leader)
+	}()
+}
+
+// startRefresh makes a request the one that refreshes a cache key. If another request is already refreshing it,
+// in this process or on another gateway, false is returned once it finished, or right away if wait is not set.
+func (m *RedisCacheMiddleware) startRefresh(thisKey string, wait bool) bool {
+	timeout := time.Duration(m.CacheRefresh.LockTimeout) * time.Second
+	done, started := cacheRefreshFlights.start(thisKey)
+	if !started {
+		if wait {
+			select {
+			case <-done:
+			case <-time.After(timeout):
 			}
+		}
+		return false
+	}
+
+	if !m.CacheRefresh.RedisLock {
+		return true
+	}
+
+	lockStore := getCacheLockStore()
+	locked, err := lockStore.SetKeyIfNotExists(thisKey, "1", m.CacheRefresh.LockTimeout)
+	if err != nil {
+		// The refresh is still coalesced in this process
+		log.Error("Failed to lock cache key: ", err)
+		return true
+	}
+	if locked {
+		return true
+	}
+
+	// Requests in this process keep waiting for this one while it waits for the other gateway
+	if wait {
+		waitForCacheLock(lockStore, thisKey, timeout)
+	}
+	cacheRefreshFlights.finish(thisKey)
+	return false
+}
+
+// finishRefresh releases a cache key after the request that refreshed it stored the response
+func (m *RedisCacheMiddleware) finishRefresh(thisKey string, leader bool) {
+	if !leader {
+		return
+	}
+
+	if m.CacheRefresh.RedisLock {
+		getCacheLockStore().DeleteKey(thisKey)
+	}
+	cacheRefreshFlights.finish(thisKey)
+}
+
+// canRevalidate checks if a conditional request can be sent for a cached response
+func (m *RedisCacheMiddleware) canRevalidate(cached *cachedResponse) bool {
+	return m.HTTPCache.Enabled && hasValidators(cached.Response.Header)
+}
 
-			copyHeader(w.Header(), newRes.Header)
-			sessObj := context.Get(r, SessionData)
-			var thisSessionState SessionState
+// requestRefresh sends the request for a stale response to the upstream and buffers the response. While it runs
+// the request carries the validators of the cached response instead of the conditional headers of the client.
+// Background refreshes are not client requests and are left out of the analytics.
+func (m *RedisCacheMiddleware) requestRefresh(r *http.Request, requestHeaders http.Header, cached *cachedResponse, background bool) (*cacheResponseBuffer, *http.Response) {
+	r.Header.Del("If-None-Match")
+	r.Header.Del("If-Modified-Since")
+	if m.canRevalidate(cached) {
+		if etag := cached.Response.Header.Get("ETag"); etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := cached.Response.Header.Get("Last-Modified"); lastModified != "" {
+			r.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	upstreamResponse := newCacheResponseBuffer()
+	var reqVal *http.Response
+	if background {
+		if m.Spec.Proxy.StripListenPath {
+			r.URL.Path = strings.Replace(r.URL.Path, m.Spec.Proxy.ListenPath, "", 1)
+		}
+		reqVal = m.Proxy.ServeHTTPForCache(upstreamResponse, r)
+	} else {
+		reqVal = m.sh.ServeHTTPWithCache(upstreamResponse, r)
+	}
+
+	// The client's own conditions are checked against the cached response
+	for _, name := range []string{"If-None-Match", "If-Modified-Since"} {
+		r.Header.Del(name)
+		if values, found := requestHeaders[name]; found {
+			r.Header[name] = values
+		}
+	}
+
+	return upstreamResponse, reqVal
+}
+
+// isRevalidated checks if the upstream confirmed that a cached response is still valid
+func (m *RedisCacheMiddleware) isRevalidated(reqVal *http.Response, cached *cachedResponse) bool {
+	return reqVal != nil && reqVal.StatusCode == 304 && m.canRevalidate(cached)
+}
+
+// refreshInBackground refreshes a stale response that was already served to the client, the stale response is
+// kept if the upstream fails
+func (m *RedisCacheMiddleware) refreshInBackground(r *http.Request, requestHeaders http.Header, thisKey string, upstreamPath string, cached *cachedResponse, perClient bool) {
+	defer m.finishRefresh(thisKey, true)
+	defer context.Clear(r)
+
+	_, reqVal := m.requestRefresh(r, requestHeaders, cached, true)
+	switch {
+	case reqVal == nil:
+		log.Warning("Background cache refresh failed, keeping the stale response")
+	case m.isRevalidated(reqVal, cached):
+		cached.refresh(reqVal, time.Now())
+		reqVal.Body.Close()
+		m.storeCachedResponse(requestHeaders, thisKey, upstreamPath, cached.Response, cached.Body, perClient)
+	case reqVal.StatusCode >= 500:
+		reqVal.Body.Close()
+		log.Warning("Background cache refresh got status ", reqVal.StatusCode, ", keeping the stale response")
+	default:
+		m.storeResponse(requestHeaders, thisKey, upstreamPath, reqVal, perClient)
+	}
+}
+
+// revalidate asks the upstream for a stale response. The cached response is served again if the upstream says
+// it is still valid, or if the upstream failed, or the circuit breaker is open, within the stale-if-error window.
+// Otherwise the client gets the new response.
+func (m *RedisCacheMiddleware) revalidate(w http.ResponseWriter, r *http.Request, requestHeaders http.Header, thisKey string, upstreamPath string, cached *cachedResponse, perClient bool, leader bool) {
+	upstreamResponse, reqVal := m.requestRefresh(r, requestHeaders, cached, false)
+	_, ifError := m.CacheRefresh.staleWindows(cached.Response.Header, m.HTTPCache.Enabled)
+	now := time.Now()
+
+	switch {
+	case m.isRevalidated(reqVal, cached):
+		log.Debug("Cached response is still valid")
+		cached.refresh(reqVal, now)
+		reqVal.Body.Close()
+		m.serveCachedResponse(w, r, cached, false, "")
+		go func() {
+			m.storeCachedResponse(requestHeaders, thisKey, upstreamPath, cached.Response, cached.Body, perClient)
+			m.finishRefresh(thisKey, leader)
+		}()
+	case (reqVal == nil || reqVal.StatusCode >= 500) && cached.IsStaleWithin(now, ifError):
+		log.Warning("Upstream failed, serving stale cached response")
+		if reqVal != nil {
+			reqVal.Body.Close()
+		}
+		m.finishRefresh(thisKey, leader)
+		m.serveCachedResponse(w, r, cached, false, CACHE_WARNING_REVALIDATION_ERROR)
+	default:
+		upstreamResponse.replay(w)
+		m.storeInBackground(requestHeaders, thisKey, upstreamPath, reqVal, perClient, leader)
+	}
+}
 
-			// Only add ratelimit data to keyed sessions
-			if sessObj != nil {
-				thisSessionState = sessObj.(SessionState)
-				w.Header().Set("X-RateLimit-Limit", strconv.Itoa(int(thisSessionState.QuotaMax)))
-				w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(thisSessionState.QuotaRemaining)))
-				w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(thisSessionState.QuotaRenews)))
+// serveCachedResponse writes a cached response, with HTTP semantics a 304 is sent if the client already has it.
+// Stale responses are sent with a Warning header.
+func (m *RedisCacheMiddleware) serveCachedResponse(w http.ResponseWriter, r *http.Request, cached *cachedResponse, recordHit bool, warning string) {
+	newRes, body := cached.Response, cached.Body
+	if m.Proxy.CacheResponseChain == CACHE_RESPONSE_CHAIN_REPLAY {
+		newRes, body = m.replayResponseChain(w, r, cached)
+	}
+
+	if m.HTTPCache.Enabled && isNotModified(r, newRes.Header) {
+		for _, name := range notModifiedHeaders {
+			if values, found := newRes.Header[name]; found {
+				w.Header()[name] = values
 			}
-			w.Header().Add("x-tyk-cached-response", "1")
-			w.WriteHeader(newRes.StatusCode)
-			m.Proxy.copyResponse(w, newRes.Body)
+		}
+	} else {
+		copyHeader(w.Header(), newRes.Header)
+	}
 
-			// Record analytics
-			go m.sh.RecordHit(w, r, 0)
+	sessObj := context.Get(r, SessionData)
+	var thisSessionState SessionState
 
-			// Stop any further execution
-			return nil, 666
+	// Only add ratelimit data to keyed sessions
+	if sessObj != nil {
+		thisSessionState = sessObj.(SessionState)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(int(thisSessionState.QuotaMax)))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(thisSessionState.QuotaRemaining)))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(thisSessionState.QuotaRenews)))
+	}
+	w.Header().Add("x-tyk-cached-response", "1")
+	if warning != "" {
+		w.Header().Add("Warning", warning)
+	}
+
+	if m.HTTPCache.Enabled {
+		now := time.Now()
+		w.Header().Set("Age", strconv.FormatInt(cached.Age(now), 10))
+		if isNotModified(r, newRes.Header) {
+			w.WriteHeader(304)
+			if recordHit {
+				go m.sh.RecordHit(w, r, 0)
+			}
+			return
 		}
 	}
 
-	return nil, 200
+	w.WriteHeader(newRes.StatusCode)
+	m.Proxy.copyResponse(w, bytes.NewReader(body))
+
+	// Record analytics
+	if recordHit {
+		go m.sh.RecordHit(w, r, 0)
+	}
+}
+
+// replayResponseChain runs the response chain of the API on a copy of a cached response that was stored before
+// the chain ran. The chain sees the request path the upstream got, as it does for live responses.
+func (m *RedisCacheMiddleware) replayResponseChain(w http.ResponseWriter, r *http.Request, cached *cachedResponse) (*http.Response, []byte) {
+	res := cached.copy().Response
+	chainReq := new(http.Request)
+	*chainReq = *r
+	chainReq.URL = new(url.URL)
+	*chainReq.URL = *r.URL
+	chainReq.URL.Path = cacheUpstreamPath(m.Spec, r)
+
+	var thisSessionState SessionState
+	if sessObj := context.Get(r, SessionData); sessObj != nil {
+		thisSessionState = sessObj.(SessionState)
+	}
+
+	chainErr := m.Proxy.ResponseHandler.Go(m.Spec.ResponseChain, w, res, chainReq, &thisSessionState)
+	if chainErr != nil {
+		log.Error("Response chain failed! ", chainErr)
+	}
+
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.Error("Failed to read cached response from the response chain: ", err)
+		return cached.Response, cached.Body
+	}
+
+	return res, body
 }
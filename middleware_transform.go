@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/gorilla/context"
 	"github.com/lonelycode/tykcommon"
 	"io/ioutil"
@@ -44,6 +45,9 @@ func (t *TransformMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Requ
 		// Read the body:
 		defer r.Body.Close()
 		body, err := ioutil.ReadAll(r.Body)
+		if isRequestBodyTooLarge(err) {
+			return errors.New("Request body too large"), 413
+		}
 
 		// Put into an interface:
 		var bodyData interface{}
@@ -216,6 +216,13 @@ func (d *VirtualEndpoint) ServeHTTPForCache(w http.ResponseWriter, r *http.Reque
 	newResponse.Header.Add("Server", "tyk")
 	newResponse.Header.Add("Date", requestTime)
 
+	// Clone the response so we can save it, before the response chain if the cache runs it again on replay
+	var copiedRes *http.Response
+	replayChain := d.Proxy != nil && d.Proxy.CacheResponseChain == CACHE_RESPONSE_CHAIN_REPLAY
+	if replayChain {
+		copiedRes = copyResponseForCache(newResponse)
+	}
+
 	// Handle response middleware
 	ResponseHandler := ResponseChain{}
 
@@ -224,23 +231,11 @@ func (d *VirtualEndpoint) ServeHTTPForCache(w http.ResponseWriter, r *http.Reque
 		log.Error("Response chain failed! ", chainErr)
 	}
 
-	// Clone the response so we can save it
-	copiedRes := new(http.Response)
-	*copiedRes = *newResponse // includes shallow copies of maps, but okay
-
+	if !replayChain {
+		copiedRes = copyResponseForCache(newResponse)
+	}
 	defer newResponse.Body.Close()
 
-	// Buffer body data
-	var bodyBuffer bytes.Buffer
-	bodyBuffer2 := new(bytes.Buffer)
-
-	io.Copy(&bodyBuffer, newResponse.Body)
-	*bodyBuffer2 = bodyBuffer
-
-	// Create new ReadClosers so we can split output
-	newResponse.Body = ioutil.NopCloser(&bodyBuffer)
-	copiedRes.Body = ioutil.NopCloser(bodyBuffer2)
-
 	d.HandleResponse(w, newResponse, &thisSessionState)
 
 	// Record analytics
@@ -7,11 +7,14 @@ import (
 type NotificationCommand string
 
 const (
-	NoticeApiUpdated    NotificationCommand = "ApiUpdated"
-	NoticeApiRemoved    NotificationCommand = "ApiRemoved"
-	NoticeApiAdded      NotificationCommand = "ApiAdded"
-	NoticeGroupReload   NotificationCommand = "GroupReload"
-	NoticePolicyChanged NotificationCommand = "PolicyChanged"
+	NoticeApiUpdated     NotificationCommand = "ApiUpdated"
+	NoticeApiRemoved     NotificationCommand = "ApiRemoved"
+	NoticeApiAdded       NotificationCommand = "ApiAdded"
+	NoticeGroupReload    NotificationCommand = "GroupReload"
+	NoticePolicyChanged  NotificationCommand = "PolicyChanged"
+	NoticeBreakerChanged NotificationCommand = "BreakerChanged"
+	NoticeTargetsChanged NotificationCommand = "TargetsChanged"
+	NoticeCachePurged    NotificationCommand = "CachePurged"
 )
 
 // Notification is a type that encodes a message published to a pub sub channel
@@ -33,6 +36,11 @@ type RedisNotifier struct {
 
 // Notify will send a notification to a channel
 func (r *RedisNotifier) Notify(notification Notification) bool {
+	if r.store == nil {
+		log.Debug("Notifier not connected, dropping notification ", notification.Command)
+		return false
+	}
+
 	toSend, err := json.Marshal(notification)
 	if err != nil {
 		log.Error("Problem marshalling notification!")
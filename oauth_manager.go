@@ -97,6 +97,11 @@ func (o *OAuthHandlers) HandleGenerateAuthCodeData(w http.ResponseWriter, r *htt
 	var responseMessage []byte
 	var code int
 
+	if !GetAdminTokenFromRequest(r).CanAccessOrg(o.Manager.API.OrgID) {
+		DoJSONWrite(w, 403, createError("Forbidden"))
+		return
+	}
+
 	if r.Method == "POST" {
 		// On AUTH grab session state data and add to UserData (not validated, not good!)
 		sessionStateJSONData := r.FormValue("key_rules")
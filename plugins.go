@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/context"
 	"github.com/mitchellh/mapstructure"
@@ -75,6 +76,9 @@ func (d *DynamicMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Reques
 	// Createthe proxy object
 	defer r.Body.Close()
 	originalBody, err := ioutil.ReadAll(r.Body)
+	if isRequestBodyTooLarge(err) {
+		return errors.New("Request body too large"), 413
+	}
 	if err != nil {
 		log.Error("Failed to read request body! ", err)
 		return nil, 200
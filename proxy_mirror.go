@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// Mirrored requests are recorded in analytics with this tag so that they can be told apart from client traffic
+const MIRROR_ANALYTICS_TAG string = "tyk-mirror"
+
+// TrafficMirrorConfig is set per API in the definition under "traffic_mirror". A copy of SampleRate percent of
+// the requests, or of the requests matching Paths if any are set, is sent to Target. Responses are discarded.
+type TrafficMirrorConfig struct {
+	Enable      bool     `mapstructure:"enable" bson:"enable" json:"enable"`
+	Target      string   `mapstructure:"target" bson:"target" json:"target"`
+	Paths       []string `mapstructure:"paths" bson:"paths" json:"paths"`
+	SampleRate  float64  `mapstructure:"sample_rate" bson:"sample_rate" json:"sample_rate"`
+	MaxBodySize int64    `mapstructure:"max_body_size" bson:"max_body_size" json:"max_body_size"`
+	Timeout     int      `mapstructure:"timeout" bson:"timeout" json:"timeout"`
+}
+
+type trafficMirrorSection struct {
+	TrafficMirror TrafficMirrorConfig `mapstructure:"traffic_mirror" bson:"traffic_mirror" json:"traffic_mirror"`
+}
+
+// TrafficMirror sends copies of requests to a shadow upstream
+type TrafficMirror struct {
+	Config TrafficMirrorConfig
+	spec   *APISpec
+	target *url.URL
+	paths  []*regexp.Regexp
+	client *http.Client
+}
+
+// NewTrafficMirror creates the mirror configured for the API, nil is returned if mirroring is off
+func NewTrafficMirror(spec *APISpec) *TrafficMirror {
+	thisSection := trafficMirrorSection{}
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisSection); err != nil {
+		log.Error("Failed to decode traffic mirror configuration: ", err)
+		return nil
+	}
+
+	thisConfig := thisSection.TrafficMirror
+	if !thisConfig.Enable {
+		return nil
+	}
+
+	target, err := url.Parse(EnsureTransport(thisConfig.Target))
+	if err != nil || thisConfig.Target == "" {
+		log.Error("Invalid traffic mirror target for API ", spec.APIID, ": ", thisConfig.Target)
+		return nil
+	}
+
+	if thisConfig.SampleRate <= 0 || thisConfig.SampleRate > 100 {
+		thisConfig.SampleRate = 100
+	}
+	if thisConfig.MaxBodySize <= 0 {
+		thisConfig.MaxBodySize = 1 << 20
+	}
+	if thisConfig.Timeout <= 0 {
+		thisConfig.Timeout = 10
+	}
+
+	thisMirror := &TrafficMirror{
+		Config: thisConfig,
+		spec:   spec,
+		target: target,
+		client: &http.Client{
+			Transport: GetTransport(thisConfig.Timeout),
+			Timeout:   time.Duration(thisConfig.Timeout) * time.Second,
+			// The shadow's redirects are its own business
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+
+	for _, path := range thisConfig.Paths {
+		asRegex, err := regexp.Compile(path)
+		if err != nil {
+			log.Error("Invalid traffic mirror path for API ", spec.APIID, ": ", err)
+			continue
+		}
+		thisMirror.paths = append(thisMirror.paths, asRegex)
+	}
+
+	return thisMirror
+}
+
+// ShouldMirror applies the path filter and the sample rate to a request
+func (m *TrafficMirror) ShouldMirror(r *http.Request) bool {
+	if len(m.paths) > 0 {
+		matched := false
+		for _, path := range m.paths {
+			if path.MatchString(r.URL.Path) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return m.Config.SampleRate >= 100 || rand.Float64()*100 < m.Config.SampleRate
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// BufferBody reads the request body so that it can be sent twice, requests with bodies larger than the limit
+// are not mirrored and their body is passed on to the upstream untouched
+func (m *TrafficMirror) BufferBody(r *http.Request, buffered []byte) ([]byte, bool) {
+	if buffered != nil {
+		return buffered, int64(len(buffered)) <= m.Config.MaxBodySize
+	}
+
+	if r.Body == nil || r.ContentLength == 0 {
+		return nil, true
+	}
+
+	if r.ContentLength > m.Config.MaxBodySize {
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, m.Config.MaxBodySize+1))
+	if err != nil {
+		log.Error("Failed to buffer request body for mirroring: ", err)
+	}
+
+	// The rest of the body, or the read error, is left for the upstream request
+	if err != nil || int64(len(body)) > m.Config.MaxBodySize {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+// Send replays a copy of the upstream request against the mirror in the background, originalURL is the
+// request URL before the director rewrote it for the upstream
+func (m *TrafficMirror) Send(req *http.Request, outreq *http.Request, originalURL url.URL, body []byte) {
+	mirrorURL := originalURL
+	mirrorURL.Scheme = m.target.Scheme
+	mirrorURL.Host = m.target.Host
+	mirrorURL.Path = singleJoiningSlash(m.target.Path, originalURL.Path)
+	if m.target.RawQuery != "" && originalURL.RawQuery != "" {
+		mirrorURL.RawQuery = m.target.RawQuery + "&" + originalURL.RawQuery
+	} else if m.target.RawQuery != "" {
+		mirrorURL.RawQuery = m.target.RawQuery
+	}
+
+	// A new request, so that the mirror is not cancelled along with the client request
+	mirrorReq, err := http.NewRequest(outreq.Method, mirrorURL.String(), bytes.NewReader(body))
+	if err != nil {
+		log.Error("Failed to create mirrored request: ", err)
+		return
+	}
+	copyHeader(mirrorReq.Header, outreq.Header)
+	if len(body) == 0 {
+		mirrorReq.Body = nil
+	}
+
+	// Read everything the analytics record needs before the request is finished with
+	keyName, _ := context.Get(req, AuthHeaderValue).(string)
+	version := m.spec.getVersionFromRequest(req)
+	if version == "" {
+		version = "Non Versioned"
+	}
+	storeAnalytics := config.StoreAnalytics(req)
+
+	go func() {
+		t1 := time.Now()
+		res, err := m.client.Do(mirrorReq)
+		latency := int64(float64(time.Since(t1).Nanoseconds()) * 0.000001)
+
+		status := 502
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"api_id": m.spec.APIID,
+				"target": m.target.Host,
+			}).Warning("Mirrored request failed: ", err)
+		} else {
+			status = res.StatusCode
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		if storeAnalytics {
+			m.recordHit(mirrorReq, keyName, version, status, latency)
+		}
+	}()
+}
+
+func (m *TrafficMirror) recordHit(r *http.Request, keyName string, version string, status int, latency int64) {
+	t := time.Now()
+	thisRecord := AnalyticsRecord{
+		r.Method,
+		r.URL.Path,
+		r.ContentLength,
+		r.Header.Get("User-Agent"),
+		t.Day(),
+		t.Month(),
+		t.Year(),
+		t.Hour(),
+		status,
+		keyName,
+		t,
+		version,
+		m.spec.APIDefinition.Name,
+		m.spec.APIDefinition.APIID,
+		m.spec.APIDefinition.OrgID,
+		"",
+		latency,
+		[]string{MIRROR_ANALYTICS_TAG},
+		0,
+		0,
+		0,
+		"",
+		"",
+		time.Now(),
+	}
+
+	thisRecord.SetExpiry(m.spec.ExpireAnalyticsAfter)
+	analytics.RecordHit(thisRecord)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mirroredRequest struct {
+	Method string
+	Path   string
+	Body   string
+}
+
+func TestTrafficMirror(t *testing.T) {
+	upstreamBodies := make(chan string, 4)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		upstreamBodies <- string(body)
+		w.WriteHeader(201)
+	}))
+	defer upstream.Close()
+
+	mirrored := make(chan mirroredRequest, 4)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- mirroredRequest{r.Method, r.URL.Path, string(body)}
+		w.WriteHeader(500)
+	}))
+	defer mirror.Close()
+
+	mirrorConf := `"traffic_mirror": {"enable": true, "target": "` + mirror.URL + `/shadow", "paths": ["^/mirrored"], "max_body_size": 8},`
+	proxy, _ := createTestProxyWithFields(mirrorConf, "", upstream.URL)
+
+	sendRequest := func(path string, body string) int {
+		req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, req)
+
+		if upstreamBody := <-upstreamBodies; upstreamBody != body {
+			t.Error("Upstream received the wrong body: ", upstreamBody)
+		}
+		return recorder.Code
+	}
+
+	// The mirror's response must not reach the client
+	if code := sendRequest("/mirrored/item", "payload"); code != 201 {
+		t.Error("Client should get the upstream response, got: ", code)
+	}
+
+	select {
+	case thisRequest := <-mirrored:
+		if thisRequest.Method != "POST" || thisRequest.Path != "/shadow/mirrored/item" || thisRequest.Body != "payload" {
+			t.Error("Mirrored request is not a copy: ", thisRequest)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Request was not mirrored")
+	}
+
+	// Neither a path that doesn't match nor a body over the limit is mirrored
+	sendRequest("/other", "payload")
+	sendRequest("/mirrored/item", "this body is too long")
+
+	select {
+	case thisRequest := <-mirrored:
+		t.Error("Request should not have been mirrored: ", thisRequest)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
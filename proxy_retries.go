@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/mitchellh/mapstructure"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Methods that can safely be sent twice, RFC 7231 section 4.2.2
+var idempotentMethods = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+
+// ProxyRetryConfig is set per API in the definition under "proxy_retries". Failed upstream requests are sent to
+// the next target up to MaxRetries times, waiting Backoff milliseconds before the first retry and doubling the
+// wait for every retry after that, up to MaxBackoff. Deadline is the time in milliseconds that all attempts
+// together may take, no limit is set if it is 0.
+type ProxyRetryConfig struct {
+	MaxRetries int      `mapstructure:"max_retries" bson:"max_retries" json:"max_retries"`
+	Backoff    int      `mapstructure:"backoff" bson:"backoff" json:"backoff"`
+	MaxBackoff int      `mapstructure:"max_backoff" bson:"max_backoff" json:"max_backoff"`
+	Deadline   int      `mapstructure:"deadline" bson:"deadline" json:"deadline"`
+	Methods    []string `mapstructure:"methods" bson:"methods" json:"methods"`
+}
+
+type proxyRetrySection struct {
+	ProxyRetries ProxyRetryConfig `mapstructure:"proxy_retries" bson:"proxy_retries" json:"proxy_retries"`
+}
+
+// GetProxyRetryConfig reads the retry settings from the API definition, only idempotent methods are retried
+// after the request may have reached the upstream unless Methods says otherwise
+func GetProxyRetryConfig(spec *APISpec) ProxyRetryConfig {
+	thisSection := proxyRetrySection{}
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisSection); err != nil {
+		log.Error("Failed to decode proxy retry configuration: ", err)
+	}
+
+	thisConfig := thisSection.ProxyRetries
+	if len(thisConfig.Methods) == 0 {
+		thisConfig.Methods = idempotentMethods
+	}
+	if thisConfig.MaxBackoff <= 0 {
+		thisConfig.MaxBackoff = 1000
+	}
+
+	return thisConfig
+}
+
+// requestNeverSent reports whether a proxy error happened before the upstream could have seen the request,
+// in which case any method can be retried
+func requestNeverSent(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
+		return true
+	}
+
+	return strings.Contains(err.Error(), "connection refused") || strings.Contains(err.Error(), "no such host")
+}
+
+// ShouldRetry decides whether a failed upstream request is retried, hard timeouts are never retried
+func (c ProxyRetryConfig) ShouldRetry(req *http.Request, err error, retries int) bool {
+	if retries >= c.MaxRetries {
+		return false
+	}
+
+	if strings.Contains(err.Error(), "timeout awaiting response headers") {
+		return false
+	}
+
+	if requestNeverSent(err) {
+		return true
+	}
+
+	for _, method := range c.Methods {
+		if strings.EqualFold(method, req.Method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Budget returns how long all attempts at a request may take together, the Deadline or the hard timeout of the
+// path, whichever is shorter. A hardTimeout of 0 means the path has none, ok is false if there is no limit at all.
+func (c ProxyRetryConfig) Budget(hardTimeout time.Duration) (time.Duration, bool) {
+	budget := time.Duration(c.Deadline) * time.Millisecond
+	if hardTimeout > 0 && (budget <= 0 || hardTimeout < budget) {
+		budget = hardTimeout
+	}
+
+	return budget, budget > 0
+}
+
+// GetBackoff returns how long to wait before a retry
+func (c ProxyRetryConfig) GetBackoff(retries int) time.Duration {
+	backoff := c.Backoff
+	for i := 0; i < retries && backoff < c.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > c.MaxBackoff {
+		backoff = c.MaxBackoff
+	}
+
+	return time.Duration(backoff) * time.Millisecond
+}
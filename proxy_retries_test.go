@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"github.com/gorilla/context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const retryTestFields = `"proxy_retries": {"max_retries": 2, "backoff": 1},`
+
+func getClosedAddress() string {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := l.Addr().String()
+	l.Close()
+
+	return "http://" + address
+}
+
+func TestProxyRetriesConnectionRefused(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	proxy, spec := createTestProxyWithFields(retryTestFields, "", upstream.URL)
+	spec.Proxy.EnableLoadBalancing = true
+	spec.Proxy.TargetList = []string{getClosedAddress(), upstream.URL}
+	if proxy.RetryConfig.MaxRetries != 2 {
+		t.Fatal("Retry configuration not loaded: ", proxy.RetryConfig)
+	}
+
+	// The request never reached the first target, so even a POST is retried
+	req, _ := http.NewRequest("POST", "/v1/", strings.NewReader("payload"))
+	req.RemoteAddr = "127.0.0.1:1234"
+	defer context.Clear(req)
+
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, req)
+
+	if recorder.Code != 200 || recorder.Body.String() != "payload" {
+		t.Error("Request should have been retried on the second target: ", recorder.Code, recorder.Body.String())
+	}
+
+	if retries, _ := context.Get(req, UpstreamRetries).(int); retries != 1 {
+		t.Error("Expected one retry to be recorded, got: ", retries)
+	}
+}
+
+func TestProxyRetriesIdempotentOnly(t *testing.T) {
+	var resetHits int32
+	resetting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&resetHits, 1)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer resetting.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer upstream.Close()
+
+	for _, method := range []string{"GET", "POST"} {
+		atomic.StoreInt32(&resetHits, 0)
+		proxy, spec := createTestProxyWithFields(retryTestFields, "", resetting.URL)
+		spec.Proxy.EnableLoadBalancing = true
+		spec.Proxy.TargetList = []string{resetting.URL, upstream.URL}
+
+		req, _ := http.NewRequest(method, "/v1/", nil)
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, req)
+		context.Clear(req)
+
+		if method == "GET" && recorder.Code != 200 {
+			t.Error("GET should be retried after the connection was reset, got: ", recorder.Code)
+		}
+
+		// The POST reached the upstream, it may have been processed
+		if method == "POST" && recorder.Code != 500 {
+			t.Error("POST should not be retried after the connection was reset, got: ", recorder.Code)
+		}
+
+		if atomic.LoadInt32(&resetHits) != 1 {
+			t.Error("Failing target should only be tried once, got: ", resetHits)
+		}
+	}
+}
+
+func TestProxyRetriesDeadline(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	proxy, spec := createTestProxyWithFields(retryTestFields, "", slow.URL)
+	spec.Proxy.EnableLoadBalancing = true
+	spec.Proxy.TargetList = []string{slow.URL, getClosedAddress()}
+	proxy.RetryConfig.Deadline = 100
+
+	req, _ := http.NewRequest("GET", "/v1/", nil)
+	defer context.Clear(req)
+
+	start := time.Now()
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, req)
+
+	if recorder.Code != 408 {
+		t.Error("Request should stop at the retry deadline, got: ", recorder.Code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Upstream request should be cancelled at the deadline, took: ", elapsed)
+	}
+
+	thisConfig := ProxyRetryConfig{Deadline: 50}
+	if budget, ok := thisConfig.Budget(time.Second); !ok || budget != 50*time.Millisecond {
+		t.Error("Expected the deadline to limit the attempts, got: ", budget)
+	}
+	if budget, ok := (ProxyRetryConfig{Deadline: 5000}).Budget(time.Second); !ok || budget != time.Second {
+		t.Error("Expected the hard timeout to limit the attempts, got: ", budget)
+	}
+	if _, ok := (ProxyRetryConfig{}).Budget(0); ok {
+		t.Error("Attempts should not be limited without a deadline or hard timeout")
+	}
+}
+
+func TestProxyRetriesHardTimeout(t *testing.T) {
+	// The first target fails late, after most of the hard timeout
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(700 * time.Millisecond)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer failing.Close()
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	hardTimeouts := `"use_extended_paths": true, "extended_paths": {"hard_timeouts": [{"path": "/", "method": "GET", "timeout": 1}]},`
+	proxy, spec := createTestProxyWithFields(retryTestFields, hardTimeouts, failing.URL)
+	spec.Proxy.EnableLoadBalancing = true
+	spec.Proxy.TargetList = []string{failing.URL, slow.URL}
+
+	req, _ := http.NewRequest("GET", "/v1/", nil)
+	req.Header.Set("version", "Default")
+	defer context.Clear(req)
+
+	// The retry only gets what is left of the hard timeout
+	start := time.Now()
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, req)
+
+	if recorder.Code != 408 {
+		t.Error("Request should stop at the hard timeout, got: ", recorder.Code, recorder.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 1300*time.Millisecond {
+		t.Error("All attempts together should stay within the hard timeout, took: ", elapsed)
+	}
+	if retries, _ := context.Get(req, UpstreamRetries).(int); retries != 1 {
+		t.Error("Expected the failed target to be retried once, got: ", retries)
+	}
+}
+
+func TestProxyRetryConfig(t *testing.T) {
+	thisConfig := ProxyRetryConfig{MaxRetries: 3, Backoff: 10, MaxBackoff: 25, Methods: idempotentMethods}
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	if thisConfig.ShouldRetry(req, errors.New("net/http: timeout awaiting response headers"), 0) {
+		t.Error("Hard timeouts should not be retried")
+	}
+
+	if thisConfig.ShouldRetry(req, errors.New("EOF"), 3) {
+		t.Error("Retry budget should be enforced")
+	}
+
+	if thisConfig.GetBackoff(0).Nanoseconds() != 10e6 || thisConfig.GetBackoff(1).Nanoseconds() != 20e6 || thisConfig.GetBackoff(2).Nanoseconds() != 25e6 {
+		t.Error("Backoff should double up to the maximum")
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WebSocketConfig is set per API in the definition under "websockets", the handshake goes through the normal
+// middleware chain so it is authenticated and rate limited like any other request
+type WebSocketConfig struct {
+	Enable               bool `mapstructure:"enable" bson:"enable" json:"enable"`
+	IdleTimeout          int  `mapstructure:"idle_timeout" bson:"idle_timeout" json:"idle_timeout"`
+	MaxConnectionsPerKey int  `mapstructure:"max_connections_per_key" bson:"max_connections_per_key" json:"max_connections_per_key"`
+}
+
+type webSocketSection struct {
+	WebSockets WebSocketConfig `mapstructure:"websockets" bson:"websockets" json:"websockets"`
+}
+
+// WebSocketStats are the totals of a closed tunnel, they are added to the analytics record of the handshake
+type WebSocketStats struct {
+	BytesIn  int64
+	BytesOut int64
+}
+
+func GetWebSocketConfig(spec *APISpec) WebSocketConfig {
+	thisSection := webSocketSection{}
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisSection); err != nil {
+		log.Error("Failed to decode websocket configuration: ", err)
+	}
+
+	thisConfig := thisSection.WebSockets
+	if thisConfig.IdleTimeout <= 0 {
+		thisConfig.IdleTimeout = 60
+	}
+
+	return thisConfig
+}
+
+// IsWebSocketUpgrade checks whether a request asks to switch to the websocket protocol
+func IsWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+
+	for _, value := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(value), "upgrade") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// webSocketConnections counts the open tunnels of every key
+var webSocketConnections = make(map[string]int)
+var webSocketConnectionsLock sync.Mutex
+
+func acquireWebSocketConnection(countKey string, max int) bool {
+	webSocketConnectionsLock.Lock()
+	defer webSocketConnectionsLock.Unlock()
+
+	if max > 0 && webSocketConnections[countKey] >= max {
+		return false
+	}
+	webSocketConnections[countKey]++
+
+	return true
+}
+
+func releaseWebSocketConnection(countKey string) {
+	webSocketConnectionsLock.Lock()
+	defer webSocketConnectionsLock.Unlock()
+
+	webSocketConnections[countKey]--
+	if webSocketConnections[countKey] <= 0 {
+		delete(webSocketConnections, countKey)
+	}
+}
+
+func dialWebSocketUpstream(outreq *http.Request, settings *UpstreamTransportSettings) (net.Conn, error) {
+	if settings == nil {
+		settings = defaultUpstreamTransportSettings
+	}
+
+	host := outreq.URL.Host
+	secure := outreq.URL.Scheme == "https" || outreq.URL.Scheme == "wss"
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if secure {
+			host = net.JoinHostPort(host, "443")
+		} else {
+			host = net.JoinHostPort(host, "80")
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: time.Duration(settings.Pool.DialTimeout) * time.Second}
+	if secure {
+		thisTLSConfig := &tls.Config{}
+		if settings.TLSConfig != nil {
+			thisTLSConfig = settings.TLSConfig.Clone()
+		}
+		if thisTLSConfig.ServerName == "" {
+			thisTLSConfig.ServerName, _, _ = net.SplitHostPort(host)
+		}
+		return tls.DialWithDialer(dialer, "tcp", host, thisTLSConfig)
+	}
+
+	return dialer.Dial("tcp", host)
+}
+
+// countingCopy copies until either side fails, recording activity so that idle tunnels can be closed
+func countingCopy(dst io.Writer, src io.Reader, total *int64, lastActivity *int64) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			atomic.StoreInt64(lastActivity, time.Now().UnixNano())
+			if _, writeErr := dst.Write(buf[:n]); writeErr != nil {
+				return
+			}
+			atomic.AddInt64(total, int64(n))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ServeWebSocket sends the handshake to the upstream and, if it agrees to switch protocols, tunnels the raw
+// connection in both directions until one side closes it or it has been idle for too long
+func (p *ReverseProxy) ServeWebSocket(rw http.ResponseWriter, req *http.Request) {
+	outreq, logreq, targetErr := p.prepareUpstreamRequest(req, nil)
+	if targetErr != nil {
+		context.Clear(outreq)
+		p.ErrorHandler.HandleError(rw, logreq, "Service temporarily unnavailable.", 503)
+		return
+	}
+	defer p.releaseUpstreamRequest(outreq)
+
+	countKey := p.TykAPISpec.APIID
+	if authHeaderValue, ok := context.Get(req, AuthHeaderValue).(string); ok {
+		countKey += "." + authHeaderValue
+	}
+
+	if !acquireWebSocketConnection(countKey, p.WebSocketConfig.MaxConnectionsPerKey) {
+		p.ErrorHandler.HandleError(rw, logreq, "Too many open WebSocket connections", 429)
+		return
+	}
+	defer releaseWebSocketConnection(countKey)
+
+	// The hop-by-hop headers were removed, the upgrade has to be requested again
+	outreq.Header.Set("Connection", "Upgrade")
+	outreq.Header.Set("Upgrade", "websocket")
+
+	upstreamConn, err := dialWebSocketUpstream(outreq, p.Transports)
+	if err != nil {
+		log.Error("[PROXY] [WEBSOCKET] Failed to connect to upstream: ", err)
+		p.ErrorHandler.HandleError(rw, logreq, "There was a problem proxying the request", 500)
+		return
+	}
+	defer upstreamConn.Close()
+
+	if err := outreq.Write(upstreamConn); err != nil {
+		log.Error("[PROXY] [WEBSOCKET] Failed to send handshake: ", err)
+		p.ErrorHandler.HandleError(rw, logreq, "There was a problem proxying the request", 500)
+		return
+	}
+
+	upstreamReader := bufio.NewReader(upstreamConn)
+	res, err := http.ReadResponse(upstreamReader, outreq)
+	if err != nil {
+		log.Error("[PROXY] [WEBSOCKET] Failed to read handshake response: ", err)
+		p.ErrorHandler.HandleError(rw, logreq, "There was a problem proxying the request", 500)
+		return
+	}
+
+	// The upstream refused the upgrade, pass its answer on as a normal response
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		defer res.Body.Close()
+		copyHeader(rw.Header(), res.Header)
+		rw.WriteHeader(res.StatusCode)
+		p.copyResponse(rw, res.Body)
+		return
+	}
+
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		log.Error("[PROXY] [WEBSOCKET] Connection can't be hijacked")
+		p.ErrorHandler.HandleError(rw, logreq, "There was a problem proxying the request", 500)
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		log.Error("[PROXY] [WEBSOCKET] Failed to hijack connection: ", err)
+		return
+	}
+	defer clientConn.Close()
+
+	// The server timeouts no longer apply once the connection is ours
+	clientConn.SetDeadline(time.Time{})
+
+	if err := res.Write(clientConn); err != nil {
+		log.Error("[PROXY] [WEBSOCKET] Failed to send handshake response: ", err)
+		return
+	}
+
+	stats := WebSocketStats{}
+	lastActivity := time.Now().UnixNano()
+	done := make(chan struct{}, 2)
+
+	go func() {
+		countingCopy(upstreamConn, clientBuf.Reader, &stats.BytesIn, &lastActivity)
+		done <- struct{}{}
+	}()
+	go func() {
+		countingCopy(clientConn, upstreamReader, &stats.BytesOut, &lastActivity)
+		done <- struct{}{}
+	}()
+
+	idleTimeout := time.Duration(p.WebSocketConfig.IdleTimeout) * time.Second
+	ticker := time.NewTicker(idleTimeout / 4)
+	defer ticker.Stop()
+
+	finished := 0
+	for running := true; running; {
+		select {
+		case <-done:
+			finished++
+			running = false
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&lastActivity))) > idleTimeout {
+				log.WithFields(logrus.Fields{
+					"api_id": p.TykAPISpec.APIID,
+					"path":   req.URL.Path,
+				}).Debug("[PROXY] [WEBSOCKET] Closing idle connection")
+				running = false
+			}
+		}
+	}
+
+	// Closing both ends stops whichever copy is still running, the counters are final once both returned
+	clientConn.Close()
+	upstreamConn.Close()
+	for ; finished < 2; finished++ {
+		<-done
+	}
+
+	context.Set(req, WebSocketData, WebSocketStats{
+		BytesIn:  atomic.LoadInt64(&stats.BytesIn),
+		BytesOut: atomic.LoadInt64(&stats.BytesOut),
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"github.com/gorilla/context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// A minimal websocket server, it accepts the upgrade and echoes everything it receives
+func createWebSocketEchoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsWebSocketUpgrade(r) {
+			w.WriteHeader(400)
+			return
+		}
+
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+		io.Copy(conn, buf)
+	}))
+}
+
+func createWebSocketTestGateway(t *testing.T, upstreamURL string, stats chan WebSocketStats) *httptest.Server {
+	def := createTestDefinition("1", `"websockets": {"enable": true, "idle_timeout": 1, "max_connections_per_key": 1},`, "")
+	proxy, _ := createTestProxyWithDefinition(def, upstreamURL)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		context.Set(r, AuthHeaderValue, "ws-key")
+		defer context.Clear(r)
+
+		proxy.ServeHTTP(w, r)
+		if thisStats, ok := context.Get(r, WebSocketData).(WebSocketStats); ok {
+			stats <- thisStats
+		}
+	}))
+}
+
+func openWebSocket(t *testing.T, gatewayURL string) (net.Conn, *bufio.Reader, *http.Response) {
+	address, _ := url.Parse(gatewayURL)
+	conn, err := net.Dial("tcp", address.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Write([]byte("GET /v1/socket HTTP/1.1\r\nHost: " + address.Host + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal("Failed to read handshake response: ", err)
+	}
+
+	return conn, reader, res
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	upstream := createWebSocketEchoServer()
+	defer upstream.Close()
+
+	stats := make(chan WebSocketStats, 2)
+	gateway := createWebSocketTestGateway(t, upstream.URL, stats)
+	defer gateway.Close()
+
+	conn, reader, res := openWebSocket(t, gateway.URL)
+	if res.StatusCode != 101 {
+		t.Fatal("Upgrade failed: ", res.StatusCode)
+	}
+
+	conn.Write([]byte("hello"))
+	echo := make([]byte, 5)
+	if _, err := io.ReadFull(reader, echo); err != nil || string(echo) != "hello" {
+		t.Fatal("Message was not tunnelled: ", string(echo), err)
+	}
+
+	// Only one connection per key is allowed
+	secondConn, _, secondRes := openWebSocket(t, gateway.URL)
+	secondConn.Close()
+	if secondRes.StatusCode != 429 {
+		t.Error("Second connection should be refused, got: ", secondRes.StatusCode)
+	}
+
+	conn.Close()
+	select {
+	case thisStats := <-stats:
+		if thisStats.BytesIn != 5 || thisStats.BytesOut != 5 {
+			t.Error("Unexpected traffic totals: ", thisStats)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Tunnel was not closed")
+	}
+
+	webSocketConnectionsLock.Lock()
+	open := webSocketConnections["1.ws-key"]
+	webSocketConnectionsLock.Unlock()
+	if open != 0 {
+		t.Error("Connection count was not released: ", open)
+	}
+}
+
+func TestWebSocketIdleTimeout(t *testing.T) {
+	upstream := createWebSocketEchoServer()
+	defer upstream.Close()
+
+	stats := make(chan WebSocketStats, 1)
+	gateway := createWebSocketTestGateway(t, upstream.URL, stats)
+	defer gateway.Close()
+
+	conn, reader, res := openWebSocket(t, gateway.URL)
+	defer conn.Close()
+	if res.StatusCode != 101 {
+		t.Fatal("Upgrade failed: ", res.StatusCode)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Error("Idle tunnel should have been closed, got: ", err)
+	}
+}
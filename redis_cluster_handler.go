@@ -527,6 +527,157 @@ func (r *RedisClusterStorageManager) AppendToSet(keyName string, value string) {
 	}
 }
 
+// AppendToList pushes a value onto the end of a list and returns the length of the list after the push
+func (r *RedisClusterStorageManager) AppendToList(keyName string, value string) (int64, error) {
+	if r.db == nil {
+		log.Warning("Connection dropped, connecting..")
+		r.Connect()
+		return r.AppendToList(keyName, value)
+	}
+
+	return redis.Int64(r.db.Do("RPUSH", r.fixKey(keyName), value))
+}
+
+// GetListRange returns the members of a list between two indexes, negative indexes count from the end of the list
+func (r *RedisClusterStorageManager) GetListRange(keyName string, from int64, to int64) []string {
+	if r.db == nil {
+		log.Warning("Connection dropped, connecting..")
+		r.Connect()
+		return r.GetListRange(keyName, from, to)
+	}
+
+	values, err := redis.Strings(r.db.Do("LRANGE", r.fixKey(keyName), from, to))
+	if err != nil {
+		log.Error("Error trying to get list range:")
+		log.Error(err)
+		return []string{}
+	}
+
+	return values
+}
+
+// GetHash returns all fields of a hash
+func (r *RedisClusterStorageManager) GetHash(keyName string) (map[string]string, error) {
+	if r.db == nil {
+		log.Warning("Connection dropped, connecting..")
+		r.Connect()
+		return r.GetHash(keyName)
+	}
+
+	return redis.StringMap(r.db.Do("HGETALL", r.fixKey(keyName)))
+}
+
+// SetHash replaces all fields of a hash in a single transaction, an empty map deletes it
+func (r *RedisClusterStorageManager) SetHash(keyName string, values map[string]string) error {
+	if r.db == nil {
+		log.Warning("Connection dropped, connecting..")
+		r.Connect()
+		return r.SetHash(keyName, values)
+	}
+
+	delCmd := rediscluster.ClusterTransaction{}
+	delCmd.Cmd = "DEL"
+	delCmd.Args = []interface{}{r.fixKey(keyName)}
+	if len(values) == 0 {
+		_, err := r.db.Do(delCmd.Cmd, delCmd.Args...)
+		return err
+	}
+
+	HMSET := rediscluster.ClusterTransaction{}
+	HMSET.Cmd = "HMSET"
+	HMSET.Args = []interface{}{r.fixKey(keyName)}
+	for field, value := range values {
+		HMSET.Args = append(HMSET.Args, field, value)
+	}
+
+	_, err := r.db.DoTransaction([]rediscluster.ClusterTransaction{delCmd, HMSET})
+	return err
+}
+
+// AddToSortedSet adds a member to a sorted set or updates its score, the set expires after expire seconds
+// unless it already lives longer than that
+func (r *RedisClusterStorageManager) AddToSortedSet(keyName string, member string, score float64, expire int64) error {
+	if r.db == nil {
+		log.Warning("Connection dropped, connecting..")
+		r.Connect()
+		return r.AddToSortedSet(keyName, member, score, expire)
+	}
+
+	if _, err := r.db.Do("ZADD", r.fixKey(keyName), score, member); err != nil {
+		return err
+	}
+	if expire <= 0 {
+		return nil
+	}
+
+	ttl, err := redis.Int64(r.db.Do("TTL", r.fixKey(keyName)))
+	if err != nil || ttl >= expire {
+		return err
+	}
+	_, err = r.db.Do("EXPIRE", r.fixKey(keyName), expire)
+	return err
+}
+
+// GetSortedSetRange returns the members of a sorted set with a score between from and to, both can be
+// "-inf" or "+inf"
+func (r *RedisClusterStorageManager) GetSortedSetRange(keyName string, from string, to string) ([]string, error) {
+	if r.db == nil {
+		log.Warning("Connection dropped, connecting..")
+		r.Connect()
+		return r.GetSortedSetRange(keyName, from, to)
+	}
+
+	return redis.Strings(r.db.Do("ZRANGEBYSCORE", r.fixKey(keyName), from, to))
+}
+
+// RemoveSortedSetRange removes the members of a sorted set with a score between from and to
+func (r *RedisClusterStorageManager) RemoveSortedSetRange(keyName string, from string, to string) error {
+	if r.db == nil {
+		log.Warning("Connection dropped, connecting..")
+		r.Connect()
+		return r.RemoveSortedSetRange(keyName, from, to)
+	}
+
+	_, err := r.db.Do("ZREMRANGEBYSCORE", r.fixKey(keyName), from, to)
+	return err
+}
+
+// RemoveSortedSetMembers removes members from a sorted set
+func (r *RedisClusterStorageManager) RemoveSortedSetMembers(keyName string, members []string) error {
+	if r.db == nil {
+		log.Warning("Connection dropped, connecting..")
+		r.Connect()
+		return r.RemoveSortedSetMembers(keyName, members)
+	}
+
+	if len(members) == 0 {
+		return nil
+	}
+
+	args := []interface{}{r.fixKey(keyName)}
+	for _, member := range members {
+		args = append(args, member)
+	}
+	_, err := r.db.Do("ZREM", args...)
+	return err
+}
+
+// SetKeyIfNotExists sets a key that expires after timeout seconds, false is returned if the key already exists
+func (r *RedisClusterStorageManager) SetKeyIfNotExists(keyName string, value string, timeout int64) (bool, error) {
+	if r.db == nil {
+		log.Warning("Connection dropped, connecting..")
+		r.Connect()
+		return r.SetKeyIfNotExists(keyName, value, timeout)
+	}
+
+	reply, err := r.db.Do("SET", r.fixKey(keyName), value, "EX", timeout, "NX")
+	if err != nil {
+		return false, err
+	}
+
+	return reply != nil, nil
+}
+
 // IncrementWithExpire will increment a key in redis
 func (r *RedisClusterStorageManager) SetRollingWindow(keyName string, per int64, expire int64) int {
 
@@ -35,6 +35,24 @@ func HandleRedisReloadMsg(message redis.Message) {
 		return
 	}
 
+	// Breaker state changes are applied to the running APIs, they don't need a reload
+	if thisMessage.Command == NoticeBreakerChanged {
+		handleBreakerNotification(thisMessage.Payload)
+		return
+	}
+
+	// So are changes to the target registry
+	if thisMessage.Command == NoticeTargetsChanged {
+		refreshRegistryTargets(thisMessage.Payload)
+		return
+	}
+
+	// And to purged cache entries, that are dropped from the memory tier of the cache
+	if thisMessage.Command == NoticeCachePurged {
+		handleCachePurgeNotification(thisMessage.Payload)
+		return
+	}
+
 	log.Info("Reload signal received, reloading endpoints")
 	ReloadURLStructure()
 }
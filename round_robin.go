@@ -1,30 +1,61 @@
 package main
 
+import (
+	"net/http"
+	"sync"
+)
+
+// RoundRobin hands out targets in turn, it is the default LoadBalancer
 type RoundRobin struct {
 	pos int
 	max int
 	cur int
+	sync.Mutex
 }
 
 func (r *RoundRobin) SetMax(rp interface{}) {
-	r.max = len(*rp.(*[]string))
+	r.Lock()
+	defer r.Unlock()
+
+	r.setMax(len(*rp.(*[]string)))
+}
+
+func (r *RoundRobin) setMax(max int) {
+	r.max = max
 
 	// Can't have a new list substituted that's shorter
-	if r.cur > r.max {
+	if r.cur >= r.max {
 		r.cur = 0
 	}
 
-	if r.pos > r.max {
+	if r.pos >= r.max {
 		r.pos = 0
 	}
 }
 
 func (r *RoundRobin) GetPos() int {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.getPos()
+}
+
+func (r *RoundRobin) getPos() int {
 	r.cur = r.pos
 	r.pos += 1
-	if r.pos == (r.max) {
+	if r.pos >= r.max {
 		r.pos = 0
 	}
 	log.Debug("[ROUND ROBIN] Returning index: ", r.cur)
 	return r.cur
 }
+
+func (r *RoundRobin) Next(targets []LoadBalancerTarget, req *http.Request) LoadBalancerTarget {
+	r.Lock()
+	defer r.Unlock()
+
+	r.setMax(len(targets))
+	return targets[r.getPos()]
+}
+
+func (r *RoundRobin) Release(target string) {}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+// The name of the routing rule that matched a request is returned in this header
+const ROUTING_RULE_HEADER string = "X-Tyk-Routing-Rule"
+
+// RoutingRule sends the requests it matches to Target instead of the API's upstream. Every condition that is
+// set has to match, Percentage puts a stable share of keys (or client IPs for open APIs) into the rule, so
+// that raising it only ever adds keys to the canary.
+type RoutingRule struct {
+	Name        string   `mapstructure:"name" bson:"name" json:"name"`
+	Target      string   `mapstructure:"target" bson:"target" json:"target"`
+	Percentage  *float64 `mapstructure:"percentage" bson:"percentage" json:"percentage"`
+	HeaderName  string   `mapstructure:"header_name" bson:"header_name" json:"header_name"`
+	HeaderValue string   `mapstructure:"header_value" bson:"header_value" json:"header_value"`
+	CookieName  string   `mapstructure:"cookie_name" bson:"cookie_name" json:"cookie_name"`
+	CookieValue string   `mapstructure:"cookie_value" bson:"cookie_value" json:"cookie_value"`
+	KeyTags     []string `mapstructure:"key_tags" bson:"key_tags" json:"key_tags"`
+	Policies    []string `mapstructure:"policies" bson:"policies" json:"policies"`
+	Path        string   `mapstructure:"path" bson:"path" json:"path"`
+
+	target *url.URL
+	path   *regexp.Regexp
+}
+
+type routingRulesSection struct {
+	RoutingRules []RoutingRule `mapstructure:"routing_rules" bson:"routing_rules" json:"routing_rules"`
+}
+
+// RoutingRules are evaluated in order before the director runs, the first match wins
+type RoutingRules struct {
+	Rules []*RoutingRule
+}
+
+// NewRoutingRules compiles the routing rules of an API, rules that can't be compiled are skipped and nil is
+// returned if there are none
+func NewRoutingRules(spec *APISpec) *RoutingRules {
+	thisSection := routingRulesSection{}
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisSection); err != nil {
+		log.Error("Failed to decode routing rules: ", err)
+		return nil
+	}
+
+	thisRules := &RoutingRules{}
+	for i, _ := range thisSection.RoutingRules {
+		thisRule := &thisSection.RoutingRules[i]
+		if err := thisRule.compile(); err != nil {
+			log.Error("Skipping routing rule '", thisRule.Name, "' of API ", spec.APIID, ": ", err)
+			continue
+		}
+		thisRules.Rules = append(thisRules.Rules, thisRule)
+	}
+
+	if len(thisRules.Rules) == 0 {
+		return nil
+	}
+
+	return thisRules
+}
+
+func (r *RoutingRule) compile() error {
+	if r.Target == "" {
+		return errors.New("No target set")
+	}
+
+	target, err := url.Parse(EnsureTransport(r.Target))
+	if err != nil {
+		return err
+	}
+	r.target = target
+
+	if r.Path != "" {
+		asRegex, err := regexp.Compile(r.Path)
+		if err != nil {
+			return err
+		}
+		r.path = asRegex
+	}
+
+	return nil
+}
+
+func containsAny(values []string, wanted []string) bool {
+	for _, value := range values {
+		for _, thisWanted := range wanted {
+			if value == thisWanted {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// getRoutingBucket places a key or client IP in one of 100 buckets, independently for every rule
+func getRoutingBucket(ruleName string, r *http.Request) float64 {
+	stickyValue, ok := context.Get(r, AuthHeaderValue).(string)
+	if !ok {
+		stickyValue, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+
+	return float64(crc32.ChecksumIEEE([]byte(ruleName+"."+stickyValue)) % 100)
+}
+
+// Matches checks every condition of the rule against a request
+func (r *RoutingRule) Matches(req *http.Request) bool {
+	if r.path != nil && !r.path.MatchString(req.URL.Path) {
+		return false
+	}
+
+	if r.HeaderName != "" {
+		value := req.Header.Get(r.HeaderName)
+		if value == "" || (r.HeaderValue != "" && value != r.HeaderValue) {
+			return false
+		}
+	}
+
+	if r.CookieName != "" {
+		cookie, err := req.Cookie(r.CookieName)
+		if err != nil || (r.CookieValue != "" && cookie.Value != r.CookieValue) {
+			return false
+		}
+	}
+
+	if len(r.KeyTags) > 0 || len(r.Policies) > 0 {
+		thisSession, ok := context.Get(req, SessionData).(SessionState)
+		if !ok {
+			return false
+		}
+		if len(r.KeyTags) > 0 && !containsAny(thisSession.Tags, r.KeyTags) {
+			return false
+		}
+		if len(r.Policies) > 0 && !containsAny([]string{thisSession.ApplyPolicyID}, r.Policies) {
+			return false
+		}
+	}
+
+	if r.Percentage != nil && getRoutingBucket(r.Name, req) >= *r.Percentage {
+		return false
+	}
+
+	return true
+}
+
+// Match returns the first rule that matches the request, or nil
+func (rr *RoutingRules) Match(req *http.Request) *RoutingRule {
+	for _, thisRule := range rr.Rules {
+		if thisRule.Matches(req) {
+			return thisRule
+		}
+	}
+
+	return nil
+}
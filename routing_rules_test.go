@@ -0,0 +1,161 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestRoutingRules(t *testing.T) {
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("stable"))
+	}))
+	defer stable.Close()
+
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("canary:" + r.URL.Path))
+	}))
+	defer canary.Close()
+
+	rules := `"routing_rules": [
+		{"name": "header", "target": "` + canary.URL + `", "header_name": "X-Canary", "header_value": "yes"},
+		{"name": "internal-keys", "target": "` + canary.URL + `", "key_tags": ["internal"]},
+		{"name": "beta-path", "target": "` + canary.URL + `/beta", "path": "^/v2/"}
+	],`
+	proxy, _ := createTestProxyWithFields(rules, "", stable.URL)
+
+	sendRequest := func(path string, headers map[string]string, session *SessionState) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		if session != nil {
+			context.Set(req, SessionData, *session)
+		}
+		defer context.Clear(req)
+
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := sendRequest("/v1/item", nil, nil)
+	if recorder.Body.String() != "stable" || recorder.Header().Get(ROUTING_RULE_HEADER) != "" {
+		t.Error("Unmatched request should go to the stable upstream: ", recorder.Body.String())
+	}
+
+	recorder = sendRequest("/v1/item", map[string]string{"X-Canary": "yes"}, nil)
+	if recorder.Body.String() != "canary:/v1/item" || recorder.Header().Get(ROUTING_RULE_HEADER) != "header" {
+		t.Error("Header rule did not route to the canary: ", recorder.Body.String(), recorder.Header())
+	}
+
+	recorder = sendRequest("/v1/item", map[string]string{"X-Canary": "no"}, nil)
+	if recorder.Body.String() != "stable" {
+		t.Error("Header value should have to match: ", recorder.Body.String())
+	}
+
+	internalSession := createSampleSession()
+	internalSession.Tags = []string{"internal"}
+	recorder = sendRequest("/v1/item", nil, &internalSession)
+	if recorder.Header().Get(ROUTING_RULE_HEADER) != "internal-keys" {
+		t.Error("Key tag rule did not match: ", recorder.Header())
+	}
+
+	recorder = sendRequest("/v2/item", nil, nil)
+	if recorder.Body.String() != "canary:/beta/v2/item" {
+		t.Error("Path rule did not route to the canary path: ", recorder.Body.String())
+	}
+}
+
+func TestRoutingRulePercentage(t *testing.T) {
+	half := 50.0
+	thisRule := &RoutingRule{Name: "ramp", Target: "http://canary.com", Percentage: &half}
+	thisRule.compile()
+
+	matched := 0
+	for i := 0; i < 1000; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		context.Set(req, AuthHeaderValue, "key-"+strconv.Itoa(i))
+
+		first := thisRule.Matches(req)
+		if thisRule.Matches(req) != first {
+			t.Fatal("Percentage split should be sticky per key")
+		}
+		if first {
+			matched++
+		}
+
+		// Ramping up must keep the keys that are already in the canary
+		full := 100.0
+		thisRule.Percentage = &full
+		if first && !thisRule.Matches(req) {
+			t.Fatal("Key left the canary when the percentage was raised")
+		}
+		thisRule.Percentage = &half
+
+		context.Clear(req)
+	}
+
+	if matched < 400 || matched > 600 {
+		t.Error("Expected about half of the keys to match, got: ", matched)
+	}
+}
+
+func TestRoutingRuleCacheKey(t *testing.T) {
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("stable"))
+	}))
+	defer stable.Close()
+
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("canary:" + r.URL.Path))
+	}))
+	defer canary.Close()
+
+	rules := `"routing_rules": [{"name": "header", "target": "` + canary.URL + `", "header_name": "X-Canary"}],`
+	proxy, spec := createTestProxyWithDefinition(createTestDefinition("routing-cache-test", cacheTestOptions+rules, `"use_extended_paths": true, "extended_paths": {"cache": ["/resource"]},`), stable.URL)
+	m := &RedisCacheMiddleware{TykMiddleware: &TykMiddleware{Spec: spec, Proxy: proxy}, CacheStore: getCacheStore(spec.APIID)}
+	m.New()
+	defer PurgeAPICache(m.Spec.APIID)
+
+	m.ProcessRequest(httptest.NewRecorder(), cacheRefreshTestRequest(), nil)
+	waitForCacheEntry(t, m, "stable")
+
+	// The stable response is cached, but routed requests have their own cache entries
+	req := cacheRefreshTestRequest()
+	req.Header.Set("X-Canary", "yes")
+	defer context.Clear(req)
+
+	recorder := httptest.NewRecorder()
+	m.ProcessRequest(recorder, req, nil)
+	if recorder.Body.String() != "canary:/resource" || recorder.Header().Get(ROUTING_RULE_HEADER) != "header" {
+		t.Error("Routed request should not be served the cached stable response: ", recorder.Body.String(), recorder.Header())
+	}
+}
+
+func TestRoutingRuleSkipsLoadBalancer(t *testing.T) {
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("canary"))
+	}))
+	defer canary.Close()
+
+	proxy, spec := createTestProxyWithFields(`"routing_rules": [{"name": "header", "target": "`+canary.URL+`", "header_name": "X-Canary"}],`, "", canary.URL)
+	spec.Proxy.EnableLoadBalancing = true
+	spec.Proxy.TargetList = []string{canary.URL}
+	lb := &LeastConnections{inFlight: make(map[string]int)}
+	spec.LoadBalancer = lb
+
+	// A request the load balancer sent to the same host is still in flight
+	lb.Next(GetLoadBalancerTargets(spec.Proxy.TargetList), nil)
+
+	req, _ := http.NewRequest("GET", "/v1/item", nil)
+	req.Header.Set("X-Canary", "yes")
+	defer context.Clear(req)
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+	if lb.InFlight(canary.URL) != 1 {
+		t.Error("Routed requests should not release load balancer targets, in flight: ", lb.InFlight(canary.URL))
+	}
+}
@@ -2,15 +2,219 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/Sirupsen/logrus"
 	"github.com/lonelycode/gabs"
+	"github.com/lonelycode/tykcommon"
+	"github.com/mitchellh/mapstructure"
 	"io/ioutil"
 	"net/http"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 const ARRAY_NAME string = "tyk_array"
 
+const (
+	DISCOVERY_HTTP     string = "http"
+	DISCOVERY_CONSUL   string = "consul"
+	DISCOVERY_DNS      string = "dns"
+	DISCOVERY_REGISTRY string = "registry"
+)
+
+// DiscoveryConfig is set per API in the definition under "discovery" and selects the provider that is used
+// when service discovery is enabled. The http provider (the default) queries the query endpoint of the API
+// and reads the targets with its data paths, every RefreshInterval seconds. When a lookup fails the last
+// known targets are used for up to MaxStale seconds.
+type DiscoveryConfig struct {
+	Provider        string                  `mapstructure:"provider" bson:"provider" json:"provider"`
+	RefreshInterval int                     `mapstructure:"refresh_interval" bson:"refresh_interval" json:"refresh_interval"`
+	MaxStale        int                     `mapstructure:"max_stale" bson:"max_stale" json:"max_stale"`
+	Consul          ConsulDiscoveryConfig   `mapstructure:"consul" bson:"consul" json:"consul"`
+	DNS             DNSDiscoveryConfig      `mapstructure:"dns" bson:"dns" json:"dns"`
+	Registry        RegistryDiscoveryConfig `mapstructure:"registry" bson:"registry" json:"registry"`
+}
+
+type discoverySection struct {
+	Discovery DiscoveryConfig `mapstructure:"discovery" bson:"discovery" json:"discovery"`
+}
+
+// GetDiscoveryConfig reads the discovery settings from the API definition and fills in defaults
+func GetDiscoveryConfig(spec *APISpec) DiscoveryConfig {
+	thisSection := discoverySection{}
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisSection); err != nil {
+		log.Error("Failed to decode discovery configuration: ", err)
+	}
+
+	thisConfig := thisSection.Discovery
+	if thisConfig.Provider == "" {
+		thisConfig.Provider = DISCOVERY_HTTP
+	}
+	if thisConfig.RefreshInterval <= 0 && thisConfig.Provider == DISCOVERY_REGISTRY {
+		thisConfig.RefreshInterval = 5
+	}
+	if thisConfig.RefreshInterval <= 0 {
+		// Refresh before the cached targets expire
+		cacheTimeout := int(spec.Proxy.ServiceDiscovery.CacheTimeout)
+		if cacheTimeout <= 0 {
+			cacheTimeout = config.ServiceDiscovery.DefaultCacheTimeout
+		}
+		if cacheTimeout <= 0 {
+			cacheTimeout = 120
+		}
+		thisConfig.RefreshInterval = cacheTimeout * 3 / 4
+		if thisConfig.RefreshInterval < 1 {
+			thisConfig.RefreshInterval = 1
+		}
+	}
+	if thisConfig.MaxStale <= 0 {
+		thisConfig.MaxStale = 300
+	}
+	thisConfig.Consul = thisConfig.Consul.withDefaults()
+	thisConfig.DNS = thisConfig.DNS.withDefaults()
+	thisConfig.Registry = thisConfig.Registry.withDefaults(spec)
+
+	return thisConfig
+}
+
+// TargetProvider looks up the upstream targets of an API, a single target is returned as a string and a
+// list of targets (when load balancing is enabled) as a *[]string
+type TargetProvider interface {
+	GetTarget(serviceURL string) (interface{}, error)
+}
+
+// NewTargetProvider creates the discovery provider that is configured for an API
+func NewTargetProvider(spec *APISpec) TargetProvider {
+	thisConfig := GetDiscoveryConfig(spec)
+	switch thisConfig.Provider {
+	case DISCOVERY_CONSUL:
+		return NewConsulDiscovery(spec, thisConfig.Consul)
+	case DISCOVERY_DNS:
+		return NewDNSDiscovery(spec, thisConfig.DNS)
+	case DISCOVERY_REGISTRY:
+		return NewRegistryDiscovery(spec, thisConfig)
+	}
+
+	sd := &ServiceDiscovery{}
+	sd.New(spec)
+	return sd
+}
+
+// DiscoveryWatcher keeps the targets of an API in the service cache up to date in the background
+type DiscoveryWatcher interface {
+	Start()
+	Stop()
+	RefreshNow()
+}
+
+func newDiscoveryWatcher(spec *APISpec, thisConfig DiscoveryConfig, targets *discoveryTargets) DiscoveryWatcher {
+	switch thisConfig.Provider {
+	case DISCOVERY_CONSUL:
+		return NewConsulWatcher(NewConsulDiscovery(spec, thisConfig.Consul), targets)
+	case DISCOVERY_DNS:
+		return newDNSDiscoveryRefresher(NewDNSDiscovery(spec, thisConfig.DNS), targets)
+	case DISCOVERY_REGISTRY:
+		return newRegistryDiscoveryRefresher(NewRegistryDiscovery(spec, thisConfig), targets)
+	}
+
+	return newHTTPDiscoveryRefresher(spec, thisConfig, targets)
+}
+
+type discoveryWatcherEntry struct {
+	watcher      DiscoveryWatcher
+	targets      *discoveryTargets
+	config       DiscoveryConfig
+	orgID        string
+	loadBalanced bool
+	discovery    tykcommon.ServiceDiscoveryConfiguration
+}
+
+var discoveryWatchers = make(map[string]*discoveryWatcherEntry)
+var discoveryWatchersLock sync.Mutex
+
+// startDiscoveryWatcher starts refreshing the targets of an API in the background, a watcher survives
+// reloads as long as the discovery configuration of the API is unchanged
+func startDiscoveryWatcher(spec *APISpec) {
+	thisEntry := &discoveryWatcherEntry{
+		config:       GetDiscoveryConfig(spec),
+		orgID:        spec.OrgID,
+		loadBalanced: spec.Proxy.EnableLoadBalancing,
+		discovery:    spec.Proxy.ServiceDiscovery,
+	}
+	if spec.Proxy.ServiceDiscovery.UseDiscoveryService {
+		thisEntry.targets = newDiscoveryTargets(spec, thisEntry.config)
+		thisEntry.watcher = newDiscoveryWatcher(spec, thisEntry.config, thisEntry.targets)
+	}
+
+	discoveryWatchersLock.Lock()
+	defer discoveryWatchersLock.Unlock()
+
+	existing, found := discoveryWatchers[spec.APIID]
+	if found {
+		sameConfig := reflect.DeepEqual(existing.config, thisEntry.config) &&
+			existing.orgID == thisEntry.orgID &&
+			existing.loadBalanced == thisEntry.loadBalanced &&
+			existing.discovery == thisEntry.discovery
+		if thisEntry.watcher != nil && sameConfig {
+			existing.targets.setSpec(spec)
+			return
+		}
+
+		existing.watcher.Stop()
+		delete(discoveryWatchers, spec.APIID)
+		if ServiceCache != nil {
+			ServiceCache.Delete(spec.APIID)
+		}
+	}
+
+	if thisEntry.watcher == nil {
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"api_id":   spec.APIID,
+		"provider": thisEntry.config.Provider,
+	}).Info("Watching service discovery targets")
+
+	discoveryWatchers[spec.APIID] = thisEntry
+	thisEntry.watcher.Start()
+}
+
+// refreshDiscoveryTargets asks the watcher of an API to look its targets up again, it returns false if the API
+// has no watcher
+func refreshDiscoveryTargets(APIID string) bool {
+	discoveryWatchersLock.Lock()
+	defer discoveryWatchersLock.Unlock()
+
+	thisEntry, found := discoveryWatchers[APIID]
+	if !found {
+		return false
+	}
+
+	thisEntry.watcher.RefreshNow()
+	return true
+}
+
+// pruneDiscoveryWatchers stops the watchers of APIs that are no longer loaded
+func pruneDiscoveryWatchers(specs []APISpec) {
+	loaded := make(map[string]bool)
+	for _, spec := range specs {
+		loaded[spec.APIID] = true
+	}
+
+	discoveryWatchersLock.Lock()
+	defer discoveryWatchersLock.Unlock()
+
+	for APIID, thisEntry := range discoveryWatchers {
+		if !loaded[APIID] {
+			thisEntry.watcher.Stop()
+			delete(discoveryWatchers, APIID)
+		}
+	}
+}
+
 type ServiceDiscovery struct {
 	spec                *APISpec
 	isNested            bool
@@ -47,8 +251,12 @@ func (s *ServiceDiscovery) getServiceData(name string) (string, error) {
 	}
 
 	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", errors.New("Discovery endpoint returned status " + strconv.Itoa(resp.StatusCode))
+	}
+
 	contents, readErr := ioutil.ReadAll(resp.Body)
-	if err != nil {
+	if readErr != nil {
 		return "", readErr
 	}
 
@@ -203,6 +411,7 @@ func (s *ServiceDiscovery) ParseObject(contents string, jsonParsed *gabs.Contain
 	jp, pErr := gabs.ParseJSON([]byte(contents))
 	if pErr != nil {
 		log.Error(pErr)
+		return pErr
 	}
 	*jsonParsed = *jp
 	log.Debug("Got:", jsonParsed)
@@ -244,7 +453,10 @@ func (s *ServiceDiscovery) ProcessRawData(rawData string) (interface{}, error) {
 	}
 
 	// It's an object
-	s.ParseObject(rawData, &jsonParsed)
+	if err := s.ParseObject(rawData, &jsonParsed); err != nil {
+		log.Error("Parse object failed: ", err)
+		return nil, err
+	}
 	if s.isTargetList {
 		// It's a list object
 		log.Debug("It's a target list - getting sub object from list")
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const CONSUL_DEFAULT_ADDRESS string = "http://127.0.0.1:8500"
+
+// ConsulDiscoveryConfig is set under "discovery.consul", only instances of Service that pass all of their
+// health checks and carry every one of Tags are used. WaitTime is how long (in seconds) a blocking query
+// waits for a change before it is sent again.
+type ConsulDiscoveryConfig struct {
+	Address    string   `mapstructure:"address" bson:"address" json:"address"`
+	Service    string   `mapstructure:"service" bson:"service" json:"service"`
+	Datacenter string   `mapstructure:"datacenter" bson:"datacenter" json:"datacenter"`
+	Tags       []string `mapstructure:"tags" bson:"tags" json:"tags"`
+	Token      string   `mapstructure:"token" bson:"token" json:"token"`
+	Scheme     string   `mapstructure:"scheme" bson:"scheme" json:"scheme"`
+	WaitTime   int      `mapstructure:"wait_time" bson:"wait_time" json:"wait_time"`
+}
+
+func (c ConsulDiscoveryConfig) withDefaults() ConsulDiscoveryConfig {
+	if c.Address == "" {
+		c.Address = CONSUL_DEFAULT_ADDRESS
+	}
+	if c.Scheme == "" {
+		c.Scheme = "http"
+	}
+	if c.WaitTime <= 0 {
+		c.WaitTime = 60
+	}
+
+	return c
+}
+
+// consulServiceEntry is the part of an entry of /v1/health/service/<name> that we need
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Tags    []string
+	}
+}
+
+// ConsulDiscovery finds the targets of an API with the health endpoint of a Consul agent
+type ConsulDiscovery struct {
+	APIID        string
+	Config       ConsulDiscoveryConfig
+	loadBalanced bool
+	transport    *http.Transport
+	client       *http.Client
+}
+
+func NewConsulDiscovery(spec *APISpec, thisConfig ConsulDiscoveryConfig) *ConsulDiscovery {
+	// Blocking queries are cancelled by closing their connection, so they get a transport of their own
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	return &ConsulDiscovery{
+		APIID:        spec.APIID,
+		Config:       thisConfig,
+		loadBalanced: spec.Proxy.EnableLoadBalancing,
+		transport:    transport,
+		// Consul adds up to wait/16 to the wait time of a blocking query
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   time.Duration(thisConfig.WaitTime)*time.Second*17/16 + 10*time.Second,
+		},
+	}
+}
+
+func (c *ConsulDiscovery) queryURL(index uint64) string {
+	query := url.Values{}
+	query.Set("passing", "true")
+	if c.Config.Datacenter != "" {
+		query.Set("dc", c.Config.Datacenter)
+	}
+	for _, tag := range c.Config.Tags {
+		query.Add("tag", tag)
+	}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", strconv.Itoa(c.Config.WaitTime)+"s")
+	}
+
+	servicePath := (&url.URL{Path: c.Config.Service}).String()
+	return strings.TrimRight(c.Config.Address, "/") + "/v1/health/service/" + servicePath + "?" + query.Encode()
+}
+
+// query returns the passing instances of the service and the Consul index they were read at, if an index is
+// given the request blocks until the instances change or the wait time is over. Closing cancel aborts it.
+func (c *ConsulDiscovery) query(index uint64, cancel <-chan struct{}) ([]string, uint64, error) {
+	req, err := http.NewRequest("GET", c.queryURL(index), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.Config.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Config.Token)
+	}
+
+	if cancel != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-cancel:
+				c.transport.CancelRequest(req)
+			case <-done:
+			}
+		}()
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, 0, errors.New("Consul returned status " + strconv.Itoa(resp.StatusCode))
+	}
+
+	entries := []consulServiceEntry{}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	targets := []string{}
+	for _, thisEntry := range entries {
+		// Older agents only filter on the first tag
+		if !hasAllTags(thisEntry.Service.Tags, c.Config.Tags) {
+			continue
+		}
+
+		host := thisEntry.Service.Address
+		if host == "" {
+			host = thisEntry.Node.Address
+		}
+		targets = append(targets, c.Config.Scheme+"://"+net.JoinHostPort(host, strconv.Itoa(thisEntry.Service.Port)))
+	}
+
+	return targets, newIndex, nil
+}
+
+func hasAllTags(tags []string, required []string) bool {
+	for _, thisRequired := range required {
+		found := false
+		for _, thisTag := range tags {
+			if thisTag == thisRequired {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// asTargetData converts a list of instances into the format the proxy expects for the API
+func (c *ConsulDiscovery) asTargetData(targets []string) (interface{}, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("No passing instances of service " + c.Config.Service)
+	}
+
+	if c.loadBalanced {
+		return &targets, nil
+	}
+
+	return targets[0], nil
+}
+
+func (c *ConsulDiscovery) GetTarget(serviceURL string) (interface{}, error) {
+	targets, _, err := c.query(0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.asTargetData(targets)
+}
+
+// ConsulWatcher keeps the targets of an API up to date with blocking queries, so changes to the instances
+// are picked up as soon as Consul sees them
+type ConsulWatcher struct {
+	discovery *ConsulDiscovery
+	targets   *discoveryTargets
+	index     uint64
+	stop      chan struct{}
+}
+
+func NewConsulWatcher(discovery *ConsulDiscovery, targets *discoveryTargets) *ConsulWatcher {
+	return &ConsulWatcher{
+		discovery: discovery,
+		targets:   targets,
+		stop:      make(chan struct{}),
+	}
+}
+
+// Start watches the service until Stop is called
+func (w *ConsulWatcher) Start() {
+	go w.watch()
+}
+
+func (w *ConsulWatcher) Stop() {
+	close(w.stop)
+}
+
+// RefreshNow does nothing, the blocking query already returns as soon as the instances change
+func (w *ConsulWatcher) RefreshNow() {}
+
+// wait pauses the watcher, false is returned if it was stopped in the meantime
+func (w *ConsulWatcher) wait(delay time.Duration) bool {
+	select {
+	case <-time.After(delay):
+		return true
+	case <-w.stop:
+		return false
+	}
+}
+
+func (w *ConsulWatcher) watch() {
+	retryDelay := time.Second
+	idleDelay := time.Second
+	waitTime := time.Duration(w.discovery.Config.WaitTime) * time.Second
+	for {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+
+		queryStart := time.Now()
+		targets, index, err := w.discovery.query(w.index, w.stop)
+		if err == nil {
+			advanced := index > w.index
+			// An index that goes backwards means Consul was reset, start over
+			if index < w.index {
+				index = 0
+			}
+			w.index = index
+
+			var data interface{}
+			if data, err = w.discovery.asTargetData(targets); err == nil {
+				retryDelay = time.Second
+				w.targets.success(data, 0)
+
+				// Without an index that moves on the next query would return at once, back off instead of
+				// sending queries in a loop
+				if index == 0 || (!advanced && time.Since(queryStart) < waitTime) {
+					if !w.wait(idleDelay) {
+						return
+					}
+					if idleDelay < 30*time.Second {
+						idleDelay *= 2
+					}
+				} else {
+					idleDelay = time.Second
+				}
+				continue
+			}
+		}
+
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+
+		// No passing instances is treated like a failure, so the last known instances are kept
+		w.targets.failure(err)
+
+		if !w.wait(retryDelay) {
+			return
+		}
+		if retryDelay < 30*time.Second {
+			retryDelay *= 2
+		}
+	}
+}
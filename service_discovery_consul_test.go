@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeConsulInstance struct {
+	Address string
+	Port    int
+	Tags    []string
+	Passing bool
+}
+
+// fakeConsul serves /v1/health/service/<name> and answers blocking queries like a Consul agent
+type fakeConsul struct {
+	lock       sync.Mutex
+	index      uint64
+	instances  []fakeConsulInstance
+	changed    chan struct{}
+	datacenter string
+	token      string
+	noIndex    bool
+	queries    int
+}
+
+func newFakeConsul(instances []fakeConsulInstance) *fakeConsul {
+	return &fakeConsul{index: 10, instances: instances, changed: make(chan struct{})}
+}
+
+func (f *fakeConsul) setInstances(instances []fakeConsulInstance) {
+	f.lock.Lock()
+	f.index++
+	f.instances = instances
+	close(f.changed)
+	f.changed = make(chan struct{})
+	f.lock.Unlock()
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/orders" {
+		w.WriteHeader(404)
+		return
+	}
+
+	f.lock.Lock()
+	f.queries++
+	f.datacenter = r.URL.Query().Get("dc")
+	f.token = r.Header.Get("X-Consul-Token")
+	index, changed := f.index, f.changed
+	f.lock.Unlock()
+
+	if waitIndex, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); waitIndex >= index {
+		wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	entries := []map[string]interface{}{}
+	for _, thisInstance := range f.instances {
+		// Like older agents, only the first tag is filtered on
+		tag := r.URL.Query().Get("tag")
+		if (r.URL.Query().Get("passing") == "true" && !thisInstance.Passing) || (tag != "" && !hasAllTags(thisInstance.Tags, []string{tag})) {
+			continue
+		}
+		entries = append(entries, map[string]interface{}{
+			"Node":    map[string]interface{}{"Address": "10.0.0.1"},
+			"Service": map[string]interface{}{"Address": thisInstance.Address, "Port": thisInstance.Port, "Tags": thisInstance.Tags},
+		})
+	}
+
+	if !f.noIndex {
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
+// consulTestDiscovery is the discovery field of an API that looks up the orders service in the agent at consulURL
+func consulTestDiscovery(consulURL string) string {
+	return `"discovery": {
+		"provider": "consul",
+		"consul": {"address": "` + consulURL + `", "service": "orders", "datacenter": "dc2", "tags": ["v2", "primary"], "token": "secret", "wait_time": 1}
+	},`
+}
+
+func getServiceCacheTargets(APIID string) []string {
+	cachedTargets, found := ServiceCache.Get(APIID)
+	if !found {
+		return nil
+	}
+
+	return *cachedTargets.(*[]string)
+}
+
+func waitForServiceCacheTargets(t *testing.T, APIID string, timeout time.Duration, expected ...string) {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if strings.Join(getServiceCacheTargets(APIID), ",") == strings.Join(expected, ",") {
+			return
+		}
+	}
+	t.Fatal("Service cache was not updated, expected ", expected, " got: ", getServiceCacheTargets(APIID))
+}
+
+func TestConsulDiscovery(t *testing.T) {
+	consul := newFakeConsul([]fakeConsulInstance{
+		{"10.0.0.2", 8000, []string{"v2", "primary"}, true},
+		{"", 8001, []string{"v2", "primary"}, true},
+		{"10.0.0.3", 8000, []string{"v2", "primary"}, false},
+		{"10.0.0.4", 8000, []string{"v2"}, true},
+		{"10.0.0.5", 8000, []string{"v1", "primary"}, true},
+	})
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	thisSpec := createDefinitionFromString(createTestDefinition("consul-test", consulTestDiscovery(server.URL), ""))
+	thisSpec.Proxy.ServiceDiscovery.UseDiscoveryService = true
+	thisSpec.Proxy.EnableLoadBalancing = true
+	spec := &thisSpec
+	TykNewSingleHostReverseProxy(spec.target, spec)
+	defer ServiceCache.Delete(spec.APIID)
+
+	targets, err := GetURLFromService(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"http://10.0.0.2:8000", "http://10.0.0.1:8001"}
+	if thisList := *targets.(*[]string); strings.Join(thisList, ",") != strings.Join(expected, ",") {
+		t.Fatal("Expected only passing instances with all tags, got: ", thisList)
+	}
+	if consul.datacenter != "dc2" || consul.token != "secret" {
+		t.Error("Datacenter and token were not sent: ", consul.datacenter, consul.token)
+	}
+
+	// Without load balancing the first instance is used
+	spec.Proxy.EnableLoadBalancing = false
+	if target, _ := NewTargetProvider(spec).GetTarget(""); target != "http://10.0.0.2:8000" {
+		t.Error("Expected a single target, got: ", target)
+	}
+	spec.Proxy.EnableLoadBalancing = true
+
+	consul.setInstances([]fakeConsulInstance{})
+	if _, err := NewTargetProvider(spec).GetTarget(""); err == nil {
+		t.Error("Lookup without passing instances should fail")
+	}
+}
+
+func TestConsulWatcher(t *testing.T) {
+	consul := newFakeConsul([]fakeConsulInstance{{"10.0.0.2", 8000, []string{"v2", "primary"}, true}})
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	thisSpec := createDefinitionFromString(createTestDefinition("consul-test", consulTestDiscovery(server.URL), ""))
+	thisSpec.Proxy.ServiceDiscovery.UseDiscoveryService = true
+	thisSpec.Proxy.EnableLoadBalancing = true
+	spec := &thisSpec
+	TykNewSingleHostReverseProxy(spec.target, spec)
+	defer ServiceCache.Delete(spec.APIID)
+
+	startDiscoveryWatcher(spec)
+	defer pruneDiscoveryWatchers(nil)
+
+	waitForServiceCacheTargets(t, spec.APIID, time.Second, "http://10.0.0.2:8000")
+
+	// The blocking query returns as soon as the instances change
+	consul.setInstances([]fakeConsulInstance{
+		{"10.0.0.2", 8000, []string{"v2", "primary"}, false},
+		{"10.0.0.6", 9000, []string{"v2", "primary"}, true},
+	})
+	waitForServiceCacheTargets(t, spec.APIID, time.Second, "http://10.0.0.6:9000")
+
+	// An unchanged configuration keeps the watcher across reloads
+	existing := discoveryWatchers[spec.APIID]
+	reloaded := thisSpec
+	startDiscoveryWatcher(&reloaded)
+	if discoveryWatchers[spec.APIID] != existing {
+		t.Error("Watcher should be kept when the configuration is unchanged")
+	}
+
+	pruneDiscoveryWatchers(nil)
+	if len(discoveryWatchers) != 0 {
+		t.Error("Watchers of unloaded APIs should be stopped")
+	}
+}
+
+func TestConsulWatcherWithoutIndex(t *testing.T) {
+	consul := newFakeConsul([]fakeConsulInstance{{"10.0.0.2", 8000, []string{"v2", "primary"}, true}})
+	consul.noIndex = true
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	thisSpec := createDefinitionFromString(createTestDefinition("consul-test", consulTestDiscovery(server.URL), ""))
+	thisSpec.Proxy.ServiceDiscovery.UseDiscoveryService = true
+	thisSpec.Proxy.EnableLoadBalancing = true
+	spec := &thisSpec
+	TykNewSingleHostReverseProxy(spec.target, spec)
+	defer ServiceCache.Delete(spec.APIID)
+
+	startDiscoveryWatcher(spec)
+	waitForServiceCacheTargets(t, spec.APIID, time.Second, "http://10.0.0.2:8000")
+	time.Sleep(500 * time.Millisecond)
+	pruneDiscoveryWatchers(nil)
+
+	// Queries can't block without an index, the watcher has to wait between them
+	consul.lock.Lock()
+	defer consul.lock.Unlock()
+	if consul.queries > 2 {
+		t.Error("Watcher should back off when Consul sends no index, queries: ", consul.queries)
+	}
+}
+
+func TestConsulQueryURL(t *testing.T) {
+	discovery := &ConsulDiscovery{Config: ConsulDiscoveryConfig{Address: "http://consul:8500/", Service: "orders v2/eu"}.withDefaults()}
+	if queryURL := discovery.queryURL(0); !strings.HasPrefix(queryURL, "http://consul:8500/v1/health/service/orders%20v2/eu?") {
+		t.Error("Service name should be escaped, got: ", queryURL)
+	}
+}
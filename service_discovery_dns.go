@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTypeA    uint16 = 1
+	dnsTypeAAAA uint16 = 28
+	dnsTypeSRV  uint16 = 33
+	dnsClassIN  uint16 = 1
+)
+
+// DNSDiscoveryConfig is set under "discovery.dns", Record is the full SRV name, e.g. "_orders._tcp.example.com".
+// Resolver is the address of the name server to ask, the first name server in /etc/resolv.conf is used if it
+// is empty. Results are cached for the TTL of the records, but at least MinTTL seconds.
+type DNSDiscoveryConfig struct {
+	Record   string `mapstructure:"record" bson:"record" json:"record"`
+	Resolver string `mapstructure:"resolver" bson:"resolver" json:"resolver"`
+	Scheme   string `mapstructure:"scheme" bson:"scheme" json:"scheme"`
+	MinTTL   int    `mapstructure:"min_ttl" bson:"min_ttl" json:"min_ttl"`
+	Timeout  int    `mapstructure:"timeout" bson:"timeout" json:"timeout"`
+}
+
+func (c DNSDiscoveryConfig) withDefaults() DNSDiscoveryConfig {
+	if c.Scheme == "" {
+		c.Scheme = "http"
+	}
+	if c.MinTTL <= 0 {
+		c.MinTTL = 5
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 5
+	}
+	if c.Resolver != "" {
+		if _, _, err := net.SplitHostPort(c.Resolver); err != nil {
+			c.Resolver = net.JoinHostPort(c.Resolver, "53")
+		}
+	}
+
+	return c
+}
+
+// SRVRecord is a single answer to an SRV query, Address is set when the name server sent the address of
+// the target along with the answer
+type SRVRecord struct {
+	Target   string
+	Address  string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+	TTL      uint32
+}
+
+// systemResolver returns the first name server from /etc/resolv.conf
+func systemResolver() (string, error) {
+	resolvConf, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	defer resolvConf.Close()
+
+	scanner := bufio.NewScanner(resolvConf)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+
+	return "", errors.New("No name server found in /etc/resolv.conf")
+}
+
+func encodeDNSQuestion(id uint16, name string, qType uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	// Recursion desired
+	binary.BigEndian.PutUint16(msg[2:], 0x0100)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, errors.New("Invalid DNS name: " + name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qType>>8), byte(qType), byte(dnsClassIN>>8), byte(dnsClassIN))
+
+	return msg, nil
+}
+
+// readDNSName reads a possibly compressed name and returns it with the offset of the data that follows it
+func readDNSName(msg []byte, offset int) (string, int, error) {
+	labels := []string{}
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, errors.New("DNS name out of bounds")
+		}
+
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if next == -1 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(msg) || jumps > 10 {
+				return "", 0, errors.New("Invalid DNS name pointer")
+			}
+			if next == -1 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3FFF)
+			jumps++
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errors.New("DNS label out of bounds")
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// decodeSRVResponse reads the SRV answers of a response to the SRV query for name, addresses in the additional
+// section are matched to the targets. The second return value is set if the response was truncated.
+func decodeSRVResponse(msg []byte, id uint16, name string) ([]SRVRecord, bool, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[0:]) != id {
+		return nil, false, errors.New("Invalid DNS response")
+	}
+
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x0200 != 0 {
+		return nil, true, nil
+	}
+	if rcode := flags & 0x000F; rcode != 0 {
+		return nil, false, errors.New("DNS query failed with response code " + strconv.Itoa(int(rcode)))
+	}
+
+	// Answers to anything but the question we asked are not ours
+	if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return nil, false, errors.New("DNS response does not match the query")
+	}
+	questionName, offset, err := readDNSName(msg, 12)
+	if err != nil {
+		return nil, false, err
+	}
+	if offset+4 > len(msg) || !strings.EqualFold(questionName, strings.TrimSuffix(name, ".")) ||
+		binary.BigEndian.Uint16(msg[offset:]) != dnsTypeSRV || binary.BigEndian.Uint16(msg[offset+2:]) != dnsClassIN {
+		return nil, false, errors.New("DNS response does not match the query")
+	}
+	offset += 4
+
+	records := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+
+	srvRecords := []SRVRecord{}
+	addresses := make(map[string]string)
+	for i := 0; i < records; i++ {
+		name, next, err := readDNSName(msg, offset)
+		if err != nil {
+			return nil, false, err
+		}
+		if next+10 > len(msg) {
+			return nil, false, errors.New("DNS record out of bounds")
+		}
+
+		rType := binary.BigEndian.Uint16(msg[next:])
+		ttl := binary.BigEndian.Uint32(msg[next+4:])
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		data := next + 10
+		if data+length > len(msg) {
+			return nil, false, errors.New("DNS record out of bounds")
+		}
+
+		switch rType {
+		case dnsTypeSRV:
+			if length < 7 {
+				return nil, false, errors.New("Invalid SRV record")
+			}
+			target, _, err := readDNSName(msg, data+6)
+			if err != nil {
+				return nil, false, err
+			}
+			srvRecords = append(srvRecords, SRVRecord{
+				Target:   target,
+				Priority: binary.BigEndian.Uint16(msg[data:]),
+				Weight:   binary.BigEndian.Uint16(msg[data+2:]),
+				Port:     binary.BigEndian.Uint16(msg[data+4:]),
+				TTL:      ttl,
+			})
+		case dnsTypeA, dnsTypeAAAA:
+			if _, found := addresses[strings.ToLower(name)]; !found {
+				addresses[strings.ToLower(name)] = net.IP(msg[data : data+length]).String()
+			}
+		}
+
+		offset = data + length
+	}
+
+	for i, _ := range srvRecords {
+		srvRecords[i].Address = addresses[strings.ToLower(srvRecords[i].Target)]
+	}
+
+	return srvRecords, false, nil
+}
+
+func exchangeDNS(network, resolver string, query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout(network, resolver, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		response := make([]byte, 65535)
+		n, err := conn.Read(response)
+		if err != nil {
+			return nil, err
+		}
+		return response[:n], nil
+	}
+
+	// Over TCP messages are prefixed with their length
+	framed := make([]byte, 2, len(query)+2)
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	if _, err := conn.Write(append(framed, query...)); err != nil {
+		return nil, err
+	}
+
+	lengthPrefix := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lengthPrefix); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(lengthPrefix))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// newDNSQueryID returns a transaction ID that can't be guessed by someone spoofing responses
+func newDNSQueryID() (uint16, error) {
+	id := make([]byte, 2)
+	if _, err := rand.Read(id); err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint16(id), nil
+}
+
+// LookupSRV queries a name server for the SRV records of a name, truncated answers are fetched again over TCP
+func LookupSRV(resolver string, name string, timeout time.Duration) ([]SRVRecord, error) {
+	id, err := newDNSQueryID()
+	if err != nil {
+		return nil, err
+	}
+	query, err := encodeDNSQuestion(id, name, dnsTypeSRV)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		response, err := exchangeDNS(network, resolver, query, timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		records, truncated, err := decodeSRVResponse(response, id, name)
+		if err != nil || !truncated {
+			return records, err
+		}
+	}
+
+	return nil, errors.New("DNS response truncated")
+}
+
+// DNSDiscovery finds the targets of an API with SRV records. Only the records with the lowest priority are
+// used, their weights become the load balancing weights of the targets. A single record with the target "."
+// says the service is not available, its requests are answered with a 503.
+type DNSDiscovery struct {
+	APIID        string
+	Config       DNSDiscoveryConfig
+	loadBalanced bool
+}
+
+func NewDNSDiscovery(spec *APISpec, thisConfig DNSDiscoveryConfig) *DNSDiscovery {
+	return &DNSDiscovery{
+		APIID:        spec.APIID,
+		Config:       thisConfig,
+		loadBalanced: spec.Proxy.EnableLoadBalancing,
+	}
+}
+
+// lookup resolves the targets and returns them with the time they can be cached for
+func (d *DNSDiscovery) lookup() (interface{}, time.Duration, error) {
+	resolver := d.Config.Resolver
+	if resolver == "" {
+		var err error
+		if resolver, err = systemResolver(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	records, err := LookupSRV(resolver, d.Config.Record, time.Duration(d.Config.Timeout)*time.Second)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(records) == 0 {
+		return nil, 0, errors.New("No SRV records for " + d.Config.Record)
+	}
+
+	// A single record with a target of "." says the service is not available, RFC 2782
+	if len(records) == 1 && records[0].Target == "" {
+		log.Warning("[SERVICE DISCOVERY] [DNS] Service ", d.Config.Record, " is not available")
+		cacheFor := time.Duration(d.Config.MinTTL) * time.Second
+		if d.loadBalanced {
+			return &[]string{}, cacheFor, nil
+		}
+		return "", cacheFor, nil
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Priority != records[j].Priority {
+			return records[i].Priority < records[j].Priority
+		}
+		return records[i].Weight > records[j].Weight
+	})
+
+	ttl := records[0].TTL
+	targets := []string{}
+	for _, thisRecord := range records {
+		if thisRecord.Priority != records[0].Priority {
+			break
+		}
+		if thisRecord.TTL < ttl {
+			ttl = thisRecord.TTL
+		}
+
+		host := thisRecord.Address
+		if host == "" {
+			host = strings.TrimSuffix(thisRecord.Target, ".")
+		}
+
+		// A weight of 0 gets the smallest share there is
+		weight := int(thisRecord.Weight)
+		if weight < 1 {
+			weight = 1
+		}
+		targets = append(targets, d.Config.Scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(thisRecord.Port)))+"|"+strconv.Itoa(weight))
+	}
+
+	cacheFor := time.Duration(ttl) * time.Second
+	if minTTL := time.Duration(d.Config.MinTTL) * time.Second; cacheFor < minTTL {
+		cacheFor = minTTL
+	}
+
+	if d.loadBalanced {
+		return &targets, cacheFor, nil
+	}
+
+	// Without load balancing the heaviest target is used
+	return targets[0][:strings.LastIndex(targets[0], "|")], cacheFor, nil
+}
+
+func (d *DNSDiscovery) GetTarget(serviceURL string) (interface{}, error) {
+	data, _, err := d.lookup()
+	return data, err
+}
+
+// newDNSDiscoveryRefresher resolves the SRV records of an API again when their TTL runs out, failed
+// lookups are retried after MinTTL seconds
+func newDNSDiscoveryRefresher(discovery *DNSDiscovery, targets *discoveryTargets) *DiscoveryRefresher {
+	return NewDiscoveryRefresher(targets, discovery.lookup, time.Duration(discovery.Config.MinTTL)*time.Second)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDNSServer answers every query with the same SRV records, over UDP it can answer with a truncated
+// response so that the client has to ask again over TCP
+type fakeDNSServer struct {
+	lock      sync.Mutex
+	records   []SRVRecord
+	truncate  bool
+	tcpUsed   bool
+	udpConn   net.PacketConn
+	tcpListen net.Listener
+}
+
+func newFakeDNSServer(t *testing.T, records []SRVRecord) *fakeDNSServer {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpListen, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeDNSServer{records: records, udpConn: udpConn, tcpListen: tcpListen}
+	go f.serveUDP()
+	go f.serveTCP()
+
+	return f
+}
+
+func (f *fakeDNSServer) Address() string {
+	return f.udpConn.LocalAddr().String()
+}
+
+func (f *fakeDNSServer) Close() {
+	f.udpConn.Close()
+	f.tcpListen.Close()
+}
+
+func (f *fakeDNSServer) setRecords(records []SRVRecord) {
+	f.lock.Lock()
+	f.records = records
+	f.lock.Unlock()
+}
+
+func (f *fakeDNSServer) setTruncate(truncate bool) {
+	f.lock.Lock()
+	f.truncate = truncate
+	f.lock.Unlock()
+}
+
+func (f *fakeDNSServer) usedTCP() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.tcpUsed
+}
+
+func (f *fakeDNSServer) serveUDP() {
+	query := make([]byte, 512)
+	for {
+		n, addr, err := f.udpConn.ReadFrom(query)
+		if err != nil {
+			return
+		}
+		f.lock.Lock()
+		truncate := f.truncate
+		f.lock.Unlock()
+		f.udpConn.WriteTo(f.answer(query[:n], truncate), addr)
+	}
+}
+
+func (f *fakeDNSServer) serveTCP() {
+	for {
+		conn, err := f.tcpListen.Accept()
+		if err != nil {
+			return
+		}
+
+		lengthPrefix := make([]byte, 2)
+		io.ReadFull(conn, lengthPrefix)
+		query := make([]byte, binary.BigEndian.Uint16(lengthPrefix))
+		io.ReadFull(conn, query)
+
+		f.lock.Lock()
+		f.tcpUsed = true
+		f.lock.Unlock()
+
+		response := f.answer(query, false)
+		binary.BigEndian.PutUint16(lengthPrefix, uint16(len(response)))
+		conn.Write(append(lengthPrefix, response...))
+		conn.Close()
+	}
+}
+
+func appendDNSName(msg []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0)
+}
+
+func appendDNSRecord(msg []byte, rType uint16, ttl uint32, data []byte) []byte {
+	header := make([]byte, 10)
+	binary.BigEndian.PutUint16(header[0:], rType)
+	binary.BigEndian.PutUint16(header[2:], dnsClassIN)
+	binary.BigEndian.PutUint32(header[4:], ttl)
+	binary.BigEndian.PutUint16(header[8:], uint16(len(data)))
+	return append(append(msg, header...), data...)
+}
+
+func (f *fakeDNSServer) answer(query []byte, truncate bool) []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	response := append([]byte{}, query[:12]...)
+	flags := uint16(0x8180)
+	if truncate {
+		binary.BigEndian.PutUint16(response[2:], flags|0x0200)
+		return append(response, query[12:]...)
+	}
+
+	addresses := 0
+	for _, thisRecord := range f.records {
+		if thisRecord.Address != "" {
+			addresses++
+		}
+	}
+	binary.BigEndian.PutUint16(response[2:], flags)
+	binary.BigEndian.PutUint16(response[6:], uint16(len(f.records)))
+	binary.BigEndian.PutUint16(response[10:], uint16(addresses))
+	response = append(response, query[12:]...)
+
+	for _, thisRecord := range f.records {
+		// The owner name points back at the question
+		response = append(response, 0xC0, 12)
+		data := make([]byte, 6)
+		binary.BigEndian.PutUint16(data[0:], thisRecord.Priority)
+		binary.BigEndian.PutUint16(data[2:], thisRecord.Weight)
+		binary.BigEndian.PutUint16(data[4:], thisRecord.Port)
+		response = appendDNSRecord(response, dnsTypeSRV, thisRecord.TTL, appendDNSName(data, thisRecord.Target))
+	}
+
+	for _, thisRecord := range f.records {
+		if thisRecord.Address != "" {
+			response = appendDNSName(response, thisRecord.Target)
+			response = appendDNSRecord(response, dnsTypeA, thisRecord.TTL, net.ParseIP(thisRecord.Address).To4())
+		}
+	}
+
+	return response
+}
+
+// dnsTestDiscovery is the discovery field of an API that looks up the orders SRV record with resolver
+func dnsTestDiscovery(resolver string) string {
+	return `"discovery": {
+		"provider": "dns",
+		"dns": {"record": "_orders._tcp.example.com", "resolver": "` + resolver + `", "min_ttl": 1, "timeout": 1}
+	},`
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	server := newFakeDNSServer(t, []SRVRecord{
+		{Target: "orders-1.example.com", Address: "10.0.0.1", Port: 8000, Priority: 10, Weight: 20, TTL: 30},
+		{Target: "orders-2.example.com", Port: 8001, Priority: 10, Weight: 60, TTL: 10},
+		{Target: "orders-3.example.com", Port: 8002, Priority: 10, Weight: 0, TTL: 30},
+		{Target: "backup.example.com", Port: 9000, Priority: 20, Weight: 100, TTL: 30},
+	})
+	defer server.Close()
+
+	spec := createDefinitionFromString(createTestDefinition("dns-test", dnsTestDiscovery(server.Address()), ""))
+	spec.Proxy.ServiceDiscovery.UseDiscoveryService = true
+	spec.Proxy.EnableLoadBalancing = true
+	discovery := NewTargetProvider(&spec).(*DNSDiscovery)
+	data, cacheFor, err := discovery.lookup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the lowest priority is used, ordered by weight, and the addresses from the response are used
+	expected := []string{"http://orders-2.example.com:8001|60", "http://10.0.0.1:8000|20", "http://orders-3.example.com:8002|1"}
+	if thisList := *data.(*[]string); strings.Join(thisList, ",") != strings.Join(expected, ",") {
+		t.Error("Unexpected targets: ", thisList)
+	}
+	if cacheFor != 10*time.Second {
+		t.Error("Targets should be cached for the lowest TTL, got: ", cacheFor)
+	}
+
+	targets := GetLoadBalancerTargets(*data.(*[]string))
+	if targets[0].URL != "http://orders-2.example.com:8001" || targets[0].Weight != 60 {
+		t.Error("Weights should be passed to the load balancer: ", targets[0])
+	}
+
+	// Without load balancing the heaviest target is used
+	spec.Proxy.EnableLoadBalancing = false
+	single, _ := NewTargetProvider(&spec).GetTarget("")
+	if single != "http://orders-2.example.com:8001" {
+		t.Error("Expected a single target, got: ", single)
+	}
+
+	// Truncated answers are fetched again over TCP
+	server.setTruncate(true)
+	if _, _, err := discovery.lookup(); err != nil || !server.usedTCP() {
+		t.Error("Truncated answer should be retried over TCP: ", err)
+	}
+
+	server.setRecords([]SRVRecord{})
+	if _, err := discovery.GetTarget(""); err == nil {
+		t.Error("Lookup without records should fail")
+	}
+
+	// A target of "." means the service is not available, requests to it fail instead of using old targets
+	server.setRecords([]SRVRecord{{Target: ".", Port: 0, TTL: 30}})
+	if data, err := discovery.GetTarget(""); err != nil || len(*data.(*[]string)) != 0 {
+		t.Error("Unavailable service should have no targets, got: ", data, err)
+	}
+}
+
+func TestDNSResponseQuestion(t *testing.T) {
+	// A response to another question is rejected, even with the right ID
+	response, _ := encodeDNSQuestion(42, "_billing._tcp.example.com", dnsTypeSRV)
+	if _, _, err := decodeSRVResponse(response, 42, "_orders._tcp.example.com"); err == nil {
+		t.Error("Response for another name should be rejected")
+	}
+
+	response, _ = encodeDNSQuestion(42, "_Orders._tcp.example.com", dnsTypeSRV)
+	if _, _, err := decodeSRVResponse(response, 42, "_orders._tcp.example.com."); err != nil {
+		t.Error("Names should be compared without case: ", err)
+	}
+
+	response, _ = encodeDNSQuestion(42, "_orders._tcp.example.com", dnsTypeA)
+	if _, _, err := decodeSRVResponse(response, 42, "_orders._tcp.example.com"); err == nil {
+		t.Error("Response for another type should be rejected")
+	}
+}
+
+func TestDNSWatcher(t *testing.T) {
+	server := newFakeDNSServer(t, []SRVRecord{{Target: "orders-1.example.com", Address: "10.0.0.1", Port: 8000, Weight: 1, TTL: 1}})
+	defer server.Close()
+
+	thisSpec := createDefinitionFromString(createTestDefinition("dns-test", dnsTestDiscovery(server.Address()), ""))
+	thisSpec.Proxy.ServiceDiscovery.UseDiscoveryService = true
+	thisSpec.Proxy.EnableLoadBalancing = true
+	spec := &thisSpec
+	TykNewSingleHostReverseProxy(spec.target, spec)
+	defer ServiceCache.Delete(spec.APIID)
+
+	startDiscoveryWatcher(spec)
+	defer pruneDiscoveryWatchers(nil)
+
+	// The records are resolved when the watcher starts and again once the TTL runs out
+	waitForServiceCacheTargets(t, spec.APIID, 3*time.Second, "http://10.0.0.1:8000|1")
+	server.setRecords([]SRVRecord{{Target: "orders-2.example.com", Address: "10.0.0.2", Port: 8000, Weight: 1, TTL: 1}})
+	waitForServiceCacheTargets(t, spec.APIID, 3*time.Second, "http://10.0.0.2:8000|1")
+}
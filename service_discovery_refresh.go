@@ -0,0 +1,220 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// discoveryTargets holds the last targets that were found for an API. They stay in the service cache while
+// discovery fails, until MaxStale has passed since the last successful lookup.
+type discoveryTargets struct {
+	APIID       string
+	Provider    string
+	MaxStale    time.Duration
+	spec        *APISpec
+	lastGood    []string
+	lastSuccess time.Time
+	unreachable bool
+	lock        sync.Mutex
+}
+
+func newDiscoveryTargets(spec *APISpec, thisConfig DiscoveryConfig) *discoveryTargets {
+	return &discoveryTargets{
+		APIID:    spec.APIID,
+		Provider: thisConfig.Provider,
+		MaxStale: time.Duration(thisConfig.MaxStale) * time.Second,
+		spec:     spec,
+	}
+}
+
+func (d *discoveryTargets) setSpec(spec *APISpec) {
+	d.lock.Lock()
+	d.spec = spec
+	d.lock.Unlock()
+}
+
+// targetDataAsList converts the target data of a provider into a list of targets
+func targetDataAsList(data interface{}) []string {
+	switch thisData := data.(type) {
+	case string:
+		return []string{thisData}
+	case *[]string:
+		return append([]string{}, *thisData...)
+	}
+
+	return []string{}
+}
+
+func sameTargetList(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, _ := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// success stores the targets of a lookup, validFor is how long the provider considers them valid
+func (d *discoveryTargets) success(data interface{}, validFor time.Duration) {
+	targets := targetDataAsList(data)
+
+	d.lock.Lock()
+	previous := d.lastGood
+	changed := !d.lastSuccess.IsZero() && !sameTargetList(previous, targets)
+	recovered := d.unreachable
+	d.lastGood = targets
+	d.lastSuccess = time.Now()
+	d.unreachable = false
+	spec := d.spec
+	d.lock.Unlock()
+
+	if ServiceCache != nil {
+		if validFor < d.MaxStale {
+			validFor = d.MaxStale
+		}
+		ServiceCache.Set(d.APIID, data, validFor)
+	}
+
+	if recovered {
+		log.WithFields(logrus.Fields{
+			"api_id":   d.APIID,
+			"provider": d.Provider,
+		}).Info("[SERVICE DISCOVERY] Discovery is reachable again")
+	}
+
+	if changed {
+		log.WithFields(logrus.Fields{
+			"api_id":   d.APIID,
+			"provider": d.Provider,
+			"targets":  targets,
+		}).Info("[SERVICE DISCOVERY] Targets changed")
+
+		spec.FireEvent(EVENT_DiscoveryTargetsChanged,
+			EVENT_ServiceDiscoveryMeta{
+				EventMetaDefault: EventMetaDefault{Message: "Service discovery targets changed"},
+				APIID:            d.APIID,
+				Provider:         d.Provider,
+				Targets:          targets,
+				PreviousTargets:  previous,
+			})
+	}
+}
+
+// failure keeps the last known targets, the event is only fired for the first failure of an outage
+func (d *discoveryTargets) failure(err error) {
+	d.lock.Lock()
+	firstFailure := !d.unreachable
+	d.unreachable = true
+	lastGood, lastSuccess := d.lastGood, d.lastSuccess
+	spec := d.spec
+	d.lock.Unlock()
+
+	thisLog := log.WithFields(logrus.Fields{
+		"api_id":   d.APIID,
+		"provider": d.Provider,
+	})
+	if lastSuccess.IsZero() {
+		thisLog.Warning("[SERVICE DISCOVERY] Lookup failed, no targets known: ", err)
+	} else if time.Since(lastSuccess) < d.MaxStale {
+		thisLog.Warning("[SERVICE DISCOVERY] Lookup failed, serving targets from ", lastSuccess.Format(time.RFC3339), ": ", err)
+	} else {
+		thisLog.Error("[SERVICE DISCOVERY] Lookup failed, last known targets are too old to use: ", err)
+	}
+
+	if !firstFailure {
+		return
+	}
+
+	spec.FireEvent(EVENT_DiscoveryUnreachable,
+		EVENT_ServiceDiscoveryMeta{
+			EventMetaDefault: EventMetaDefault{Message: "Service discovery is unreachable: " + err.Error()},
+			APIID:            d.APIID,
+			Provider:         d.Provider,
+			Targets:          lastGood,
+		})
+}
+
+// DiscoveryRefresher looks up the targets of an API in the background, lookup returns the targets and the
+// time until the next lookup. Failed lookups are retried after RetryInterval.
+type DiscoveryRefresher struct {
+	RetryInterval time.Duration
+	targets       *discoveryTargets
+	lookup        func() (interface{}, time.Duration, error)
+	refreshNow    chan struct{}
+	stop          chan struct{}
+}
+
+func NewDiscoveryRefresher(targets *discoveryTargets, lookup func() (interface{}, time.Duration, error), retryInterval time.Duration) *DiscoveryRefresher {
+	return &DiscoveryRefresher{
+		RetryInterval: retryInterval,
+		targets:       targets,
+		lookup:        lookup,
+		refreshNow:    make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+	}
+}
+
+// Start refreshes the targets until Stop is called, the first lookup is made straight away
+func (r *DiscoveryRefresher) Start() {
+	go func() {
+		for {
+			nextRefresh := r.refresh()
+			select {
+			case <-time.After(nextRefresh):
+			case <-r.refreshNow:
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (r *DiscoveryRefresher) Stop() {
+	close(r.stop)
+}
+
+// RefreshNow makes the next lookup happen straight away, without waiting for the refresh interval
+func (r *DiscoveryRefresher) RefreshNow() {
+	select {
+	case r.refreshNow <- struct{}{}:
+	default:
+	}
+}
+
+// refresh makes one lookup and returns the time until the next one
+func (r *DiscoveryRefresher) refresh() time.Duration {
+	data, nextRefresh, err := r.lookup()
+	if err != nil {
+		r.targets.failure(err)
+		return r.RetryInterval
+	}
+
+	// Targets are valid until two refreshes have been missed
+	r.targets.success(data, 2*nextRefresh)
+	return nextRefresh
+}
+
+// newHTTPDiscoveryRefresher polls the query endpoint of an API every RefreshInterval seconds
+func newHTTPDiscoveryRefresher(spec *APISpec, thisConfig DiscoveryConfig, targets *discoveryTargets) *DiscoveryRefresher {
+	sd := &ServiceDiscovery{}
+	sd.New(spec)
+	queryEndpoint := spec.Proxy.ServiceDiscovery.QueryEndpoint
+	interval := time.Duration(thisConfig.RefreshInterval) * time.Second
+
+	lookup := func() (interface{}, time.Duration, error) {
+		data, err := sd.GetTarget(queryEndpoint)
+		return data, interval, err
+	}
+
+	retryInterval := 5 * time.Second
+	if interval < retryInterval {
+		retryInterval = interval
+	}
+
+	return NewDiscoveryRefresher(targets, lookup, retryInterval)
+}
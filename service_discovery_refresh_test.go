@@ -0,0 +1,147 @@
+package main
+
+import (
+	"github.com/lonelycode/tykcommon"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitForDiscoveryEvent(t *testing.T, events chan EventMessage, expected tykcommon.TykEvent, timeout time.Duration) EVENT_ServiceDiscoveryMeta {
+	select {
+	case em := <-events:
+		if em.EventType != expected {
+			t.Fatal("Expected event ", expected, " got ", em.EventType)
+		}
+		return em.EventMetaData.(EVENT_ServiceDiscoveryMeta)
+	case <-time.After(timeout):
+		t.Fatal("Event not fired: ", expected)
+	}
+
+	return EVENT_ServiceDiscoveryMeta{}
+}
+
+func TestDiscoveryRefresh(t *testing.T) {
+	var lock sync.Mutex
+	response, status := `[{"Address": "10.0.0.1", "ServicePort": 8000}]`, 200
+	setResponse := func(newResponse string, newStatus int) {
+		lock.Lock()
+		response, status = newResponse, newStatus
+		lock.Unlock()
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	def := createTestDefinition("refresh-test", `"discovery": {"refresh_interval": 1, "max_stale": 2},`, "")
+	spec := createDefinitionFromString(def)
+	spec.Proxy.EnableLoadBalancing = true
+	spec.Proxy.ServiceDiscovery = tykcommon.ServiceDiscoveryConfiguration{
+		UseDiscoveryService: true,
+		QueryEndpoint:       server.URL,
+		UseTargetList:       true,
+		EndpointReturnsList: true,
+		DataPath:            "Address",
+		PortDataPath:        "ServicePort",
+	}
+
+	events := make(chan EventMessage, 10)
+	spec.EventPaths = map[tykcommon.TykEvent][]TykEventHandler{
+		EVENT_DiscoveryTargetsChanged: {testHostEventHandler{events}},
+		EVENT_DiscoveryUnreachable:    {testHostEventHandler{events}},
+	}
+
+	TykNewSingleHostReverseProxy(spec.target, &spec)
+	defer ServiceCache.Delete(spec.APIID)
+
+	startDiscoveryWatcher(&spec)
+	defer pruneDiscoveryWatchers(nil)
+	waitForServiceCacheTargets(t, spec.APIID, time.Second, "10.0.0.1:8000")
+
+	// Targets are refreshed before they expire
+	setResponse(`[{"Address": "10.0.0.1", "ServicePort": 8000}, {"Address": "10.0.0.2", "ServicePort": 8000}]`, 200)
+	changed := waitForDiscoveryEvent(t, events, EVENT_DiscoveryTargetsChanged, 3*time.Second)
+	if len(changed.PreviousTargets) != 1 || len(changed.Targets) != 2 {
+		t.Error("Event should carry the old and new targets: ", changed)
+	}
+	waitForServiceCacheTargets(t, spec.APIID, time.Second, "10.0.0.1:8000", "10.0.0.2:8000")
+
+	// The last known targets are kept while discovery fails
+	setResponse("", 503)
+	unreachable := waitForDiscoveryEvent(t, events, EVENT_DiscoveryUnreachable, 3*time.Second)
+	if len(unreachable.Targets) != 2 {
+		t.Error("Event should carry the last known targets: ", unreachable)
+	}
+	if targets, err := GetURLFromService(&spec); err != nil || len(*targets.(*[]string)) != 2 {
+		t.Error("Last known targets should be served: ", targets, err)
+	}
+
+	// Until they are too old
+	for deadline := time.Now().Add(4 * time.Second); getServiceCacheTargets(spec.APIID) != nil; time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Stale targets were not dropped")
+		}
+	}
+	select {
+	case em := <-events:
+		t.Error("Only the first failure should fire an event, got: ", em.EventType)
+	default:
+	}
+
+	setResponse(`[{"Address": "10.0.0.3", "ServicePort": 8000}]`, 200)
+	waitForServiceCacheTargets(t, spec.APIID, 3*time.Second, "10.0.0.3:8000")
+}
+
+func TestDiscoveryRefreshNow(t *testing.T) {
+	var lookups int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&lookups, 1)
+		w.Write([]byte(`[{"Address": "10.0.0.1", "ServicePort": 8000}]`))
+	}))
+	defer server.Close()
+
+	def := createTestDefinition("refresh-now-test", `"discovery": {"refresh_interval": 60},`, "")
+	spec := createDefinitionFromString(def)
+	spec.Proxy.EnableLoadBalancing = true
+	spec.Proxy.ServiceDiscovery = tykcommon.ServiceDiscoveryConfiguration{
+		UseDiscoveryService: true,
+		QueryEndpoint:       server.URL,
+		UseTargetList:       true,
+		EndpointReturnsList: true,
+		DataPath:            "Address",
+		PortDataPath:        "ServicePort",
+	}
+
+	TykNewSingleHostReverseProxy(spec.target, &spec)
+	defer ServiceCache.Delete(spec.APIID)
+
+	startDiscoveryWatcher(&spec)
+	defer pruneDiscoveryWatchers(nil)
+	waitForServiceCacheTargets(t, spec.APIID, time.Second, "10.0.0.1:8000")
+
+	// Failing upstreams make the watcher look the targets up again, the cached ones stay in use meanwhile
+	refreshDiscoveryTargets(spec.APIID)
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&lookups) < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Watcher did not refresh the targets")
+		}
+	}
+	if getServiceCacheTargets(spec.APIID) == nil {
+		t.Error("Targets should stay cached during a refresh")
+	}
+
+	// Requests don't wait for a lookup when the cache is empty
+	ServiceCache.Delete(spec.APIID)
+	if _, err := GetURLFromService(&spec); err == nil {
+		t.Error("Lookup should not happen on the request path when the API has a watcher")
+	}
+	waitForServiceCacheTargets(t, spec.APIID, time.Second, "10.0.0.1:8000")
+}
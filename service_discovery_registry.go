@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	REGISTRY_KEYPREFIX    string = "tyk-targets."
+	REGISTRY_SOURCE_FILE  string = "file"
+	REGISTRY_SOURCE_REDIS string = "redis"
+)
+
+// RegistryDiscoveryConfig is set under "discovery.registry". The targets of Service (the API ID by default)
+// are read from the JSON or YAML file at Path, or from a Redis hash that is managed with /tyk/targets/{api_id}.
+// Hashes belong to the organisation of the API, APIs of other organisations with the same Service use their own.
+type RegistryDiscoveryConfig struct {
+	Source  string `mapstructure:"source" bson:"source" json:"source"`
+	Path    string `mapstructure:"path" bson:"path" json:"path"`
+	Service string `mapstructure:"service" bson:"service" json:"service"`
+}
+
+func (c RegistryDiscoveryConfig) withDefaults(spec *APISpec) RegistryDiscoveryConfig {
+	if c.Source == "" {
+		c.Source = REGISTRY_SOURCE_REDIS
+		if c.Path != "" {
+			c.Source = REGISTRY_SOURCE_FILE
+		}
+	}
+	if c.Service == "" {
+		c.Service = spec.APIID
+	}
+
+	return c
+}
+
+// RegistryTarget is a single upstream in the target registry, a weight below 1 counts as 1
+type RegistryTarget struct {
+	URL    string `json:"url" yaml:"url"`
+	Weight int    `json:"weight" yaml:"weight"`
+}
+
+// sortRegistryTargets orders targets by weight, heaviest first, so that lists can be compared
+func sortRegistryTargets(targets []RegistryTarget) {
+	sort.SliceStable(targets, func(i, j int) bool {
+		if targets[i].Weight != targets[j].Weight {
+			return targets[i].Weight > targets[j].Weight
+		}
+		return targets[i].URL < targets[j].URL
+	})
+}
+
+func checkRegistryTargets(targets []RegistryTarget) error {
+	for i, _ := range targets {
+		if err := checkTargetURL(targets[i].URL); err != nil {
+			return errors.New(targets[i].URL + ": " + err.Error())
+		}
+		if targets[i].Weight < 1 {
+			targets[i].Weight = 1
+		}
+	}
+
+	return nil
+}
+
+// readRegistryFile reads a file that maps service names to their targets, files ending in .yaml or .yml
+// are read as YAML and anything else as JSON
+func readRegistryFile(path string) (map[string][]RegistryTarget, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	services := make(map[string][]RegistryTarget)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(contents, &services)
+	default:
+		err = json.Unmarshal(contents, &services)
+	}
+
+	return services, err
+}
+
+var registryStore *RedisClusterStorageManager
+var registryStoreOnce sync.Once
+
+func getRegistryStore() *RedisClusterStorageManager {
+	registryStoreOnce.Do(func() {
+		registryStore = &RedisClusterStorageManager{KeyPrefix: REGISTRY_KEYPREFIX}
+		registryStore.Connect()
+	})
+
+	return registryStore
+}
+
+// registryServiceKey names the hash of a service, e.g. tyk-targets.{org_id}.{service}
+func registryServiceKey(orgID string, service string) string {
+	return orgID + "." + service
+}
+
+// readRegistryHash reads the targets of a service from Redis, the hash maps target URLs to weights
+func readRegistryHash(orgID string, service string) ([]RegistryTarget, error) {
+	fields, err := getRegistryStore().GetHash(registryServiceKey(orgID, service))
+	if err != nil {
+		return nil, err
+	}
+
+	targets := []RegistryTarget{}
+	for targetURL, weight := range fields {
+		asInt, _ := strconv.Atoi(weight)
+		targets = append(targets, RegistryTarget{URL: targetURL, Weight: asInt})
+	}
+
+	return targets, nil
+}
+
+func writeRegistryHash(orgID string, service string, targets []RegistryTarget) error {
+	fields := make(map[string]string)
+	for _, thisTarget := range targets {
+		fields[thisTarget.URL] = strconv.Itoa(thisTarget.Weight)
+	}
+
+	return getRegistryStore().SetHash(registryServiceKey(orgID, service), fields)
+}
+
+// RegistryDiscovery finds the targets of an API in the target registry
+type RegistryDiscovery struct {
+	APIID        string
+	OrgID        string
+	Config       RegistryDiscoveryConfig
+	loadBalanced bool
+	interval     time.Duration
+}
+
+func NewRegistryDiscovery(spec *APISpec, thisConfig DiscoveryConfig) *RegistryDiscovery {
+	return &RegistryDiscovery{
+		APIID:        spec.APIID,
+		OrgID:        spec.OrgID,
+		Config:       thisConfig.Registry,
+		loadBalanced: spec.Proxy.EnableLoadBalancing,
+		interval:     time.Duration(thisConfig.RefreshInterval) * time.Second,
+	}
+}
+
+// Targets returns the registered targets of the service, heaviest first
+func (d *RegistryDiscovery) Targets() ([]RegistryTarget, error) {
+	var targets []RegistryTarget
+	if d.Config.Source == REGISTRY_SOURCE_FILE {
+		services, err := readRegistryFile(d.Config.Path)
+		if err != nil {
+			return nil, err
+		}
+		targets = services[d.Config.Service]
+	} else {
+		var err error
+		if targets, err = readRegistryHash(d.OrgID, d.Config.Service); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkRegistryTargets(targets); err != nil {
+		return nil, err
+	}
+	sortRegistryTargets(targets)
+
+	return targets, nil
+}
+
+func (d *RegistryDiscovery) lookup() (interface{}, time.Duration, error) {
+	targets, err := d.Targets()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(targets) == 0 {
+		return nil, 0, errors.New("No targets registered for service " + d.Config.Service)
+	}
+
+	if !d.loadBalanced {
+		return targets[0].URL, d.interval, nil
+	}
+
+	targetList := []string{}
+	for _, thisTarget := range targets {
+		targetList = append(targetList, thisTarget.URL+"|"+strconv.Itoa(thisTarget.Weight))
+	}
+
+	return &targetList, d.interval, nil
+}
+
+func (d *RegistryDiscovery) GetTarget(serviceURL string) (interface{}, error) {
+	data, _, err := d.lookup()
+	return data, err
+}
+
+// newRegistryDiscoveryRefresher reads the registry every RefreshInterval seconds, changes made through the
+// targets endpoint are picked up straight away
+func newRegistryDiscoveryRefresher(discovery *RegistryDiscovery, targets *discoveryTargets) *DiscoveryRefresher {
+	return NewDiscoveryRefresher(targets, discovery.lookup, discovery.interval)
+}
+
+// refreshRegistryTargets re-reads the targets of every API that uses a registry service, serviceKey is
+// built with registryServiceKey
+func refreshRegistryTargets(serviceKey string) {
+	discoveryWatchersLock.Lock()
+	defer discoveryWatchersLock.Unlock()
+
+	for _, thisEntry := range discoveryWatchers {
+		if thisEntry.config.Provider != DISCOVERY_REGISTRY || registryServiceKey(thisEntry.orgID, thisEntry.config.Registry.Service) != serviceKey {
+			continue
+		}
+		thisEntry.watcher.RefreshNow()
+	}
+}
+
+// RegistryTargetsStatus is returned by the targets endpoint
+type RegistryTargetsStatus struct {
+	APIID   string           `json:"api_id"`
+	Service string           `json:"service"`
+	Source  string           `json:"source"`
+	Targets []RegistryTarget `json:"targets"`
+}
+
+// targetsHandler shows the registered targets of an API with GET /tyk/targets/{api_id}, replaces them with
+// PUT and removes them with DELETE. Only targets that are kept in Redis can be changed.
+func targetsHandler(w http.ResponseWriter, r *http.Request) {
+	APIID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tyk/targets"), "/")
+	thisSpec := GetSpecForApi(APIID)
+	if APIID == "" || thisSpec == nil || !GetAdminTokenFromRequest(r).CanAccessAPI(APIID) {
+		DoJSONWrite(w, 404, createError("API ID not found"))
+		return
+	}
+
+	thisConfig := GetDiscoveryConfig(thisSpec)
+	if thisConfig.Provider != DISCOVERY_REGISTRY {
+		DoJSONWrite(w, 400, createError("API does not use the target registry"))
+		return
+	}
+
+	discovery := NewRegistryDiscovery(thisSpec, thisConfig)
+	before, err := discovery.Targets()
+	if err != nil {
+		log.Error("Failed to read registered targets: ", err)
+		DoJSONWrite(w, 500, createError("Failed to read registered targets"))
+		return
+	}
+
+	status := RegistryTargetsStatus{APIID: APIID, Service: thisConfig.Registry.Service, Source: thisConfig.Registry.Source, Targets: before}
+	switch r.Method {
+	case "GET":
+		responseMessage, _ := json.Marshal(status)
+		DoJSONWrite(w, 200, responseMessage)
+		return
+	case "PUT", "DELETE":
+	default:
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	if thisConfig.Registry.Source != REGISTRY_SOURCE_REDIS {
+		DoJSONWrite(w, 400, createError("Targets of this API are managed in "+thisConfig.Registry.Path))
+		return
+	}
+
+	after := []RegistryTarget{}
+	if r.Method == "PUT" {
+		if err := json.NewDecoder(r.Body).Decode(&after); err != nil {
+			DoJSONWrite(w, 400, createError("Request malformed"))
+			return
+		}
+		if err := checkRegistryTargets(after); err != nil {
+			DoJSONWrite(w, 400, createError("Invalid target "+err.Error()))
+			return
+		}
+		sortRegistryTargets(after)
+	}
+
+	if err := writeRegistryHash(thisSpec.OrgID, thisConfig.Registry.Service, after); err != nil {
+		log.Error("Failed to store registered targets: ", err)
+		DoJSONWrite(w, 500, createError("Failed to store registered targets"))
+		return
+	}
+
+	action := "update"
+	if r.Method == "DELETE" {
+		action = "delete"
+	}
+	RecordAuditEvent(r, action, AuditObjectTargets, APIID, thisSpec.OrgID, before, after)
+
+	// Apply the change here and on the other nodes
+	serviceKey := registryServiceKey(thisSpec.OrgID, thisConfig.Registry.Service)
+	refreshRegistryTargets(serviceKey)
+	MainNotifier.Notify(Notification{Command: NoticeTargetsChanged, Payload: serviceKey})
+
+	status.Targets = after
+	responseMessage, _ := json.Marshal(status)
+	DoJSONWrite(w, 200, responseMessage)
+}
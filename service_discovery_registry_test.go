@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistryDiscoveryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tyk-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jsonPath := filepath.Join(dir, "targets.json")
+	yamlPath := filepath.Join(dir, "targets.yaml")
+	ioutil.WriteFile(jsonPath, []byte(`{"orders": [{"url": "http://10.0.0.1:8000", "weight": 1}, {"url": "http://10.0.0.2:8000", "weight": 3}]}`), 0644)
+	ioutil.WriteFile(yamlPath, []byte("orders:\n  - url: http://10.0.0.3:8000\n    weight: 2\n  - url: http://10.0.0.4:8000\n"), 0644)
+
+	// Targets are ordered by weight and a missing weight counts as 1
+	yamlSpec := createDefinitionFromString(createTestDefinition("registry-yaml", `"discovery": {"provider": "registry", "refresh_interval": 1, "registry": {"path": "`+yamlPath+`", "service": "orders"}},`, ""))
+	yamlSpec.Proxy.ServiceDiscovery.UseDiscoveryService = true
+	yamlSpec.Proxy.EnableLoadBalancing = true
+	yamlData, err := NewTargetProvider(&yamlSpec).GetTarget("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thisList := *yamlData.(*[]string); strings.Join(thisList, ",") != "http://10.0.0.3:8000|2,http://10.0.0.4:8000|1" {
+		t.Error("Unexpected targets from YAML: ", thisList)
+	}
+
+	thisSpec := createDefinitionFromString(createTestDefinition("registry-file", `"discovery": {"provider": "registry", "refresh_interval": 1, "registry": {"path": "`+jsonPath+`", "service": "orders"}},`, ""))
+	thisSpec.Proxy.ServiceDiscovery.UseDiscoveryService = true
+	thisSpec.Proxy.EnableLoadBalancing = true
+	spec := &thisSpec
+	TykNewSingleHostReverseProxy(spec.target, spec)
+	defer ServiceCache.Delete(spec.APIID)
+
+	startDiscoveryWatcher(spec)
+	defer pruneDiscoveryWatchers(nil)
+	waitForServiceCacheTargets(t, spec.APIID, time.Second, "http://10.0.0.2:8000|3", "http://10.0.0.1:8000|1")
+
+	// Changes to the file are picked up without a reload
+	ioutil.WriteFile(jsonPath, []byte(`{"orders": [{"url": "http://10.0.0.5:8000", "weight": 1}]}`), 0644)
+	waitForServiceCacheTargets(t, spec.APIID, 3*time.Second, "http://10.0.0.5:8000|1")
+
+	// A broken file keeps the last known targets
+	ioutil.WriteFile(jsonPath, []byte(`{"orders": `), 0644)
+	time.Sleep(1500 * time.Millisecond)
+	if targets := getServiceCacheTargets(spec.APIID); len(targets) != 1 || targets[0] != "http://10.0.0.5:8000|1" {
+		t.Error("Last known targets should be kept: ", targets)
+	}
+}
+
+func TestRegistryTargetsEndpoint(t *testing.T) {
+	// Refreshes come from the endpoint, not from polling
+	thisSpec := createDefinitionFromString(createTestDefinition("registry-redis", `"discovery": {"provider": "registry", "refresh_interval": 60, "registry": {}},`, ""))
+	thisSpec.Proxy.ServiceDiscovery.UseDiscoveryService = true
+	spec := &thisSpec
+	ApiSpecRegister = map[string]*APISpec{spec.APIID: spec}
+	defer func() { ApiSpecRegister = make(map[string]*APISpec) }()
+	defer writeRegistryHash(spec.OrgID, spec.APIID, nil)
+
+	TykNewSingleHostReverseProxy(spec.target, spec)
+	defer ServiceCache.Delete(spec.APIID)
+
+	writeRegistryHash(spec.OrgID, spec.APIID, []RegistryTarget{{URL: "http://10.0.0.1:8000", Weight: 1}})
+	startDiscoveryWatcher(spec)
+	defer pruneDiscoveryWatchers(nil)
+
+	callTargetsEndpoint := func(method string, body string) (int, RegistryTargetsStatus) {
+		req, _ := http.NewRequest(method, "/tyk/targets/"+spec.APIID, bytes.NewBufferString(body))
+		req.Header.Set("x-tyk-authorization", config.Secret)
+		recorder := httptest.NewRecorder()
+		CheckAdminScope(AdminScopeTargets, targetsHandler)(recorder, req)
+
+		status := RegistryTargetsStatus{}
+		json.Unmarshal(recorder.Body.Bytes(), &status)
+		return recorder.Code, status
+	}
+
+	waitForCachedTarget := func(expected string) {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if cached, found := ServiceCache.Get(spec.APIID); found && cached == expected {
+				return
+			}
+		}
+		cached, _ := ServiceCache.Get(spec.APIID)
+		t.Fatal("Expected target ", expected, " got: ", cached)
+	}
+	waitForCachedTarget("http://10.0.0.1:8000")
+
+	if code, status := callTargetsEndpoint("GET", ""); code != 200 || status.Source != REGISTRY_SOURCE_REDIS || len(status.Targets) != 1 {
+		t.Fatal("Unexpected targets: ", code, status)
+	}
+
+	// Updates apply straight away, the heaviest target is used without load balancing
+	code, status := callTargetsEndpoint("PUT", `[{"url": "http://10.0.0.2:8000", "weight": 1}, {"url": "http://10.0.0.3:8000", "weight": 5}]`)
+	if code != 200 || len(status.Targets) != 2 || status.Targets[0].URL != "http://10.0.0.3:8000" {
+		t.Fatal("Targets were not updated: ", code, status)
+	}
+	waitForCachedTarget("http://10.0.0.3:8000")
+
+	if code, _ := callTargetsEndpoint("PUT", `[{"url": "not a url"}]`); code != 400 {
+		t.Error("Invalid targets should be rejected, got: ", code)
+	}
+	if code, _ := callTargetsEndpoint("POST", `[]`); code != 405 {
+		t.Error("Unsupported methods should be rejected, got: ", code)
+	}
+
+	// Other nodes are told about changes through the reload channel
+	writeRegistryHash(spec.OrgID, spec.APIID, []RegistryTarget{{URL: "http://10.0.0.4:8000", Weight: 1}})
+	notice, _ := json.Marshal(Notification{Command: NoticeTargetsChanged, Payload: registryServiceKey(spec.OrgID, spec.APIID)})
+	HandleRedisReloadMsg(redis.Message{Data: notice})
+	waitForCachedTarget("http://10.0.0.4:8000")
+
+	// Without targets the last known ones are kept
+	if code, status := callTargetsEndpoint("DELETE", ""); code != 200 || len(status.Targets) != 0 {
+		t.Fatal("Targets were not removed: ", code, status)
+	}
+	time.Sleep(100 * time.Millisecond)
+	waitForCachedTarget("http://10.0.0.4:8000")
+}
+
+func TestRegistryTargetsOrgs(t *testing.T) {
+	thisSpec := createDefinitionFromString(createTestDefinition("registry-org", `"discovery": {"provider": "registry", "refresh_interval": 60, "registry": {"service": "orders"}},`, ""))
+	thisSpec.Proxy.ServiceDiscovery.UseDiscoveryService = true
+	thisSpec.Proxy.EnableLoadBalancing = true
+	spec := &thisSpec
+	ApiSpecRegister = map[string]*APISpec{spec.APIID: spec}
+	defer func() { ApiSpecRegister = make(map[string]*APISpec) }()
+	defer writeRegistryHash(spec.OrgID, "orders", nil)
+
+	// Targets are kept per organisation
+	writeRegistryHash(spec.OrgID, "orders", []RegistryTarget{{URL: "http://10.0.0.1:8000", Weight: 1}})
+	if targets, _ := readRegistryHash("other-org", "orders"); len(targets) != 0 {
+		t.Error("Targets of another organisation should not be visible: ", targets)
+	}
+	if targets, _ := readRegistryHash(spec.OrgID, "orders"); len(targets) != 1 {
+		t.Error("Expected the registered target, got: ", targets)
+	}
+
+	// APIs of other organisations can use the same service name, it refers to their own hash
+	def := createTestDefinition("registry-other-org", `"discovery": {"provider": "registry", "registry": {"service": "orders"}},`, "")
+	def = strings.Replace(def, `"org_id": "default",`, `"org_id": "other-org",`, 1)
+	def = strings.Replace(def, `"listen_path": "/v1",`, `"listen_path": "/other-org", "service_discovery": {"use_discovery_service": true},`, 1)
+	if result := ValidateAPIDefinition([]byte(def)); !result.Valid {
+		t.Error("Service name of another organisation should be accepted, got: ", result.Errors)
+	}
+}
@@ -8,6 +8,8 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/context"
 	"github.com/pmylund/go-cache"
 	"io"
@@ -18,17 +20,50 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var ServiceCache *cache.Cache
 
+// ErrNoUpstreamTargets is returned when an API has no target to send a request to
+var ErrNoUpstreamTargets = errors.New("no upstream targets available")
+
+// GetURLFromService returns the targets of an API from the service cache. APIs with a discovery watcher never
+// look their targets up on the request path, the watcher is asked to refresh them instead. Otherwise they are
+// looked up with the discovery provider of the API if the cache has expired.
 func GetURLFromService(spec *APISpec) (interface{}, error) {
-	sd := ServiceDiscovery{}
-	sd.New(spec)
-	data, err := sd.GetTarget(spec.Proxy.ServiceDiscovery.QueryEndpoint)
+	if ServiceCache != nil {
+		if cachedTargets, found := ServiceCache.Get(spec.APIID); found {
+			return cachedTargets, nil
+		}
+	}
+
+	if refreshDiscoveryTargets(spec.APIID) {
+		return nil, errors.New("No service discovery targets known for API " + spec.APIID)
+	}
+
+	data, err := NewTargetProvider(spec).GetTarget(spec.Proxy.ServiceDiscovery.QueryEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	setServiceCache(spec, data)
+	return data, nil
+}
+
+// setServiceCache stores the targets of an API for the cache timeout of the API, or the default timeout
+func setServiceCache(spec *APISpec, data interface{}) {
+	if ServiceCache == nil {
+		return
+	}
+
+	expiry := cache.DefaultExpiration
+	if spec.Proxy.ServiceDiscovery.CacheTimeout > 0 {
+		expiry = time.Duration(spec.Proxy.ServiceDiscovery.CacheTimeout) * time.Second
+	}
 
-	return data, err
+	ServiceCache.Set(spec.APIID, data, expiry)
 }
 
 func EnsureTransport(host string) string {
@@ -45,17 +80,73 @@ func EnsureTransport(host string) string {
 	return host
 }
 
-func GetNextTarget(targetData interface{}, spec *APISpec) string {
+func GetNextTarget(targetData interface{}, spec *APISpec, r *http.Request) (string, error) {
 	if spec.Proxy.EnableLoadBalancing {
 		log.Debug("[PROXY] [LOAD BALANCING] Load balancer enabled, getting upstream target")
 		// Use a list
-		spec.RoundRobin.SetMax(targetData)
-		td := *targetData.(*[]string)
-		return EnsureTransport(td[spec.RoundRobin.GetPos()])
+		targets := GetLoadBalancerTargets(*targetData.(*[]string))
+		if len(targets) == 0 {
+			log.Error("[PROXY] [LOAD BALANCING] No upstream targets for API ", spec.APIID)
+			return "", ErrNoUpstreamTargets
+		}
+
+		if spec.UpstreamHealth != nil {
+			// Skip targets that are failing their health checks
+			healthyTargets := make([]LoadBalancerTarget, 0, len(targets))
+			for _, thisTarget := range targets {
+				if spec.UpstreamHealth.IsHealthy(thisTarget.URL) {
+					healthyTargets = append(healthyTargets, thisTarget)
+				}
+			}
+
+			if len(healthyTargets) > 0 {
+				targets = healthyTargets
+			} else {
+				log.Warning("[PROXY] [LOAD BALANCING] No healthy upstream targets for API ", spec.APIID, ", using all targets")
+			}
+		}
+
+		if r != nil {
+			if triedTargets, ok := context.Get(r, RetryExcludedTargets).(map[string]bool); ok {
+				untriedTargets := make([]LoadBalancerTarget, 0, len(targets))
+				for _, thisTarget := range targets {
+					if !triedTargets[lbTargetKey(thisTarget.URL)] {
+						untriedTargets = append(untriedTargets, thisTarget)
+					}
+				}
+
+				if len(untriedTargets) > 0 {
+					targets = untriedTargets
+				}
+			}
+		}
+
+		thisTarget := spec.LoadBalancer.Next(targets, r)
+		if r != nil {
+			context.Set(r, LoadBalancedTarget, lbTargetKey(thisTarget.URL))
+		}
+		return thisTarget.URL, nil
 	}
 	// Use standard target - might still be service data
 	log.Debug("TARGET DATA:", targetData)
-	return EnsureTransport(targetData.(string))
+	if targetData.(string) == "" {
+		log.Error("[PROXY] No upstream target for API ", spec.APIID)
+		return "", ErrNoUpstreamTargets
+	}
+	return EnsureTransport(targetData.(string)), nil
+}
+
+// directToTarget points a request at the target, the target's path is prepended to the request path
+func directToTarget(req *http.Request, target *url.URL) {
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
+	req.Host = target.Host
+	if target.RawQuery == "" || req.URL.RawQuery == "" {
+		req.URL.RawQuery = target.RawQuery + req.URL.RawQuery
+	} else {
+		req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
+	}
 }
 
 // TykNewSingleHostReverseProxy returns a new ReverseProxy that rewrites
@@ -65,9 +156,8 @@ func GetNextTarget(targetData interface{}, spec *APISpec) string {
 // stdlib version by also setting the host to the target, this allows
 // us to work with heroku and other such providers
 func TykNewSingleHostReverseProxy(target *url.URL, spec *APISpec) *ReverseProxy {
-	// initalise round robin
-	spec.RoundRobin = &RoundRobin{}
-	spec.RoundRobin.SetMax(&[]string{})
+	// initialise the load balancer
+	spec.LoadBalancer = NewLoadBalancer(spec)
 
 	if spec.Proxy.ServiceDiscovery.UseDiscoveryService {
 		log.Debug("[PROXY] Service discovery enabled")
@@ -81,8 +171,13 @@ func TykNewSingleHostReverseProxy(target *url.URL, spec *APISpec) *ReverseProxy
 		}
 	}
 
-	targetQuery := target.RawQuery
 	director := func(req *http.Request) {
+		// A routing rule matched, it overrides discovery and load balancing
+		if thisRule, ok := context.Get(req, RoutingRuleData).(*RoutingRule); ok {
+			directToTarget(req, thisRule.target)
+			return
+		}
+
 		var targetSet bool
 		if spec.Proxy.ServiceDiscovery.UseDiscoveryService {
 			tempTargetURL, tErr := GetURLFromService(spec)
@@ -90,26 +185,17 @@ func TykNewSingleHostReverseProxy(target *url.URL, spec *APISpec) *ReverseProxy
 				log.Error("[PROXY] [SERVICE DISCOVERY] Failed target lookup: ", tErr)
 			} else {
 				// No error, replace the target
-				if spec.Proxy.EnableLoadBalancing {
-					var targetPtr *[]string = tempTargetURL.(*[]string)
-					remote, err := url.Parse(GetNextTarget(targetPtr, spec))
-					if err != nil {
-						log.Error("[PROXY] [SERVICE DISCOVERY] Couldn't parse target URL:", err)
-					} else {
-						// Only replace target if everything is OK
-						target = remote
-						targetQuery = target.RawQuery
-					}
+				nextTarget, nextErr := GetNextTarget(tempTargetURL, spec, req)
+				if nextErr != nil {
+					context.Set(req, UpstreamTargetError, nextErr)
+					return
+				}
+				remote, err := url.Parse(nextTarget)
+				if err != nil {
+					log.Error("[PROXY] [SERVICE DISCOVERY] Couldn't parse target URL:", err)
 				} else {
-					var targetPtr string = tempTargetURL.(string)
-					remote, err := url.Parse(GetNextTarget(targetPtr, spec))
-					if err != nil {
-						log.Error("[PROXY] [SERVICE DISCOVERY] Couldn't parse target URL:", err)
-					} else {
-						// Only replace target if everything is OK
-						target = remote
-						targetQuery = target.RawQuery
-					}
+					// Only replace target if everything is OK
+					target = remote
 				}
 			}
 			// We've overriden remote now, don;t need to do it again
@@ -120,30 +206,38 @@ func TykNewSingleHostReverseProxy(target *url.URL, spec *APISpec) *ReverseProxy
 			// no override, better check if LB is enabled
 			if spec.Proxy.EnableLoadBalancing {
 				// it is, lets get that target data
-				lbRemote, lbErr := url.Parse(GetNextTarget(&spec.Proxy.TargetList, spec))
+				nextTarget, nextErr := GetNextTarget(&spec.Proxy.TargetList, spec, req)
+				if nextErr != nil {
+					context.Set(req, UpstreamTargetError, nextErr)
+					return
+				}
+				lbRemote, lbErr := url.Parse(nextTarget)
 				if lbErr != nil {
 					log.Error("[PROXY] [LOAD BALANCING] Couldn't parse target URL:", lbErr)
 				} else {
 					// Only replace target if everything is OK
 					target = lbRemote
-					targetQuery = target.RawQuery
 				}
 			}
 		}
 
 		// No override, and no load balancing? Use the existing target
-		req.URL.Scheme = target.Scheme
-		req.URL.Host = target.Host
-		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
-		req.Host = target.Host
-		if targetQuery == "" || req.URL.RawQuery == "" {
-			req.URL.RawQuery = targetQuery + req.URL.RawQuery
-		} else {
-			req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
-		}
+		directToTarget(req, target)
 	}
 
-	return &ReverseProxy{Director: director, TykAPISpec: spec, FlushInterval: time.Duration(config.HttpServerOptions.FlushInterval) * time.Second}
+	return &ReverseProxy{
+		Director:        director,
+		TykAPISpec:      spec,
+		FlushInterval:   time.Duration(config.HttpServerOptions.FlushInterval) * time.Second,
+		RetryConfig:     GetProxyRetryConfig(spec),
+		WebSocketConfig: GetWebSocketConfig(spec),
+		Mirror:          NewTrafficMirror(spec),
+		Routing:         NewRoutingRules(spec),
+		Transports:      NewUpstreamTransportSettings(spec),
+		SizeLimits:      NewBodySizeLimits(spec),
+		// Cached responses either keep the changes of the response chain or go through it again when served
+		CacheResponseChain: GetCacheResponseChainMode(spec),
+	}
 }
 
 // onExitFlushLoop is a callback set by tests to detect the state of the
@@ -173,6 +267,14 @@ type ReverseProxy struct {
 	TykAPISpec      *APISpec
 	ErrorHandler    ErrorHandler
 	ResponseHandler ResponseChain
+	RetryConfig     ProxyRetryConfig
+	WebSocketConfig WebSocketConfig
+	Mirror          *TrafficMirror
+	Routing         *RoutingRules
+	Transports      *UpstreamTransportSettings
+	SizeLimits      *BodySizeLimits
+	// CacheResponseChain is CACHE_RESPONSE_CHAIN_STORE or CACHE_RESPONSE_CHAIN_REPLAY
+	CacheResponseChain string
 }
 
 var TykDefaultTransport http.RoundTripper = &http.Transport{
@@ -185,23 +287,7 @@ var TykDefaultTransport http.RoundTripper = &http.Transport{
 }
 
 func GetTransport(timeOut int) http.RoundTripper {
-	if timeOut > 0 {
-		log.Debug("Setting timeout for outbound request to: ", timeOut)
-		var ModifiedTransport http.RoundTripper = &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			Dial: (&net.Dialer{
-				Timeout:   time.Duration(timeOut) * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).Dial,
-			ResponseHeaderTimeout: time.Duration(timeOut) * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-		}
-
-		return ModifiedTransport
-
-	}
-
-	return TykDefaultTransport
+	return UpstreamTransports.Get(nil, timeOut)
 }
 
 func singleJoiningSlash(a, b string) string {
@@ -324,24 +410,33 @@ func (p *ReverseProxy) CheckCircuitBreakerEnforced(spec *APISpec, req *http.Requ
 	return false, nil
 }
 
-func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Request, withCache bool) *http.Response {
-	transport := p.Transport
-	if transport == nil {
-		// 1. Check if timeouts are set for this endpoint
-		_, timeout := p.CheckHardTimeoutEnforced(p.TykAPISpec, req)
-		transport = GetTransport(timeout)
-	}
-
-	// Do this before we make a shallow copy
-	sessVal := context.Get(req, SessionData)
-
+// prepareUpstreamRequest makes the copy of the request that is sent upstream, the director picks the target. An
+// error is returned if the director found no target to send the request to.
+func (p *ReverseProxy) prepareUpstreamRequest(req *http.Request, triedTargets map[string]bool) (*http.Request, *http.Request, error) {
 	outreq := new(http.Request)
 	logreq := new(http.Request)
 	log.Debug("UPSTREAM REQUEST URL: ", req.URL)
 	*outreq = *req // includes shallow copies of maps, but okay
 	*logreq = *req
 
+	// The load balancer may hash on the key, which is stored against the original request
+	if authHeaderValue := context.Get(req, AuthHeaderValue); authHeaderValue != nil {
+		context.Set(outreq, AuthHeaderValue, authHeaderValue)
+	}
+
+	if thisRule := context.Get(req, RoutingRuleData); thisRule != nil {
+		context.Set(outreq, RoutingRuleData, thisRule)
+	}
+
+	// Retries go to targets that have not failed yet
+	if len(triedTargets) > 0 {
+		context.Set(outreq, RetryExcludedTargets, triedTargets)
+	}
+
 	p.Director(outreq)
+	if targetErr, ok := context.Get(outreq, UpstreamTargetError).(error); ok {
+		return outreq, logreq, targetErr
+	}
 	outreq.Proto = "HTTP/1.1"
 	outreq.ProtoMajor = 1
 	outreq.ProtoMinor = 1
@@ -377,44 +472,197 @@ func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Reques
 		outreq.Header.Set("X-Forwarded-For", clientIP)
 	}
 
-	// Circuit breaker
-	breakerEnforced, breakerConf := p.CheckCircuitBreakerEnforced(p.TykAPISpec, req)
-	// TODO:
-	// 1. If the circuit breaker is active - wrap the RoundTrip call with a breaker function
-	// 2. when we init the APISpec, we need to create CBs for each monitored endpoint, this means extending the APISpec so we can store pointers
-	// 3. Set up monitoring functions and hook them up to the event handler
+	return outreq, logreq, nil
+}
+
+// releaseUpstreamRequest is called once the upstream is done with a request, the target is only released if
+// the load balancer picked it
+func (p *ReverseProxy) releaseUpstreamRequest(outreq *http.Request) {
+	if thisTarget, ok := context.Get(outreq, LoadBalancedTarget).(string); ok {
+		p.TykAPISpec.LoadBalancer.Release(thisTarget)
+	}
+	context.Clear(outreq)
+}
+
+// MatchRoutingRule returns the routing rule for a request and stores it in the request context, the rule is
+// only matched once so that the cache and the proxy agree on it
+func (p *ReverseProxy) MatchRoutingRule(rw http.ResponseWriter, req *http.Request) *RoutingRule {
+	if thisRule, ok := context.Get(req, RoutingRuleData).(*RoutingRule); ok {
+		return thisRule
+	}
+	if p.Routing == nil {
+		return nil
+	}
+
+	thisRule := p.Routing.Match(req)
+	if thisRule != nil {
+		context.Set(req, RoutingRuleData, thisRule)
+		rw.Header().Set(ROUTING_RULE_HEADER, thisRule.Name)
+	}
+
+	return thisRule
+}
+
+func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Request, withCache bool) *http.Response {
+	matchedRule := p.MatchRoutingRule(rw, req)
+
+	if p.WebSocketConfig.Enable && IsWebSocketUpgrade(req) {
+		p.ServeWebSocket(rw, req)
+		return nil
+	}
+
+	// 1. Check if timeouts are set for this endpoint
+	hardTimeoutEnforced, timeout := p.CheckHardTimeoutEnforced(p.TykAPISpec, req)
+	transport := p.Transport
+	if transport == nil {
+		transport = UpstreamTransports.Get(p.Transports, timeout)
+	}
+
+	// Do this before we make a shallow copy
+	sessVal := context.Get(req, SessionData)
+
+	// The limits are matched on the listen path, before the director rewrites the URL
+	var maxResponseSize int64
+	if p.SizeLimits != nil {
+		_, maxResponseSize = p.SizeLimits.GetLimits(req)
+	}
+
+	// Retries need to send the body again
+	var retryBody []byte
+	if p.RetryConfig.MaxRetries > 0 && req.Body != nil && req.ContentLength != 0 {
+		var readErr error
+		retryBody, readErr = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if isRequestBodyTooLarge(readErr) {
+			p.ErrorHandler.HandleError(rw, req, "Request body too large", 413)
+			return nil
+		}
+		if readErr != nil {
+			log.Error("Failed to buffer request body for retries: ", readErr)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(retryBody))
+	}
+
+	var mirrorBody []byte
+	mirrorThis := p.Mirror != nil && p.Mirror.ShouldMirror(req)
+	if mirrorThis {
+		mirrorBody, mirrorThis = p.Mirror.BufferBody(req, retryBody)
+	}
+
+	// The director and the forwarding headers modify the original request, these are restored on a retry
+	originalURL := *req.URL
+	priorForwardedFor, hadForwardedFor := req.Header["X-Forwarded-For"]
 
+	var outreq, logreq *http.Request
 	var res *http.Response
 	var err error
-	if breakerEnforced {
-		log.Debug("ON REQUEST: Breaker status: ", breakerConf.CB.Ready())
-		if breakerConf.CB.Ready() {
-			res, err = transport.RoundTrip(outreq)
-			if err != nil {
-				breakerConf.CB.Fail()
-			} else if res.StatusCode == 500 {
-				breakerConf.CB.Fail()
+	var deadlineExceeded bool
+	// Every attempt is cancelled once the retry deadline or the hard timeout of the path has passed
+	var hardTimeout time.Duration
+	if hardTimeoutEnforced {
+		hardTimeout = time.Duration(timeout) * time.Second
+	}
+	budget, hasBudget := p.RetryConfig.Budget(hardTimeout)
+
+	retries := 0
+	triedTargets := make(map[string]bool)
+	retryStart := time.Now()
+	for {
+		var targetErr error
+		outreq, logreq, targetErr = p.prepareUpstreamRequest(req, triedTargets)
+		if targetErr != nil {
+			context.Clear(outreq)
+			p.ErrorHandler.HandleError(rw, logreq, "Service temporarily unnavailable.", 503)
+			return nil
+		}
+		if retryBody != nil {
+			outreq.Body = ioutil.NopCloser(bytes.NewReader(retryBody))
+		}
+
+		// Only the first attempt is mirrored
+		if mirrorThis && retries == 0 {
+			p.Mirror.Send(req, outreq, originalURL, mirrorBody)
+		}
+
+		// Circuit breaker
+		breakerEnforced, breakerConf := p.CheckCircuitBreakerEnforced(p.TykAPISpec, req)
+		if breakerEnforced {
+			breakerReady := breakerConf.CB.Ready()
+			log.Debug("ON REQUEST: Breaker status: ", breakerReady)
+			if breakerReady {
+				res, deadlineExceeded, err = p.roundTripWithDeadline(transport, outreq, retryStart, budget)
+				breakerConf.CB.Record(res, err)
 			} else {
-				breakerConf.CB.Success()
+				p.releaseUpstreamRequest(outreq)
+				p.ErrorHandler.HandleError(rw, logreq, "Service temporarily unnavailable.", 503)
+				return nil
 			}
 		} else {
-			p.ErrorHandler.HandleError(rw, logreq, "Service temporarily unnavailable.", 503)
-			return nil
+			res, deadlineExceeded, err = p.roundTripWithDeadline(transport, outreq, retryStart, budget)
+		}
+
+		if err == nil || deadlineExceeded || !p.RetryConfig.ShouldRetry(req, err, retries) {
+			break
+		}
+
+		backoff := p.RetryConfig.GetBackoff(retries)
+		if hasBudget && time.Since(retryStart)+backoff >= budget {
+			log.Warning("[PROXY] Not retrying upstream request, retry deadline or hard timeout would be exceeded")
+			break
+		}
+
+		failedTarget := outreq.URL.Scheme + "://" + outreq.URL.Host
+		log.WithFields(logrus.Fields{
+			"api_id": p.TykAPISpec.APIID,
+			"target": failedTarget,
+			"retry":  retries + 1,
+		}).Warning("[PROXY] Upstream request failed, retrying: ", err)
+
+		p.releaseUpstreamRequest(outreq)
+		triedTargets[failedTarget] = true
+		retries++
+		time.Sleep(backoff)
+
+		*req.URL = originalURL
+		if hadForwardedFor {
+			req.Header["X-Forwarded-For"] = priorForwardedFor
+		} else {
+			req.Header.Del("X-Forwarded-For")
 		}
-	} else {
-		res, err = transport.RoundTrip(outreq)
+	}
+	defer p.releaseUpstreamRequest(outreq)
+	defer context.Clear(logreq)
+
+	// Picked up by the analytics record
+	if retries > 0 {
+		context.Set(req, UpstreamRetries, retries)
+		context.Set(logreq, UpstreamRetries, retries)
+	}
+	if matchedRule != nil {
+		context.Set(logreq, RoutingRuleData, matchedRule)
+	}
+
+	if isRequestBodyTooLarge(err) {
+		p.ErrorHandler.HandleError(rw, logreq, "Request body too large", 413)
+		return nil
+	}
+
+	// The hard timeout is reached either by the transport or by the cancellation of the attempt
+	hardTimeoutReached := deadlineExceeded && budget == hardTimeout
+	if deadlineExceeded && !hardTimeoutReached {
+		log.Error("http: proxy error: ", err)
+		p.ErrorHandler.HandleError(rw, logreq, "Upstream service reached retry deadline.", 408)
+		return nil
 	}
 
 	if err != nil {
 		log.Error("http: proxy error: ", err)
-		if strings.Contains(err.Error(), "timeout awaiting response headers") {
+		if hardTimeoutReached || strings.Contains(err.Error(), "timeout awaiting response headers") {
 			p.ErrorHandler.HandleError(rw, logreq, "Upstream service reached hard timeout.", 408)
 
 			if p.TykAPISpec.Proxy.ServiceDiscovery.UseDiscoveryService {
-				if ServiceCache != nil {
-					log.Debug("[PROXY] [SERVICE DISCOVERY] Upstream host failed, refreshing host list")
-					ServiceCache.Delete(p.TykAPISpec.APIID)
-				}
+				log.Debug("[PROXY] [SERVICE DISCOVERY] Upstream host failed, refreshing host list")
+				refreshDiscoveryTargets(p.TykAPISpec.APIID)
 			}
 			return nil
 		}
@@ -428,22 +676,16 @@ func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Reques
 
 	}
 
-	inres := new(http.Response)
-	if withCache {
-		*inres = *res // includes shallow copies of maps, but okay
-
-		defer res.Body.Close()
-
-		// Buffer body data
-		var bodyBuffer bytes.Buffer
-		bodyBuffer2 := new(bytes.Buffer)
-
-		p.copyResponse(&bodyBuffer, res.Body)
-		*bodyBuffer2 = bodyBuffer
+	if maxResponseSize > 0 && !p.limitResponseSize(res, maxResponseSize, withCache) {
+		p.ErrorHandler.HandleError(rw, logreq, "Upstream response too large", 502)
+		return nil
+	}
 
-		// Create new ReadClosers so we can split output
-		res.Body = ioutil.NopCloser(&bodyBuffer)
-		inres.Body = ioutil.NopCloser(bodyBuffer2)
+	// The response chain runs again on cached responses that are stored before it
+	replayChain := p.CacheResponseChain == CACHE_RESPONSE_CHAIN_REPLAY
+	inres := new(http.Response)
+	if withCache && replayChain {
+		inres = copyResponseForCache(res)
 	}
 
 	ses := SessionState{}
@@ -451,16 +693,87 @@ func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Reques
 		ses = sessVal.(SessionState)
 	}
 
+	// Upstreams can purge cached responses after they changed data
+	handleUpstreamCachePurge(p.TykAPISpec, req, res)
+
 	// Middleware chain handling here - very simple, but should do the trick
 	chainErr := p.ResponseHandler.Go(p.TykAPISpec.ResponseChain, rw, res, req, &ses)
 	if chainErr != nil {
 		log.Error("Response chain failed! ", chainErr)
 	}
 
+	// Otherwise the cache gets the response as the chain left it, before the rate limit headers of this session
+	if withCache && !replayChain {
+		inres = copyResponseForCache(res)
+	}
+
 	p.HandleResponse(rw, res, req, &ses)
 	return inres
 }
 
+// requestCanceler is implemented by transports that can abort a request that is in flight
+type requestCanceler interface {
+	CancelRequest(*http.Request)
+}
+
+// roundTripWithDeadline sends a request upstream, if the attempts at a request have a budget (see
+// ProxyRetryConfig.Budget) the request is cancelled once the time left of it since start has passed.
+// deadlineExceeded is true if the budget stopped the request.
+func (p *ReverseProxy) roundTripWithDeadline(transport http.RoundTripper, outreq *http.Request, start time.Time, budget time.Duration) (res *http.Response, deadlineExceeded bool, err error) {
+	if budget <= 0 {
+		res, err = transport.RoundTrip(outreq)
+		return res, false, err
+	}
+	remaining := budget - time.Since(start)
+	if remaining <= 0 {
+		return nil, true, errors.New("retry deadline exceeded")
+	}
+
+	canceler, ok := transport.(requestCanceler)
+	if !ok {
+		res, err = transport.RoundTrip(outreq)
+		return res, false, err
+	}
+
+	var cancelled int32
+	timer := time.AfterFunc(remaining, func() {
+		atomic.StoreInt32(&cancelled, 1)
+		canceler.CancelRequest(outreq)
+	})
+	res, err = transport.RoundTrip(outreq)
+	timer.Stop()
+
+	return res, err != nil && atomic.LoadInt32(&cancelled) == 1, err
+}
+
+// limitResponseSize checks the size of an upstream response before it is buffered for the cache or the
+// response middleware, responses that are streamed to the client are only checked against their Content-Length
+func (p *ReverseProxy) limitResponseSize(res *http.Response, maxSize int64, withCache bool) bool {
+	if res.ContentLength > maxSize {
+		res.Body.Close()
+		return false
+	}
+
+	hasResponseChain := p.TykAPISpec.ResponseChain != nil && len(*p.TykAPISpec.ResponseChain) > 0
+	if !withCache && !hasResponseChain {
+		return true
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxSize+1))
+	res.Body.Close()
+	if err != nil {
+		// A truncated body must not be served or cached as if it was complete
+		log.Error("Failed to read upstream response: ", err)
+		return false
+	}
+	if int64(len(body)) > maxSize {
+		return false
+	}
+
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return true
+}
+
 func (p *ReverseProxy) HandleResponse(rw http.ResponseWriter, res *http.Response, req *http.Request, ses *SessionState) error {
 
 	for _, h := range hopHeaders {
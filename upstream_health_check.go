@@ -0,0 +1,470 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/mapstructure"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const UPSTREAM_HEALTH_KEYPREFIX string = "upstream-health."
+
+// UpstreamHealthCheckConfig is set per API in the definition under "upstream_health_check", a target is marked
+// down after Fall consecutive failed checks and back up after Rise consecutive successful ones
+type UpstreamHealthCheckConfig struct {
+	Enable         bool   `mapstructure:"enable" bson:"enable" json:"enable"`
+	Path           string `mapstructure:"path" bson:"path" json:"path"`
+	Method         string `mapstructure:"method" bson:"method" json:"method"`
+	Interval       int    `mapstructure:"interval" bson:"interval" json:"interval"`
+	Timeout        int    `mapstructure:"timeout" bson:"timeout" json:"timeout"`
+	ExpectedStatus int    `mapstructure:"expected_status" bson:"expected_status" json:"expected_status"`
+	Rise           int    `mapstructure:"rise" bson:"rise" json:"rise"`
+	Fall           int    `mapstructure:"fall" bson:"fall" json:"fall"`
+	ShareState     bool   `mapstructure:"share_state" bson:"share_state" json:"share_state"`
+}
+
+type upstreamHealthCheckSection struct {
+	UpstreamHealthCheck UpstreamHealthCheckConfig `mapstructure:"upstream_health_check" bson:"upstream_health_check" json:"upstream_health_check"`
+}
+
+// GetUpstreamHealthCheckConfig reads the health check settings from the API definition and fills in defaults
+func GetUpstreamHealthCheckConfig(spec *APISpec) UpstreamHealthCheckConfig {
+	thisSection := upstreamHealthCheckSection{}
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisSection); err != nil {
+		log.Error("Failed to decode upstream health check configuration: ", err)
+	}
+
+	thisConfig := thisSection.UpstreamHealthCheck
+	if thisConfig.Path == "" {
+		thisConfig.Path = "/"
+	}
+	if thisConfig.Method == "" {
+		thisConfig.Method = "GET"
+	}
+	if thisConfig.Interval <= 0 {
+		thisConfig.Interval = 10
+	}
+	if thisConfig.Timeout <= 0 {
+		thisConfig.Timeout = 5
+	}
+	if thisConfig.ExpectedStatus == 0 {
+		thisConfig.ExpectedStatus = 200
+	}
+	if thisConfig.Rise <= 0 {
+		thisConfig.Rise = 2
+	}
+	if thisConfig.Fall <= 0 {
+		thisConfig.Fall = 3
+	}
+
+	return thisConfig
+}
+
+// UpstreamHostState is the health of a single target as seen by this node
+type UpstreamHostState struct {
+	Host       string    `json:"host"`
+	Healthy    bool      `json:"healthy"`
+	Successes  int       `json:"successes"`
+	Failures   int       `json:"failures"`
+	LastCheck  time.Time `json:"last_check"`
+	LastStatus int       `json:"last_status"`
+	LastError  string    `json:"last_error"`
+}
+
+// UpstreamHealthChecker actively probes the targets of an API. Targets that are not known when the checker
+// starts, e.g. ones returned by service discovery, are added the first time they are asked about and dropped
+// on a reload if no request asked about them since the reload before.
+type UpstreamHealthChecker struct {
+	APIID    string
+	Config   UpstreamHealthCheckConfig
+	spec     *APISpec
+	hosts    map[string]*UpstreamHostState
+	asked    map[string]*int64
+	prunedAt time.Time
+	// The checks share the API's transport, the checker is replaced when that changes
+	transportKey upstreamTransportKey
+	lock         sync.RWMutex
+	store        *RedisClusterStorageManager
+	client       *http.Client
+	stop         chan struct{}
+}
+
+// NewUpstreamHealthChecker creates a checker for the targets that are configured on the API
+func NewUpstreamHealthChecker(spec *APISpec, thisConfig UpstreamHealthCheckConfig) *UpstreamHealthChecker {
+	transportSettings := NewUpstreamTransportSettings(spec)
+	h := &UpstreamHealthChecker{
+		APIID:    spec.APIID,
+		Config:   thisConfig,
+		spec:     spec,
+		hosts:    make(map[string]*UpstreamHostState),
+		asked:    make(map[string]*int64),
+		prunedAt: time.Now(),
+		client: &http.Client{
+			Transport: UpstreamTransports.Get(transportSettings, 0),
+			Timeout:   time.Duration(thisConfig.Timeout) * time.Second,
+		},
+		stop:         make(chan struct{}),
+		transportKey: transportSettings.key(0),
+	}
+
+	if thisConfig.ShareState {
+		h.store = &RedisClusterStorageManager{KeyPrefix: UPSTREAM_HEALTH_KEYPREFIX}
+		h.store.Connect()
+	}
+
+	for _, host := range configuredHealthCheckHosts(spec) {
+		h.addHost(host)
+	}
+
+	return h
+}
+
+// configuredHealthCheckHosts returns the targets that are set in the definition of an API
+func configuredHealthCheckHosts(spec *APISpec) []string {
+	hosts := []string{}
+	if spec.Proxy.EnableLoadBalancing {
+		for _, thisTarget := range GetLoadBalancerTargets(spec.Proxy.TargetList) {
+			hosts = append(hosts, thisTarget.URL)
+		}
+	} else if !spec.Proxy.ServiceDiscovery.UseDiscoveryService {
+		hosts = append(hosts, EnsureTransport(spec.Proxy.TargetURL))
+	}
+
+	return hosts
+}
+
+// addHost starts tracking a target, it counts as asked about so that a prune running right after doesn't drop it
+func (h *UpstreamHealthChecker) addHost(host string) *UpstreamHostState {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	thisState, found := h.hosts[host]
+	if !found {
+		thisState = &UpstreamHostState{Host: host, Healthy: true}
+		h.hosts[host] = thisState
+		h.asked[host] = new(int64)
+	}
+	atomic.StoreInt64(h.asked[host], time.Now().UnixNano())
+
+	return thisState
+}
+
+// pruneHosts drops the targets that aren't configured on the API and that no request asked about since the last
+// prune, targets from service discovery stay as long as they are in use
+func (h *UpstreamHealthChecker) pruneHosts(spec *APISpec) {
+	configured := make(map[string]bool)
+	for _, host := range configuredHealthCheckHosts(spec) {
+		configured[host] = true
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for host := range h.hosts {
+		if configured[host] || atomic.LoadInt64(h.asked[host]) >= h.prunedAt.UnixNano() {
+			continue
+		}
+		delete(h.hosts, host)
+		delete(h.asked, host)
+	}
+	h.prunedAt = time.Now()
+}
+
+// IsHealthy reports whether a target can receive traffic, unknown targets are healthy until checked
+func (h *UpstreamHealthChecker) IsHealthy(host string) bool {
+	h.lock.RLock()
+	thisState, found := h.hosts[host]
+	healthy := !found || thisState.Healthy
+	if asked := h.asked[host]; found && asked != nil {
+		atomic.StoreInt64(asked, time.Now().UnixNano())
+	}
+	h.lock.RUnlock()
+
+	if !found {
+		h.addHost(host)
+	}
+
+	return healthy
+}
+
+// HostStates returns a copy of the state of every target
+func (h *UpstreamHealthChecker) HostStates() []UpstreamHostState {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	states := []UpstreamHostState{}
+	for _, thisState := range h.hosts {
+		states = append(states, *thisState)
+	}
+
+	return states
+}
+
+func (h *UpstreamHealthChecker) setSpec(spec *APISpec) {
+	h.lock.Lock()
+	h.spec = spec
+	h.lock.Unlock()
+}
+
+// Start runs the checks every Interval seconds until Stop is called
+func (h *UpstreamHealthChecker) Start() {
+	go func() {
+		ticker := time.NewTicker(time.Duration(h.Config.Interval) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			h.CheckNow()
+			select {
+			case <-ticker.C:
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (h *UpstreamHealthChecker) Stop() {
+	close(h.stop)
+}
+
+// CheckNow probes every known target once
+func (h *UpstreamHealthChecker) CheckNow() {
+	h.lock.RLock()
+	hosts := make([]string, 0, len(h.hosts))
+	for host := range h.hosts {
+		hosts = append(hosts, host)
+	}
+	h.lock.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			status, err := h.probe(host)
+			h.recordResult(host, status, err)
+		}(host)
+	}
+	wg.Wait()
+
+	if h.store != nil {
+		h.syncSharedState(hosts)
+	}
+}
+
+func (h *UpstreamHealthChecker) probe(host string) (int, error) {
+	target, err := url.Parse(host)
+	if err != nil {
+		return 0, err
+	}
+
+	checkURL := url.URL{Scheme: target.Scheme, Host: target.Host, Path: h.Config.Path}
+	req, err := http.NewRequest(h.Config.Method, checkURL.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+func (h *UpstreamHealthChecker) recordResult(host string, status int, err error) {
+	h.lock.Lock()
+	thisState, found := h.hosts[host]
+	if !found {
+		h.lock.Unlock()
+		return
+	}
+
+	thisState.LastCheck = time.Now()
+	thisState.LastStatus = status
+	thisState.LastError = ""
+	if err != nil {
+		thisState.LastError = err.Error()
+	}
+
+	var changed bool
+	if err == nil && status == h.Config.ExpectedStatus {
+		thisState.Successes++
+		thisState.Failures = 0
+		if !thisState.Healthy && thisState.Successes >= h.Config.Rise {
+			thisState.Healthy = true
+			changed = true
+		}
+	} else {
+		thisState.Failures++
+		thisState.Successes = 0
+		if thisState.Healthy && thisState.Failures >= h.Config.Fall {
+			thisState.Healthy = false
+			changed = true
+		}
+	}
+
+	snapshot := *thisState
+	spec := h.spec
+	h.lock.Unlock()
+
+	if changed {
+		h.fireHostEvent(spec, snapshot)
+		if h.store != nil {
+			h.writeSharedState(snapshot)
+		}
+	}
+}
+
+func (h *UpstreamHealthChecker) fireHostEvent(spec *APISpec, thisState UpstreamHostState) {
+	eventType := EVENT_HostDown
+	message := "Upstream host is down"
+	if thisState.Healthy {
+		eventType = EVENT_HostUp
+		message = "Upstream host is back up"
+	}
+
+	log.WithFields(logrus.Fields{
+		"api_id": h.APIID,
+		"host":   thisState.Host,
+		"status": thisState.LastStatus,
+		"error":  thisState.LastError,
+	}).Warning(message)
+
+	spec.FireEvent(eventType, EVENT_HostStatusMeta{
+		EventMetaDefault: EventMetaDefault{Message: message},
+		HostInfo:         thisState.Host,
+		APIID:            h.APIID,
+	})
+}
+
+func (h *UpstreamHealthChecker) sharedStateKey(host string) string {
+	return h.APIID + "." + host
+}
+
+// writeSharedState publishes a state change, the record expires if no node refreshes it
+func (h *UpstreamHealthChecker) writeSharedState(thisState UpstreamHostState) {
+	asJSON, err := json.Marshal(thisState)
+	if err != nil {
+		log.Error("Failed to encode upstream host state: ", err)
+		return
+	}
+
+	h.store.SetKey(h.sharedStateKey(thisState.Host), string(asJSON), int64(h.Config.Interval*h.Config.Fall*2))
+}
+
+// syncSharedState adopts state changes made by other nodes, the most recent change seen by any node wins
+func (h *UpstreamHealthChecker) syncSharedState(hosts []string) {
+	for _, host := range hosts {
+		rawState, err := h.store.GetKey(h.sharedStateKey(host))
+		if err != nil {
+			continue
+		}
+
+		sharedState := UpstreamHostState{}
+		if err := json.Unmarshal([]byte(rawState), &sharedState); err != nil {
+			continue
+		}
+
+		h.lock.Lock()
+		thisState, found := h.hosts[host]
+		if found && thisState.Healthy != sharedState.Healthy && sharedState.LastCheck.After(thisState.LastCheck.Add(-time.Duration(h.Config.Interval)*time.Second)) {
+			log.WithFields(logrus.Fields{
+				"api_id":  h.APIID,
+				"host":    host,
+				"healthy": sharedState.Healthy,
+			}).Debug("Adopting shared upstream host state")
+			thisState.Healthy = sharedState.Healthy
+			thisState.Successes = 0
+			thisState.Failures = 0
+		}
+		agrees := found && thisState.Healthy == sharedState.Healthy
+		h.lock.Unlock()
+
+		// Keep the record alive while it reflects our view
+		if agrees {
+			h.writeSharedState(sharedState)
+		}
+	}
+}
+
+var upstreamHealthCheckers = make(map[string]*UpstreamHealthChecker)
+var upstreamHealthCheckersLock sync.Mutex
+
+// startUpstreamHealthChecker attaches a health checker to a spec, checkers survive reloads as long as their
+// configuration and targets are unchanged, so a reload does not reset the state of the targets
+func startUpstreamHealthChecker(spec *APISpec) {
+	thisConfig := GetUpstreamHealthCheckConfig(spec)
+
+	upstreamHealthCheckersLock.Lock()
+	defer upstreamHealthCheckersLock.Unlock()
+
+	existing, found := upstreamHealthCheckers[spec.APIID]
+	if !thisConfig.Enable {
+		if found {
+			existing.Stop()
+			delete(upstreamHealthCheckers, spec.APIID)
+		}
+		return
+	}
+
+	sameTransport := found && existing.transportKey == getUpstreamTransportKey(spec, 0)
+	if found && existing.Config == thisConfig && sameTargets(existing.spec, spec) && sameTransport {
+		existing.setSpec(spec)
+		existing.pruneHosts(spec)
+		spec.UpstreamHealth = existing
+		return
+	}
+
+	if found {
+		existing.Stop()
+	}
+
+	log.WithFields(logrus.Fields{
+		"api_id":   spec.APIID,
+		"interval": thisConfig.Interval,
+		"path":     thisConfig.Path,
+	}).Info("Starting upstream health checks")
+
+	thisChecker := NewUpstreamHealthChecker(spec, thisConfig)
+	upstreamHealthCheckers[spec.APIID] = thisChecker
+	spec.UpstreamHealth = thisChecker
+	thisChecker.Start()
+}
+
+func sameTargets(a *APISpec, b *APISpec) bool {
+	if a.Proxy.TargetURL != b.Proxy.TargetURL || len(a.Proxy.TargetList) != len(b.Proxy.TargetList) {
+		return false
+	}
+
+	for i, _ := range a.Proxy.TargetList {
+		if a.Proxy.TargetList[i] != b.Proxy.TargetList[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// pruneUpstreamHealthCheckers stops the checkers of APIs that are no longer loaded
+func pruneUpstreamHealthCheckers(specs []APISpec) {
+	loaded := make(map[string]bool)
+	for _, spec := range specs {
+		loaded[spec.APIID] = true
+	}
+
+	upstreamHealthCheckersLock.Lock()
+	defer upstreamHealthCheckersLock.Unlock()
+
+	for APIID, thisChecker := range upstreamHealthCheckers {
+		if !loaded[APIID] {
+			thisChecker.Stop()
+			delete(upstreamHealthCheckers, APIID)
+		}
+	}
+}
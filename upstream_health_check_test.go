@@ -0,0 +1,176 @@
+package main
+
+import (
+	"github.com/lonelycode/tykcommon"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testHostEventHandler struct {
+	events chan EventMessage
+}
+
+func (h testHostEventHandler) New(interface{}) (TykEventHandler, error) {
+	return h, nil
+}
+
+func (h testHostEventHandler) HandleEvent(em EventMessage) {
+	h.events <- em
+}
+
+func waitForHostEvent(t *testing.T, events chan EventMessage, expected tykcommon.TykEvent) {
+	select {
+	case em := <-events:
+		if em.EventType != expected {
+			t.Error("Expected event ", expected, " got ", em.EventType)
+		}
+	case <-time.After(time.Second):
+		t.Error("Event not fired: ", expected)
+	}
+}
+
+func TestUpstreamHealthCheck(t *testing.T) {
+	var failing int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(503)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer upstream.Close()
+
+	healthyUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer healthyUpstream.Close()
+
+	spec := createDefinitionFromString(apiTestDef)
+	spec.APIDefinition.Proxy.EnableLoadBalancing = true
+	spec.APIDefinition.Proxy.TargetList = []string{upstream.URL, healthyUpstream.URL}
+	spec.LoadBalancer = &RoundRobin{}
+
+	events := make(chan EventMessage, 4)
+	spec.EventPaths = map[tykcommon.TykEvent][]TykEventHandler{
+		EVENT_HostDown: {testHostEventHandler{events}},
+		EVENT_HostUp:   {testHostEventHandler{events}},
+	}
+
+	checker := NewUpstreamHealthChecker(&spec, UpstreamHealthCheckConfig{
+		Enable:         true,
+		Path:           "/health",
+		Method:         "GET",
+		Timeout:        1,
+		ExpectedStatus: 200,
+		Rise:           2,
+		Fall:           2,
+	})
+	spec.UpstreamHealth = checker
+
+	atomic.StoreInt32(&failing, 1)
+	checker.CheckNow()
+	if !checker.IsHealthy(upstream.URL) {
+		t.Fatal("Host should stay up until the fall threshold is reached")
+	}
+
+	checker.CheckNow()
+	if checker.IsHealthy(upstream.URL) {
+		t.Fatal("Host should be down after two failed checks")
+	}
+	waitForHostEvent(t, events, EVENT_HostDown)
+
+	targets := &spec.Proxy.TargetList
+	for i := 0; i < 4; i++ {
+		if target, _ := GetNextTarget(targets, &spec, nil); target != healthyUpstream.URL {
+			t.Error("Unhealthy target should be skipped, got: ", target)
+		}
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	checker.CheckNow()
+	checker.CheckNow()
+	if !checker.IsHealthy(upstream.URL) {
+		t.Fatal("Host should be back up after two successful checks")
+	}
+	waitForHostEvent(t, events, EVENT_HostUp)
+}
+
+func TestUpstreamHealthCheckPrunesHosts(t *testing.T) {
+	spec := createDefinitionFromString(apiTestDef)
+	spec.APIDefinition.Proxy.EnableLoadBalancing = true
+	spec.APIDefinition.Proxy.TargetList = []string{"http://configured.test"}
+	spec.LoadBalancer = &RoundRobin{}
+
+	checker := NewUpstreamHealthChecker(&spec, UpstreamHealthCheckConfig{Enable: true, Rise: 1, Fall: 1})
+	checker.IsHealthy("http://discovered.test")
+	checker.IsHealthy("http://removed.test")
+
+	// Targets asked about since the last reload are kept
+	checker.pruneHosts(&spec)
+	if len(checker.HostStates()) != 3 {
+		t.Fatal("Hosts in use should survive a reload, got: ", checker.HostStates())
+	}
+
+	checker.IsHealthy("http://discovered.test")
+	checker.pruneHosts(&spec)
+	for _, thisState := range checker.HostStates() {
+		if thisState.Host == "http://removed.test" {
+			t.Error("Unused host should be pruned on reload")
+		}
+	}
+	if len(checker.HostStates()) != 2 {
+		t.Error("Configured and discovered hosts should be kept, got: ", checker.HostStates())
+	}
+}
+
+func TestUpstreamHealthCheckPruneDuringRequests(t *testing.T) {
+	spec := createDefinitionFromString(apiTestDef)
+	spec.APIDefinition.Proxy.EnableLoadBalancing = true
+	spec.APIDefinition.Proxy.TargetList = []string{"http://configured.test"}
+	spec.LoadBalancer = &RoundRobin{}
+	checker := NewUpstreamHealthChecker(&spec, UpstreamHealthCheckConfig{Enable: true, Rise: 1, Fall: 1})
+
+	// Reloads prune the hosts while requests add new ones
+	stop := make(chan struct{})
+	pruned := make(chan struct{})
+	go func() {
+		defer close(pruned)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				checker.pruneHosts(&spec)
+			}
+		}
+	}()
+	var requests sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		requests.Add(1)
+		go func(i int) {
+			defer requests.Done()
+			for j := 0; j < 5000; j++ {
+				checker.IsHealthy("http://discovered-" + strconv.Itoa(i) + "-" + strconv.Itoa(j) + ".test")
+			}
+		}(i)
+	}
+	requests.Wait()
+	close(stop)
+	<-pruned
+
+	// A new host survives the prune right after it was added
+	checker.IsHealthy("http://new.test")
+	checker.pruneHosts(&spec)
+	found := false
+	for _, thisState := range checker.HostStates() {
+		found = found || thisState.Host == "http://new.test"
+	}
+	if !found {
+		t.Error("Host that was just asked about should not be pruned")
+	}
+}
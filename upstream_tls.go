@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/mitchellh/mapstructure"
+	"io/ioutil"
+	"strings"
+)
+
+// UpstreamTLSOptions is set per API in the definition under "upstream_tls". PinnedPublicKeys are base64
+// encoded SHA-256 hashes of the subject public key info, the same format as HPKP's pin-sha256, the connection
+// is refused unless a certificate of the verified chain matches a pin, or the leaf certificate when verification
+// is skipped. The TLS configuration is part of the API's transport settings, the transports themselves come
+// from UpstreamTransports.
+type UpstreamTLSOptions struct {
+	CAFile             string   `mapstructure:"ca_file" bson:"ca_file" json:"ca_file"`
+	CertFile           string   `mapstructure:"cert_file" bson:"cert_file" json:"cert_file"`
+	KeyFile            string   `mapstructure:"key_file" bson:"key_file" json:"key_file"`
+	MinVersion         string   `mapstructure:"min_version" bson:"min_version" json:"min_version"`
+	ServerName         string   `mapstructure:"server_name" bson:"server_name" json:"server_name"`
+	PinnedPublicKeys   []string `mapstructure:"pinned_public_keys" bson:"pinned_public_keys" json:"pinned_public_keys"`
+	InsecureSkipVerify bool     `mapstructure:"insecure_skip_verify" bson:"insecure_skip_verify" json:"insecure_skip_verify"`
+}
+
+type upstreamTLSSection struct {
+	UpstreamTLS UpstreamTLSOptions `mapstructure:"upstream_tls" bson:"upstream_tls" json:"upstream_tls"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+func GetUpstreamTLSOptions(spec *APISpec) UpstreamTLSOptions {
+	thisSection := upstreamTLSSection{}
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisSection); err != nil {
+		log.Error("Failed to decode upstream TLS configuration: ", err)
+	}
+
+	return thisSection.UpstreamTLS
+}
+
+// fingerprint identifies the options in the key of a transport, without reading the files they point to
+func (o UpstreamTLSOptions) fingerprint() string {
+	asJSON, _ := json.Marshal(o)
+	return string(asJSON)
+}
+
+// IsSet is false when an API uses the default TLS settings
+func (o UpstreamTLSOptions) IsSet() bool {
+	return o.CAFile != "" || o.CertFile != "" || o.MinVersion != "" || o.ServerName != "" ||
+		len(o.PinnedPublicKeys) > 0 || o.InsecureSkipVerify
+}
+
+// GetPublicKeyPin returns the pin of a certificate's public key
+func GetPublicKeyPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return b64.StdEncoding.EncodeToString(hash[:])
+}
+
+// checkPinnedPublicKeys only matches the pins against the certificates of the verified chains, anyone can append
+// a pinned certificate to the ones they present. Without verification only the leaf certificate is checked.
+func checkPinnedPublicKeys(pins []string, insecureSkipVerify bool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		certs := []*x509.Certificate{}
+		for _, chain := range verifiedChains {
+			certs = append(certs, chain...)
+		}
+		if insecureSkipVerify && len(rawCerts) > 0 {
+			if leaf, err := x509.ParseCertificate(rawCerts[0]); err == nil {
+				certs = append(certs, leaf)
+			}
+		}
+
+		for _, cert := range certs {
+			thisPin := GetPublicKeyPin(cert)
+			for _, pin := range pins {
+				if strings.TrimPrefix(pin, "sha256/") == thisPin {
+					return nil
+				}
+			}
+		}
+
+		return errors.New("Upstream certificate does not match any pinned public key")
+	}
+}
+
+// CreateUpstreamTLSConfig builds the TLS configuration for the connections to an API's upstream, nil means
+// the defaults are used
+func CreateUpstreamTLSConfig(options UpstreamTLSOptions) (*tls.Config, error) {
+	if !options.IsSet() {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         options.ServerName,
+		InsecureSkipVerify: options.InsecureSkipVerify,
+	}
+
+	if options.MinVersion != "" {
+		version, found := tlsVersions[options.MinVersion]
+		if !found {
+			return nil, errors.New("Unknown TLS version " + options.MinVersion + ", use one of 1.0, 1.1 or 1.2")
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if options.CAFile != "" {
+		caData, err := ioutil.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caData) {
+			return nil, errors.New("No certificates found in CA file " + options.CAFile)
+		}
+	}
+
+	if options.CertFile != "" || options.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(options.PinnedPublicKeys) > 0 {
+		tlsConfig.VerifyPeerCertificate = checkPinnedPublicKeys(options.PinnedPublicKeys, options.InsecureSkipVerify)
+	}
+
+	return tlsConfig, nil
+}
+
+// GetUpstreamTLSConfig builds the TLS configuration of an API, if it is broken the API still loads but the
+// upstream connections fail instead of silently falling back to the default settings
+func GetUpstreamTLSConfig(APIID string, options UpstreamTLSOptions) *tls.Config {
+	tlsConfig, err := CreateUpstreamTLSConfig(options)
+	if err != nil {
+		log.Error("Invalid upstream TLS configuration for API ", APIID, ": ", err)
+		return &tls.Config{
+			VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+				return errors.New("Upstream TLS configuration is invalid: " + err.Error())
+			},
+		}
+	}
+
+	return tlsConfig
+}
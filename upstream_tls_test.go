@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func writePEMFile(t *testing.T, dir string, name string, blockType string, data []byte) string {
+	fileName := path.Join(dir, name)
+	if err := ioutil.WriteFile(fileName, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return fileName
+}
+
+// createClientCertificate writes a self signed client certificate and its key
+func createClientCertificate(t *testing.T, dir string) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tyk-test-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	certData, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyData, _ := x509.MarshalECPrivateKey(key)
+
+	return writePEMFile(t, dir, "client.pem", "CERTIFICATE", certData), writePEMFile(t, dir, "client.key", "EC PRIVATE KEY", keyData)
+}
+
+func proxyWithUpstreamTLS(upstreamURL string, tlsConf string) int {
+	def := createTestDefinition("1", `"upstream_tls": `+tlsConf+`,`, "")
+	proxy, _ := createTestProxyWithDefinition(def, upstreamURL)
+
+	req, _ := http.NewRequest("GET", "/v1/", nil)
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, req)
+
+	return recorder.Code
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tyk-tls")
+	defer os.RemoveAll(dir)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(401)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequestClientCert, MaxVersion: tls.VersionTLS12}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	serverCert := upstream.TLS.Certificates[0]
+	parsedCert, _ := x509.ParseCertificate(serverCert.Certificate[0])
+	caFile := writePEMFile(t, dir, "ca.pem", "CERTIFICATE", serverCert.Certificate[0])
+	certFile, keyFile := createClientCertificate(t, dir)
+
+	withClientCert := `"ca_file": "` + caFile + `", "cert_file": "` + certFile + `", "key_file": "` + keyFile + `"`
+
+	tests := []struct {
+		Name     string
+		Config   string
+		Expected int
+	}{
+		{"Unknown CA", `{"min_version": "1.2"}`, 500},
+		{"Insecure", `{"insecure_skip_verify": true, "cert_file": "` + certFile + `", "key_file": "` + keyFile + `"}`, 200},
+		{"Custom CA without client certificate", `{"ca_file": "` + caFile + `"}`, 401},
+		{"Custom CA with client certificate", `{` + withClientCert + `}`, 200},
+		{"Matching pin", `{` + withClientCert + `, "pinned_public_keys": ["sha256/` + GetPublicKeyPin(parsedCert) + `"]}`, 200},
+		{"Wrong pin", `{` + withClientCert + `, "pinned_public_keys": ["sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="]}`, 500},
+		{"Unknown minimum version", `{` + withClientCert + `, "min_version": "1.3"}`, 500},
+		{"Broken configuration", `{"ca_file": "/does/not/exist.pem"}`, 500},
+	}
+
+	for _, test := range tests {
+		if code := proxyWithUpstreamTLS(upstream.URL, test.Config); code != test.Expected {
+			t.Error(test.Name, ": expected ", test.Expected, " got ", code)
+		}
+	}
+}
+
+func TestUpstreamTLSPinnedCertificateAppended(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tyk-tls")
+	defer os.RemoveAll(dir)
+
+	// The upstream presents its own certificate followed by a certificate that is pinned
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "tyk-test-upstream"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	leafData, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(leafData)
+
+	pinnedKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pinnedData, _ := x509.CreateCertificate(rand.Reader, template, template, &pinnedKey.PublicKey, pinnedKey)
+	pinned, _ := x509.ParseCertificate(pinnedData)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	upstream.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{leafData, pinnedData}, PrivateKey: key}},
+		MaxVersion:   tls.VersionTLS12,
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	caFile := writePEMFile(t, dir, "ca.pem", "CERTIFICATE", leafData)
+
+	tests := []struct {
+		Name     string
+		Config   string
+		Expected int
+	}{
+		{"Appended pin", `{"ca_file": "` + caFile + `", "pinned_public_keys": ["sha256/` + GetPublicKeyPin(pinned) + `"]}`, 500},
+		{"Appended pin without verification", `{"insecure_skip_verify": true, "pinned_public_keys": ["sha256/` + GetPublicKeyPin(pinned) + `"]}`, 500},
+		{"Leaf pin", `{"ca_file": "` + caFile + `", "pinned_public_keys": ["sha256/` + GetPublicKeyPin(leaf) + `"]}`, 200},
+		{"Leaf pin without verification", `{"insecure_skip_verify": true, "pinned_public_keys": ["sha256/` + GetPublicKeyPin(leaf) + `"]}`, 200},
+	}
+
+	for _, test := range tests {
+		if code := proxyWithUpstreamTLS(upstream.URL, test.Config); code != test.Expected {
+			t.Error(test.Name, ": expected ", test.Expected, " got ", code)
+		}
+	}
+}
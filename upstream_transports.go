@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/mitchellh/mapstructure"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UpstreamPoolConfig is set per API in the definition under "upstream_pool", the timeouts are in seconds.
+// A hard timeout on an endpoint replaces the dial and response header timeouts for that endpoint.
+type UpstreamPoolConfig struct {
+	MaxIdleConnsPerHost   int `mapstructure:"max_idle_conns_per_host" bson:"max_idle_conns_per_host" json:"max_idle_conns_per_host"`
+	IdleConnTimeout       int `mapstructure:"idle_conn_timeout" bson:"idle_conn_timeout" json:"idle_conn_timeout"`
+	DialTimeout           int `mapstructure:"dial_timeout" bson:"dial_timeout" json:"dial_timeout"`
+	ResponseHeaderTimeout int `mapstructure:"response_header_timeout" bson:"response_header_timeout" json:"response_header_timeout"`
+}
+
+type upstreamPoolSection struct {
+	UpstreamPool UpstreamPoolConfig `mapstructure:"upstream_pool" bson:"upstream_pool" json:"upstream_pool"`
+}
+
+func GetUpstreamPoolConfig(spec *APISpec) UpstreamPoolConfig {
+	thisSection := upstreamPoolSection{}
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisSection); err != nil {
+		log.Error("Failed to decode upstream pool configuration: ", err)
+	}
+
+	return thisSection.UpstreamPool.withDefaults()
+}
+
+func (c UpstreamPoolConfig) withDefaults() UpstreamPoolConfig {
+	if c.MaxIdleConnsPerHost <= 0 {
+		c.MaxIdleConnsPerHost = 100
+	}
+	if c.IdleConnTimeout <= 0 {
+		c.IdleConnTimeout = 90
+	}
+	if c.DialTimeout <= 0 {
+		c.DialTimeout = 30
+	}
+	if c.ResponseHeaderTimeout < 0 {
+		c.ResponseHeaderTimeout = 0
+	}
+
+	return c
+}
+
+// UpstreamTransportSettings holds everything a proxy needs to get its transports from the registry, the health
+// checks and WebSocket tunnels of an API use the same settings
+type UpstreamTransportSettings struct {
+	APIID     string
+	TLSConfig *tls.Config
+	Pool      UpstreamPoolConfig
+
+	tlsFingerprint string
+}
+
+var defaultUpstreamTransportSettings = &UpstreamTransportSettings{Pool: UpstreamPoolConfig{}.withDefaults()}
+
+func NewUpstreamTransportSettings(spec *APISpec) *UpstreamTransportSettings {
+	tlsOptions := GetUpstreamTLSOptions(spec)
+	return &UpstreamTransportSettings{
+		APIID:          spec.APIID,
+		TLSConfig:      GetUpstreamTLSConfig(spec.APIID, tlsOptions),
+		Pool:           GetUpstreamPoolConfig(spec),
+		tlsFingerprint: tlsOptions.fingerprint(),
+	}
+}
+
+// getUpstreamTransportKey returns the key of an API's transport without building its TLS configuration
+func getUpstreamTransportKey(spec *APISpec, timeOut int) upstreamTransportKey {
+	return upstreamTransportKey{
+		APIID:   spec.APIID,
+		Timeout: timeOut,
+		TLS:     GetUpstreamTLSOptions(spec).fingerprint(),
+		Pool:    GetUpstreamPoolConfig(spec),
+	}
+}
+
+func (s *UpstreamTransportSettings) key(timeOut int) upstreamTransportKey {
+	return upstreamTransportKey{
+		APIID:   s.APIID,
+		Timeout: timeOut,
+		TLS:     s.tlsFingerprint,
+		Pool:    s.Pool,
+	}
+}
+
+type upstreamTransportKey struct {
+	APIID   string
+	Timeout int
+	TLS     string
+	Pool    UpstreamPoolConfig
+}
+
+// NewUpstreamTransport creates a transport with the timeout, TLS and pool settings of an API
+func NewUpstreamTransport(timeOut int, tlsConfig *tls.Config, pool UpstreamPoolConfig) *http.Transport {
+	pool = pool.withDefaults()
+	dialTimeout := time.Duration(pool.DialTimeout) * time.Second
+	thisTransport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSHandshakeTimeout:   10 * time.Second,
+		TLSClientConfig:       tlsConfig,
+		MaxIdleConnsPerHost:   pool.MaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(pool.IdleConnTimeout) * time.Second,
+		ResponseHeaderTimeout: time.Duration(pool.ResponseHeaderTimeout) * time.Second,
+	}
+
+	if timeOut > 0 {
+		log.Debug("Setting timeout for outbound request to: ", timeOut)
+		dialTimeout = time.Duration(timeOut) * time.Second
+		thisTransport.ResponseHeaderTimeout = time.Duration(timeOut) * time.Second
+	}
+
+	thisTransport.Dial = (&net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).Dial
+
+	return thisTransport
+}
+
+// UpstreamPoolStats are reported per transport in the API's health values
+type UpstreamPoolStats struct {
+	Timeout           int   `bson:"timeout" json:"timeout"`
+	Requests          int64 `bson:"requests" json:"requests"`
+	InFlight          int64 `bson:"in_flight" json:"in_flight"`
+	ConnectionsOpened int64 `bson:"connections_opened" json:"connections_opened"`
+	OpenConnections   int64 `bson:"open_connections" json:"open_connections"`
+	ReusedConnections int64 `bson:"reused_connections" json:"reused_connections"`
+}
+
+// pooledTransport counts the requests and connections that go through a transport
+type pooledTransport struct {
+	*http.Transport
+	key upstreamTransportKey
+
+	requests          int64
+	inFlight          int64
+	connectionsOpened int64
+	openConnections   int64
+}
+
+func newPooledTransport(key upstreamTransportKey, tlsConfig *tls.Config) *pooledTransport {
+	t := &pooledTransport{
+		Transport: NewUpstreamTransport(key.Timeout, tlsConfig, key.Pool),
+		key:       key,
+	}
+
+	dial := t.Transport.Dial
+	t.Transport.Dial = func(network, addr string) (net.Conn, error) {
+		conn, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		atomic.AddInt64(&t.connectionsOpened, 1)
+		atomic.AddInt64(&t.openConnections, 1)
+		return &countedConn{Conn: conn, open: &t.openConnections}, nil
+	}
+
+	return t
+}
+
+func (t *pooledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&t.requests, 1)
+	atomic.AddInt64(&t.inFlight, 1)
+	defer atomic.AddInt64(&t.inFlight, -1)
+
+	return t.Transport.RoundTrip(req)
+}
+
+func (t *pooledTransport) Stats() UpstreamPoolStats {
+	thisStats := UpstreamPoolStats{
+		Timeout:           t.key.Timeout,
+		Requests:          atomic.LoadInt64(&t.requests),
+		InFlight:          atomic.LoadInt64(&t.inFlight),
+		ConnectionsOpened: atomic.LoadInt64(&t.connectionsOpened),
+		OpenConnections:   atomic.LoadInt64(&t.openConnections),
+	}
+
+	if thisStats.Requests > thisStats.ConnectionsOpened {
+		thisStats.ReusedConnections = thisStats.Requests - thisStats.ConnectionsOpened
+	}
+
+	return thisStats
+}
+
+type countedConn struct {
+	net.Conn
+	open   *int64
+	closed sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closed.Do(func() {
+		atomic.AddInt64(c.open, -1)
+	})
+
+	return c.Conn.Close()
+}
+
+// UpstreamTransportRegistry shares transports, and with them their connection pools, between all the
+// requests to an API with the same timeout. Transports outlive the proxies they were created for, so
+// a reload that leaves the upstream settings of an API unchanged keeps its idle connections.
+type UpstreamTransportRegistry struct {
+	transports map[upstreamTransportKey]*pooledTransport
+	sync.RWMutex
+}
+
+var UpstreamTransports = &UpstreamTransportRegistry{transports: make(map[upstreamTransportKey]*pooledTransport)}
+
+// Get returns the transport for the settings and timeout, creating it on first use
+func (u *UpstreamTransportRegistry) Get(settings *UpstreamTransportSettings, timeOut int) http.RoundTripper {
+	if settings == nil {
+		settings = defaultUpstreamTransportSettings
+	}
+	thisKey := settings.key(timeOut)
+
+	u.RLock()
+	thisTransport, found := u.transports[thisKey]
+	u.RUnlock()
+	if found {
+		return thisTransport
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	if thisTransport, found = u.transports[thisKey]; !found {
+		thisTransport = newPooledTransport(thisKey, settings.TLSConfig)
+		u.transports[thisKey] = thisTransport
+	}
+
+	return thisTransport
+}
+
+// Stats returns the pool statistics of an API's transports, ordered by timeout
+func (u *UpstreamTransportRegistry) Stats(apiID string) []UpstreamPoolStats {
+	u.RLock()
+	defer u.RUnlock()
+
+	stats := []UpstreamPoolStats{}
+	for thisKey, thisTransport := range u.transports {
+		if thisKey.APIID == apiID {
+			stats = append(stats, thisTransport.Stats())
+		}
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Timeout < stats[j].Timeout })
+	return stats
+}
+
+// Prune closes the transports of APIs that are no longer loaded or whose upstream settings have changed
+func (u *UpstreamTransportRegistry) Prune(specs []APISpec) {
+	current := make(map[string]*APISpec)
+	for i := range specs {
+		current[specs[i].APIID] = &specs[i]
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	for thisKey, thisTransport := range u.transports {
+		if thisKey.APIID == "" {
+			continue
+		}
+
+		spec, found := current[thisKey.APIID]
+		if found && getUpstreamTransportKey(spec, thisKey.Timeout) == thisKey {
+			continue
+		}
+
+		log.Debug("Closing upstream transport of API ", thisKey.APIID)
+		thisTransport.CloseIdleConnections()
+		delete(u.transports, thisKey)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpstreamTransportRegistry(t *testing.T) {
+	settings := &UpstreamTransportSettings{APIID: "registry-test", Pool: UpstreamPoolConfig{}.withDefaults()}
+
+	if UpstreamTransports.Get(settings, 5) != UpstreamTransports.Get(settings, 5) {
+		t.Error("Transports should be reused")
+	}
+
+	if UpstreamTransports.Get(settings, 5) == UpstreamTransports.Get(settings, 10) {
+		t.Error("Timeouts should have separate transports")
+	}
+
+	other := &UpstreamTransportSettings{APIID: "registry-test", Pool: UpstreamPoolConfig{MaxIdleConnsPerHost: 5}.withDefaults()}
+	if UpstreamTransports.Get(settings, 5) == UpstreamTransports.Get(other, 5) {
+		t.Error("Different pool settings should have separate transports")
+	}
+
+	thisTransport := UpstreamTransports.Get(other, 5).(*pooledTransport)
+	if thisTransport.MaxIdleConnsPerHost != 5 || thisTransport.IdleConnTimeout.Seconds() != 90 {
+		t.Error("Pool settings were not applied: ", thisTransport.MaxIdleConnsPerHost, thisTransport.IdleConnTimeout)
+	}
+
+	UpstreamTransports.Prune([]APISpec{})
+	if len(UpstreamTransports.Stats("registry-test")) != 0 {
+		t.Error("Transports of unloaded APIs should be pruned")
+	}
+}
+
+func TestUpstreamTransportShared(t *testing.T) {
+	proxy, spec := createTestProxyWithFields(`"upstream_pool": {"max_idle_conns_per_host": 5},`, "", "http://upstream.test")
+	defer UpstreamTransports.Prune([]APISpec{})
+
+	if proxy.Transports.key(0) != getUpstreamTransportKey(spec, 0) {
+		t.Error("Transport keys should not depend on how the settings were built")
+	}
+
+	// Health checks go through the transport of the proxy
+	checker := NewUpstreamHealthChecker(spec, UpstreamHealthCheckConfig{Enable: true})
+	if checker.client.Transport != UpstreamTransports.Get(proxy.Transports, 0) {
+		t.Error("Health checks should share the transport of the API")
+	}
+}
+
+func TestUpstreamTransportPooling(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pooled"))
+	}))
+	defer upstream.Close()
+
+	proxy, spec := createTestProxyWithFields(`"upstream_pool": {"max_idle_conns_per_host": 10, "idle_conn_timeout": 30},`, "", upstream.URL)
+	defer UpstreamTransports.Prune([]APISpec{})
+
+	for i := 0; i < 5; i++ {
+		req, _ := http.NewRequest("GET", "/v1/", nil)
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, req)
+		if recorder.Code != 200 {
+			t.Fatal("Proxied request failed: ", recorder.Code)
+		}
+	}
+
+	// A reload rebuilds the proxy, it has to get the same pool back
+	reloaded, _ := createTestProxyWithFields(`"upstream_pool": {"max_idle_conns_per_host": 10, "idle_conn_timeout": 30},`, "", upstream.URL)
+	req, _ := http.NewRequest("GET", "/v1/", nil)
+	reloaded.ServeHTTP(httptest.NewRecorder(), req)
+
+	health, _ := spec.Health.GetApiHealthValues()
+	if len(health.UpstreamPools) != 1 {
+		t.Fatal("Expected one pool in the health values, got: ", health.UpstreamPools)
+	}
+
+	thisPool := health.UpstreamPools[0]
+	if thisPool.Requests != 6 || thisPool.ConnectionsOpened != 1 || thisPool.ReusedConnections != 5 || thisPool.InFlight != 0 {
+		t.Error("Connections were not reused: ", thisPool)
+	}
+
+	UpstreamTransports.Prune([]APISpec{})
+	if stats := UpstreamTransports.Stats(spec.APIID); len(stats) != 0 {
+		t.Error("Pool should be closed once the API is unloaded: ", stats)
+	}
+}
+
+func benchmarkProxy(b *testing.B, newTransport bool) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pooled"))
+	}))
+	defer upstream.Close()
+
+	proxy, _ := createTestProxyWithFields(`"upstream_pool": {},`, "", upstream.URL)
+	defer UpstreamTransports.Prune([]APISpec{})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if newTransport {
+			// What every request used to do before transports were shared
+			proxy.Transport = NewUpstreamTransport(0, nil, UpstreamPoolConfig{})
+		}
+
+		req, _ := http.NewRequest("GET", "/v1/", nil)
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+		if newTransport {
+			proxy.Transport.(*http.Transport).CloseIdleConnections()
+		}
+	}
+}
+
+func BenchmarkProxyPooledTransport(b *testing.B) {
+	benchmarkProxy(b, false)
+}
+
+func BenchmarkProxyNewTransportPerRequest(b *testing.B) {
+	benchmarkProxy(b, true)
+}